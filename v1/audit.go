@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// auditPageSize is how many objects audit lists per request to the API
+// server.
+const auditPageSize = 500
+
+// auditReport is what audit found: the objects of the namespaces the
+// current validation rules would deny, those allowed too when asked for.
+type auditReport struct {
+	// Namespaces are the namespaces audited, none for all of them
+	Namespaces []string `json:"namespaces,omitempty"`
+	Audited    int      `json:"audited"`
+	Denied     int      `json:"denied"`
+	// Results are sorted by kind, namespace and name
+	Results []*manifestVerdict `json:"results"`
+}
+
+// auditNamespaces lists the Deployments and Services of namespaces, of all
+// of them when empty, and runs them through the current validation rules as
+// if they were created now, so the workloads running already which a
+// tightened policy would deny are found before it is enforced. Mutation
+// isn't run, the objects carry the mutations of their admission. The
+// verdicts of the objects allowed are only reported with allowed.
+func auditNamespaces(ctx context.Context, client kubernetes.Interface, namespaces []string, allowed bool) (*auditReport, error) {
+	report := &auditReport{Namespaces: namespaces, Results: []*manifestVerdict{}}
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	add := func(kind string, object runtime.Object, objectMeta *metav1.ObjectMeta) error {
+		verdict, err := auditObject(ctx, kind, object, objectMeta)
+		if err != nil {
+			return fmt.Errorf("%s %s/%s: %v", kind, objectMeta.Namespace, objectMeta.Name, err)
+		}
+		report.Audited++
+		if !verdict.Allowed {
+			report.Denied++
+		}
+		if !verdict.Allowed || allowed {
+			report.Results = append(report.Results, verdict)
+		}
+		return nil
+	}
+	for _, namespace := range namespaces {
+		options := metav1.ListOptions{Limit: auditPageSize}
+		for {
+			list, err := client.AppsV1().Deployments(namespace).List(ctx, options)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list the Deployments: %v", err)
+			}
+			for i := range list.Items {
+				if err := add("Deployment", &list.Items[i], &list.Items[i].ObjectMeta); err != nil {
+					return nil, err
+				}
+			}
+			if options.Continue = list.Continue; options.Continue == "" {
+				break
+			}
+		}
+		options = metav1.ListOptions{Limit: auditPageSize}
+		for {
+			list, err := client.CoreV1().Services(namespace).List(ctx, options)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list the Services: %v", err)
+			}
+			for i := range list.Items {
+				if err := add("Service", &list.Items[i], &list.Items[i].ObjectMeta); err != nil {
+					return nil, err
+				}
+			}
+			if options.Continue = list.Continue; options.Continue == "" {
+				break
+			}
+		}
+	}
+	sort.SliceStable(report.Results, func(i, j int) bool {
+		a, b := report.Results[i], report.Results[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return report, nil
+}
+
+// auditKinds are the groups and versions of the kinds audit lists.
+var auditKinds = map[string]schema.GroupVersion{
+	"Deployment": appsv1.SchemeGroupVersion,
+	"Service":    corev1.SchemeGroupVersion,
+}
+
+// auditObject validates object, of kind and metadata objectMeta, as the
+// request creating it. Lists leave the kind of their items empty, it is set
+// back for the rules.
+func auditObject(ctx context.Context, kind string, object runtime.Object, objectMeta *metav1.ObjectMeta) (*manifestVerdict, error) {
+	gv := auditKinds[kind]
+	object.GetObjectKind().SetGroupVersionKind(gv.WithKind(kind))
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	request := &v1.AdmissionRequest{
+		UID:       types.UID("audit"),
+		Kind:      metav1.GroupVersionKind{Group: gv.Group, Version: gv.Version, Kind: kind},
+		Resource:  simulateResources[kind],
+		Name:      objectMeta.Name,
+		Namespace: objectMeta.Namespace,
+		Operation: v1.Create,
+	}
+	request.Object.Raw = raw
+	verdict := &manifestVerdict{
+		Kind:      kind,
+		Namespace: objectMeta.Namespace,
+		Name:      objectMeta.Name,
+		Allowed:   true,
+	}
+	if !handles(admission.ValidateRulesFor(policy.CurrentConfig()), request) {
+		return verdict, nil
+	}
+	response := admission.Validate(ctx, request, newRequestLogger(request))
+	verdict.Warnings = response.Warnings
+	if !response.Allowed {
+		verdict.Allowed, verdict.DeniedBy, verdict.Message = false, "validate", responseMessage(response)
+	}
+	return verdict, nil
+}
+
+// printAuditReport prints report as text, a line per object.
+func printAuditReport(report *auditReport, out io.Writer) {
+	for _, verdict := range report.Results {
+		status := "ALLOWED"
+		if !verdict.Allowed {
+			status = "DENIED"
+		}
+		fmt.Fprintf(out, "%s %s %s/%s", status, verdict.Kind, verdict.Namespace, verdict.Name)
+		if verdict.Message != "" {
+			fmt.Fprintf(out, ": %s", verdict.Message)
+		}
+		fmt.Fprintln(out)
+		for _, warning := range verdict.Warnings {
+			fmt.Fprintf(out, "  warning: %s\n", warning)
+		}
+	}
+	fmt.Fprintf(out, "audited %d objects: %d would be denied\n", report.Audited, report.Denied)
+}
+
+// audit implements the audit command: it lists the Deployments and Services
+// of the namespaces with -kubeconfig and reports those the policy config
+// would deny now. It exits with 1 when there are any.
+//
+//	admission-webhook audit -policyConfigFile=policy.yaml -n team-a -n team-b
+func audit(parameters *WhSvrParameters, namespaces []string, allNamespaces, allowed bool, output string) {
+	if len(namespaces) == 0 && !allNamespaces {
+		fmt.Fprintln(os.Stderr, "Set the namespaces to audit with -n, or --all-namespaces")
+		os.Exit(1)
+	}
+	if output != "text" && output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid output %q, expect text or json\n", output)
+		os.Exit(1)
+	}
+	loadPolicy(parameters)
+	client, err := newKubeClient(parameters.kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create the client: %v\n", err)
+		os.Exit(1)
+	}
+	if allNamespaces {
+		namespaces = nil
+	}
+	report, err := auditNamespaces(context.Background(), client, namespaces, allowed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to audit: %v\n", err)
+		os.Exit(1)
+	}
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write the report: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		printAuditReport(report, os.Stdout)
+	}
+	if report.Denied > 0 {
+		os.Exit(1)
+	}
+}
+
+// newAuditCommand returns the audit command.
+func newAuditCommand(parameters *WhSvrParameters) *cobra.Command {
+	var (
+		namespaces             []string
+		allNamespaces, allowed bool
+		output                 string
+	)
+	command := &cobra.Command{
+		Use:   "audit",
+		Short: "Report the Deployments and Services of namespaces the current policy would deny",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			audit(parameters, namespaces, allNamespaces, allowed, output)
+		},
+	}
+	command.Flags().StringArrayVarP(&namespaces, "namespace", "n", nil, "Namespace to audit. Can be repeated.")
+	command.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "Audit every namespace.")
+	command.Flags().BoolVar(&allowed, "allowed", false, "Report the objects allowed too.")
+	command.Flags().StringVarP(&output, "output", "o", "text", "Format of the report: text or json.")
+	return command
+}
+
+// auditHandler serves the audit of namespaces as JSON, e.g.
+//
+//	curl -k -H "Authorization: Bearer $TOKEN" "https://webhook/audit?namespace=team-a&namespace=team-b"
+//
+// with every namespace audited when none is given and allowed=true for the
+// objects allowed too. The objects are listed with the service account of
+// the webhook, the calls are authenticated like those of /debug/loglevel,
+// see endpointAuth.
+type auditHandler struct {
+	client kubernetes.Interface
+}
+
+func (h *auditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	ctx := context.WithValue(r.Context(), handlerKey{}, "audit")
+	report, err := auditNamespaces(ctx, h.client, query["namespace"], query.Get("allowed") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		glog.Errorf("Failed to write the /audit response: %v", err)
+	}
+}
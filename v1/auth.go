@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxReviewedTokens bounds the tokens a tokenReviewer caches, the expired
+// ones are dropped beyond it.
+const maxReviewedTokens = 1024
+
+// bearerToken is the static token the calls of an endpoint may carry in
+// their Authorization header.
+type bearerToken []byte
+
+// readBearerToken reads the token from file, which must not be empty.
+func readBearerToken(file string) (bearerToken, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("token file %s is empty", file)
+	}
+	return bearerToken(token), nil
+}
+
+func (t bearerToken) matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), t) == 1
+}
+
+// bearerOf returns the bearer token of the Authorization header of r.
+func bearerOf(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	return token, token != ""
+}
+
+// endpointAuth authenticates the calls of one of the endpoints the
+// apiserver doesn't call, /check and /debug/loglevel, which its TLS client
+// certificate doesn't guard: with the static token of a file, with the
+// tokens the apiserver authenticates through a TokenReview (service
+// account tokens of CI jobs, OIDC tokens of users), or with both.
+type endpointAuth struct {
+	endpoint string
+	// static is the token of the file, not accepted when nil
+	static bearerToken
+	// reviewer reviews the other tokens, only the static one is accepted
+	// when nil
+	reviewer *tokenReviewer
+	// subjects are the users, and the groups as group:<name>, allowed with
+	// a reviewed token, any authenticated one when empty
+	subjects []string
+	// access authorizes the reviewed users, the static token may only read
+	// then. The subjects alone authorize them when nil.
+	access *accessReviewer
+}
+
+// newEndpointAuth returns the authentication of endpoint, nil when neither
+// tokenFile nor reviewer is set and the endpoint is disabled.
+func newEndpointAuth(endpoint, tokenFile string, reviewer *tokenReviewer, subjects string, access *accessReviewer) (*endpointAuth, error) {
+	if access != nil && reviewer == nil {
+		return nil, fmt.Errorf("the access review of %s needs the tokens reviewed", endpoint)
+	}
+	a := &endpointAuth{endpoint: endpoint, reviewer: reviewer, subjects: splitList(subjects), access: access}
+	if tokenFile != "" {
+		token, err := readBearerToken(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		a.static = token
+	}
+	if a.static == nil && a.reviewer == nil {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// wrap answers the calls next mustn't serve: 401 without an accepted
+// token, 403 for the reviewed users the subjects or the access review don't
+// allow and for the changes made with the static token under an access
+// review, 503 when a review fails.
+func (a *endpointAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerOf(r)
+		if !ok {
+			a.deny(w, "unauthorized", "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if a.static != nil && a.static.matches(token) {
+			if a.access != nil && verbOf(r) != "get" {
+				a.deny(w, "forbidden", fmt.Sprintf("changes of %s need a token the API server authenticates", a.endpoint), http.StatusForbidden)
+				return
+			}
+			endpointAuthentications.WithLabelValues(a.endpoint, "static").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.reviewer == nil {
+			a.deny(w, "unauthorized", "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		user, err := a.reviewer.review(r.Context(), token)
+		if err != nil {
+			glog.Warningf("Failed to review the token of a call of %s: %v", a.endpoint, err)
+			a.deny(w, "error", "failed to authenticate the token", http.StatusServiceUnavailable)
+			return
+		}
+		if user == nil {
+			a.deny(w, "unauthorized", "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !a.allows(user) {
+			glog.Warningf("Denied %s to %s, not in its subjects", a.endpoint, user.Username)
+			a.deny(w, "forbidden", fmt.Sprintf("%s is not allowed to call %s", user.Username, a.endpoint), http.StatusForbidden)
+			return
+		}
+		if a.access != nil {
+			verb, name := verbOf(r), path.Base(a.endpoint)
+			allowed, reason, err := a.access.review(r.Context(), user, verb, name)
+			if err != nil {
+				glog.Warningf("Failed to review the access of %s to %s: %v", user.Username, a.endpoint, err)
+				a.deny(w, "error", "failed to authorize the call", http.StatusServiceUnavailable)
+				return
+			}
+			if !allowed {
+				glog.Warningf("Denied %s %s to %s: %s", verb, a.endpoint, user.Username, reason)
+				message := fmt.Sprintf("%s cannot %s %s %s", user.Username, verb, a.access, name)
+				if reason != "" {
+					message += ": " + reason
+				}
+				a.deny(w, "forbidden", message, http.StatusForbidden)
+				return
+			}
+			if verb != "get" {
+				glog.Infof("%s calls %s %s", user.Username, r.Method, r.URL.RequestURI())
+			}
+		}
+		glog.V(2).Infof("%s called %s", user.Username, a.endpoint)
+		endpointAuthentications.WithLabelValues(a.endpoint, "tokenreview").Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deny answers a call with status, counted as result.
+func (a *endpointAuth) deny(w http.ResponseWriter, result, message string, status int) {
+	endpointAuthentications.WithLabelValues(a.endpoint, result).Inc()
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	http.Error(w, message, status)
+}
+
+// allows reports whether the subjects allow user.
+func (a *endpointAuth) allows(user *authenticationv1.UserInfo) bool {
+	if len(a.subjects) == 0 {
+		return true
+	}
+	for _, subject := range a.subjects {
+		if group := strings.TrimPrefix(subject, "group:"); group != subject {
+			for _, g := range user.Groups {
+				if g == group {
+					return true
+				}
+			}
+		} else if subject == user.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenReviewer authenticates bearer tokens through TokenReviews, caching
+// the outcome by a hash of the token so a CI job polling an endpoint
+// doesn't review its token on every call. Failed reviews aren't cached.
+type tokenReviewer struct {
+	client    kubernetes.Interface
+	audiences []string
+	ttl       time.Duration
+
+	mu      sync.Mutex
+	reviews map[[sha256.Size]byte]tokenReview
+}
+
+// tokenReview is the cached outcome of a TokenReview, user is nil when the
+// token wasn't authenticated.
+type tokenReview struct {
+	user    *authenticationv1.UserInfo
+	expires time.Time
+}
+
+func newTokenReviewer(client kubernetes.Interface, audiences string, ttl time.Duration) *tokenReviewer {
+	return &tokenReviewer{
+		client:    client,
+		audiences: splitList(audiences),
+		ttl:       ttl,
+		reviews:   make(map[[sha256.Size]byte]tokenReview),
+	}
+}
+
+// review returns the user token authenticates as, nil when the apiserver
+// doesn't authenticate it.
+func (t *tokenReviewer) review(ctx context.Context, token string) (*authenticationv1.UserInfo, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	t.mu.Lock()
+	cached, ok := t.reviews[key]
+	t.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.user, nil
+	}
+
+	review, err := t.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: t.audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var user *authenticationv1.UserInfo
+	if review.Status.Authenticated {
+		user = &review.Status.User
+	} else if review.Status.Error != "" {
+		glog.V(2).Infof("Token not authenticated: %s", review.Status.Error)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.reviews) >= maxReviewedTokens {
+		for key, review := range t.reviews {
+			if !now.Before(review.expires) {
+				delete(t.reviews, key)
+			}
+		}
+		if len(t.reviews) >= maxReviewedTokens {
+			t.reviews = make(map[[sha256.Size]byte]tokenReview)
+		}
+	}
+	t.reviews[key] = tokenReview{user: user, expires: now.Add(t.ttl)}
+	return user, nil
+}
+
+// verbOf returns the verb the access review checks for the method of r: get
+// reads the settings of the endpoint, update changes them.
+func verbOf(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return "get"
+	}
+	return "update"
+}
+
+// accessReviewer authorizes the callers of the endpoints changing the
+// webhook at runtime through SubjectAccessReviews of a resource, which
+// needn't exist: RBAC grants its verbs like for any resource, the setting
+// changed being the resource name, e.g. get and update on the resource
+// settings.admission-webhook-example.qikqiak.com named loglevel.
+type accessReviewer struct {
+	client    kubernetes.Interface
+	group     string
+	resource  string
+	namespace string
+}
+
+// newAccessReviewer returns the reviewer of resource, as resource.group,
+// in namespace, cluster-scoped when empty.
+func newAccessReviewer(client kubernetes.Interface, resource, namespace string) *accessReviewer {
+	a := &accessReviewer{client: client, resource: resource, namespace: namespace}
+	if i := strings.Index(resource, "."); i >= 0 {
+		a.resource, a.group = resource[:i], resource[i+1:]
+	}
+	return a
+}
+
+func (a *accessReviewer) String() string {
+	if a.group == "" {
+		return a.resource
+	}
+	return a.resource + "." + a.group
+}
+
+// review reports whether user may verb the resource named name, with the
+// reason of the apiserver when it may not.
+func (a *accessReviewer) review(ctx context.Context, user *authenticationv1.UserInfo, verb, name string) (bool, string, error) {
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for key, values := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(values)
+	}
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: a.namespace,
+				Verb:      verb,
+				Group:     a.group,
+				Resource:  a.resource,
+				Name:      name,
+			},
+			User:   user.Username,
+			Groups: user.Groups,
+			UID:    user.UID,
+			Extra:  extra,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", err
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
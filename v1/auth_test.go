@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// reviewedUsers is a clientset authenticating the tokens of users through
+// TokenReviews, failing them all when err is set, counting them in reviews.
+func reviewedUsers(users map[string]authenticationv1.UserInfo, err error, reviews *int) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		*reviews++
+		if err != nil {
+			return true, nil, err
+		}
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if user, ok := users[review.Spec.Token]; ok {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: user}
+		} else {
+			review.Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+		}
+		return true, review, nil
+	})
+	return client
+}
+
+// called answers the calls an endpointAuth lets through with 200.
+var called = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+// call calls handler with method and the Authorization header auth,
+// returning the status answered.
+func call(handler http.Handler, method, auth string) int {
+	req := httptest.NewRequest(method, "/debug/loglevel", nil)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+// tokenFile writes token to a temporary file and returns its name.
+func tokenFile(t *testing.T, token string) string {
+	t.Helper()
+	file, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(token); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestEndpointAuthStaticToken(t *testing.T) {
+	file := tokenFile(t, "s3cret\n")
+	defer os.Remove(file)
+	auth, err := newEndpointAuth("/debug/loglevel", file, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth.wrap(called)
+	tests := []struct {
+		name string
+		auth string
+		code int
+	}{
+		{"right", "Bearer s3cret", http.StatusOK},
+		{"wrong", "Bearer s3cre", http.StatusUnauthorized},
+		{"longer", "Bearer s3cret2", http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+		{"not bearer", "Basic s3cret", http.StatusUnauthorized},
+		{"empty bearer", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if code := call(handler, http.MethodPut, tt.auth); code != tt.code {
+			t.Errorf("%s token: answered %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
+
+func TestNewEndpointAuth(t *testing.T) {
+	if auth, err := newEndpointAuth("/check", "", nil, "", nil); auth != nil || err != nil {
+		t.Errorf("without token file nor reviewer: got %v, %v, want the endpoint disabled", auth, err)
+	}
+	empty := tokenFile(t, " \n")
+	defer os.Remove(empty)
+	if _, err := newEndpointAuth("/check", empty, nil, "", nil); err == nil {
+		t.Error("accepted an empty token file")
+	}
+	if _, err := newEndpointAuth("/check", filepath.Join(os.TempDir(), "admission-webhook-missing-token"), nil, "", nil); err == nil {
+		t.Error("accepted a missing token file")
+	}
+}
+
+func TestEndpointAuthTokenReview(t *testing.T) {
+	users := map[string]authenticationv1.UserInfo{
+		"ci":    {Username: "system:serviceaccount:ci:deployer"},
+		"alice": {Username: "alice", Groups: []string{"platform"}},
+		"bob":   {Username: "bob", Groups: []string{"developers"}},
+	}
+	tests := []struct {
+		name     string
+		subjects string
+		err      error
+		auth     string
+		code     int
+	}{
+		{"authenticated", "", nil, "Bearer bob", http.StatusOK},
+		{"not authenticated", "", nil, "Bearer mallory", http.StatusUnauthorized},
+		{"missing", "", nil, "", http.StatusUnauthorized},
+		{"review failed", "", errors.New("apiserver unavailable"), "Bearer bob", http.StatusServiceUnavailable},
+		{"user subject", "system:serviceaccount:ci:deployer,group:platform", nil, "Bearer ci", http.StatusOK},
+		{"group subject", "system:serviceaccount:ci:deployer,group:platform", nil, "Bearer alice", http.StatusOK},
+		{"not a subject", "system:serviceaccount:ci:deployer,group:platform", nil, "Bearer bob", http.StatusForbidden},
+		{"user named like a group", "group:bob", nil, "Bearer bob", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reviews int
+			reviewer := newTokenReviewer(reviewedUsers(users, tt.err, &reviews), "", time.Minute)
+			auth, err := newEndpointAuth("/debug/loglevel", "", reviewer, tt.subjects, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code := call(auth.wrap(called), http.MethodGet, tt.auth); code != tt.code {
+				t.Errorf("answered %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestTokenReviewerCache(t *testing.T) {
+	users := map[string]authenticationv1.UserInfo{"bob": {Username: "bob"}}
+	var reviews int
+	reviewer := newTokenReviewer(reviewedUsers(users, nil, &reviews), "", time.Minute)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if user, err := reviewer.review(ctx, "bob"); err != nil || user == nil || user.Username != "bob" {
+			t.Fatalf("reviewed as %v, %v, want bob", user, err)
+		}
+		if user, err := reviewer.review(ctx, "mallory"); err != nil || user != nil {
+			t.Fatalf("reviewed as %v, %v, want unauthenticated", user, err)
+		}
+	}
+	if reviews != 2 {
+		t.Errorf("%d TokenReviews for 2 tokens, want the outcomes cached", reviews)
+	}
+
+	// the failed reviews aren't cached
+	failing := newTokenReviewer(reviewedUsers(users, errors.New("apiserver unavailable"), &reviews), "", time.Minute)
+	reviews = 0
+	for i := 0; i < 2; i++ {
+		if _, err := failing.review(ctx, "bob"); err == nil {
+			t.Fatal("no error from a failed review")
+		}
+	}
+	if reviews != 2 || len(failing.reviews) != 0 {
+		t.Errorf("%d TokenReviews and %d cached after 2 failed ones, want none cached", reviews, len(failing.reviews))
+	}
+}
+
+func TestTokenReviewerEviction(t *testing.T) {
+	var reviews int
+	reviewer := newTokenReviewer(reviewedUsers(nil, nil, &reviews), "", time.Minute)
+	ctx := context.Background()
+	for i := 0; i < maxReviewedTokens; i++ {
+		if _, err := reviewer.review(ctx, fmt.Sprint("token-", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the expired reviews are dropped first
+	expired := 0
+	for key, review := range reviewer.reviews {
+		if expired == 10 {
+			break
+		}
+		review.expires = time.Now().Add(-time.Second)
+		reviewer.reviews[key] = review
+		expired++
+	}
+	if _, err := reviewer.review(ctx, "token-new"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(reviewer.reviews), maxReviewedTokens-10+1; got != want {
+		t.Errorf("%d reviews cached, want %d with the expired ones dropped", got, want)
+	}
+	if _, ok := reviewer.reviews[sha256.Sum256([]byte("token-new"))]; !ok {
+		t.Error("the new review isn't cached")
+	}
+
+	// without expired ones, the cache starts over
+	for i := 0; len(reviewer.reviews) < maxReviewedTokens; i++ {
+		if _, err := reviewer.review(ctx, fmt.Sprint("more-", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := reviewer.review(ctx, "token-last"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reviewer.reviews) != 1 {
+		t.Errorf("%d reviews cached beyond %d, want only the new one", len(reviewer.reviews), maxReviewedTokens)
+	}
+}
+
+// reviewedAccess is a clientset answering the SubjectAccessReviews with
+// allowed and reason, recording them in reviews.
+func reviewedAccess(allowed bool, reason string, reviews *[]authorizationv1.SubjectAccessReview) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		*reviews = append(*reviews, *review)
+		review.Status = authorizationv1.SubjectAccessReviewStatus{Allowed: allowed, Reason: reason}
+		return true, review, nil
+	})
+	return client
+}
+
+func TestEndpointAuthAccessReview(t *testing.T) {
+	user := authenticationv1.UserInfo{
+		Username: "alice",
+		UID:      "a1",
+		Groups:   []string{"platform"},
+		Extra:    map[string]authenticationv1.ExtraValue{"scopes": {"admin"}},
+	}
+	tests := []struct {
+		endpoint string
+		method   string
+		verb     string
+		name     string
+	}{
+		{"/check", http.MethodPost, "update", "check"},
+		{"/audit", http.MethodGet, "get", "audit"},
+		{"/debug/loglevel", http.MethodGet, "get", "loglevel"},
+		{"/debug/loglevel", http.MethodHead, "get", "loglevel"},
+		{"/debug/loglevel", http.MethodPut, "update", "loglevel"},
+	}
+	for _, tt := range tests {
+		for _, allowed := range []bool{true, false} {
+			t.Run(fmt.Sprint(tt.method, tt.endpoint, allowed), func(t *testing.T) {
+				var tokenReviews int
+				var reviews []authorizationv1.SubjectAccessReview
+				reviewer := newTokenReviewer(reviewedUsers(map[string]authenticationv1.UserInfo{"alice": user}, nil, &tokenReviews), "", time.Minute)
+				access := newAccessReviewer(reviewedAccess(allowed, "no RBAC rule", &reviews), "settings.admission-webhook-example.qikqiak.com", "admission-webhook")
+				auth, err := newEndpointAuth(tt.endpoint, "", reviewer, "", access)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req := httptest.NewRequest(tt.method, tt.endpoint, nil)
+				req.Header.Set("Authorization", "Bearer alice")
+				w := httptest.NewRecorder()
+				auth.wrap(called).ServeHTTP(w, req)
+
+				want := http.StatusOK
+				if !allowed {
+					want = http.StatusForbidden
+				}
+				if w.Code != want {
+					t.Errorf("answered %d, want %d", w.Code, want)
+				}
+				if len(reviews) != 1 {
+					t.Fatalf("%d SubjectAccessReviews, want 1", len(reviews))
+				}
+				spec := reviews[0].Spec
+				wantAttributes := authorizationv1.ResourceAttributes{
+					Namespace: "admission-webhook",
+					Verb:      tt.verb,
+					Group:     "admission-webhook-example.qikqiak.com",
+					Resource:  "settings",
+					Name:      tt.name,
+				}
+				if spec.ResourceAttributes == nil || *spec.ResourceAttributes != wantAttributes {
+					t.Errorf("reviewed %+v, want %+v", spec.ResourceAttributes, wantAttributes)
+				}
+				if spec.User != "alice" || spec.UID != "a1" || len(spec.Groups) != 1 || spec.Groups[0] != "platform" ||
+					len(spec.Extra["scopes"]) != 1 || spec.Extra["scopes"][0] != "admin" {
+					t.Errorf("reviewed the access of %+v, want alice", spec)
+				}
+			})
+		}
+	}
+}
+
+func TestEndpointAuthStaticTokenUnderAccessReview(t *testing.T) {
+	file := tokenFile(t, "s3cret")
+	defer os.Remove(file)
+	var tokenReviews int
+	var reviews []authorizationv1.SubjectAccessReview
+	reviewer := newTokenReviewer(reviewedUsers(nil, nil, &tokenReviews), "", time.Minute)
+	access := newAccessReviewer(reviewedAccess(true, "", &reviews), "settings", "")
+	auth, err := newEndpointAuth("/debug/loglevel", file, reviewer, "", access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth.wrap(called)
+	if code := call(handler, http.MethodGet, "Bearer s3cret"); code != http.StatusOK {
+		t.Errorf("read with the static token answered %d, want 200", code)
+	}
+	if code := call(handler, http.MethodPut, "Bearer s3cret"); code != http.StatusForbidden {
+		t.Errorf("change with the static token answered %d, want 403", code)
+	}
+	if len(reviews) != 0 {
+		t.Errorf("%d SubjectAccessReviews of the static token, want none", len(reviews))
+	}
+	if _, err := newEndpointAuth("/debug/loglevel", file, nil, "", access); err == nil {
+		t.Error("accepted an access review without token review")
+	}
+}
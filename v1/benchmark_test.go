@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// benchmarkReview returns the AdmissionReview creating the self-test
+// Deployment, in contentType.
+func benchmarkReview(b *testing.B, contentType string) []byte {
+	b.Helper()
+	object, err := json.Marshal(selfTestDeployment())
+	if err != nil {
+		b.Fatal(err)
+	}
+	review := &v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &v1.AdmissionRequest{
+			UID:       "benchmark",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Resource:  simulateResources["Deployment"],
+			Name:      "self-test",
+			Namespace: "default",
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: object},
+		},
+	}
+	var body []byte
+	if contentType == runtime.ContentTypeProtobuf {
+		body, err = admission.Encode(review, contentType)
+	} else {
+		body, err = json.Marshal(review)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	return body
+}
+
+// BenchmarkServe serves the same AdmissionReview through the handlers of
+// /mutate and /validate, the ones of the server minus the TLS and the
+// connection handling, concurrently like the apiserver does under load.
+// The requests and recorders of the benchmark are counted in the
+// allocations too:
+//
+//	go test -run '^$' -bench Serve -benchmem -args -logtostderr -v 0 2>/dev/null
+func BenchmarkServe(b *testing.B) {
+	whsvr := &WebhookServer{maxRequestBytes: 6 * 1024 * 1024}
+	endpoints := []struct {
+		name  string
+		admit admissionHandler
+	}{
+		{"mutate", whsvr.mutate},
+		{"validate", whsvr.validate},
+	}
+	for _, endpoint := range endpoints {
+		handler := whsvr.handler(endpoint.name, endpoint.admit)
+		for _, contentType := range []string{"application/json", runtime.ContentTypeProtobuf} {
+			body := benchmarkReview(b, contentType)
+			b.Run(endpoint.name+"/"+contentType, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(body)))
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						req := httptest.NewRequest(http.MethodPost, "/"+endpoint.name, bytes.NewReader(body))
+						req.Header.Set("Content-Type", contentType)
+						req.Header.Set("Accept", contentType)
+						rec := httptest.NewRecorder()
+						handler.ServeHTTP(rec, req)
+						if rec.Code != http.StatusOK {
+							b.Fatalf("/%s answered %d: %s", endpoint.name, rec.Code, rec.Body.String())
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkReadBody reads request bodies into the buffers of the pool and
+// gives them back, as serve does.
+func BenchmarkReadBody(b *testing.B) {
+	body := benchmarkReview(b, "application/json")
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		buf, err := readBody(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		putBuffer(buf)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// certBootstrapper replaces the webhook-create-signed-cert.sh and
+// webhook-patch-ca-bundle.sh scripts: it keeps a self-signed serving
+// certificate in a Secret and injects its CA into the caBundle of the
+// webhook configurations.
+type certBootstrapper struct {
+	client                      kubernetes.Interface
+	namespace                   string
+	service                     string
+	secretName                  string
+	mutatingWebhookConfigName   string
+	validatingWebhookConfigName string
+	validity                    time.Duration
+	renewBefore                 time.Duration
+}
+
+// ensureCerts returns the certificate stored in the Secret, generating and
+// storing a new one when it is missing or about to expire. Replicas starting
+// at the same time converge on whichever Secret got created first.
+func (b *certBootstrapper) ensureCerts(ctx context.Context) (*webhookCerts, error) {
+	secrets := b.client.CoreV1().Secrets(b.namespace)
+
+	secret, err := secrets.Get(ctx, b.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		certs, err := generateCerts(b.service, b.namespace, b.validity)
+		if err != nil {
+			return nil, err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: b.secretName, Namespace: b.namespace},
+			Type:       corev1.SecretTypeOpaque,
+		}
+		certs.toSecret(secret)
+		if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				return b.ensureCerts(ctx)
+			}
+			return nil, err
+		}
+		glog.Infof("Created serving certificate secret %s/%s", b.namespace, b.secretName)
+		return certs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if certs := certsFromSecret(secret); certs != nil && !certs.expiresWithin(b.renewBefore) {
+		return certs, nil
+	}
+	certs, err := generateCerts(b.service, b.namespace, b.validity)
+	if err != nil {
+		return nil, err
+	}
+	certs.toSecret(secret)
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return nil, err
+	}
+	glog.Infof("Renewed serving certificate in secret %s/%s", b.namespace, b.secretName)
+	return certs, nil
+}
+
+// patchCABundle sets caBundle on every webhook of the configured webhook
+// configurations.
+func (b *certBootstrapper) patchCABundle(ctx context.Context, caBundle []byte) error {
+	registration := b.client.AdmissionregistrationV1()
+
+	if b.mutatingWebhookConfigName != "" {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			config, err := registration.MutatingWebhookConfigurations().Get(ctx, b.mutatingWebhookConfigName, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			for i := range config.Webhooks {
+				config.Webhooks[i].ClientConfig.CABundle = caBundle
+			}
+			_, err = registration.MutatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		glog.Infof("Patched caBundle of MutatingWebhookConfiguration %s", b.mutatingWebhookConfigName)
+	}
+
+	if b.validatingWebhookConfigName != "" {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			config, err := registration.ValidatingWebhookConfigurations().Get(ctx, b.validatingWebhookConfigName, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			for i := range config.Webhooks {
+				config.Webhooks[i].ClientConfig.CABundle = caBundle
+			}
+			_, err = registration.ValidatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		glog.Infof("Patched caBundle of ValidatingWebhookConfiguration %s", b.validatingWebhookConfigName)
+	}
+	return nil
+}
+
+func certsFromSecret(secret *corev1.Secret) *webhookCerts {
+	certs := &webhookCerts{
+		caCert: secret.Data[secretCAKey],
+		cert:   secret.Data[secretCertKey],
+		key:    secret.Data[secretKeyKey],
+	}
+	if len(certs.caCert) == 0 || len(certs.cert) == 0 || len(certs.key) == 0 {
+		return nil
+	}
+	return certs
+}
+
+func (c *webhookCerts) toSecret(secret *corev1.Secret) {
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[secretCAKey] = c.caCert
+	secret.Data[secretCertKey] = c.cert
+	secret.Data[secretKeyKey] = c.key
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/golang/glog"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// startClusterCache lists and watches the objects rules look up, the
+// PodDisruptionBudgets, the NetworkPolicies, the namespaces, the
+// Deployments, the Services, the HorizontalPodAutoscalers, the nodes, the
+// metadata of the objects pods reference and the WebhookPolicyOverrides as
+// enabled, so that admission doesn't wait for the API server, starts the
+// controller of the managed finalizer, and returns once the cache is filled.
+// The decisions cached in a namespace are flushed as the objects rules look
+// up in it change, all of them as the nodes do.
+func startClusterCache(ctx context.Context, parameters *WhSvrParameters, decisions *decisionCache) error {
+	if !parameters.watchPDBs && !parameters.watchNetworkPolicies && !parameters.watchNamespaces && !parameters.watchDeployments && !parameters.watchServices && !parameters.watchHPAs && !parameters.watchReferences && !parameters.watchPolicyOverrides && !parameters.watchNodes && !parameters.configChecksums && !parameters.managedFinalizer {
+		return nil
+	}
+	client, err := newKubeClient(parameters.kubeconfig)
+	if err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactory(client, 0)
+	var setters []func()
+	if parameters.watchPDBs {
+		informer := factory.Policy().V1().PodDisruptionBudgets()
+		flushDecisions(informer.Informer(), decisions, specChanged)
+		lister := informer.Lister()
+		setters = append(setters, func() {
+			admission.SetPodDisruptionBudgetLister(func(namespace string) ([]*policyv1.PodDisruptionBudget, error) {
+				return lister.PodDisruptionBudgets(namespace).List(labels.Everything())
+			})
+		})
+	}
+	if parameters.watchNetworkPolicies {
+		informer := factory.Networking().V1().NetworkPolicies()
+		flushDecisions(informer.Informer(), decisions, specChanged)
+		lister := informer.Lister()
+		setters = append(setters, func() {
+			admission.SetNetworkPolicyLister(func(namespace string) ([]*networkingv1.NetworkPolicy, error) {
+				return lister.NetworkPolicies(namespace).List(labels.Everything())
+			})
+		})
+	}
+	if parameters.watchNamespaces {
+		informer := factory.Core().V1().Namespaces()
+		flushDecisions(informer.Informer(), decisions, metadataChanged)
+		setters = append(setters, func() {
+			admission.SetNamespaceGetter(namespaceGetter(informer.Lister(), informer.Informer().HasSynced))
+		})
+	}
+	if parameters.watchDeployments {
+		informer := factory.Apps().V1().Deployments()
+		flushDecisions(informer.Informer(), decisions, specChanged)
+		lister := informer.Lister()
+		setters = append(setters, func() {
+			admission.SetDeploymentGetter(func(namespace, name string) (*appsv1.Deployment, error) {
+				return lister.Deployments(namespace).Get(name)
+			})
+			admission.SetDeploymentLister(func(namespace string) ([]*appsv1.Deployment, error) {
+				return lister.Deployments(namespace).List(labels.Everything())
+			})
+		})
+	}
+	if parameters.watchServices {
+		informer := factory.Core().V1().Services()
+		flushDecisions(informer.Informer(), decisions, specChanged)
+		lister := informer.Lister()
+		setters = append(setters, func() {
+			admission.SetServiceLister(func(namespace string) ([]*corev1.Service, error) {
+				return lister.Services(namespace).List(labels.Everything())
+			})
+		})
+	}
+	if parameters.watchHPAs {
+		informer := factory.Autoscaling().V1().HorizontalPodAutoscalers()
+		flushDecisions(informer.Informer(), decisions, specChanged)
+		lister := informer.Lister()
+		setters = append(setters, func() {
+			admission.SetHorizontalPodAutoscalerLister(func(namespace string) ([]*autoscalingv1.HorizontalPodAutoscaler, error) {
+				return lister.HorizontalPodAutoscalers(namespace).List(labels.Everything())
+			})
+		})
+	}
+	if parameters.watchNodes {
+		informer := factory.Core().V1().Nodes()
+		flushAllDecisions(informer.Informer(), decisions)
+		lister := informer.Lister()
+		setters = append(setters, func() {
+			admission.SetNodeLister(func() ([]*corev1.Node, error) {
+				return lister.List(labels.Everything())
+			})
+		})
+	}
+	if parameters.watchReferences {
+		// only the metadata, Secrets are kept out of the memory of the webhook
+		client, err := newMetadataClient(parameters.kubeconfig)
+		if err != nil {
+			return err
+		}
+		metadataFactory := metadatainformer.NewSharedInformerFactory(client, 0)
+		listers := map[string]cache.GenericLister{}
+		for kind, resource := range referenceResources {
+			informer := metadataFactory.ForResource(resource)
+			// only whether they exist matters, not their updates
+			flushDecisions(informer.Informer(), decisions, nil)
+			listers[kind] = informer.Lister()
+		}
+		metadataFactory.Start(ctx.Done())
+		for resource, synced := range metadataFactory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return fmt.Errorf("can't sync %v", resource)
+			}
+		}
+		setters = append(setters, func() {
+			admission.SetReferenceLookup(referenceLookup(client, listers))
+		})
+	}
+	if parameters.configChecksums {
+		setters = append(setters, func() {
+			admission.SetConfigDigest(configDigest(client))
+		})
+	}
+	if parameters.managedFinalizer {
+		startManagedFinalizer(ctx, client, factory.Apps().V1().Deployments())
+		setters = append(setters, func() {
+			admission.SetManagedFinalizer(true)
+		})
+	}
+	if parameters.watchPolicyOverrides {
+		if err := startPolicyOverrides(ctx, parameters.kubeconfig); err != nil {
+			return err
+		}
+	}
+	factory.Start(ctx.Done())
+	for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("can't sync %v", informer)
+		}
+	}
+	for _, set := range setters {
+		set()
+	}
+	glog.Info("Cluster cache synced")
+	return nil
+}
+
+// flushDecisions flushes the decisions cached in the namespace of the objects
+// of informer, or in the namespace itself for namespaces, as they are added
+// and deleted, and updated when changed reports so. Nothing is flushed when
+// the decision cache is disabled.
+func flushDecisions(informer cache.SharedIndexInformer, decisions *decisionCache, changed func(old, new metav1.Object) bool) {
+	if decisions == nil {
+		return
+	}
+	flush := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return
+		}
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return
+		}
+		if namespace == "" {
+			namespace = name
+		}
+		decisions.flushNamespace(namespace)
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: flush,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, err := meta.Accessor(oldObj)
+			if err != nil || changed == nil {
+				return
+			}
+			if new, err := meta.Accessor(newObj); err == nil && changed(old, new) {
+				flush(newObj)
+			}
+		},
+		DeleteFunc: flush,
+	})
+}
+
+// flushAllDecisions flushes all the decisions cached as the nodes of
+// informer are added and deleted, and updated when nodeChanged reports so:
+// their status is updated all the time. Nothing is flushed when the decision
+// cache is disabled.
+func flushAllDecisions(informer cache.SharedIndexInformer, decisions *decisionCache) {
+	if decisions == nil {
+		return
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { decisions.flushAll() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, ok := oldObj.(*corev1.Node)
+			if !ok {
+				return
+			}
+			if new, ok := newObj.(*corev1.Node); ok && nodeChanged(old, new) {
+				decisions.flushAll()
+			}
+		},
+		DeleteFunc: func(interface{}) { decisions.flushAll() },
+	})
+}
+
+// nodeChanged reports whether a node changed where the podResources policy
+// looks: its labels, taints, schedulability or allocatable.
+func nodeChanged(old, new *corev1.Node) bool {
+	return !reflect.DeepEqual(old.Labels, new.Labels) || !reflect.DeepEqual(old.Spec.Taints, new.Spec.Taints) ||
+		old.Spec.Unschedulable != new.Spec.Unschedulable || !equality.Semantic.DeepEqual(old.Status.Allocatable, new.Status.Allocatable)
+}
+
+// metadataChanged reports whether the labels or annotations of an object
+// changed, the rules select namespaces by them.
+func metadataChanged(old, new metav1.Object) bool {
+	return !reflect.DeepEqual(old.GetLabels(), new.GetLabels()) || !reflect.DeepEqual(old.GetAnnotations(), new.GetAnnotations())
+}
+
+// specChanged reports whether an object changed other than its status: its
+// generation, which status updates don't increment, or its metadata. Objects
+// without a generation, such as Services, change on every update.
+func specChanged(old, new metav1.Object) bool {
+	return new.GetGeneration() == 0 || old.GetGeneration() != new.GetGeneration() || metadataChanged(old, new)
+}
+
+// resources of the kinds pods reference
+var referenceResources = map[string]schema.GroupVersionResource{
+	"ConfigMap":             corev1.SchemeGroupVersion.WithResource("configmaps"),
+	"Secret":                corev1.SchemeGroupVersion.WithResource("secrets"),
+	"PersistentVolumeClaim": corev1.SchemeGroupVersion.WithResource("persistentvolumeclaims"),
+}
+
+// referenceLookup looks the objects pods reference up in listers, by kind,
+// and confirms the missing ones with the API server: they are often created
+// right before the pods, by the same kubectl apply, and the watch lags
+// behind.
+func referenceLookup(client metadata.Interface, listers map[string]cache.GenericLister) admission.ReferenceLookup {
+	return func(ctx context.Context, kind, namespace, name string) (bool, error) {
+		_, err := listers[kind].ByNamespace(namespace).Get(name)
+		if !apierrors.IsNotFound(err) {
+			return err == nil, err
+		}
+		_, err = client.Resource(referenceResources[kind]).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
+
+// configDigest digests the data of ConfigMaps and Secrets read from the API
+// server rather than a cache, the watch may lag behind the change made by
+// the same kubectl apply, and the Secrets are kept out of the memory of the
+// webhook.
+func configDigest(client kubernetes.Interface) admission.ConfigDigest {
+	return func(ctx context.Context, kind, namespace, name string) (string, bool, error) {
+		hash := sha256.New()
+		var err error
+		switch kind {
+		case "ConfigMap":
+			var configMap *corev1.ConfigMap
+			if configMap, err = client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil {
+				digestData(hash, configMap.Data, configMap.BinaryData)
+			}
+		case "Secret":
+			var secret *corev1.Secret
+			if secret, err = client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil {
+				digestData(hash, nil, secret.Data)
+			}
+		default:
+			return "", false, fmt.Errorf("unsupported kind %s", kind)
+		}
+		if apierrors.IsNotFound(err) {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), true, nil
+	}
+}
+
+// digestData writes the entries of data and binaryData to hash, by key.
+func digestData(hash io.Writer, data map[string]string, binaryData map[string][]byte) {
+	keys := make([]string, 0, len(data)+len(binaryData))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	for key := range binaryData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, ok := binaryData[key]
+		if !ok {
+			value = []byte(data[key])
+		}
+		fmt.Fprintf(hash, "%s\n%d\n", key, len(value))
+		hash.Write(value)
+	}
+}
+
+// namespaceGetter looks namespaces up in lister. Its error wraps
+// admission.ErrNamespaceCacheCold while the cache isn't synced or doesn't
+// have the namespace: the objects admitted are in it, so it exists and the
+// watch is only lagging behind.
+func namespaceGetter(lister corelisters.NamespaceLister, synced func() bool) admission.NamespaceGetter {
+	return func(name string) (*corev1.Namespace, error) {
+		if !synced() {
+			return nil, admission.ErrNamespaceCacheCold
+		}
+		namespace, err := lister.Get(name)
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %v", admission.ErrNamespaceCacheCold, err)
+		}
+		return namespace, err
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// cachedTwice reviews the ConfigMap web of default twice with c and reports
+// whether the second review was answered from the cache.
+func cachedTwice(c *decisionCache) bool {
+	var calls int
+	admit := countedAdmit(&calls, &v1.AdmissionResponse{Allowed: true})
+	c.do(context.Background(), "validate", configMapRequest("default", "web", ""), admit)
+	c.do(context.Background(), "validate", configMapRequest("default", "web", ""), admit)
+	return calls == 1
+}
+
+// waitFlushed waits for the responses of c to be flushed.
+func waitFlushed(t *testing.T, c *decisionCache) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		flushed := c.order.Len() == 0
+		c.mu.Unlock()
+		if flushed {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the cached responses aren't flushed")
+		}
+	}
+}
+
+func TestClusterCacheFlushesDecisions(t *testing.T) {
+	policy.SetConfig(&policy.Config{})
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status:     corev1.NodeStatus{Allocatable: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")}},
+	}
+	client := fake.NewSimpleClientset(namespace, node)
+	decisions := newDecisionCache(10, time.Minute)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	flushDecisions(factory.Core().V1().Namespaces().Informer(), decisions, metadataChanged)
+	flushAllDecisions(factory.Core().V1().Nodes().Informer(), decisions)
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	ctx := context.Background()
+
+	// the namespace is labeled between two identical reviews
+	if !cachedTwice(decisions) {
+		t.Fatal("the second review isn't answered from the cache")
+	}
+	namespace.Labels = map[string]string{"tier": "critical"}
+	if _, err := client.CoreV1().Namespaces().Update(ctx, namespace, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFlushed(t, decisions)
+	if !cachedTwice(decisions) {
+		t.Fatal("the review isn't cached again after the flush")
+	}
+
+	// the allocatable of a node changes
+	node.Status.Allocatable[corev1.ResourceCPU] = resource.MustParse("2")
+	if _, err := client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFlushed(t, decisions)
+}
+
+func TestDecisionsChanged(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"pool": "a"}},
+		Status:     corev1.NodeStatus{Allocatable: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}},
+	}
+	heartbeat := node.DeepCopy()
+	heartbeat.ResourceVersion = "2"
+	heartbeat.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}
+	// the same quantity spelled differently
+	heartbeat.Status.Allocatable[corev1.ResourceMemory] = resource.MustParse("1024Mi")
+	if nodeChanged(node, heartbeat) {
+		t.Error("a status update of a node flushes the decisions")
+	}
+	cordoned := node.DeepCopy()
+	cordoned.Spec.Unschedulable = true
+	relabeled := node.DeepCopy()
+	relabeled.Labels["pool"] = "b"
+	tainted := node.DeepCopy()
+	tainted.Spec.Taints = []corev1.Taint{{Key: "gpu", Effect: corev1.TaintEffectNoSchedule}}
+	for name, changed := range map[string]*corev1.Node{"cordoned": cordoned, "relabeled": relabeled, "tainted": tainted} {
+		if !nodeChanged(node, changed) {
+			t.Errorf("%s node doesn't flush the decisions", name)
+		}
+	}
+
+	deployment := &metav1.ObjectMeta{Name: "web", Generation: 1}
+	status := deployment.DeepCopy()
+	status.ResourceVersion = "2"
+	if specChanged(deployment, status) {
+		t.Error("a status update flushes the decisions")
+	}
+	spec := deployment.DeepCopy()
+	spec.Generation = 2
+	annotated := deployment.DeepCopy()
+	annotated.Annotations = map[string]string{"owner": "web"}
+	service := &metav1.ObjectMeta{Name: "web"}
+	for name, changed := range map[string][2]*metav1.ObjectMeta{
+		"spec":      {deployment, spec},
+		"annotated": {deployment, annotated},
+		"service":   {service, service.DeepCopy()},
+	} {
+		if !specChanged(changed[0], changed[1]) {
+			t.Errorf("%s update doesn't flush the decisions", name)
+		}
+	}
+}
+
+// TestDecisionCacheFlushDuringAdmission checks a response made while its
+// namespace, or every one, is flushed isn't cached: it may have been made
+// with the objects before the change.
+func TestDecisionCacheFlushDuringAdmission(t *testing.T) {
+	policy.SetConfig(&policy.Config{})
+	for name, flush := range map[string]func(c *decisionCache){
+		"namespace": func(c *decisionCache) { c.flushNamespace("default") },
+		"all":       func(c *decisionCache) { c.flushAll() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newDecisionCache(10, time.Minute)
+			var calls int
+			stale := func() *v1.AdmissionResponse {
+				calls++
+				// the informer flushes while the rules run
+				flush(c)
+				return &v1.AdmissionResponse{Allowed: true}
+			}
+			c.do(context.Background(), "validate", configMapRequest("default", "web", ""), stale)
+			if c.order.Len() != 0 {
+				t.Fatal("the response made during the flush is cached")
+			}
+			c.do(context.Background(), "validate", configMapRequest("default", "web", ""), stale)
+			if calls != 2 {
+				t.Errorf("admitted %d times, want the stale response made again", calls)
+			}
+		})
+	}
+}
+
+// TestDecisionCacheConcurrentFlush races flushes with admissions for -race.
+func TestDecisionCacheConcurrentFlush(t *testing.T) {
+	policy.SetConfig(&policy.Config{})
+	c := newDecisionCache(10, time.Minute)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			c.flushNamespace("default")
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		c.do(context.Background(), "validate", configMapRequest("default", "web", ""), func() *v1.AdmissionResponse {
+			return &v1.AdmissionResponse{Allowed: true}
+		})
+	}
+	<-done
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// keys of the serving certificate Secret, matching the files the deployment
+// mounts under /etc/webhook/certs
+const (
+	secretCertKey = "cert.pem"
+	secretKeyKey  = "key.pem"
+	secretCAKey   = "ca.pem"
+)
+
+// webhookCerts is a serving certificate together with the CA that signed it,
+// all PEM encoded. The CA is what goes into the caBundle of the webhook
+// configurations.
+type webhookCerts struct {
+	caCert []byte
+	cert   []byte
+	key    []byte
+}
+
+// serviceDNSNames are the names the apiserver may use to reach the service.
+func serviceDNSNames(service, namespace string) []string {
+	return []string{
+		service,
+		fmt.Sprintf("%s.%s", service, namespace),
+		fmt.Sprintf("%s.%s.svc", service, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace),
+	}
+}
+
+// generateCerts creates a self-signed CA and a serving certificate for the
+// webhook service signed by it, both valid for validity.
+func generateCerts(service, namespace string, validity time.Duration) (*webhookCerts, error) {
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(validity)
+
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("%s-ca", service)},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	dnsNames := serviceDNSNames(service, namespace)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsNames[2]},
+		DNSNames:     dnsNames,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhookCerts{
+		caCert: pemEncode("CERTIFICATE", caDER),
+		cert:   pemEncode("CERTIFICATE", der),
+		key:    pemEncode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+	}, nil
+}
+
+func pemEncode(blockType string, der []byte) []byte {
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: blockType, Bytes: der})
+	return buf.Bytes()
+}
+
+// keyPair parses the serving certificate for the TLS listener.
+func (c *webhookCerts) keyPair() (tls.Certificate, error) {
+	return tls.X509KeyPair(c.cert, c.key)
+}
+
+// expiresWithin reports whether the serving certificate is unusable or
+// expires before now+d.
+func (c *webhookCerts) expiresWithin(d time.Duration) bool {
+	block, _ := pem.Decode(c.cert)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(d).After(cert.NotAfter)
+}
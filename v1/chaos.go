@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// chaosInjector delays and fails admission requests on purpose, for
+// rehearsing how the apiserver applies the failurePolicy of the webhooks and
+// tuning their timeoutSeconds in staging. It must never run in production:
+// the failures it injects are real to the apiserver.
+type chaosInjector struct {
+	latency time.Duration
+	// jitter is the max random delay added to latency
+	jitter      time.Duration
+	failureRate float64
+	// failure is how failing requests fail: error answers 500, timeout
+	// holds the request until the apiserver gives up
+	failure string
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newChaosInjector returns the injector of the -chaos* parameters, nil when
+// -chaos isn't set.
+func newChaosInjector(parameters *WhSvrParameters) (*chaosInjector, error) {
+	if !parameters.chaos {
+		return nil, nil
+	}
+	if parameters.chaosLatency < 0 || parameters.chaosLatencyJitter < 0 {
+		return nil, fmt.Errorf("-chaosLatency and -chaosLatencyJitter can't be negative")
+	}
+	if parameters.chaosFailureRate < 0 || parameters.chaosFailureRate > 1 {
+		return nil, fmt.Errorf("-chaosFailureRate %v is not between 0 and 1", parameters.chaosFailureRate)
+	}
+	switch parameters.chaosFailure {
+	case "error", "timeout":
+	default:
+		return nil, fmt.Errorf("-chaosFailure %q is neither error nor timeout", parameters.chaosFailure)
+	}
+	return &chaosInjector{
+		latency:     parameters.chaosLatency,
+		jitter:      parameters.chaosLatencyJitter,
+		failureRate: parameters.chaosFailureRate,
+		failure:     parameters.chaosFailure,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+func (c *chaosInjector) String() string {
+	return fmt.Sprintf("latency %v (+ up to %v), %v%% of the requests failing with %s", c.latency, c.jitter, c.failureRate*100, c.failure)
+}
+
+// draw returns the delay of a request and whether it fails.
+func (c *chaosInjector) draw() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delay := c.latency
+	if c.jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.jitter) + 1))
+	}
+	return delay, c.failureRate > 0 && c.rand.Float64() < c.failureRate
+}
+
+// wrap injects the latency and the failures into the requests of the
+// handler name before next serves them. The latency counts against the
+// timeout of the apiserver like a slow webhook does.
+func (c *chaosInjector) wrap(name string, next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay, fail := c.draw()
+		if delay > 0 {
+			chaosInjections.WithLabelValues(name, "latency").Inc()
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		if !fail {
+			next.ServeHTTP(w, r)
+			return
+		}
+		chaosInjections.WithLabelValues(name, c.failure).Inc()
+		glog.V(2).Infof("Chaos: failing %s request with %s", r.URL.Path, c.failure)
+		if c.failure == "timeout" {
+			<-r.Context().Done()
+			return
+		}
+		http.Error(w, "chaos: injected failure", http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// checkHandler admits raw manifests offline for CI pipelines, so merges can
+// be gated on the policy before anything reaches the cluster, e.g.
+//
+//	curl -k -H "Authorization: Bearer $TOKEN" --data-binary @deployment.yaml "https://webhook/check?namespace=team-a"
+//
+// The body holds one or more YAML documents or JSON objects, Lists are
+// expanded, and namespace is the namespace of the objects without one. The
+// response carries the verdict, warnings and patch of every object, allowed
+// being false as soon as one is denied, and with patchFormat (json6902 or
+// strategic-merge) the patch as a kustomize patch too. Every call must carry
+// the bearer token read from -checkTokenFile or, with -checkTokenReview, a
+// token the apiserver authenticates, see endpointAuth. Go programs call it
+// with pkg/client, whose types mirror checkResponse.
+type checkHandler struct {
+	maxRequestBytes int64
+}
+
+// checkResponse is the response of /check.
+type checkResponse struct {
+	Allowed bool               `json:"allowed"`
+	Results []*manifestVerdict `json:"results"`
+}
+
+func (h *checkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, h.maxRequestBytes))
+	if err != nil {
+		status := http.StatusBadRequest
+		if isBodyTooLarge(err) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("failed to read the manifests: %v", err), status)
+		return
+	}
+	objects, err := splitManifests(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse the manifests: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(objects) == 0 {
+		http.Error(w, "no manifest in the request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), handlerKey{}, "check")
+	namespace := r.URL.Query().Get("namespace")
+	patchFormat := r.URL.Query().Get("patchFormat")
+	if err := validatePatchFormat(patchFormat); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := checkResponse{Allowed: true}
+	for i, object := range objects {
+		verdict, err := admitManifest(ctx, object, namespace)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("manifest %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if patchFormat != "" && verdict.Allowed {
+			if verdict.KustomizePatch, err = kustomizePatch(verdict, patchFormat); err != nil {
+				http.Error(w, fmt.Sprintf("manifest %d: %v", i, err), http.StatusBadRequest)
+				return
+			}
+		}
+		response.Allowed = response.Allowed && verdict.Allowed
+		response.Results = append(response.Results, verdict)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		glog.Errorf("Failed to write the /check response: %v", err)
+	}
+}
+
+// splitManifests returns the JSON of the objects of data, a stream of YAML
+// documents or JSON objects. Empty documents are skipped and the items of
+// Lists, such as kubectl get -o yaml prints, returned in their place.
+func splitManifests(data []byte) ([]json.RawMessage, error) {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	var objects []json.RawMessage
+	for {
+		var object json.RawMessage
+		if err := decoder.Decode(&object); err == io.EOF {
+			return objects, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(object) == 0 || string(object) == "null" {
+			continue
+		}
+		var list struct {
+			Kind  string            `json:"kind"`
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(object, &list); err != nil {
+			return nil, err
+		}
+		if list.Kind == "List" {
+			objects = append(objects, list.Items...)
+			continue
+		}
+		objects = append(objects, object)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/spf13/cobra"
+)
+
+// checkConfig implements the check-config command: it loads the policy
+// config file the way the server does, with the flags and -clusterName, and
+// prints the error which would make the server keep its previous config, or
+// else the warnings about the rules which can't work as written. It exits
+// with 1 on an error, and on warnings with --strict. With --diff it prints
+// first the changes from the config of another file, such as the one
+// deployed, the server would log when reloading it.
+//
+//	admission-webhook check-config -f policy.yaml --diff deployed.yaml
+func checkConfig(parameters *WhSvrParameters, file, against string, strict bool) {
+	reloader := newPolicyReloader(parameters)
+	if file != "" {
+		reloader.file = file
+	}
+	if reloader.file == "" {
+		fmt.Fprintln(os.Stderr, "No policy config to check, pass --file or set -policyConfigFile")
+		os.Exit(1)
+	}
+	loaded, err := reloader.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid policy config: %v\n", err)
+		os.Exit(1)
+	}
+	if against != "" {
+		previous := *reloader
+		previous.file = against
+		deployed, err := previous.load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid policy config %s: %v\n", against, err)
+			os.Exit(1)
+		}
+		changes, err := policy.Diff(deployed, loaded)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't diff the policy configs: %v\n", err)
+			os.Exit(1)
+		}
+		for _, change := range changes {
+			fmt.Printf("%s\n", change)
+		}
+		fmt.Printf("%s: %d changes from %s\n", reloader.file, len(changes), against)
+	}
+
+	// lint the whole file, the policy of every cluster included, not only
+	// the one of -clusterName
+	config, err := policy.LoadConfig(reloader.file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid policy config: %v\n", err)
+		os.Exit(1)
+	}
+	config.IgnoredNamespaces = append(append([]string{}, reloader.ignoredNamespaces...), config.IgnoredNamespaces...)
+	warnings := config.Lint()
+	for _, warning := range warnings {
+		fmt.Printf("warning: %s: %s\n", reloader.file, warning)
+	}
+	fmt.Printf("%s: valid, %d warnings\n", reloader.file, len(warnings))
+	if strict && len(warnings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// newCheckConfigCommand returns the check-config command.
+func newCheckConfigCommand(parameters *WhSvrParameters) *cobra.Command {
+	var file, against string
+	var strict bool
+	command := &cobra.Command{
+		Use:   "check-config",
+		Short: "Check a policy config file before deploying it",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			checkConfig(parameters, file, against, strict)
+		},
+	}
+	command.Flags().StringVarP(&file, "file", "f", "", "Policy config file to check, -policyConfigFile when empty.")
+	command.Flags().StringVar(&against, "diff", "", "Policy config file, such as the deployed one, to print the changes from.")
+	command.Flags().BoolVar(&strict, "strict", false, "Exit with 1 on warnings too.")
+	return command
+}
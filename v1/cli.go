@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// envPrefix prefixes the environment variables setting the server flags,
+// WEBHOOK_TLS_CERT_FILE sets -tlsCertFile.
+const envPrefix = "WEBHOOK_"
+
+// newCommand returns the admission-webhook command. It serves the webhook
+// without a subcommand, its subcommands share the server flags so they all
+// see the same configuration.
+func newCommand(parameters *WhSvrParameters) *cobra.Command {
+	serverFlags := pflag.NewFlagSet("server", pflag.ContinueOnError)
+	bindFlags(serverFlags, parameters)
+
+	serve := func(cmd *cobra.Command, args []string) {
+		runServer(parameters)
+	}
+	command := &cobra.Command{
+		Use:   "admission-webhook",
+		Short: "Mutating and validating admission webhook of the policy config",
+		Long: "Mutating and validating admission webhook of the policy config.\n\n" +
+			"Every server flag can also be set by an environment variable, " + envPrefix + "TLS_CERT_FILE for -tlsCertFile, the flag wins when both are set.",
+		Args:         cobra.NoArgs,
+		Run:          serve,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// glog only logs as configured once its flags are parsed
+			if err := flag.CommandLine.Parse(nil); err != nil {
+				return err
+			}
+			if err := bindEnv(serverFlags); err != nil {
+				return err
+			}
+			return validateParameters(serverFlags, parameters)
+		},
+	}
+	command.PersistentFlags().AddFlagSet(serverFlags)
+	// -v, -logtostderr... of glog
+	command.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+
+	command.AddCommand(
+		&cobra.Command{
+			Use:   "serve",
+			Short: "Serve the admission webhook, the default",
+			Args:  cobra.NoArgs,
+			Run:   serve,
+		},
+		newSimulateCommand(parameters),
+		newReplayCommand(parameters),
+		newAuditCommand(parameters),
+		newOutageReportCommand(parameters),
+		newCheckConfigCommand(parameters),
+		newGenCertsCommand(parameters),
+		newGenManifestsCommand(parameters, serverFlags),
+	)
+	return command
+}
+
+// singleDashFlag matches the long flags given with a single dash, -port=443,
+// which the standard flag package accepted.
+var singleDashFlag = regexp.MustCompile(`^-[A-Za-z][A-Za-z0-9]+(=|$)`)
+
+// normalizeArgs rewrites the long flags of args given with a single dash to
+// two, so the command lines and manifests written for the flag package keep
+// working. Shorthands like -f and the arguments after -- are kept.
+func normalizeArgs(args []string) []string {
+	normalized := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(normalized, args[i:]...)
+		}
+		if singleDashFlag.MatchString(arg) {
+			arg = "-" + arg
+		}
+		normalized = append(normalized, arg)
+	}
+	return normalized
+}
+
+// bindEnv sets the flags of flags not given on the command line from their
+// environment variable, if set.
+func bindEnv(flags *pflag.FlagSet) error {
+	env := viper.New()
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if err = env.BindEnv(f.Name, name); err != nil {
+			return
+		}
+		if f.Changed || !env.IsSet(f.Name) {
+			return
+		}
+		if setErr := flags.Set(f.Name, env.GetString(f.Name)); setErr != nil {
+			err = fmt.Errorf("invalid %s for -%s: %v", name, f.Name, setErr)
+		}
+	})
+	return err
+}
+
+// envName returns the environment variable of the flag name, its words in
+// upper case separated by underscores: WEBHOOK_HARBOR_URL for harborURL.
+func envName(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			// the last capital of an acronym starts the next word: URLPath
+			endsAcronym := unicode.IsUpper(previous) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || endsAcronym {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// validateParameters checks the values of the server flags and the
+// combinations of them which can't apply together, before any command
+// starts. It reports every problem, and how to fix it, at once.
+func validateParameters(flags *pflag.FlagSet, parameters *WhSvrParameters) error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	given := func(name string) bool {
+		return flags.Changed(name)
+	}
+
+	if !contains(messages.Languages(), parameters.logLanguage) {
+		invalid("invalid -logLanguage %q, expect one of %s", parameters.logLanguage, strings.Join(messages.Languages(), ", "))
+	}
+	if _, err := time.LoadLocation(parameters.logTimezone); err != nil {
+		invalid("invalid -logTimezone %q: %v", parameters.logTimezone, err)
+	}
+	if parameters.deadlineResponse != deadlineAllow && parameters.deadlineResponse != deadlineDeny {
+		invalid("invalid -deadlineResponse %q, expect %s or %s", parameters.deadlineResponse, deadlineAllow, deadlineDeny)
+	}
+	if parameters.onInternalError != internalErrorAllow && parameters.onInternalError != internalErrorDeny {
+		invalid("invalid -onInternalError %q, expect %s or %s", parameters.onInternalError, internalErrorAllow, internalErrorDeny)
+	}
+
+	if parameters.insecureHTTP {
+		if parameters.clientCAFile != "" {
+			invalid("-insecureHTTP can't verify client certificates, drop -tlsClientCAFile")
+		}
+		if parameters.certBootstrap {
+			invalid("-insecureHTTP serves no certificate, drop -certBootstrap")
+		}
+		for _, name := range []string{"tlsCertFile", "tlsKeyFile", "tlsMinVersion", "tlsCipherSuites", "tlsCurvePreferences"} {
+			if given(name) {
+				invalid("-insecureHTTP serves no TLS, drop -%s", name)
+			}
+		}
+	}
+	if parameters.certBootstrap {
+		for _, name := range []string{"tlsCertFile", "tlsKeyFile", "caBundleFile"} {
+			if given(name) {
+				invalid("-certBootstrap generates the serving certificate and its CA, drop -%s", name)
+			}
+		}
+	}
+	if parameters.disableHTTP2 && parameters.http2MaxStreams > 0 {
+		invalid("-http2MaxConcurrentStreams can't apply with -disableHTTP2, drop either")
+	}
+	if parameters.listenUnix != "" && given("port") {
+		invalid("-listenUnix replaces -port, drop either")
+	}
+	if parameters.otlpInsecure && parameters.otlpEndpoint == "" {
+		invalid("-otlpInsecure needs -otlpEndpoint, tracing is disabled without it")
+	}
+	if parameters.harborCredentialsFile != "" && parameters.harborURL == "" {
+		invalid("-harborCredentialsFile needs -harborURL")
+	}
+	for _, name := range []string{"calloutTimeout", "calloutRetries"} {
+		if given(name) && parameters.calloutURL == "" {
+			invalid("-%s needs -calloutURL", name)
+		}
+	}
+	for _, name := range []string{"notifyFormat", "notifyTemplateFile", "notifyPerMinute", "notifyBurst"} {
+		if given(name) && parameters.notifyURL == "" {
+			invalid("-%s needs -notifyURL", name)
+		}
+	}
+	if given("namespaceCacheFailOpen") && !parameters.watchNamespaces {
+		invalid("-namespaceCacheFailOpen needs -watchNamespaces, namespaces aren't looked up without it")
+	}
+	if given("namespaceBurst") && parameters.namespaceQPS <= 0 {
+		invalid("-namespaceBurst needs a positive -namespaceQPS, the limit is disabled without it")
+	}
+	if given("decisionCacheTTL") && parameters.decisionCacheSize <= 0 {
+		invalid("-decisionCacheTTL needs a positive -decisionCacheSize, the cache is disabled without it")
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Answers given when the rules don't finish within the budget of the
+// apiserver.
+const (
+	deadlineAllow = "allow"
+	deadlineDeny  = "deny"
+)
+
+// Answers given when the webhook fails to process a request.
+const (
+	internalErrorAllow = "allow"
+	internalErrorDeny  = "deny"
+)
+
+// requestContext returns ctx, the context of r, ending margin before the
+// timeout the apiserver waits for the answer, which it sends as the timeout
+// query parameter. Without one ctx is only cancelled with r.
+func requestContext(ctx context.Context, r *http.Request, margin time.Duration) (context.Context, context.CancelFunc, error) {
+	timeout := r.URL.Query().Get("timeout")
+	if timeout == "" {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	budget, err := time.ParseDuration(timeout)
+	if err == nil && budget <= 0 {
+		err = fmt.Errorf("not positive")
+	}
+	if err != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, fmt.Errorf("invalid timeout %q: %v", timeout, err)
+	}
+	// answering late is worse than answering early, keep at least half
+	if margin > budget/2 {
+		margin = budget / 2
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget-margin)
+	return ctx, cancel, nil
+}
+
+// admitWithin returns the response of admit, or the deadline response when
+// ctx is done first. admit keeps running then, its response is discarded,
+// and holds the in-flight slot of the request until it returns so that
+// -maxInflight still bounds the admissions really running.
+func (whsvr *WebhookServer) admitWithin(ctx context.Context, name string, admit func() *v1.AdmissionResponse) *v1.AdmissionResponse {
+	done := make(chan *v1.AdmissionResponse, 1)
+	slot := heldInflightSlot(ctx)
+	slot.hold()
+	go func() {
+		defer slot.release()
+		done <- admit()
+	}()
+	select {
+	case response := <-done:
+		return response
+	case <-ctx.Done():
+		admissionDeadlineExceeded.WithLabelValues(name).Inc()
+		return whsvr.deadlineResponse(ctx.Err())
+	}
+}
+
+// deadlineResponse is the best effort answer when the rules didn't finish
+// in time: allowed, without mutations, with a warning, or denied with a
+// timeout when -deadlineResponse is deny.
+func (whsvr *WebhookServer) deadlineResponse(err error) *v1.AdmissionResponse {
+	if whsvr.onDeadline == deadlineDeny {
+		return &v1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusGatewayTimeout,
+				Reason:  metav1.StatusReasonTimeout,
+				Message: fmt.Sprintf(messages.DeadlineDenied, err),
+			},
+		}
+	}
+	return &v1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: []string{fmt.Sprintf(messages.DeadlineAllowed, err)},
+	}
+}
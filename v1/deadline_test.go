@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1"
+)
+
+// TestDeadlineHoldsInflightSlot checks an admission answered at the
+// deadline keeps its in-flight slot until its rules return.
+func TestDeadlineHoldsInflightSlot(t *testing.T) {
+	limiter := newInflightLimiter(1, 10*time.Millisecond)
+	whsvr := &WebhookServer{maxRequestBytes: 1024}
+	release := make(chan struct{})
+	blocking := func(ctx context.Context, ar *v1.AdmissionReview, log *requestLogger) *v1.AdmissionResponse {
+		<-release
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+	handler := limiter.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whsvr.serve(w, r, "validate", blocking)
+	}))
+	post := func() *httptest.ResponseRecorder {
+		body := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"d1","operation":"CREATE"}}`
+		req := httptest.NewRequest(http.MethodPost, "/validate?timeout=100ms", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post()
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", w.Code, w.Body.String())
+	}
+	if inflight := testutil.ToFloat64(inflightRequests); inflight != 1 {
+		t.Errorf("%v requests in flight after the deadline, want the blocked one", inflight)
+	}
+	if w := post(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second request answered %d while the first one runs, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(inflightRequests) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the slot isn't freed once the rules return")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w := post(); w.Code != http.StatusOK {
+		t.Errorf("answered %d once the slot is freed", w.Code)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// decisionCache remembers the responses of the admission handlers, the
+// controllers resubmit the same objects on every reconcile. Responses are
+// keyed by a hash of the stage, the request without the fields changing on
+// every write, the policy generation and the windows of the policy open, and
+// expire after ttl since they also depend on the cluster state. The cluster
+// cache flushes the responses of a namespace when the objects rules look up
+// in it change, and all of them when the nodes change. The responses of a
+// previous policy generation are flushed once the policy changes.
+type decisionCache struct {
+	size int
+	ttl  time.Duration
+
+	mu         sync.Mutex
+	order      *list.List // most recently used first
+	entries    map[[sha256.Size]byte]*list.Element
+	generation uint64 // policy generation of the entries
+	flushes    uint64 // number of namespaces flushed
+}
+
+type decisionEntry struct {
+	key       [sha256.Size]byte
+	namespace string
+	response  *v1.AdmissionResponse
+	expires   time.Time
+}
+
+// newDecisionCache returns a cache of at most size responses, nil when size
+// isn't positive.
+func newDecisionCache(size int, ttl time.Duration) *decisionCache {
+	if size <= 0 {
+		return nil
+	}
+	return &decisionCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// do returns the cached response of stage to req, or the one of admit which
+// is cached unless ctx, the context of admit, was done meanwhile: its lookups
+// failed then. Answers to retry later (503) aren't cached either, nor are
+// the requests sent to the external policy service, its decisions are its
+// own, nor the mutations setting the config checksum, which changes with the
+// configuration rather than the request.
+func (c *decisionCache) do(ctx context.Context, stage string, req *v1.AdmissionRequest, admit func() *v1.AdmissionResponse) *v1.AdmissionResponse {
+	if c == nil || req == nil || policy.CurrentConfig().Callout.Applies(req.Kind.Kind) ||
+		(stage == "mutate" && admission.ConfigChecksummed(req)) {
+		return admit()
+	}
+	// the generation is read before admit runs, a response can't be cached
+	// under a newer generation than the policy it was made with
+	generation := policy.Generation()
+	key, ok := decisionKey(stage, req, generation)
+	if !ok {
+		return admit()
+	}
+	flushes := c.flushGeneration(generation)
+	if response := c.get(key); response != nil {
+		decisionCacheHits.WithLabelValues(stage).Inc()
+		return response
+	}
+	decisionCacheMisses.WithLabelValues(stage).Inc()
+	response := admit()
+	if response != nil && ctx.Err() == nil && responseCode(response) != http.StatusServiceUnavailable {
+		c.add(key, req.Namespace, flushes, response)
+	}
+	return response
+}
+
+// flushGeneration flushes the cache when the policy generation isn't the one
+// of its entries anymore, they can't be looked up since, and returns the
+// number of namespaces flushed so far.
+func (c *decisionCache) flushGeneration(generation uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		c.generation = generation
+		c.order.Init()
+		c.entries = make(map[[sha256.Size]byte]*list.Element)
+		decisionCacheEntries.Set(0)
+	}
+	return c.flushes
+}
+
+// flushNamespace flushes the responses to the requests of namespace, the
+// objects their rules looked up changed. It is a no-op on a nil cache.
+func (c *decisionCache) flushNamespace(namespace string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushes++
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if entry := element.Value.(*decisionEntry); entry.namespace == namespace {
+			c.order.Remove(element)
+			delete(c.entries, entry.key)
+		}
+		element = next
+	}
+	decisionCacheEntries.Set(float64(c.order.Len()))
+}
+
+// flushAll flushes every response, the cluster-scoped objects their rules
+// looked up, such as the nodes, changed. It is a no-op on a nil cache.
+func (c *decisionCache) flushAll() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushes++
+	c.order.Init()
+	c.entries = make(map[[sha256.Size]byte]*list.Element)
+	decisionCacheEntries.Set(0)
+}
+
+func (c *decisionCache) get(key [sha256.Size]byte) *v1.AdmissionResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*decisionEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry.response.DeepCopy()
+}
+
+// add caches response unless a namespace was flushed since flushes were
+// counted: the response may have been made with the objects before the change.
+func (c *decisionCache) add(key [sha256.Size]byte, namespace string, flushes uint64, response *v1.AdmissionResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flushes != flushes {
+		return
+	}
+	entry := &decisionEntry{key: key, namespace: namespace, response: response.DeepCopy(), expires: time.Now().Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decisionEntry).key)
+	}
+	decisionCacheEntries.Set(float64(c.order.Len()))
+}
+
+// decisionKey hashes what the response of stage to req under the policy of
+// generation depends on, ok is false when the objects can't be decoded.
+func decisionKey(stage string, req *v1.AdmissionRequest, generation uint64) (key [sha256.Size]byte, ok bool) {
+	object, err := relevantObject(req.Object.Raw)
+	if err != nil {
+		return key, false
+	}
+	oldObject, err := relevantObject(req.OldObject.Raw)
+	if err != nil {
+		return key, false
+	}
+	data, err := json.Marshal(struct {
+		Stage       string
+		Generation  uint64
+		Windows     []string
+		Kind        interface{}
+		Resource    interface{}
+		SubResource string
+		Namespace   string
+		Name        string
+		Operation   v1.Operation
+		User        string
+		Groups      []string
+		Object      interface{}
+		OldObject   interface{}
+	}{
+		Stage:       stage,
+		Generation:  generation,
+		Windows:     policy.OpenWindows(),
+		Kind:        req.Kind,
+		Resource:    req.Resource,
+		SubResource: req.SubResource,
+		Namespace:   req.Namespace,
+		Name:        req.Name,
+		Operation:   req.Operation,
+		User:        req.UserInfo.Username,
+		Groups:      req.UserInfo.Groups,
+		Object:      object,
+		OldObject:   oldObject,
+	})
+	if err != nil {
+		return key, false
+	}
+	return sha256.Sum256(data), true
+}
+
+// relevantObject decodes raw without the metadata every write changes.
+func relevantObject(raw []byte) (map[string]interface{}, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	for _, field := range []string{"resourceVersion", "generation", "managedFields", "uid", "creationTimestamp"} {
+		unstructured.RemoveNestedField(object, "metadata", field)
+	}
+	return object, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// configMapRequest is a request creating the ConfigMap name in namespace
+// with metadata, the fields of its object metadata other than the name.
+func configMapRequest(namespace, name, metadata string) *v1.AdmissionRequest {
+	return &v1.AdmissionRequest{
+		UID:       "c1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+		Namespace: namespace,
+		Name:      name,
+		Operation: v1.Create,
+		Object: runtime.RawExtension{Raw: []byte(fmt.Sprintf(
+			`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":%q,"namespace":%q%s},"data":{"key":"value"}}`, name, namespace, metadata))},
+	}
+}
+
+// countedAdmit returns an admit function answering response and counting
+// its calls in calls.
+func countedAdmit(calls *int, response *v1.AdmissionResponse) func() *v1.AdmissionResponse {
+	return func() *v1.AdmissionResponse {
+		*calls++
+		return response
+	}
+}
+
+func TestDecisionCacheHits(t *testing.T) {
+	policy.SetConfig(&policy.Config{})
+	c := newDecisionCache(10, time.Minute)
+	ctx := context.Background()
+	var calls int
+	admit := countedAdmit(&calls, &v1.AdmissionResponse{Allowed: true})
+
+	c.do(ctx, "validate", configMapRequest("default", "web", ""), admit)
+	// the fields every write changes aren't part of the key
+	volatile := `,"resourceVersion":"42","generation":3,"uid":"u1","creationTimestamp":"2021-10-09T12:00:00Z","managedFields":[{"manager":"kubectl"}]`
+	c.do(ctx, "validate", configMapRequest("default", "web", volatile), admit)
+	if calls != 1 {
+		t.Errorf("admitted %d times, want the resubmission answered from the cache", calls)
+	}
+	for _, req := range []*v1.AdmissionRequest{
+		configMapRequest("default", "web", `,"labels":{"app":"web"}`),
+		configMapRequest("default", "api", ""),
+		configMapRequest("staging", "web", ""),
+	} {
+		calls = 0
+		c.do(ctx, "validate", req, admit)
+		if calls != 1 {
+			t.Errorf("%s/%s %s answered from the cache, want a miss", req.Namespace, req.Name, req.Object.Raw)
+		}
+	}
+	calls = 0
+	c.do(ctx, "mutate", configMapRequest("default", "web", ""), admit)
+	if calls != 1 {
+		t.Error("the mutation answered with the cached validation")
+	}
+}
+
+func TestDecisionCacheEviction(t *testing.T) {
+	policy.SetConfig(&policy.Config{})
+	c := newDecisionCache(2, time.Minute)
+	ctx := context.Background()
+	var calls int
+	admit := countedAdmit(&calls, &v1.AdmissionResponse{Allowed: true})
+	do := func(name string) bool {
+		before := calls
+		c.do(ctx, "validate", configMapRequest("default", name, ""), admit)
+		return calls == before
+	}
+
+	do("a")
+	do("b")
+	// a is used last, b is the least recently used one
+	if !do("a") {
+		t.Fatal("a isn't cached")
+	}
+	do("c")
+	if c.order.Len() != 2 {
+		t.Errorf("%d responses cached, want at most 2", c.order.Len())
+	}
+	if !do("a") {
+		t.Error("a evicted, want the least recently used b")
+	}
+	if do("b") {
+		t.Error("b still cached, want it evicted")
+	}
+}
+
+func TestDecisionCacheExpiry(t *testing.T) {
+	policy.SetConfig(&policy.Config{})
+	c := newDecisionCache(10, time.Millisecond)
+	ctx := context.Background()
+	var calls int
+	admit := countedAdmit(&calls, &v1.AdmissionResponse{Allowed: true})
+	c.do(ctx, "validate", configMapRequest("default", "web", ""), admit)
+	time.Sleep(5 * time.Millisecond)
+	c.do(ctx, "validate", configMapRequest("default", "web", ""), admit)
+	if calls != 2 {
+		t.Errorf("admitted %d times, want the expired response made again", calls)
+	}
+}
+
+func TestDecisionCacheSkips(t *testing.T) {
+	unavailable := &v1.AdmissionResponse{Result: &metav1.Status{Code: http.StatusServiceUnavailable}}
+	tests := []struct {
+		name     string
+		config   *policy.Config
+		response *v1.AdmissionResponse
+		cancel   bool
+	}{
+		{"retry later", &policy.Config{}, unavailable, false},
+		{"context done", &policy.Config{}, &v1.AdmissionResponse{Allowed: true}, true},
+		{"callout kind", &policy.Config{Callout: policy.CalloutPolicy{Kinds: []string{"ConfigMap"}}}, &v1.AdmissionResponse{Allowed: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy.SetConfig(tt.config)
+			defer policy.SetConfig(&policy.Config{})
+			c := newDecisionCache(10, time.Minute)
+			var calls int
+			for i := 0; i < 2; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				if tt.cancel {
+					cancel()
+				}
+				c.do(ctx, "validate", configMapRequest("default", "web", ""), countedAdmit(&calls, tt.response))
+				cancel()
+			}
+			if calls != 2 || c.order.Len() != 0 {
+				t.Errorf("admitted %d times with %d responses cached, want none cached", calls, c.order.Len())
+			}
+		})
+	}
+}
+
+func TestDecisionCachePolicyChange(t *testing.T) {
+	policy.SetConfig(&policy.Config{})
+	c := newDecisionCache(10, time.Minute)
+	ctx := context.Background()
+	var calls int
+	admit := countedAdmit(&calls, &v1.AdmissionResponse{Allowed: true})
+	c.do(ctx, "validate", configMapRequest("default", "web", ""), admit)
+	policy.SetConfig(&policy.Config{})
+	c.do(ctx, "validate", configMapRequest("default", "web", ""), admit)
+	if calls != 2 {
+		t.Errorf("admitted %d times, want the response of the previous policy dropped", calls)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/golang/glog"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// finalizerController records the deletion of the Deployments the webhook
+// manages and removes their policy.FinalizerManaged, or its legacy key, so
+// their deletion goes on. Every replica of the webhook runs one, only the
+// first patch removing the finalizer succeeds and records the deletion.
+type finalizerController struct {
+	client kubernetes.Interface
+	lister appslisters.DeploymentLister
+	queue  workqueue.RateLimitingInterface
+}
+
+// startManagedFinalizer finalizes the Deployments of informer being deleted
+// until ctx is done, informer has to be started after.
+func startManagedFinalizer(ctx context.Context, client kubernetes.Interface, informer appsinformers.DeploymentInformer) {
+	c := &finalizerController{
+		client: client,
+		lister: informer.Lister(),
+		queue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "managed-finalizer"),
+	}
+	enqueue := func(obj interface{}) {
+		deployment, ok := obj.(*appsv1.Deployment)
+		if !ok || deployment.DeletionTimestamp == nil || finalizerIndex(deployment) < 0 {
+			return
+		}
+		if key, err := cache.MetaNamespaceKeyFunc(deployment); err == nil {
+			c.queue.Add(key)
+		}
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+	})
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	go func() {
+		for c.processNext(ctx) {
+		}
+	}()
+}
+
+// processNext finalizes the next Deployment of the queue, retried later on
+// failure, and returns false once the queue is shut down.
+func (c *finalizerController) processNext(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+	key := item.(string)
+	if err := c.finalize(ctx, key); err != nil {
+		glog.Warningf("Failed to finalize Deployment %s, retrying: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// finalize removes the finalizer of the Deployment of key and records its
+// deletion once removed.
+func (c *finalizerController) finalize(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil
+	}
+	deployment, err := c.lister.Deployments(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	index := finalizerIndex(deployment)
+	if deployment.DeletionTimestamp == nil || index < 0 {
+		return nil
+	}
+	// the test fails the patch when the finalizers changed meanwhile, it is
+	// retried with those of the cache then
+	patch := fmt.Sprintf(`[{"op":"test","path":"/metadata/finalizers/%d","value":%q},{"op":"remove","path":"/metadata/finalizers/%d"}]`,
+		index, deployment.Finalizers[index], index)
+	_, err = c.client.AppsV1().Deployments(namespace).Patch(ctx, name, types.JSONPatchType, []byte(patch), metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	managedDeletions.WithLabelValues("Deployment").Inc()
+	glog.Infof("Managed Deployment %s deleted at %s after %s, sidecars: [%s], injection templates: %q",
+		key, deployment.DeletionTimestamp.UTC().Format(time.RFC3339),
+		deployment.DeletionTimestamp.Sub(deployment.CreationTimestamp.Time).Round(time.Second),
+		strings.Join(sidecarVersions(deployment), ", "), policy.LookupValue(deployment.Spec.Template.Annotations, policy.AnnotationInjectKey))
+	return nil
+}
+
+// finalizerIndex returns the index of policy.FinalizerManaged, or its legacy
+// key, in the finalizers of deployment, -1 without it.
+func finalizerIndex(deployment *appsv1.Deployment) int {
+	for i, finalizer := range deployment.Finalizers {
+		if policy.IsKey(finalizer, policy.FinalizerManaged) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sidecarVersions returns the sidecars the pod template of deployment
+// records the version of, as name=version, sorted.
+func sidecarVersions(deployment *appsv1.Deployment) []string {
+	var versions []string
+	for key, version := range deployment.Spec.Template.Annotations {
+		if name, ok := policy.TrimKeyPrefix(key, policy.AnnotationSidecarVersionPrefix); ok {
+			versions = append(versions, name+"="+version)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// genCerts implements the gen-certs command, replacing
+// deployment/webhook-create-signed-cert.sh: it writes a self-signed CA and a
+// serving certificate for -serviceName in -serviceNamespace to -output and
+// prints the base64 caBundle for the webhook configurations.
+//
+//	admission-webhook gen-certs --output /etc/webhook/certs
+//	admission-webhook gen-certs --secret | kubectl apply -f -
+func genCerts(parameters *WhSvrParameters, output string, secret bool) {
+	certs, err := generateCerts(parameters.serviceName, parameters.serviceNamespace, parameters.certValidity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate certificates: %v\n", err)
+		os.Exit(1)
+	}
+	caBundle := base64.StdEncoding.EncodeToString(certs.caCert)
+
+	if secret {
+		s := &corev1.Secret{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        parameters.certSecretName,
+				Namespace:   parameters.serviceNamespace,
+				Labels:      manifestLabels(),
+				Annotations: map[string]string{"caBundle": caBundle},
+			},
+		}
+		certs.toSecret(s)
+		data, err := yaml.Marshal(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to marshal secret: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s", data)
+		return
+	}
+
+	if err := certs.writeFiles(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write certificates: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s, %s and %s to %s for %v\n", secretCAKey, secretCertKey, secretKeyKey, output, serviceDNSNames(parameters.serviceName, parameters.serviceNamespace))
+	fmt.Println(caBundle)
+}
+
+// newGenCertsCommand returns the gen-certs command.
+func newGenCertsCommand(parameters *WhSvrParameters) *cobra.Command {
+	var output string
+	var secret bool
+	command := &cobra.Command{
+		Use:   "gen-certs",
+		Short: "Generate a self-signed serving certificate and print its caBundle",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			genCerts(parameters, output, secret)
+		},
+	}
+	command.Flags().StringVar(&output, "output", ".", "Directory to write ca.pem, cert.pem and key.pem to.")
+	command.Flags().BoolVar(&secret, "secret", false, "Print a Secret named -certSecretName holding the certificates instead of writing files.")
+	return command
+}
+
+// writeFiles stores the certificates under the names the deployment mounts
+// them with, so dir can be passed as the directory of -tlsCertFile.
+func (c *webhookCerts) writeFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, secretCAKey), c.caCert, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, secretCertKey), c.cert, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, secretKeyKey), c.key, 0600)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// inflightLimiter bounds the number of admission requests processed at the
+// same time. A request waits up to queueTimeout for a free slot and is
+// rejected with 429 afterwards, so a burst of admissions degrades into
+// failurePolicy handling instead of an OOM-killed webhook pod.
+type inflightLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// newInflightLimiter returns nil when max is not positive, which disables
+// limiting.
+func newInflightLimiter(max int, queueTimeout time.Duration) *inflightLimiter {
+	if max <= 0 {
+		inflightLimit.Set(0)
+		return nil
+	}
+	inflightLimit.Set(float64(max))
+	return &inflightLimiter{
+		slots:        make(chan struct{}, max),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (l *inflightLimiter) wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			inflightRejected.Inc()
+			glog.Warningf("Rejecting %s request, %d admission requests already in flight", r.URL.Path, cap(l.slots))
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many admission requests in flight", http.StatusTooManyRequests)
+			return
+		case <-r.Context().Done():
+			// the apiserver gave up while we were queued
+			return
+		}
+		inflightQueueWait.Observe(time.Since(start).Seconds())
+		inflightRequests.Inc()
+		slot := &inflightSlot{refs: 1, free: func() {
+			inflightRequests.Dec()
+			<-l.slots
+		}}
+		defer slot.release()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), inflightSlotKey{}, slot)))
+	})
+}
+
+type inflightSlotKey struct{}
+
+// inflightSlot is the slot of a request, freed once its handler and the
+// work it left running in the background, see admitWithin, are all done.
+type inflightSlot struct {
+	refs int32
+	free func()
+}
+
+// heldInflightSlot returns the slot of the request of ctx, nil when it isn't
+// limited.
+func heldInflightSlot(ctx context.Context) *inflightSlot {
+	slot, _ := ctx.Value(inflightSlotKey{}).(*inflightSlot)
+	return slot
+}
+
+// hold keeps the slot until a matching release.
+func (s *inflightSlot) hold() {
+	if s != nil {
+		atomic.AddInt32(&s.refs, 1)
+	}
+}
+
+func (s *inflightSlot) release() {
+	if s != nil && atomic.AddInt32(&s.refs, -1) == 0 {
+		s.free()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// restConfig loads the given kubeconfig file, or the pod's service account
+// when it is empty, tracing the requests to the API server made for
+// admission requests.
+func restConfig(kubeconfig string) (*rest.Config, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	config.Wrap(traceTransport)
+	return config, nil
+}
+
+// newKubeClient connects with the given kubeconfig file, or with the pod's
+// service account when it is empty.
+func newKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// newDynamicClient connects like newKubeClient, for the custom resources
+// the webhook has no Go types of.
+func newDynamicClient(kubeconfig string) (dynamic.Interface, error) {
+	config, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// newMetadataClient connects like newKubeClient, to get and watch the
+// metadata of objects only.
+func newMetadataClient(kubeconfig string) (metadata.Interface, error) {
+	config, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.NewForConfig(config)
+}
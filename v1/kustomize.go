@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// formats the mutations can be exported in as kustomize patches
+const (
+	// a patches entry of kustomization.yaml with the JSON patch inline
+	patchFormatJSON6902 = "json6902"
+	// a strategic merge patch file
+	patchFormatStrategicMerge = "strategic-merge"
+)
+
+// types the strategic merge patches are computed with, by kind, telling how
+// their lists are merged
+var kustomizeTypes = map[string]interface{}{
+	"Deployment":            appsv1.Deployment{},
+	"ReplicaSet":            appsv1.ReplicaSet{},
+	"Pod":                   corev1.Pod{},
+	"Service":               corev1.Service{},
+	"Namespace":             corev1.Namespace{},
+	"Ingress":               networkingv1.Ingress{},
+	"PersistentVolumeClaim": corev1.PersistentVolumeClaim{},
+	"ConfigMap":             corev1.ConfigMap{},
+	"Secret":                corev1.Secret{},
+}
+
+func validatePatchFormat(format string) error {
+	switch format {
+	case "", patchFormatJSON6902, patchFormatStrategicMerge:
+		return nil
+	}
+	return fmt.Errorf("unknown patch format %q, expect %s or %s", format, patchFormatJSON6902, patchFormatStrategicMerge)
+}
+
+// kustomizePatch renders the mutation of verdict as a kustomize patch in
+// format, so teams preferring explicit configuration can bake it into their
+// repository. It is empty when the mutation changes nothing.
+func kustomizePatch(verdict *manifestVerdict, format string) (string, error) {
+	if len(verdict.Patch) == 0 {
+		return "", nil
+	}
+	var meta struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(verdict.original, &meta); err != nil {
+		return "", err
+	}
+	// kustomize finds the object to patch by name
+	if meta.Name == "" {
+		return "", fmt.Errorf("%s without metadata.name can't be patched by kustomize", meta.Kind)
+	}
+
+	switch format {
+	case patchFormatJSON6902:
+		operations, err := yaml.JSONToYAML(verdict.Patch)
+		if err != nil {
+			return "", err
+		}
+		gvk := meta.GroupVersionKind()
+		target := map[string]string{
+			"group":     gvk.Group,
+			"version":   gvk.Version,
+			"kind":      gvk.Kind,
+			"name":      meta.Name,
+			"namespace": verdict.Namespace,
+		}
+		// the core group and cluster-scoped objects go without
+		for key, value := range target {
+			if value == "" {
+				delete(target, key)
+			}
+		}
+		entry := []map[string]interface{}{{"target": target, "patch": string(operations)}}
+		data, err := yaml.Marshal(entry)
+		return string(data), err
+
+	case patchFormatStrategicMerge:
+		patch, err := strategicpatch.CreateTwoWayMergePatch(verdict.original, verdict.object, kustomizeTypes[meta.Kind])
+		if err != nil {
+			return "", err
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(patch, &fields); err != nil {
+			return "", err
+		}
+		if len(fields) == 0 {
+			return "", nil
+		}
+		stripElementOrder(fields)
+		// the patch is applied to the object of the same kind and name
+		fields["apiVersion"], fields["kind"] = meta.APIVersion, meta.Kind
+		metadata, _ := fields["metadata"].(map[string]interface{})
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+			fields["metadata"] = metadata
+		}
+		metadata["name"] = meta.Name
+		if verdict.Namespace != "" && meta.Kind != "Namespace" {
+			metadata["namespace"] = verdict.Namespace
+		}
+		data, err := yaml.Marshal(fields)
+		return string(data), err
+	}
+	return "", validatePatchFormat(format)
+}
+
+// stripElementOrder removes the $setElementOrder directives of a strategic
+// merge patch, which only keep the order of the merged lists and which
+// kustomize doesn't need.
+func stripElementOrder(fields map[string]interface{}) {
+	for key, value := range fields {
+		if strings.HasPrefix(key, "$setElementOrder/") {
+			delete(fields, key)
+			continue
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			stripElementOrder(value)
+		case []interface{}:
+			for _, item := range value {
+				if item, ok := item.(map[string]interface{}); ok {
+					stripElementOrder(item)
+				}
+			}
+		}
+	}
+}
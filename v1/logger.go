@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1"
+)
+
+// requestLogger writes glog lines prefixed with the UID of the admission
+// request being served, so the output of concurrent requests can be grepped
+// per request instead of being buffered and stitched together afterwards.
+// Lines start with an RFC3339 timestamp in the -logTimezone, which unlike
+// the glog header carries the year and the offset.
+// Formats from the messages catalog are logged in the -logLanguage.
+type requestLogger struct {
+	prefix string
+}
+
+// newRequestLogger returns a logger for req. req may be nil while the body
+// has not been decoded yet.
+func newRequestLogger(req *v1.AdmissionRequest) *requestLogger {
+	l := &requestLogger{}
+	l.setRequest(req)
+	return l
+}
+
+// setRequest switches the prefix to req once it has been decoded.
+func (l *requestLogger) setRequest(req *v1.AdmissionRequest) {
+	if req == nil {
+		l.prefix = "[uid=-] "
+		return
+	}
+	l.prefix = fmt.Sprintf("[uid=%s] ", req.UID)
+}
+
+func (l *requestLogger) Infof(format string, args ...interface{}) {
+	glog.InfoDepth(1, logTimestamp()+" "+l.prefix+fmt.Sprintf(messages.Localize(format), args...))
+}
+
+func (l *requestLogger) Warningf(format string, args ...interface{}) {
+	glog.WarningDepth(1, logTimestamp()+" "+l.prefix+fmt.Sprintf(messages.Localize(format), args...))
+}
+
+func (l *requestLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, logTimestamp()+" "+l.prefix+fmt.Sprintf(messages.Localize(format), args...))
+}
+
+// logLocation is the time zone of the timestamps of the request logs, set by
+// -logTimezone.
+var logLocation = time.UTC
+
+// logTimestampFormat is RFC3339 with a fixed millisecond precision, so the
+// timestamps of one zone sort as text.
+const logTimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// setLogTimezone sets the time zone of the request logs, an IANA name such as
+// Asia/Shanghai, UTC or Local.
+func setLogTimezone(name string) error {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	logLocation = location
+	return nil
+}
+
+// logTimestamp returns the timestamp the request log lines start with.
+func logTimestamp() string {
+	return time.Now().In(logLocation).Format(logTimestampFormat)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// dump the generated patch of every mutation
+	logFinalPatch = newLogToggle(true)
+)
+
+// logToggle is a logging switch that can be flipped at runtime while
+// requests are being served.
+type logToggle struct {
+	v int32
+}
+
+func newLogToggle(enabled bool) *logToggle {
+	t := &logToggle{}
+	t.Set(enabled)
+	return t
+}
+
+func (t *logToggle) Enabled() bool {
+	return atomic.LoadInt32(&t.v) == 1
+}
+
+func (t *logToggle) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&t.v, v)
+}
+
+// logLevelHandler reports and changes the glog verbosity and the dump toggles
+// at runtime, e.g.
+//
+//	curl -k -H "Authorization: Bearer $TOKEN" -X PUT "https://webhook/debug/loglevel?v=4&logFinalPatch=true"
+//
+// Every call must carry the bearer token read from -adminTokenFile or, with
+// -adminTokenReview, a token the apiserver authenticates, see endpointAuth.
+// With -adminAccessResource only the users a SubjectAccessReview allows may
+// change the settings.
+type logLevelHandler struct{}
+
+func (h *logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		if err := h.apply(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"v":             flag.Lookup("v").Value.String(),
+		"logFinalPatch": logFinalPatch.Enabled(),
+	})
+}
+
+// apply validates all query parameters before changing anything, so a bad
+// request leaves the settings untouched.
+func (h *logLevelHandler) apply(r *http.Request) error {
+	query := r.URL.Query()
+
+	var level string
+	if v := query.Get("v"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return fmt.Errorf("invalid verbosity %q", v)
+		}
+		level = v
+	}
+	var patch *bool
+	if v := query.Get("logFinalPatch"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid logFinalPatch %q", v)
+		}
+		patch = &b
+	}
+
+	if level != "" {
+		if err := flag.Set("v", level); err != nil {
+			return err
+		}
+		glog.Infof("Log verbosity set to %s", level)
+	}
+	if patch != nil {
+		logFinalPatch.Set(*patch)
+		glog.Infof("logFinalPatch set to %v", *patch)
+	}
+	return nil
+}
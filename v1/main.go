@@ -3,50 +3,406 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"flag"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/cnych/admission-webhook/pkg/callout"
+	"github.com/cnych/admission-webhook/pkg/cosign"
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/notify"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/cnych/admission-webhook/pkg/registry"
+	"github.com/cnych/admission-webhook/pkg/scan"
 	"github.com/golang/glog"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 func main() {
 	var parameters WhSvrParameters
+	command := newCommand(&parameters)
+	command.SetArgs(normalizeArgs(os.Args[1:]))
+	if err := command.Execute(); err != nil {
+		os.Exit(2)
+	}
+}
 
+// bindFlags registers the server flags on flags.
+func bindFlags(flags *pflag.FlagSet, parameters *WhSvrParameters) {
 	// get command line parameters
-	flag.IntVar(&parameters.port, "port", 443, "Webhook server port.")
-	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
-	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
-	flag.Parse()
+	flags.IntVar(&parameters.port, "port", 443, "Webhook server port.")
+	flags.StringVar(&parameters.listenUnix, "listenUnix", "", "Serve the webhook on this unix socket instead of -port.")
+	flags.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
+	flags.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flags.StringVar(&parameters.otlpEndpoint, "otlpEndpoint", "", "OTLP/gRPC collector address (host:port) to export traces to, tracing is disabled when empty.")
+	flags.BoolVar(&parameters.otlpInsecure, "otlpInsecure", false, "Connect to the OTLP collector without TLS.")
+	flags.BoolVar(&parameters.certBootstrap, "certBootstrap", false, "Generate a self-signed serving certificate into -certSecretName (unless a valid one exists) and patch the caBundle of the webhook configurations, instead of reading -tlsCertFile/-tlsKeyFile.")
+	flags.StringVar(&parameters.kubeconfig, "kubeconfig", "", "Path to a kubeconfig file, the in-cluster service account is used when empty.")
+	flags.StringVar(&parameters.serviceName, "serviceName", "admission-webhook-example-svc", "Name of the Service in front of the webhook.")
+	flags.StringVar(&parameters.serviceNamespace, "serviceNamespace", envOrDefault("POD_NAMESPACE", "default"), "Namespace of the webhook Service and certificate Secret.")
+	flags.StringVar(&parameters.certSecretName, "certSecretName", "admission-webhook-example-certs", "Secret storing the bootstrapped serving certificate.")
+	flags.DurationVar(&parameters.certValidity, "certValidity", 365*24*time.Hour, "Validity of bootstrapped certificates.")
+	flags.StringVar(&parameters.mutatingWebhookConfigName, "mutatingWebhookConfigName", "mutating-webhook-example-cfg", "MutatingWebhookConfiguration whose caBundle is patched, skipped when empty.")
+	flags.StringVar(&parameters.validatingWebhookConfigName, "validatingWebhookConfigName", "validation-webhook-example-cfg", "ValidatingWebhookConfiguration whose caBundle is patched, skipped when empty.")
+	flags.BoolVar(&parameters.register, "register", false, "Create or update the webhook configurations at startup from the resources this binary handles.")
+	flags.StringVar(&parameters.failurePolicy, "failurePolicy", "Fail", "failurePolicy of the registered webhooks: Ignore or Fail.")
+	flags.IntVar(&parameters.webhookTimeoutSeconds, "webhookTimeoutSeconds", 10, "timeoutSeconds of the registered webhooks, between 1 and 30.")
+	flags.StringVar(&parameters.namespaceSelector, "namespaceSelector", "admission-webhook-example=enabled", "Label selector of the namespaces the registered webhooks apply to, all namespaces when empty.")
+	flags.IntVar(&parameters.ruleWorkers, "ruleWorkers", 4, "How many validation rules of a workload, and lookups of its images and digests, run at once per request, so the registry, signature and vulnerability lookups stay within the webhook timeout. The responses don't depend on it, 1 runs them one after the other.")
+	flags.StringVar(&parameters.selfSelector, "selfSelector", "app="+appName, "Label selector of the objects of the webhook itself in -serviceNamespace, such as its Deployment and pods, admitted unchanged and, when a single requirement, left out of the registered webhooks in every namespace, so the webhook never blocks or mutates its own upgrade. Its Service named -serviceName always is. None when empty.")
+	flags.BoolVar(&parameters.selfNamespace, "selfNamespace", false, "Admit every object of -serviceNamespace unchanged and leave the namespace out of the registered webhooks, for a namespace dedicated to the webhook.")
+	flags.BoolVar(&parameters.mutateNamespaces, "mutateNamespaces", false, "Also register the mutation of new namespaces, which get the namespaceDefaults of the policy config.")
+	flags.StringVar(&parameters.caBundleFile, "caBundleFile", "", "PEM file registered as caBundle, ignored with -certBootstrap. The registered caBundle is kept when empty.")
+	flags.BoolVar(&parameters.insecureHTTP, "insecureHTTP", false, "INSECURE: serve plain HTTP, for meshes (Istio, Linkerd) terminating mTLS in front of the webhook. The apiserver must never reach the webhook over plain HTTP.")
+	flags.DurationVar(&parameters.certExpiryWindow, "certExpiryWindow", 24*time.Hour, "Fail readiness once the serving certificate expires within this window, 0 disables the check.")
+	flags.StringVar(&parameters.clientCAFile, "tlsClientCAFile", "", "File containing the CA certificates used to verify client certificates. When set, only callers presenting a valid client certificate (the kube-apiserver) are served, except on /check, /audit, /debug/loglevel and /debug/snapshots which authenticate their callers with bearer tokens; serve the probes and metrics on -metricsPort.")
+	flags.StringVar(&parameters.tlsMinVersion, "tlsMinVersion", "1.2", "Minimum TLS version accepted by the webhook listener: 1.0, 1.1, 1.2 or 1.3.")
+	flags.StringVar(&parameters.tlsCipherSuites, "tlsCipherSuites", "", "Comma separated list of TLS 1.2 cipher suites (IANA names), in order of preference. Go defaults when empty.")
+	flags.StringVar(&parameters.tlsCurvePreferences, "tlsCurvePreferences", "", "Comma separated list of elliptic curves (X25519, P256, P384, P521), in order of preference. Go defaults when empty.")
+	flags.Int64Var(&parameters.maxRequestBytes, "maxRequestBytes", 6*1024*1024, "Max size in bytes of an AdmissionReview request body, larger requests are rejected with 413.")
+	flags.DurationVar(&parameters.readTimeout, "readTimeout", 30*time.Second, "Max duration for reading an entire request, including the body.")
+	flags.DurationVar(&parameters.readHeaderTimeout, "readHeaderTimeout", 10*time.Second, "Max duration for reading request headers.")
+	flags.DurationVar(&parameters.writeTimeout, "writeTimeout", 30*time.Second, "Max duration before timing out writes of the response.")
+	flags.DurationVar(&parameters.idleTimeout, "idleTimeout", 90*time.Second, "Max time to wait for the next request when keep-alives are enabled.")
+	flags.BoolVar(&parameters.disableHTTP2, "disableHTTP2", false, "Serve HTTP/1.1 only, so the apiserver opens a connection per concurrent request instead of multiplexing them over one HTTP/2 connection.")
+	flags.UintVar(&parameters.http2MaxStreams, "http2MaxConcurrentStreams", 0, "Max number of concurrent streams of an HTTP/2 connection, the apiserver opens more connections beyond it. 0 keeps the Go default of 250.")
+	flags.BoolVar(&parameters.disableKeepAlives, "disableKeepAlives", false, "Close the connection after every response instead of reusing it.")
+	flags.DurationVar(&parameters.tcpKeepAlivePeriod, "tcpKeepAlivePeriod", 0, "Period of the TCP keep-alive probes of the webhook connections. 0 keeps the Go default of 15s, negative disables them.")
+	flags.IntVar(&parameters.maxHeaderBytes, "maxHeaderBytes", http.DefaultMaxHeaderBytes, "Max size in bytes of request headers.")
+	flags.IntVar(&parameters.maxInflight, "maxInflight", 100, "Max number of admission requests processed concurrently, 0 disables the limit.")
+	flags.DurationVar(&parameters.inflightQueueTimeout, "inflightQueueTimeout", 2*time.Second, "How long a request waits for a free slot before being rejected with 429.")
+	flags.BoolVar(&parameters.chaos, "chaos", false, "Testing only, never in production: inject the latency and failures of the -chaos* flags into the admission requests, for rehearsing the failurePolicy of the webhooks and tuning their timeoutSeconds in staging.")
+	flags.DurationVar(&parameters.chaosLatency, "chaosLatency", 0, "Delay added to every admission request with -chaos.")
+	flags.DurationVar(&parameters.chaosLatencyJitter, "chaosLatencyJitter", 0, "Max random delay added to -chaosLatency with -chaos.")
+	flags.Float64Var(&parameters.chaosFailureRate, "chaosFailureRate", 0, "Fraction of the admission requests failed with -chaos, between 0 and 1.")
+	flags.StringVar(&parameters.chaosFailure, "chaosFailure", "error", "How the requests of -chaosFailureRate fail: error answers 500, timeout holds the request until the API server gives up.")
+	flags.IntVar(&parameters.metricsPort, "metricsPort", 8080, "Plaintext port serving /metrics, /healthz, /readyz and pprof, so probes and Prometheus don't need the serving certificate. 0 serves them on the webhook port.")
+	flags.BoolVar(&parameters.enablePprof, "enablePprof", false, "Serve net/http/pprof under /debug/pprof/ on -metricsPort.")
+	flags.BoolVar(&parameters.selfTest, "selfTest", true, "Mutate a sample Deployment through the handler chain at startup and stay unready if that fails.")
+	flags.StringVar(&parameters.adminTokenFile, "adminTokenFile", "", "File containing the bearer token for /debug/loglevel and /audit, the endpoints are disabled when empty and -adminTokenReview is false.")
+	flags.BoolVar(&parameters.adminTokenReview, "adminTokenReview", false, "Accept on /debug/loglevel the bearer tokens the API server authenticates through a TokenReview, such as service account tokens, requires create on tokenreviews.")
+	flags.StringVar(&parameters.adminSubjects, "adminSubjects", "", "Comma separated users, and groups as group:<name>, allowed on /debug/loglevel with a reviewed token, e.g. system:serviceaccount:ops:oncall,group:sre. Every authenticated user is allowed when empty.")
+	flags.StringVar(&parameters.adminAccessResource, "adminAccessResource", "", "Resource, as resource.group, the reviewed users of /debug/loglevel need get (to read) and update (to change the settings) on through a SubjectAccessReview, named after the setting (loglevel), e.g. settings.admission-webhook-example.qikqiak.com. The static token of -adminTokenFile may only read then. Requires -adminTokenReview and create on subjectaccessreviews.")
+	flags.StringVar(&parameters.adminAccessNamespace, "adminAccessNamespace", "", "Namespace of the -adminAccessResource, which is cluster-scoped when empty.")
+	flags.StringVar(&parameters.checkTokenFile, "checkTokenFile", "", "File containing the bearer token for /check, which admits raw manifests for CI pipelines, the endpoint is disabled when empty and -checkTokenReview is false.")
+	flags.BoolVar(&parameters.checkTokenReview, "checkTokenReview", false, "Accept on /check the bearer tokens the API server authenticates through a TokenReview, such as the service account tokens of CI jobs, requires create on tokenreviews.")
+	flags.StringVar(&parameters.checkSubjects, "checkSubjects", "", "Comma separated users, and groups as group:<name>, allowed on /check with a reviewed token, e.g. system:serviceaccount:ci:runner. Every authenticated user is allowed when empty.")
+	flags.StringVar(&parameters.tokenReviewAudiences, "tokenReviewAudiences", "", "Comma separated audiences the reviewed tokens must be issued for, such as admission-webhook for projected service account tokens. The audiences of the API server when empty.")
+	flags.DurationVar(&parameters.tokenReviewCacheTTL, "tokenReviewCacheTTL", time.Minute, "How long the outcome of a TokenReview is cached by a hash of the token, a revoked token is still accepted meanwhile.")
+	flags.IntVar(&parameters.snapshots, "snapshots", 0, "Number of admission requests and responses kept per kind for post-incident debugging, served on /debug/snapshots with the authentication of /debug/loglevel. The data of Secrets is dropped. 0 disables the snapshots.")
+	flags.StringVar(&parameters.snapshotDir, "snapshotDir", "", "Directory the snapshots are written to every 10s and on shutdown, one file of JSON lines per kind, and read back from on startup. Snapshots are only kept in memory when empty.")
+	flags.StringVar(&parameters.ignoredNamespaces, "ignoredNamespaces", "", "Comma separated namespaces skipped in addition to kube-system and kube-public, glob patterns such as istio-* are allowed.")
+	flags.StringVar(&parameters.policyConfigFile, "policyConfigFile", "", "YAML policy config file (ignoredNamespaces, operations, exemptSelector, subjects, skipMutationOwners, skipMutationManagers, immutableFields, requiredAnnotations, services, requestReduction, qosClass, replicaBounds, autoscaling, podDisruptionBudgets, networkPolicies, deprecations, probes, references, strategy, memoryPerCPU, containerResources, podResources, priorityClasses, runtimeClasses, namespaceMetadata, propagatedLabels, guaranteedQoSSelector, antiAffinity, templateLabels, configChecksum, termination, serviceAccountToken, freezeWindows, registryMirrors, imagePullSecrets, sidecars, injectionTemplates, gpus, signatures, vulnerabilities, callout, ephemeralContainers, restrictedServiceTypes, serviceTypeNamespaces, ingress, persistentVolumeClaims, configData, namespaceDefaults, metadataResources, mutationProvenance, namespaceOverrides, activations, clusters), reloaded whenever it changes.")
+	flags.StringVar(&parameters.clusterName, "clusterName", envOrDefault("CLUSTER_NAME", ""), "Name of the cluster, such as dev, stage or prod, selecting the clusters sections of the -policyConfigFile which apply.")
+	flags.StringVar(&parameters.annotationDomain, "annotationDomain", policy.LegacyAnnotationDomain, "Domain of the keys of the annotations, labels and finalizer of the webhook, such as webhook.example.com for webhook.example.com/mutate.")
+	flags.BoolVar(&parameters.readLegacyAnnotations, "readLegacyAnnotations", true, "With another -annotationDomain, read the keys under "+policy.LegacyAnnotationDomain+" where the objects don't have those under the domain, while migrating. The webhook always writes the keys under -annotationDomain.")
+	flags.StringVar(&parameters.exemptSelector, "exemptSelector", "", "Label selector of the objects admitted without running any rule, e.g. policy.webhook/exempt=true for emergency bypasses. Overridden by the policy config file.")
+	flags.StringVar(&parameters.skipMutationOwners, "skipMutationOwners", "", "Comma separated owner kinds (Kind or group/Kind, e.g. argoproj.io/Rollout) whose objects aren't mutated, their controllers would revert the patch.")
+	flags.StringVar(&parameters.skipMutationManagers, "skipMutationManagers", "", "Comma separated field managers (e.g. rollouts-controller) whose objects aren't mutated.")
+	flags.StringVar(&parameters.immutableFields, "immutableFields", "", "Comma separated field paths updates of Deployments and Services can't change, e.g. metadata.labels[app.kubernetes.io/name].")
+	flags.StringVar(&parameters.restrictedServiceTypes, "restrictedServiceTypes", "", "Comma separated Service types only allowed in -serviceTypeNamespaces, e.g. NodePort,LoadBalancer.")
+	flags.StringVar(&parameters.serviceTypeNamespaces, "serviceTypeNamespaces", "", "Comma separated namespaces, glob patterns allowed, where the -restrictedServiceTypes can be created.")
+	flags.BoolVar(&parameters.watchPDBs, "watchPodDisruptionBudgets", false, "Watch the PodDisruptionBudgets of the cluster, which the podDisruptionBudgets policy needs, requires list and watch on poddisruptionbudgets.")
+	flags.BoolVar(&parameters.watchNetworkPolicies, "watchNetworkPolicies", false, "Watch the NetworkPolicies of the cluster, which the networkPolicies policy needs, requires list and watch on networkpolicies.")
+	flags.BoolVar(&parameters.managedFinalizer, "managedFinalizer", false, "Add a finalizer to the Deployments whose sidecars or injection templates the webhook manages, and remove it once their deletion is logged and counted, requires list, watch and patch on deployments. Their deletion waits for the webhook while the finalizer is set.")
+	flags.BoolVar(&parameters.configChecksums, "configChecksums", false, "Read the ConfigMaps and Secrets the pods of Deployments reference from the API server, whose data the configChecksum policy digests, requires get on configmaps and secrets.")
+	flags.BoolVar(&parameters.watchDeployments, "watchDeployments", false, "Watch the Deployments of the cluster, whose labels the replicaBounds with a selector need when Deployments are scaled through their scale subresource and the services.requireSelectedPods policy checks the selectors of Services against, requires list and watch on deployments.")
+	flags.BoolVar(&parameters.watchServices, "watchServices", false, "Watch the Services of the cluster, which the preStop hook of the termination policy and the services.uniquePorts policy need, requires list and watch on services.")
+	flags.BoolVar(&parameters.watchReferences, "watchReferences", false, "Watch the metadata of the ConfigMaps, Secrets and PersistentVolumeClaims of the cluster, which the references policy checks the pods of Deployments and Pods against, requires get, list and watch on configmaps, secrets and persistentvolumeclaims.")
+	flags.BoolVar(&parameters.watchPolicyOverrides, "watchPolicyOverrides", false, "Watch the WebhookPolicyOverrides of the cluster (deployment/policyoverride-crd.yaml), which change the sections of the policy namespaceOverrides allows for their namespace, requires list and watch on webhookpolicyoverrides.")
+	flags.BoolVar(&parameters.watchNodes, "watchNodes", false, "Watch the nodes of the cluster, the podResources.fitNodes policy checks the requests of pods against their allocatable, requires list and watch on nodes.")
+	flags.BoolVar(&parameters.watchHPAs, "watchHorizontalPodAutoscalers", false, "Watch the HorizontalPodAutoscalers of the cluster, the Deployments they target skip the replicaBounds and, with the autoscaling.keepReplicas policy, keep their replicas on updates, requires list and watch on horizontalpodautoscalers.")
+	flags.BoolVar(&parameters.watchNamespaces, "watchNamespaces", false, "Watch the namespaces of the cluster, which the rules depending on namespace labels (priorityClasses, runtimeClasses, namespaceMetadata, propagatedLabels, guaranteedQoSSelector) need, requires list and watch on namespaces.")
+	flags.BoolVar(&parameters.namespaceFailOpen, "namespaceCacheFailOpen", true, "Admit the objects of namespaces the -watchNamespaces cache doesn't have yet, e.g. created just before them, without the rules depending on namespace labels. When false they are answered with 503 for the client to retry.")
+	flags.BoolVar(&parameters.pinImageDigests, "pinImageDigests", false, "Pin the images of Deployments and Pods to the digest their tag points to, resolved anonymously from the registry or its mirror.")
+	flags.DurationVar(&parameters.registryTimeout, "registryTimeout", 2*time.Second, "Timeout of the requests to registries, resolving digests and reading signatures, and to Harbor.")
+	flags.DurationVar(&parameters.digestCacheTTL, "digestCacheTTL", 5*time.Minute, "How long resolved digests are cached, the tag may be moved meanwhile.")
+	flags.DurationVar(&parameters.signatureCacheTTL, "signatureCacheTTL", 10*time.Minute, "How long the image digests whose cosign signature was verified are cached.")
+	flags.StringVar(&parameters.harborURL, "harborURL", "", "URL of the Harbor whose vulnerability scans the vulnerabilities policy checks images against, e.g. https://harbor.example.com.")
+	flags.StringVar(&parameters.harborCredentialsFile, "harborCredentialsFile", "", "File holding username:password of the Harbor robot account reading scans, anonymous when empty.")
+	flags.DurationVar(&parameters.scanCacheTTL, "scanCacheTTL", 10*time.Minute, "How long the vulnerability scan results of images are cached.")
+	flags.StringVar(&parameters.calloutURL, "calloutURL", "", "URL of the external policy service the admission requests of the kinds of the callout policy are posted to, its allow/deny/patch answer is merged into the response.")
+	flags.DurationVar(&parameters.calloutTimeout, "calloutTimeout", 2*time.Second, "Timeout of each request to the policy service.")
+	flags.IntVar(&parameters.calloutRetries, "calloutRetries", 2, "How often failed requests to the policy service are retried.")
+	flags.StringVar(&parameters.notifyURL, "notifyURL", "", "Slack incoming webhook or generic HTTP endpoint every denied admission request is reported to (namespace, kind, name, user, reason).")
+	flags.StringVar(&parameters.notifyFormat, "notifyFormat", notify.FormatSlack, "Payload of the notifications: slack posts {\"text\": message}, webhook posts the denial as JSON with the message.")
+	flags.StringVar(&parameters.notifyTemplateFile, "notifyTemplateFile", "", "text/template file of the notification message, with .Namespace, .Kind, .Name, .Operation, .User and .Reason.")
+	flags.IntVar(&parameters.notifyPerMinute, "notifyPerMinute", 30, "Max number of notifications sent per minute, further denials aren't reported.")
+	flags.IntVar(&parameters.notifyBurst, "notifyBurst", 10, "Max number of notifications sent at once.")
+	flags.IntVar(&parameters.decisionCacheSize, "decisionCacheSize", 0, "Max number of admission responses cached by a hash of the object, operation, user and policy version, answering identical resubmissions of controllers without running the rules again. 0 disables the cache.")
+	flags.DurationVar(&parameters.decisionCacheTTL, "decisionCacheTTL", time.Minute, "How long cached admission responses are used, they also depend on the cluster state: the responses of a namespace are flushed as the watched objects in it change, but image digests and scans and the objects not watched may change meanwhile.")
+	flags.BoolVar(&parameters.gzipResponses, "gzipResponses", true, "Compress the AdmissionReview responses of at least 1KiB with gzip when the caller accepts it.")
+	flags.IntVar(&parameters.patchWarningBytes, "patchWarningBytes", 256*1024, "Log a warning and count webhook_large_patches_total when a generated patch reaches this many bytes, 0 disables the warning.")
+	flags.DurationVar(&parameters.deadlineMargin, "deadlineMargin", 500*time.Millisecond, "Time kept from the timeout the apiserver sends with every request to answer it, at most half of it. The rules still running then are answered with -deadlineResponse.")
+	flags.StringVar(&parameters.deadlineResponse, "deadlineResponse", deadlineAllow, "Answer when the rules (registry lookups, callouts...) don't finish within the timeout of the apiserver: allow admits without mutations and with a warning, deny rejects with a timeout.")
+	flags.StringVar(&parameters.onInternalError, "onInternalError", internalErrorDeny, "Answer when the webhook fails to process a request, e.g. its object doesn't decode or its patch can't be generated: deny rejects it like the failurePolicy Fail would, allow admits it unchanged with a warning so a bug of the webhook doesn't block workloads.")
+	flags.DurationVar(&parameters.shutdownGracePeriod, "shutdownGracePeriod", 5*time.Second, "How long the requests still running on SIGTERM may take, their registry lookups and callouts are cancelled after it and they are answered with -deadlineResponse.")
+	flags.Float64Var(&parameters.namespaceQPS, "namespaceQPS", 0, "CREATE and UPDATE requests of a namespace admitted per second by each of /mutate and /validate, further ones are denied at once with 429 so one namespace can't starve the others. 0 disables the limit.")
+	flags.IntVar(&parameters.namespaceBurst, "namespaceBurst", 20, "CREATE and UPDATE requests of a namespace admitted at once above -namespaceQPS.")
+	flags.StringVar(&parameters.logLanguage, "logLanguage", "en", "Language of the admission request logs: en or zh. AdmissionResponse messages are always English.")
+	flags.StringVar(&parameters.logTimezone, "logTimezone", "UTC", "Time zone of the RFC3339 timestamps the admission request logs start with, an IANA name such as Asia/Shanghai, UTC or Local.")
+}
+
+// runServer serves admission requests until SIGINT/SIGTERM.
+func runServer(parameters *WhSvrParameters) {
+	if err := messages.SetLanguage(parameters.logLanguage); err != nil {
+		glog.Exitf("Invalid -logLanguage: %v", err)
+	}
+	if err := setLogTimezone(parameters.logTimezone); err != nil {
+		glog.Exitf("Invalid -logTimezone: %v", err)
+	}
+
+	shutdownTracer := func(context.Context) error { return nil }
+	if parameters.otlpEndpoint != "" {
+		shutdown, err := initTracer(context.Background(), parameters.otlpEndpoint, parameters.otlpInsecure)
+		if err != nil {
+			glog.Errorf("Failed to init tracing: %v", err)
+		} else {
+			shutdownTracer = shutdown
+			glog.Infof("Exporting traces to %s", parameters.otlpEndpoint)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	setAnnotationDomain(parameters)
+	policy.SetLegacyKeyObserver(func(key string) { legacyKeysRead.WithLabelValues(key).Inc() })
+	policyConfig := newPolicyReloader(parameters)
+	if err := policyConfig.reload(); err != nil {
+		glog.Exitf("Failed to load policy config: %v", err)
+	}
+	go func() {
+		if err := policyConfig.watch(ctx); err != nil {
+			glog.Errorf("Failed to watch policy config: %v", err)
+		}
+	}()
 
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+	selfSelector, err := labels.Parse(parameters.selfSelector)
 	if err != nil {
-		glog.Errorf("Failed to load key pair: %v", err)
+		glog.Exitf("Invalid selfSelector: %v", err)
+	}
+	admission.SetSelf(parameters.serviceNamespace, parameters.serviceName, selfSelector, parameters.selfNamespace)
+	admission.SetNamespaceFailOpen(parameters.namespaceFailOpen)
+	admission.SetRuleWorkers(parameters.ruleWorkers)
+	admission.SetRuleObserver(observeRuleDuration)
+	admission.SetAllowInternalErrors(parameters.onInternalError == internalErrorAllow, observeInternalError)
+	admission.SetQoSChangeObserver(observeQoSChange)
+	decisions := newDecisionCache(parameters.decisionCacheSize, parameters.decisionCacheTTL)
+	if err := startClusterCache(ctx, parameters, decisions); err != nil {
+		glog.Exitf("Failed to start cluster cache: %v", err)
+	}
+	images := registry.NewResolver(parameters.registryTimeout, parameters.digestCacheTTL)
+	if parameters.pinImageDigests {
+		admission.SetDigestResolver(images.Digest)
+	}
+	admission.SetSignatureVerifier(cosign.NewVerifier(images, parameters.signatureCacheTTL).Verify)
+	if parameters.harborURL != "" {
+		harbor, err := newHarbor(parameters)
+		if err != nil {
+			glog.Exitf("Failed to configure Harbor: %v", err)
+		}
+		admission.SetVulnerabilityScanner(harbor.Critical)
+	}
+	if parameters.calloutURL != "" {
+		client, err := callout.NewClient(parameters.calloutURL, parameters.calloutTimeout, parameters.calloutRetries)
+		if err != nil {
+			glog.Exitf("Failed to configure the policy service: %v", err)
+		}
+		admission.SetDecisionCaller(client.Decide)
+	}
+
+	certs, err := prepareCluster(parameters)
+	if err != nil {
+		glog.Exitf("Failed to prepare cluster: %v", err)
+	}
+
+	ready := &readyzHandler{}
+	var tlsConfig *tls.Config
+	if parameters.insecureHTTP {
+		warnInsecureHTTP(parameters)
+	} else {
+		tlsConfig = servingTLSConfig(ctx, parameters, certs, ready)
 	}
 
+	// cancelled once the shutdown grace period is over, the requests still
+	// running give up their lookups then
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 	whsvr := &WebhookServer{
 		server: &http.Server{
-			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			BaseContext:       func(net.Listener) context.Context { return requests },
+			Addr:              fmt.Sprintf(":%v", parameters.port),
+			TLSConfig:         tlsConfig,
+			ReadTimeout:       parameters.readTimeout,
+			ReadHeaderTimeout: parameters.readHeaderTimeout,
+			WriteTimeout:      parameters.writeTimeout,
+			IdleTimeout:       parameters.idleTimeout,
+			MaxHeaderBytes:    parameters.maxHeaderBytes,
 		},
+		maxRequestBytes: parameters.maxRequestBytes,
+		decisions:       decisions,
+		deadlineMargin:  parameters.deadlineMargin,
+		onDeadline:      parameters.deadlineResponse,
+		namespaceLimits: newNamespaceLimiter(parameters.namespaceQPS, parameters.namespaceBurst),
+		patchWarnBytes:  parameters.patchWarningBytes,
+	}
+	gzipResponses = parameters.gzipResponses
+	if whsvr.snapshots, err = newSnapshotStore(parameters.snapshots, parameters.snapshotDir); err != nil {
+		glog.Exitf("Failed to read the snapshots: %v", err)
+	}
+	if whsvr.snapshots != nil && parameters.snapshotDir != "" {
+		go whsvr.snapshots.run(ctx)
+	}
+	if err := configureConnections(whsvr.server, parameters); err != nil {
+		glog.Exitf("Failed to configure the webhook connections: %v", err)
+	}
+	if parameters.notifyURL != "" {
+		notifier, err := newNotifier(parameters)
+		if err != nil {
+			glog.Exitf("Failed to configure notifications: %v", err)
+		}
+		go notifier.Run(ctx, func(d notify.Denial, err error) {
+			notificationsFailed.Inc()
+			glog.Warningf("Failed to notify the denial of %s %s/%s: %v", d.Kind, d.Namespace, d.Name, err)
+		})
+		whsvr.notifier = notifier
 	}
 
 	// define http server and server handler
+	limiter := newInflightLimiter(parameters.maxInflight, parameters.inflightQueueTimeout)
+	chaos, err := newChaosInjector(parameters)
+	if err != nil {
+		glog.Exitf("Invalid chaos mode: %v", err)
+	} else if chaos != nil {
+		glog.Warningf("Chaos mode enabled, admission requests get %s", chaos)
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", whsvr.serve)
-	mux.HandleFunc("/validate", whsvr.serve)
-	whsvr.server.Handler = mux
+	mux.Handle("/mutate", limiter.wrap(chaos.wrap("mutate", whsvr.handler("mutate", whsvr.mutate))))
+	mux.Handle("/validate", limiter.wrap(chaos.wrap("validate", whsvr.handler("validate", whsvr.validate))))
+
+	// probes and metrics go to a plaintext listener unless -metricsPort is 0
+	var opsServer *http.Server
+	if parameters.metricsPort == 0 {
+		registerOpsHandlers(mux, ready, parameters.enablePprof)
+	} else {
+		opsMux := http.NewServeMux()
+		registerOpsHandlers(opsMux, ready, parameters.enablePprof)
+		opsServer = &http.Server{
+			Addr:              fmt.Sprintf(":%v", parameters.metricsPort),
+			Handler:           opsMux,
+			ReadHeaderTimeout: parameters.readHeaderTimeout,
+		}
+	}
+	if parameters.adminAccessResource != "" && !parameters.adminTokenReview {
+		glog.Exitf("-adminAccessResource requires -adminTokenReview, the static admin token carries no user to review")
+	}
+	var reviewer *tokenReviewer
+	var access *accessReviewer
+	if parameters.adminTokenReview || parameters.checkTokenReview {
+		client, err := newKubeClient(parameters.kubeconfig)
+		if err != nil {
+			glog.Exitf("Failed to create the client reviewing tokens: %v", err)
+		}
+		reviewer = newTokenReviewer(client, parameters.tokenReviewAudiences, parameters.tokenReviewCacheTTL)
+		if parameters.adminAccessResource != "" {
+			access = newAccessReviewer(client, parameters.adminAccessResource, parameters.adminAccessNamespace)
+		}
+	}
+	reviewerOf := func(enabled bool) *tokenReviewer {
+		if enabled {
+			return reviewer
+		}
+		return nil
+	}
+	// an unreadable or empty token file would leave the endpoints open to
+	// no one, or to the reviewed tokens only, without anyone noticing
+	auth, err := newEndpointAuth("/debug/loglevel", parameters.adminTokenFile, reviewerOf(parameters.adminTokenReview), parameters.adminSubjects, access)
+	if err != nil {
+		glog.Exitf("Failed to configure the admin authentication: %v", err)
+	}
+	if auth != nil {
+		mux.Handle("/debug/loglevel", auth.wrap(&logLevelHandler{}))
+	}
+	if whsvr.snapshots != nil {
+		// the snapshots hold the objects of every namespace, they are only
+		// served with the admin authentication
+		auth, err := newEndpointAuth("/debug/snapshots", parameters.adminTokenFile, reviewerOf(parameters.adminTokenReview), parameters.adminSubjects, access)
+		if err != nil {
+			glog.Exitf("Failed to configure the snapshots authentication: %v", err)
+		}
+		if auth != nil {
+			mux.Handle("/debug/snapshots", auth.wrap(&snapshotHandler{store: whsvr.snapshots}))
+		} else {
+			glog.Warningf("-snapshots is set without -adminTokenFile nor -adminTokenReview, /debug/snapshots is disabled")
+		}
+	}
+	auth, err = newEndpointAuth("/audit", parameters.adminTokenFile, reviewerOf(parameters.adminTokenReview), parameters.adminSubjects, access)
+	if err != nil {
+		glog.Exitf("Failed to configure the audit authentication: %v", err)
+	}
+	if auth != nil {
+		// the audit lists the objects of every namespace, it is only served
+		// with the admin authentication
+		client, err := newKubeClient(parameters.kubeconfig)
+		if err != nil {
+			glog.Exitf("Failed to create the client of /audit: %v", err)
+		}
+		mux.Handle("/audit", auth.wrap(limiter.wrap(&auditHandler{client: client})))
+	}
+	auth, err = newEndpointAuth("/check", parameters.checkTokenFile, reviewerOf(parameters.checkTokenReview), parameters.checkSubjects, nil)
+	if err != nil {
+		glog.Exitf("Failed to configure the check authentication: %v", err)
+	}
+	if auth != nil {
+		mux.Handle("/check", auth.wrap(limiter.wrap(&checkHandler{maxRequestBytes: parameters.maxRequestBytes})))
+	}
+	whsvr.server.Handler = requireClientCert(parameters, mux)
+
+	// mutate a sample Deployment through the handler chain before taking traffic
+	if parameters.selfTest {
+		selfTestErr := selfTest(mux)
+		if selfTestErr != nil {
+			glog.Errorf("Self-test failed, staying unready: %v", selfTestErr)
+		} else {
+			glog.Info("Self-test passed")
+		}
+		ready.add("self-test", func() error { return selfTestErr })
+	}
+
+	listener, err := webhookListener(parameters)
+	if err != nil {
+		glog.Exitf("Failed to listen: %v", err)
+	}
 
 	// start webhook server in new routine
 	go func() {
-		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
+		serve := func() error { return whsvr.server.ServeTLS(listener, "", "") }
+		if tlsConfig == nil {
+			serve = func() error { return whsvr.server.Serve(listener) }
+		}
+		if err := serve(); err != nil {
 			glog.Errorf("Failed to listen and serve webhook server: %v", err)
 		}
 	}()
 
+	if opsServer != nil {
+		go func() {
+			if err := opsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("Failed to listen and serve metrics server: %v", err)
+			}
+		}()
+	}
+
 	glog.Info("Server started")
 
 	// listening OS shutdown singal
@@ -55,5 +411,145 @@ func main() {
 	<-signalChan
 
 	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
-	whsvr.server.Shutdown(context.Background())
+	grace, cancelGrace := context.WithTimeout(context.Background(), parameters.shutdownGracePeriod)
+	defer cancelGrace()
+	if err := whsvr.server.Shutdown(grace); err != nil {
+		glog.Warningf("Requests still running after %v, cancelling them", parameters.shutdownGracePeriod)
+		cancelRequests()
+		whsvr.server.Shutdown(context.Background())
+	}
+	if opsServer != nil {
+		opsServer.Shutdown(context.Background())
+	}
+	if whsvr.snapshots != nil && parameters.snapshotDir != "" {
+		if err := whsvr.snapshots.flush(); err != nil {
+			glog.Errorf("Failed to write the snapshots: %v", err)
+		}
+	}
+	if err := shutdownTracer(context.Background()); err != nil {
+		glog.Errorf("Failed to flush traces: %v", err)
+	}
+}
+
+// servingTLSConfig configures TLS with the bootstrapped certificate when
+// there is one, the reloaded -tlsCertFile/-tlsKeyFile pair otherwise.
+func servingTLSConfig(ctx context.Context, parameters *WhSvrParameters, certs *webhookCerts, ready *readyzHandler) *tls.Config {
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if certs != nil {
+		pair, err := certs.keyPair()
+		if err != nil {
+			glog.Exitf("Invalid bootstrapped key pair: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			glog.Exitf("Invalid bootstrapped certificate: %v", err)
+		}
+		pair.Leaf = leaf
+		recordServedCert(leaf)
+		getCertificate = staticCertificate(pair)
+	} else {
+		// keep serving rotated certificates without a restart
+		reloader := newCertReloader(parameters.certFile, parameters.keyFile)
+		if err := reloader.reload(); err != nil {
+			glog.Errorf("Failed to load key pair: %v", err)
+		}
+		go func() {
+			if err := reloader.watch(ctx); err != nil {
+				glog.Errorf("Failed to watch serving certificate: %v", err)
+			}
+		}()
+		getCertificate = reloader.GetCertificate
+		ready.add("certificate", reloader.loaded)
+	}
+	tlsConfig, err := newTLSConfig(getCertificate, parameters)
+	if err != nil {
+		glog.Exitf("Invalid TLS configuration: %v", err)
+	}
+	if parameters.certExpiryWindow > 0 {
+		ready.add("certificate-expiry", certExpiryCheck(parameters.certExpiryWindow))
+	}
+	return tlsConfig
+}
+
+// prepareCluster provisions what the webhook needs in the cluster before it
+// starts serving: the bootstrapped serving certificate, returned when
+// -certBootstrap is set, and the webhook configurations or their caBundle.
+func prepareCluster(parameters *WhSvrParameters) (*webhookCerts, error) {
+	if !parameters.certBootstrap && !parameters.register {
+		return nil, nil
+	}
+	client, err := newKubeClient(parameters.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var caBundle []byte
+	if parameters.caBundleFile != "" {
+		if caBundle, err = ioutil.ReadFile(parameters.caBundleFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var certs *webhookCerts
+	bootstrapper := &certBootstrapper{
+		client:                      client,
+		namespace:                   parameters.serviceNamespace,
+		service:                     parameters.serviceName,
+		secretName:                  parameters.certSecretName,
+		mutatingWebhookConfigName:   parameters.mutatingWebhookConfigName,
+		validatingWebhookConfigName: parameters.validatingWebhookConfigName,
+		validity:                    parameters.certValidity,
+		renewBefore:                 parameters.certValidity / 10,
+	}
+	if parameters.certBootstrap {
+		if certs, err = bootstrapper.ensureCerts(ctx); err != nil {
+			return nil, err
+		}
+		caBundle = certs.caCert
+	}
+
+	if parameters.register {
+		settings, err := newWebhookSettings(parameters, caBundle)
+		if err != nil {
+			return nil, err
+		}
+		return certs, registerWebhooks(ctx, client, parameters, settings)
+	}
+	return certs, bootstrapper.patchCABundle(ctx, caBundle)
+}
+
+// newHarbor returns the scanner of -harborURL.
+func newHarbor(parameters *WhSvrParameters) (*scan.Harbor, error) {
+	var credentials string
+	if parameters.harborCredentialsFile != "" {
+		data, err := ioutil.ReadFile(parameters.harborCredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials = strings.TrimSpace(string(data))
+	}
+	return scan.NewHarbor(parameters.harborURL, credentials, parameters.registryTimeout, parameters.scanCacheTTL)
+}
+
+// newNotifier returns the notifier of the denials configured by the notify
+// flags.
+func newNotifier(parameters *WhSvrParameters) (*notify.Notifier, error) {
+	var text string
+	if parameters.notifyTemplateFile != "" {
+		data, err := ioutil.ReadFile(parameters.notifyTemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return notify.NewNotifier(parameters.notifyURL, parameters.notifyFormat, text, parameters.notifyPerMinute, parameters.notifyBurst, 5*time.Second)
+}
+
+func envOrDefault(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
 }
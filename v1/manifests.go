@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+const appName = "admission-webhook-example"
+
+// manifestOptions are the gen-manifests flags which are not server flags.
+type manifestOptions struct {
+	image  string
+	output string
+	// the server flags, those given are passed on to the server
+	serverFlags *pflag.FlagSet
+}
+
+// genManifests implements the gen-manifests command: it renders everything
+// needed to install the webhook from the same flags the server is started
+// with, so the installation can't drift from the server configuration.
+//
+//	admission-webhook gen-manifests --register --certBootstrap --output deploy/
+func genManifests(parameters *WhSvrParameters, options *manifestOptions) {
+	objects, err := renderManifests(parameters, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to render manifests: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeManifests(objects, options.output); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write manifests: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newGenManifestsCommand returns the gen-manifests command, serverFlags are
+// the server flags passed on to the rendered Deployment.
+func newGenManifestsCommand(parameters *WhSvrParameters, serverFlags *pflag.FlagSet) *cobra.Command {
+	options := &manifestOptions{serverFlags: serverFlags}
+	command := &cobra.Command{
+		Use:   "gen-manifests",
+		Short: "Render the manifests installing the webhook with the server flags",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			genManifests(parameters, options)
+		},
+	}
+	command.Flags().StringVar(&options.image, "image", "840859604/admission-webhook-example:v1", "Image of the webhook container.")
+	command.Flags().StringVar(&options.output, "output", "", "Directory to write the manifests and a kustomization.yaml to, stdout when empty.")
+	return command
+}
+
+// namedObject is a rendered manifest and the file it is written to.
+type namedObject struct {
+	file   string
+	object runtime.Object
+}
+
+func renderManifests(parameters *WhSvrParameters, options *manifestOptions) ([]namedObject, error) {
+	var caBundle []byte
+	if parameters.caBundleFile != "" {
+		data, err := ioutil.ReadFile(parameters.caBundleFile)
+		if err != nil {
+			return nil, err
+		}
+		caBundle = data
+	}
+	settings, err := newWebhookSettings(parameters, caBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []namedObject{
+		{"serviceaccount.yaml", serviceAccountManifest(parameters)},
+		{"clusterrole.yaml", clusterRoleManifest(parameters)},
+		{"clusterrolebinding.yaml", clusterRoleBindingManifest(parameters)},
+		{"service.yaml", serviceManifest(parameters)},
+		{"deployment.yaml", deploymentManifest(parameters, options)},
+	}
+	// with -register the server keeps the configurations up to date itself
+	if !parameters.register {
+		if parameters.mutatingWebhookConfigName != "" {
+			objects = append(objects, namedObject{"mutatingwebhook.yaml", settings.mutatingWebhookConfiguration(parameters)})
+		}
+		if parameters.validatingWebhookConfigName != "" {
+			objects = append(objects, namedObject{"validatingwebhook.yaml", settings.validatingWebhookConfiguration(parameters)})
+		}
+	}
+	return objects, nil
+}
+
+func writeManifests(objects []namedObject, output string) error {
+	if output == "" {
+		for _, o := range objects {
+			data, err := yaml.Marshal(o.object)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("---\n%s", data)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return err
+	}
+	kustomization := "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n"
+	for _, o := range objects {
+		data, err := yaml.Marshal(o.object)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(output, o.file), data, 0644); err != nil {
+			return err
+		}
+		kustomization += fmt.Sprintf("- %s\n", o.file)
+	}
+	return ioutil.WriteFile(filepath.Join(output, "kustomization.yaml"), []byte(kustomization), 0644)
+}
+
+func manifestLabels() map[string]string {
+	return map[string]string{"app": appName}
+}
+
+func serviceAccountManifest(parameters *WhSvrParameters) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      appName + "-sa",
+			Namespace: parameters.serviceNamespace,
+			Labels:    manifestLabels(),
+		},
+	}
+}
+
+// clusterRoleManifest grants only what the enabled startup modes use.
+func clusterRoleManifest(parameters *WhSvrParameters) *rbacv1.ClusterRole {
+	role := &rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   appName + "-cr",
+			Labels: manifestLabels(),
+		},
+	}
+	if parameters.certBootstrap {
+		role.Rules = append(role.Rules, rbacv1.PolicyRule{
+			APIGroups: []string{""},
+			Resources: []string{"secrets"},
+			Verbs:     []string{"get", "create", "update"},
+		})
+	}
+	if parameters.certBootstrap || parameters.register {
+		role.Rules = append(role.Rules, rbacv1.PolicyRule{
+			APIGroups: []string{"admissionregistration.k8s.io"},
+			Resources: []string{"mutatingwebhookconfigurations", "validatingwebhookconfigurations"},
+			Verbs:     []string{"get", "create", "update"},
+		})
+	}
+	return role
+}
+
+func clusterRoleBindingManifest(parameters *WhSvrParameters) *rbacv1.ClusterRoleBinding {
+	return &rbacv1.ClusterRoleBinding{
+		TypeMeta: metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   appName + "-crb",
+			Labels: manifestLabels(),
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      appName + "-sa",
+			Namespace: parameters.serviceNamespace,
+		}},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     appName + "-cr",
+		},
+	}
+}
+
+func serviceManifest(parameters *WhSvrParameters) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      parameters.serviceName,
+			Namespace: parameters.serviceNamespace,
+			Labels:    manifestLabels(),
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: manifestLabels(),
+			Ports: []corev1.ServicePort{{
+				Port:       443,
+				TargetPort: intstr.FromInt(parameters.port),
+			}},
+		},
+	}
+}
+
+func deploymentManifest(parameters *WhSvrParameters, options *manifestOptions) *appsv1.Deployment {
+	replicas := int32(1)
+	container := corev1.Container{
+		Name:  appName,
+		Image: options.image,
+		Args:  append(serverArgs(options.serverFlags), "--alsologtostderr"),
+		Ports: []corev1.ContainerPort{{ContainerPort: int32(parameters.port)}},
+		Env: []corev1.EnvVar{{
+			Name: "POD_NAMESPACE",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+			},
+		}},
+	}
+	// probe the plaintext listener, the kubelet has no client certificate
+	if parameters.metricsPort != 0 {
+		container.Ports = append(container.Ports, corev1.ContainerPort{Name: "metrics", ContainerPort: int32(parameters.metricsPort)})
+		container.LivenessProbe = httpProbe("/healthz", parameters.metricsPort)
+		container.ReadinessProbe = httpProbe("/readyz", parameters.metricsPort)
+	}
+	spec := corev1.PodSpec{
+		ServiceAccountName: appName + "-sa",
+		Containers:         []corev1.Container{container},
+	}
+	// bootstrapped certificates are kept in memory, otherwise mount them
+	if !parameters.certBootstrap {
+		spec.Volumes = []corev1.Volume{{
+			Name: "webhook-certs",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: parameters.certSecretName},
+			},
+		}}
+		spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{
+			Name:      "webhook-certs",
+			MountPath: filepath.Dir(parameters.certFile),
+			ReadOnly:  true,
+		}}
+	}
+
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      appName + "-deployment",
+			Namespace: parameters.serviceNamespace,
+			Labels:    manifestLabels(),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: manifestLabels()},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: manifestLabels()},
+				Spec:       spec,
+			},
+		},
+	}
+}
+
+func httpProbe(path string, port int) *corev1.Probe {
+	probe := &corev1.Probe{}
+	probe.HTTPGet = &corev1.HTTPGetAction{Path: path, Port: intstr.FromInt(port)}
+	return probe
+}
+
+// serverArgs passes every server flag given to gen-manifests, on the command
+// line or by its environment variable, on to the server, except the
+// kubeconfig, which only makes sense outside the cluster.
+func serverArgs(flags *pflag.FlagSet) []string {
+	var args []string
+	// Visit misses the flags parsed through the command, which merges them
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed && f.Name != "kubeconfig" {
+			args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+		}
+	})
+	sort.Strings(args)
+	return args
+}
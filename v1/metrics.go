@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// durationBuckets span the latencies of admission requests up to the
+// longest timeout of the apiserver, 30s.
+var durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+var (
+	inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_inflight_requests",
+		Help: "Number of admission requests currently being processed.",
+	})
+	inflightLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_inflight_limit",
+		Help: "Configured max number of concurrently processed admission requests, 0 means unlimited.",
+	})
+	inflightRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_inflight_rejected_total",
+		Help: "Number of admission requests rejected with 429 because no slot freed up in time.",
+	})
+	inflightQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webhook_inflight_queue_wait_seconds",
+		Help:    "Time admission requests waited for a free processing slot.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+	certReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_cert_reloads_total",
+		Help: "Number of times the serving certificate was (re)loaded from disk.",
+	})
+	certNotAfter = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_cert_not_after_timestamp_seconds",
+		Help: "Expiry of the currently served certificate as a unix timestamp.",
+	})
+	decisionCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_decision_cache_hits_total",
+		Help: "Number of admission requests answered from the decision cache, by stage.",
+	}, []string{"stage"})
+	decisionCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_decision_cache_misses_total",
+		Help: "Number of cacheable admission requests the decision cache had no response to, by stage.",
+	}, []string{"stage"})
+	decisionCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_decision_cache_entries",
+		Help: "Number of responses in the decision cache.",
+	})
+	notificationsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_notifications_dropped_total",
+		Help: "Number of denial notifications dropped by the rate limit or because too many were waiting to be sent.",
+	})
+	notificationsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_notifications_failed_total",
+		Help: "Number of denial notifications the notification endpoint didn't accept.",
+	})
+	admissionDeadlineExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deadline_exceeded_total",
+		Help: "Number of admission requests answered with the -deadlineResponse because the rules didn't finish within the timeout of the apiserver, by handler.",
+	}, []string{"handler"})
+	namespaceRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_namespace_rate_limited_total",
+		Help: "Number of CREATE and UPDATE requests denied because their namespace exceeded -namespaceQPS, by handler.",
+	}, []string{"handler"})
+	admissionResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_admission_responses_total",
+		Help: "Number of admission responses by handler and Status.Code, 200 when allowed: 400 and 422 are requests to fix, 403 denials of the policy and 500 failures of the webhook.",
+	}, []string{"handler", "code"})
+	admissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_admission_duration_seconds",
+		Help:    "Time taken to answer admission requests, by handler and kind, with the trace ID as exemplar.",
+		Buckets: durationBuckets,
+	}, []string{"handler", "kind"})
+	ruleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhook_rule_duration_seconds",
+		Help:    "Time taken by each rule on admission requests, by handler, kind and rule, with the trace ID as exemplar.",
+		Buckets: durationBuckets,
+	}, []string{"handler", "kind", "rule"})
+	internalErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_internal_errors_total",
+		Help: "Number of admission requests the webhook failed to process, by kind and by response, allow or deny as set by -onInternalError.",
+	}, []string{"kind", "response"})
+	qosClassLowered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_qos_class_lowered_total",
+		Help: "Number of requests reductions lowering the QoS class of pods, by kind, classes from and to, and action: warned, or kept when the qosClass policy skipped the reduction.",
+	}, []string{"kind", "from", "to", "action"})
+	endpointAuthentications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_endpoint_authentications_total",
+		Help: "Number of calls of /check, /audit, /debug/loglevel and /debug/snapshots by endpoint and result: static, tokenreview, unauthorized, forbidden or error.",
+	}, []string{"endpoint", "result"})
+	legacyKeysRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_legacy_keys_read_total",
+		Help: "Number of reads of the annotations, labels and finalizers under the legacy domain in place of those under -annotationDomain, by legacy key. The objects are migrated once it stops increasing.",
+	}, []string{"key"})
+	largePatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_large_patches_total",
+		Help: "Number of generated patches of at least -patchWarningBytes.",
+	})
+	chaosInjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_chaos_injections_total",
+		Help: "Number of latencies and failures injected in chaos mode, by handler and fault: latency, error or timeout.",
+	}, []string{"handler", "fault"})
+	managedDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_managed_deletions_total",
+		Help: "Number of deletions of the workloads the webhook manages recorded by removing their finalizer, by kind.",
+	}, []string{"kind"})
+	policyGeneration = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webhook_policy_generation",
+		Help: "Generation of the policy config, incremented whenever it is reloaded or the WebhookPolicyOverrides change, see the logs for what changed.",
+	}, func() float64 {
+		return float64(policy.Generation())
+	})
+	certExpiry = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webhook_cert_expiry_seconds",
+		Help: "Seconds until the currently served certificate expires, negative once expired.",
+	}, func() float64 {
+		notAfter, ok := servedCertNotAfter()
+		if !ok {
+			return 0
+		}
+		return time.Until(notAfter).Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		inflightRequests,
+		inflightLimit,
+		inflightRejected,
+		inflightQueueWait,
+		certReloads,
+		certNotAfter,
+		certExpiry,
+		decisionCacheHits,
+		decisionCacheMisses,
+		decisionCacheEntries,
+		notificationsDropped,
+		notificationsFailed,
+		admissionDeadlineExceeded,
+		namespaceRateLimited,
+		admissionResponses,
+		admissionDuration,
+		ruleDuration,
+		internalErrors,
+		qosClassLowered,
+		endpointAuthentications,
+		legacyKeysRead,
+		largePatches,
+		chaosInjections,
+		managedDeletions,
+		policyGeneration,
+		newBuildInfoCollector(),
+	)
+}
+
+// handlerKey is the context key of the name of the handler serving a
+// request, the handler label of ruleDuration.
+type handlerKey struct{}
+
+// observeDuration observes elapsed on observer with the trace ID of the span
+// of ctx as exemplar, linking the buckets of slow requests to their traces.
+// The exemplars are exposed in the OpenMetrics format only.
+func observeDuration(ctx context.Context, observer prometheus.Observer, elapsed time.Duration) {
+	span := trace.SpanContextFromContext(ctx)
+	if exemplars, ok := observer.(prometheus.ExemplarObserver); ok && span.IsValid() {
+		exemplars.ObserveWithExemplar(elapsed.Seconds(), prometheus.Labels{"trace_id": span.TraceID().String()})
+		return
+	}
+	observer.Observe(elapsed.Seconds())
+}
+
+// observeRuleDuration is the admission.RuleObserver filling ruleDuration.
+func observeRuleDuration(ctx context.Context, kind, rule string, elapsed time.Duration) {
+	handler, _ := ctx.Value(handlerKey{}).(string)
+	observeDuration(ctx, ruleDuration.WithLabelValues(handler, kind, rule), elapsed)
+}
+
+// observeQoSChange is the admission.QoSChangeObserver filling
+// qosClassLowered.
+func observeQoSChange(kind string, from, to corev1.PodQOSClass, kept bool) {
+	action := "warned"
+	if kept {
+		action = "kept"
+	}
+	qosClassLowered.WithLabelValues(kind, string(from), string(to), action).Inc()
+}
+
+// observeInternalError counts the requests of kind the webhook failed to
+// process.
+func observeInternalError(kind string, allowed bool) {
+	response := internalErrorDeny
+	if allowed {
+		response = internalErrorAllow
+	}
+	internalErrors.WithLabelValues(kind, response).Inc()
+}
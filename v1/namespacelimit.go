@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// namespaceLimiter rate limits the CREATE and UPDATE requests of every
+// namespace with a token bucket of its own for each handler, so a runaway
+// controller of one namespace can't take the capacity of the webhook from the
+// others. Requests over the limit are denied at once, deletions and cluster
+// scoped objects are never limited.
+type namespaceLimiter struct {
+	qps   float32
+	burst int
+	// buckets unused for idle are full again, they are dropped
+	idle time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*namespaceBucket // by handler and namespace
+	pruned  time.Time
+}
+
+type namespaceBucket struct {
+	limiter flowcontrol.RateLimiter
+	used    time.Time
+}
+
+// newNamespaceLimiter returns the limiter admitting qps requests per second
+// of a namespace with bursts of burst, nil when qps isn't positive.
+func newNamespaceLimiter(qps float64, burst int) *namespaceLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	idle := time.Duration(float64(burst) / qps * float64(time.Second))
+	if idle < time.Minute {
+		idle = time.Minute
+	}
+	return &namespaceLimiter{
+		qps:     float32(qps),
+		burst:   burst,
+		idle:    idle,
+		buckets: map[string]*namespaceBucket{},
+		pruned:  time.Now(),
+	}
+}
+
+// admit returns the denial of req to the handler name when its namespace is
+// over the limit, nil when req may be processed.
+func (l *namespaceLimiter) admit(name string, req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	if l == nil || req == nil || req.Namespace == "" || (req.Operation != v1.Create && req.Operation != v1.Update) {
+		return nil
+	}
+	now := time.Now()
+	l.mu.Lock()
+	key := name + "/" + req.Namespace
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &namespaceBucket{limiter: flowcontrol.NewTokenBucketRateLimiter(l.qps, l.burst)}
+		l.buckets[key] = bucket
+	}
+	bucket.used = now
+	if now.Sub(l.pruned) > l.idle {
+		for key, b := range l.buckets {
+			if now.Sub(b.used) > l.idle {
+				delete(l.buckets, key)
+			}
+		}
+		l.pruned = now
+	}
+	l.mu.Unlock()
+
+	if bucket.limiter.TryAccept() {
+		return nil
+	}
+	namespaceRateLimited.WithLabelValues(name).Inc()
+	message := fmt.Sprintf(messages.NamespaceRateLimited, req.Namespace, l.qps)
+	return &v1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusTooManyRequests,
+			Reason:  metav1.StatusReasonTooManyRequests,
+			Message: message,
+			Details: &metav1.StatusDetails{
+				Name:              req.Name,
+				Group:             req.Kind.Group,
+				Kind:              req.Kind.Kind,
+				RetryAfterSeconds: 1,
+			},
+		},
+	}
+}
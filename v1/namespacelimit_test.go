@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/admission/v1"
+)
+
+func TestNamespaceLimiterBurst(t *testing.T) {
+	l := newNamespaceLimiter(0.001, 3)
+	denied := testutil.ToFloat64(namespaceRateLimited.WithLabelValues("validate"))
+	for i := 0; i < 3; i++ {
+		if limited := l.admit("validate", configMapRequest("busy", "web", "")); limited != nil {
+			t.Fatalf("request %d of the burst denied: %s", i, limited.Result.Message)
+		}
+	}
+	limited := l.admit("validate", configMapRequest("busy", "web", ""))
+	if limited == nil {
+		t.Fatal("request over the burst admitted")
+	}
+	if limited.Allowed || limited.Result.Code != http.StatusTooManyRequests || limited.Result.Details.RetryAfterSeconds != 1 {
+		t.Errorf("request over the burst answered %+v, want a 429 to retry after a second", limited.Result)
+	}
+	if got := testutil.ToFloat64(namespaceRateLimited.WithLabelValues("validate")) - denied; got != 1 {
+		t.Errorf("counted %v denials, want 1", got)
+	}
+
+	// the other namespaces, the other handler, deletions and cluster scoped
+	// objects have buckets of their own or none
+	deletion := configMapRequest("busy", "web", "")
+	deletion.Operation = v1.Delete
+	for name, req := range map[string]*v1.AdmissionRequest{
+		"validate": configMapRequest("quiet", "web", ""),
+		"mutate":   configMapRequest("busy", "web", ""),
+	} {
+		if limited := l.admit(name, req); limited != nil {
+			t.Errorf("%s of %s denied by the bucket of busy", name, req.Namespace)
+		}
+	}
+	if limited := l.admit("validate", deletion); limited != nil {
+		t.Error("deletion rate limited")
+	}
+	if limited := l.admit("validate", configMapRequest("", "web", "")); limited != nil {
+		t.Error("cluster scoped object rate limited")
+	}
+}
+
+func TestNamespaceLimiterRefill(t *testing.T) {
+	l := newNamespaceLimiter(50, 1)
+	if limited := l.admit("validate", configMapRequest("busy", "web", "")); limited != nil {
+		t.Fatal("first request denied")
+	}
+	if limited := l.admit("validate", configMapRequest("busy", "web", "")); limited == nil {
+		t.Fatal("request over the burst admitted")
+	}
+	// a token comes back every 20ms
+	time.Sleep(50 * time.Millisecond)
+	if limited := l.admit("validate", configMapRequest("busy", "web", "")); limited != nil {
+		t.Errorf("request denied after the bucket refilled: %s", limited.Result.Message)
+	}
+}
+
+func TestNamespaceLimiterPrunesIdleBuckets(t *testing.T) {
+	l := newNamespaceLimiter(1, 1)
+	for _, namespace := range []string{"a", "b", "c"} {
+		l.admit("validate", configMapRequest(namespace, "web", ""))
+	}
+	if len(l.buckets) != 3 {
+		t.Fatalf("%d buckets, want 3", len(l.buckets))
+	}
+
+	// the buckets aren't pruned before idle passed
+	l.idle = 20 * time.Millisecond
+	l.admit("validate", configMapRequest("a", "web", ""))
+	if len(l.buckets) != 3 {
+		t.Errorf("%d buckets before the idle time, want 3", len(l.buckets))
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if limited := l.admit("validate", configMapRequest("d", "web", "")); limited != nil {
+		t.Errorf("request of a new namespace denied: %s", limited.Result.Message)
+	}
+	if _, ok := l.buckets["validate/d"]; !ok || len(l.buckets) != 1 {
+		t.Errorf("buckets %v after pruning, want only validate/d", l.buckets)
+	}
+
+	// a pruned bucket starts full again
+	if limited := l.admit("validate", configMapRequest("a", "web", "")); limited != nil {
+		t.Errorf("request of a pruned namespace denied: %s", limited.Result.Message)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/spf13/cobra"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// outageImpact is what an outage of the webhook would have done to recorded
+// requests under either failurePolicy.
+type outageImpact struct {
+	// requests sent to the webhooks
+	requests int
+	// Ignore: admitted without the patch the policy gives them
+	unmutated []string
+	// Ignore: admitted though the policy denies them
+	undenied []string
+	// Fail: rejected, by kind
+	rejected map[string]int
+	// Fail: rejected requests of service accounts and system users, whose
+	// controllers stop reconciling until the webhook is back
+	rejectedSystem int
+}
+
+// outageReport implements the outage-report command: it runs recorded
+// admission requests, read like replay reads them, through the current
+// policies and reports what an outage of the webhook would have done to
+// those the registered webhooks receive, with failurePolicy Ignore and Fail,
+// to choose between them.
+//
+//	admission-webhook outage-report -f /var/log/kubernetes/audit.log --namespaces namespaces.yaml
+func outageReport(parameters *WhSvrParameters, files []string, namespacesFile string) {
+	loadPolicy(parameters)
+	settings, err := newWebhookSettings(parameters, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid webhook settings: %v\n", err)
+		os.Exit(1)
+	}
+	inSelector, err := namespaceSelectorMatcher(settings.namespaceSelector, namespacesFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", namespacesFile, err)
+		os.Exit(1)
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	var cases []replayCase
+	for _, file := range files {
+		c, err := readReplayCases(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", file, err)
+			os.Exit(1)
+		}
+		cases = append(cases, c...)
+	}
+
+	mutatingRules := admission.MutateRules
+	if settings.mutateNamespaces {
+		mutatingRules = append(append([]admissionregistrationv1.RuleWithOperations{}, mutatingRules...), admission.NamespaceMutateRules...)
+	}
+	validatingRules := admission.ValidateRulesFor(policy.CurrentConfig())
+
+	impact := outageImpact{rejected: map[string]int{}}
+	for _, c := range cases {
+		req := c.request
+		// namespaces are mutated by a webhook without namespaceSelector
+		selected := req.Kind.Kind == "Namespace" || inSelector(req.Namespace)
+		mutated := selected && handles(mutatingRules, req)
+		validated := selected && handles(validatingRules, req)
+		if !mutated && !validated {
+			continue
+		}
+		impact.requests++
+		impact.rejected[req.Kind.Kind]++
+		if strings.HasPrefix(req.UserInfo.Username, "system:") {
+			impact.rejectedSystem++
+		}
+
+		log := newRequestLogger(req)
+		request := req
+		if mutated {
+			response := admission.Mutate(context.Background(), req, log)
+			if !response.Allowed {
+				impact.undenied = append(impact.undenied, fmt.Sprintf("%s %s: %s", c.source, describeRequest(req), responseMessage(response)))
+				continue
+			}
+			if len(response.Patch) > 0 {
+				impact.unmutated = append(impact.unmutated, fmt.Sprintf("%s %s: %s", c.source, describeRequest(req), patchPaths(response.Patch)))
+				// the validating webhook sees the mutated object
+				if patched, err := applyPatch(req.Object.Raw, response.Patch); err == nil {
+					copied := *req
+					copied.Object.Raw = patched
+					request = &copied
+				}
+			}
+		}
+		if validated {
+			if response := admission.Validate(context.Background(), request, log); !response.Allowed {
+				impact.undenied = append(impact.undenied, fmt.Sprintf("%s %s: %s", c.source, describeRequest(req), responseMessage(response)))
+			}
+		}
+	}
+	impact.print(len(cases), settings)
+}
+
+// print writes the report of impact on the requests of total recorded ones.
+func (impact *outageImpact) print(total int, settings *webhookSettings) {
+	fmt.Printf("%d of %d recorded requests are sent to the webhooks, the registered failurePolicy is %s\n", impact.requests, total, settings.failurePolicy)
+
+	fmt.Printf("\nfailurePolicy Ignore: every request is admitted unchecked\n")
+	fmt.Printf("  %d admitted without their mutation\n", len(impact.unmutated))
+	for _, line := range impact.unmutated {
+		fmt.Printf("    %s\n", line)
+	}
+	fmt.Printf("  %d admitted though the policy denies them\n", len(impact.undenied))
+	for _, line := range impact.undenied {
+		fmt.Printf("    %s\n", line)
+	}
+
+	fmt.Printf("\nfailurePolicy Fail: every request is rejected\n")
+	kinds := make([]string, 0, len(impact.rejected))
+	for kind := range impact.rejected {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Printf("  %d rejected", impact.requests)
+	for i, kind := range kinds {
+		separator := ", "
+		if i == 0 {
+			separator = ": "
+		}
+		fmt.Printf("%s%d %s", separator, impact.rejected[kind], kind)
+	}
+	fmt.Println()
+	fmt.Printf("  %d of them made by service accounts and system users, whose controllers stall until the webhook is back\n", impact.rejectedSystem)
+}
+
+// patchPaths lists the operations of a JSON patch without their values,
+// which would make the report unreadable.
+func patchPaths(patch []byte) string {
+	var operations []struct {
+		Op   string `json:"op"`
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return string(patch)
+	}
+	paths := make([]string, 0, len(operations))
+	for _, operation := range operations {
+		paths = append(paths, operation.Op+" "+operation.Path)
+	}
+	return strings.Join(paths, ", ")
+}
+
+// namespaceSelectorMatcher returns whether the namespaceSelector of the
+// webhooks selects a namespace, by the labels of the namespaces listed in
+// file, e.g. by kubectl get namespaces -o yaml. Every namespace is selected
+// without a selector or a file, since the recorded requests don't carry the
+// labels of their namespace.
+func namespaceSelectorMatcher(selector *metav1.LabelSelector, file string) (func(namespace string) bool, error) {
+	everyNamespace := func(string) bool { return true }
+	if selector == nil {
+		return everyNamespace, nil
+	}
+	if file == "" {
+		fmt.Fprintf(os.Stderr, "The namespaceSelector %s is not evaluated without --namespaces, the requests of every namespace are counted\n", metav1.FormatLabelSelector(selector))
+		return everyNamespace, nil
+	}
+	matches, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var list corev1.NamespaceList
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	selected := map[string]bool{}
+	for _, namespace := range list.Items {
+		selected[namespace.Name] = matches.Matches(labels.Set(namespace.Labels))
+	}
+	return func(namespace string) bool {
+		// cluster-scoped objects aren't filtered by the namespaceSelector
+		return namespace == "" || selected[namespace]
+	}, nil
+}
+
+// newOutageReportCommand returns the outage-report command.
+func newOutageReportCommand(parameters *WhSvrParameters) *cobra.Command {
+	var files []string
+	var namespacesFile string
+	command := &cobra.Command{
+		Use:   "outage-report",
+		Short: "Report what a webhook outage would have done to recorded admission requests with failurePolicy Ignore and Fail",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			outageReport(parameters, files, namespacesFile)
+		},
+	}
+	command.Flags().StringArrayVarP(&files, "file", "f", nil, "Audit log (JSON lines) or AdmissionReview JSON file of the requests, - for stdin. Can be repeated.")
+	command.Flags().StringVar(&namespacesFile, "namespaces", "", "NamespaceList YAML or JSON, e.g. from kubectl get namespaces -o yaml, to evaluate -namespaceSelector with.")
+	return command
+}
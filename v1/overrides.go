@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// policyOverrideResource is the resource of the WebhookPolicyOverrides, see
+// deployment/policyoverride-crd.yaml.
+var policyOverrideResource = schema.GroupVersionResource{
+	Group:    "admission-webhook-example.qikqiak.com",
+	Version:  "v1alpha1",
+	Resource: "webhookpolicyoverrides",
+}
+
+// startPolicyOverrides watches the WebhookPolicyOverrides of the cluster and
+// sets the overrides of the namespaces from them on every change, returning
+// once they are synced.
+func startPolicyOverrides(ctx context.Context, kubeconfig string) error {
+	client, err := newDynamicClient(kubeconfig)
+	if err != nil {
+		return err
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	informer := factory.ForResource(policyOverrideResource)
+	lister := informer.Lister()
+	update := func() { setPolicyOverrides(lister) }
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { update() },
+		UpdateFunc: func(interface{}, interface{}) { update() },
+		DeleteFunc: func(interface{}) { update() },
+	})
+	factory.Start(ctx.Done())
+	for resource, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return fmt.Errorf("can't sync %v", resource)
+		}
+	}
+	return nil
+}
+
+// setPolicyOverrides sets the overrides of the namespaces from the
+// WebhookPolicyOverrides lister has, those of a namespace merged by name,
+// and logs those which don't apply as written.
+func setPolicyOverrides(lister cache.GenericLister) {
+	objects, err := lister.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("Failed to list the WebhookPolicyOverrides: %v", err)
+		return
+	}
+	var items []*unstructured.Unstructured
+	for _, object := range objects {
+		if item, ok := object.(*unstructured.Unstructured); ok {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].GetName() < items[j].GetName() })
+
+	policies := map[string][]json.RawMessage{}
+	for _, item := range items {
+		spec, _, _ := unstructured.NestedMap(item.Object, "spec", "policy")
+		if len(spec) == 0 {
+			continue
+		}
+		data, err := json.Marshal(spec)
+		if err != nil {
+			glog.Warningf("WebhookPolicyOverride %s/%s is ignored: %v", item.GetNamespace(), item.GetName(), err)
+			continue
+		}
+		policies[item.GetNamespace()] = append(policies[item.GetNamespace()], data)
+	}
+	policy.SetNamespaceOverrides(policies)
+	for namespace, p := range policies {
+		if err := policy.CheckOverrides(p); err != nil {
+			glog.Warningf("WebhookPolicyOverrides of namespace %s: %v", namespace, err)
+		}
+	}
+	glog.Infof("Loaded the WebhookPolicyOverrides of %d namespaces", len(policies))
+}
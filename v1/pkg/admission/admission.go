@@ -0,0 +1,856 @@
+// Package admission implements the mutating and validating webhooks on
+// admission.k8s.io/v1 AdmissionReviews, independent of how they are served.
+// The Set functions configure the package at startup, none of them is safe
+// to call while requests are being admitted.
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/patch"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+)
+
+var (
+	runtimeScheme = runtime.NewScheme()
+	codecs        = serializer.NewCodecFactory(runtimeScheme)
+	deserializer  = codecs.UniversalDeserializer()
+	// the encoders of EncodeTo, by media type
+	encoders sync.Map
+)
+
+// resources decoded by Mutate and Validate, the registered rules are derived
+// from these so they can't drift from what the package handles
+var (
+	MutateRules = []admissionregistrationv1.RuleWithOperations{
+		createRule("apps", "v1", "deployments", admissionregistrationv1.Create, admissionregistrationv1.Update),
+		createRule("apps", "v1", "replicasets", admissionregistrationv1.Create),
+		createRule("", "v1", "pods", admissionregistrationv1.Create),
+	}
+	// namespaces are matched by their own labels against the namespaceSelector
+	// of a webhook, so they are registered with a webhook of their own
+	NamespaceMutateRules = []admissionregistrationv1.RuleWithOperations{
+		createRule("", "v1", "namespaces", admissionregistrationv1.Create),
+	}
+	ValidateRules = []admissionregistrationv1.RuleWithOperations{
+		createRule("apps", "v1", "deployments", admissionregistrationv1.Create, admissionregistrationv1.Update, admissionregistrationv1.Delete),
+		createRule("apps", "v1", "deployments/scale", admissionregistrationv1.Update),
+		createRule("apps", "v1", "replicasets", admissionregistrationv1.Create, admissionregistrationv1.Update),
+		createRule("", "v1", "services", admissionregistrationv1.Create, admissionregistrationv1.Update, admissionregistrationv1.Delete),
+		createRule("networking.k8s.io", "v1", "ingresses", admissionregistrationv1.Create, admissionregistrationv1.Update),
+		createRule("", "v1", "persistentvolumeclaims", admissionregistrationv1.Create, admissionregistrationv1.Update),
+		createRule("", "v1", "configmaps", admissionregistrationv1.Create, admissionregistrationv1.Update),
+		createRule("", "v1", "secrets", admissionregistrationv1.Create, admissionregistrationv1.Update),
+		createRule("", "v1", "pods", admissionregistrationv1.Create, admissionregistrationv1.Update),
+		createRule("", "v1", "pods/ephemeralcontainers", admissionregistrationv1.Update),
+	}
+)
+
+// ValidateRulesFor returns the ValidateRules and the rules of the
+// MetadataResources of config.
+func ValidateRulesFor(config *policy.Config) []admissionregistrationv1.RuleWithOperations {
+	rules := append([]admissionregistrationv1.RuleWithOperations{}, ValidateRules...)
+	for _, r := range config.MetadataResources {
+		rules = append(rules, createRule(r.Group, r.Version, r.Resource, admissionregistrationv1.Create, admissionregistrationv1.Update, admissionregistrationv1.Delete))
+	}
+	return rules
+}
+
+func init() {
+	_ = corev1.AddToScheme(runtimeScheme)
+	_ = admissionregistrationv1.AddToScheme(runtimeScheme)
+	// defaulting with webhooks:
+	// https://github.com/kubernetes/kubernetes/issues/57982
+	_ = v1.AddToScheme(runtimeScheme)
+}
+
+func createRule(group, version, resource string, operations ...admissionregistrationv1.OperationType) admissionregistrationv1.RuleWithOperations {
+	return admissionregistrationv1.RuleWithOperations{
+		Operations: operations,
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{group},
+			APIVersions: []string{version},
+			Resources:   []string{resource},
+		},
+	}
+}
+
+// Logger receives the progress of a single admission request.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Decode decodes an AdmissionReview request body, JSON, YAML or protobuf.
+func Decode(body []byte) (*v1.AdmissionReview, error) {
+	ar := &v1.AdmissionReview{}
+	if _, _, err := deserializer.Decode(body, nil, ar); err != nil {
+		return nil, err
+	}
+	return ar, nil
+}
+
+// Encode encodes an AdmissionReview response as mediaType, any media type
+// the scheme has a serializer for, e.g. runtime.ContentTypeProtobuf.
+func Encode(ar *v1.AdmissionReview, mediaType string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := EncodeTo(&buf, ar, mediaType); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeTo encodes an AdmissionReview response as mediaType to w, the
+// encoder of every media type is built once.
+func EncodeTo(w io.Writer, ar *v1.AdmissionReview, mediaType string) error {
+	encoder, ok := encoders.Load(mediaType)
+	if !ok {
+		info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), mediaType)
+		if !ok {
+			return fmt.Errorf("no serializer for %s", mediaType)
+		}
+		encoder, _ = encoders.LoadOrStore(mediaType, codecs.EncoderForVersion(info.Serializer, v1.SchemeGroupVersion))
+	}
+	return encoder.(runtime.Encoder).Encode(ar, w)
+}
+
+// decodeFailed answers a request whose object doesn't decode as its kind.
+// The apiserver decoded it, so the webhook is at fault, see
+// SetAllowInternalErrors.
+func decodeFailed(req *v1.AdmissionRequest, err error, log Logger) *v1.AdmissionResponse {
+	log.Errorf(messages.DecodeObjectFailed, req.Kind.Kind, err)
+	message := fmt.Sprintf(messages.DecodeObjectFailed, req.Kind.Kind, err)
+	if response := allowInternalError(req, message); response != nil {
+		return response
+	}
+	return failure(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, message)
+}
+
+// badRequest answers a request the webhook isn't meant to receive, e.g. of a
+// kind it doesn't handle, which points at its registration.
+func badRequest(message string) *v1.AdmissionResponse {
+	return failure(http.StatusBadRequest, metav1.StatusReasonBadRequest, message)
+}
+
+// internalError answers a request the webhook failed to process, which
+// isn't the fault of the user.
+func internalError(req *v1.AdmissionRequest, message string) *v1.AdmissionResponse {
+	if response := allowInternalError(req, message); response != nil {
+		return response
+	}
+	return failure(http.StatusInternalServerError, metav1.StatusReasonInternalError, message)
+}
+
+// InternalErrorObserver is told about every request of kind the webhook
+// failed to process and whether it was admitted anyway.
+type InternalErrorObserver func(kind string, allowed bool)
+
+var (
+	internalErrorsAllowed bool
+	observeInternalError  InternalErrorObserver
+)
+
+// SetAllowInternalErrors sets whether the requests the webhook fails to
+// process, e.g. because their object doesn't decode or their patch can't be
+// generated, are admitted unchanged with a warning rather than denied, so a
+// bug of the webhook doesn't block workloads, and observer, which may be nil,
+// is told about them.
+func SetAllowInternalErrors(allow bool, observer InternalErrorObserver) {
+	internalErrorsAllowed = allow
+	observeInternalError = observer
+}
+
+// allowInternalError tells the InternalErrorObserver about the internal
+// error of req and returns the response admitting it, nil when it is denied.
+func allowInternalError(req *v1.AdmissionRequest, message string) *v1.AdmissionResponse {
+	if observeInternalError != nil {
+		observeInternalError(req.Kind.Kind, internalErrorsAllowed)
+	}
+	if !internalErrorsAllowed {
+		return nil
+	}
+	return &v1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: []string{fmt.Sprintf(messages.InternalErrorAllowed, message)},
+	}
+}
+
+// failure denies a request for another reason than the policy, the code and
+// reason tell users and dashboards apart the requests to fix (400, 422),
+// the denials of the policy (403) and the malfunctions of the webhook (500).
+func failure(code int32, reason metav1.StatusReason, message string) *v1.AdmissionResponse {
+	return &v1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  reason,
+			Message: message,
+		},
+	}
+}
+
+// admittedObject returns the object req is about, the deleted one on DELETE.
+func admittedObject(req *v1.AdmissionRequest) []byte {
+	if req.Operation == v1.Delete {
+		return req.OldObject.Raw
+	}
+	return req.Object.Raw
+}
+
+// skipOperation admits req unchecked when its operation isn't checked on
+// its resource, CONNECT never is. It returns nil otherwise.
+func skipOperation(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	resource := req.Resource.Resource
+	if req.SubResource != "" {
+		resource += "/" + req.SubResource
+	}
+	if req.Operation != v1.Connect && policy.CurrentConfig().OperationChecked(resource, string(req.Operation)) {
+		return nil
+	}
+	log.Infof(messages.OperationSkipped, req.Operation, req.Kind.Kind, req.Namespace, ObjectName(req))
+	return &v1.AdmissionResponse{
+		Allowed: true,
+	}
+}
+
+// auditSubjectExempt is the audit annotation of the requests of exempt
+// subjects.
+const auditSubjectExempt = "subject-exempt"
+
+// exemptSubject admits req unchanged when it comes from an exempt subject of
+// the policy, before any rule runs, subresources included: Validate and
+// Mutate check nothing for them. The strict subjects of the policy are the
+// other way round, their requests are denied where the rules only warn, see
+// newDenial, and they aren't exempt even when they match the exempt subjects
+// too. It returns nil otherwise.
+func exemptSubject(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	if !policy.ExemptSubject(req.UserInfo) {
+		return nil
+	}
+	message := fmt.Sprintf(messages.SubjectExempt, req.Kind.Kind, req.Namespace, ObjectName(req), req.UserInfo.Username)
+	log.Infof(messages.SubjectExempt, req.Kind.Kind, req.Namespace, ObjectName(req), req.UserInfo.Username)
+	return &v1.AdmissionResponse{
+		Allowed:          true,
+		AuditAnnotations: map[string]string{auditSubjectExempt: message},
+	}
+}
+
+// ignoredNamespace admits req unchanged when its namespace is ignored by the
+// policy, before any rule runs, the way validation skips it. It returns nil
+// otherwise.
+func ignoredNamespace(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	if req.Namespace == "" || !policy.NamespaceIgnored(req.Namespace) {
+		return nil
+	}
+	log.Infof(messages.NamespaceIgnored, ObjectName(req), req.Namespace)
+	return &v1.AdmissionResponse{
+		Allowed: true,
+	}
+}
+
+// exempt admits req unchanged when the object matches the exemption selector
+// of the policy, before any rule runs. It returns nil otherwise.
+func exempt(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(admittedObject(req), &object); err != nil || !policy.Exempt(object.Labels) {
+		return nil
+	}
+	selector := policy.CurrentConfig().ExemptSelector
+	log.Warningf(messages.ObjectExempt, req.Kind.Kind, req.Namespace, nameOf(&object.ObjectMeta), selector)
+	return &v1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: []string{fmt.Sprintf(messages.ObjectExempt, req.Kind.Kind, req.Namespace, nameOf(&object.ObjectMeta), selector)},
+	}
+}
+
+// admittedThrough admits req unchanged when its object is admitted through
+// another one, such as the ReplicaSets of a Deployment: the rules ran on the
+// pod template with the Deployment, running them again would mutate it
+// twice. It returns nil otherwise.
+func admittedThrough(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	handler := lookupKind(req)
+	if handler == nil || handler.admittedThrough == nil {
+		return nil
+	}
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(admittedObject(req), &object); err != nil {
+		return nil
+	}
+	by := handler.admittedThrough(&object.ObjectMeta)
+	if by == "" {
+		return nil
+	}
+	log.Infof(messages.AdmittedThrough, req.Kind.Kind, req.Namespace, nameOf(&object.ObjectMeta), by)
+	return &v1.AdmissionResponse{
+		Allowed: true,
+	}
+}
+
+// Validate validates the objects of req against the policy: the metadata
+// rules of every kind (required labels and annotations, freeze windows,
+// deprecations) run here, the rules on the spec of each kind are registered
+// from the file of the kind, see registerKind, and call the rules of their
+// own files, such as replicas.go or signatures.go. Updates and deletes are
+// validated by validateUpdate and validateDelete, the scale and ephemeral
+// containers subresources by validateScale and validateEphemeralContainers.
+// The requests exemptSubject, self, exempt and admittedThrough admit are not
+// checked. The policy service has the last word on the kinds of the callout
+// policy. The lookups of images and the policy service are cancelled with
+// ctx.
+func Validate(ctx context.Context, req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	return consult(ctx, req, validate(ctx, req, log), false, log)
+}
+
+// validate is Validate without the policy service.
+func validate(ctx context.Context, req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	if response := skipOperation(req, log); response != nil {
+		return response
+	}
+	if response := exemptSubject(req, log); response != nil {
+		return response
+	}
+	if response := self(req, log); response != nil {
+		return response
+	}
+	switch req.SubResource {
+	// a Scale carries none of the metadata of its Deployment
+	case "scale":
+		return validateScale(req, log)
+	case "ephemeralcontainers":
+		return validateEphemeralContainers(req, log)
+	}
+	if response := exempt(req, log); response != nil {
+		return response
+	}
+	if response := admittedThrough(req, log); response != nil {
+		return response
+	}
+	switch req.Operation {
+	case v1.Update:
+		return validateUpdate(ctx, req, log)
+	case v1.Delete:
+		return validateDelete(req, log)
+	}
+
+	log.Infof(messages.AdmissionBegin, req.Namespace, req.Kind.Kind, ObjectName(req))
+
+	// kinds without rules of their own are only validated on their metadata
+	handler := lookupKind(req)
+	metadataOnly := policy.CurrentConfig().MetadataResource(req.Resource.Group, req.Resource.Version, req.Resource.Resource)
+	if (handler == nil || handler.validate == nil) && metadataOnly == nil {
+		log.Infof(messages.UnsupportedKind, req.Kind.Kind)
+		return badRequest(fmt.Sprintf(messages.UnsupportedKind, req.Kind.Kind))
+	}
+	// the rules on metadata don't need the Go type of the kind
+	objectMeta, err := decodeMetadata(req.Object.Raw)
+	if err != nil {
+		return decodeFailed(req, err, log)
+	}
+
+	if !policy.ValidationRequired(policy.Ignored(), objectMeta, log) {
+		log.Infof(messages.ValidationSkip, objectMeta.Namespace, nameOf(objectMeta))
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	d := newDenial(req)
+	// labels are only required of workloads and services by default
+	requireLabels := metadataOnly != nil && metadataOnly.RequireLabels
+	if handler != nil && handler.requireLabels != nil {
+		requireLabels = handler.requireLabels()
+	}
+	if requireLabels {
+		log.Infof(messages.LabelsAvailable, objectMeta.Labels)
+		log.Infof(messages.LabelsRequired, policy.RequiredLabels)
+		timeRule(ctx, req, "requiredLabels", func() { checkLabels(&d, objectMeta.Labels) })
+		timeRule(ctx, req, "requiredAnnotations", func() { checkAnnotations(&d, req.Namespace, objectMeta.Annotations) })
+	}
+	timeRule(ctx, req, "freezeWindows", func() { checkFreeze(&d, req, objectMeta, log) })
+	timeRule(ctx, req, "deprecations", func() { checkDeprecations(&d, req, objectMeta) })
+	// only the rules on the spec decode the object as its kind
+	if handler != nil && handler.validate != nil {
+		object, err := handler.decode(req.Object.Raw)
+		if err != nil {
+			return decodeFailed(req, err, log)
+		}
+		handler.validate(ctx, &d, req, object)
+	}
+	if response := d.response(req, nameOf(objectMeta)); response != nil {
+		log.Infof("%s", response.Result.Message)
+		return response
+	}
+	return d.allowed()
+}
+
+// checkLabels denies objects missing some of the policy.RequiredLabels.
+func checkLabels(d *denial, labels map[string]string) {
+	missing := policy.MissingLabels(labels, policy.RequiredLabels)
+	if len(missing) == 0 {
+		return
+	}
+	causes := make([]metav1.StatusCause, 0, len(missing))
+	for _, label := range missing {
+		causes = append(causes, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueRequired,
+			Message: fmt.Sprintf(messages.LabelMissing, label),
+			Field:   fmt.Sprintf("metadata.labels[%s]", label),
+		})
+	}
+	d.add(fmt.Sprintf(messages.LabelsMissing, strings.Join(missing, ", ")), causes...)
+}
+
+// checkAnnotations denies objects in namespace missing one of the
+// policy.RequiredAnnotations or setting it to a value which doesn't match
+// its pattern.
+func checkAnnotations(d *denial, namespace string, annotations map[string]string) {
+	required := policy.CurrentConfig().RequiredAnnotations
+	for i := range required {
+		a := &required[i]
+		if !a.Applies(namespace) {
+			continue
+		}
+		field := fmt.Sprintf("metadata.annotations[%s]", a.Key)
+		value, ok := annotations[a.Key]
+		switch {
+		case !ok || value == "" && a.Pattern == "":
+			message := fmt.Sprintf(messages.AnnotationMissing, a.Key)
+			d.add(message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueRequired,
+				Message: message,
+				Field:   field,
+			})
+		case !a.Matches(value):
+			message := fmt.Sprintf(messages.AnnotationInvalid, a.Key, value, a.Pattern)
+			d.add(message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueInvalid,
+				Message: message,
+				Field:   field,
+			})
+		}
+	}
+}
+
+// validateUpdate denies updates changing the immutable fields of the policy
+// along with the other violations of the updated object, checked by the
+// rules of its kind like on creation, e.g. resizing a claim beyond the
+// limit.
+func validateUpdate(ctx context.Context, req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	if len(req.OldObject.Raw) == 0 {
+		log.Warningf(messages.OldObjectMissing, req.Kind.Kind, req.Namespace, req.Name)
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	// the old object decides, the update could opt itself out otherwise
+	var old metav1.PartialObjectMetadata
+	if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+		return decodeFailed(req, err, log)
+	}
+	if !policy.ValidationRequired(policy.Ignored(), &old.ObjectMeta, log) {
+		log.Infof(messages.ValidationSkip, req.Namespace, old.Name)
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	changed, err := policy.ChangedImmutableFields(req.OldObject.Raw, req.Object.Raw)
+	if err != nil {
+		return decodeFailed(req, err, log)
+	}
+	objectMeta, err := decodeMetadata(req.Object.Raw)
+	if err != nil {
+		return decodeFailed(req, err, log)
+	}
+	d := newDenial(req)
+	// the other rules still run, the user fixes everything at once
+	if len(changed) > 0 {
+		log.Infof(messages.FieldsImmutable, req.Kind.Kind, old.Name, strings.Join(changed, ", "))
+		causes := make([]metav1.StatusCause, 0, len(changed))
+		for _, field := range changed {
+			causes = append(causes, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueInvalid,
+				Message: fmt.Sprintf(messages.FieldImmutable, field),
+				Field:   field,
+			})
+		}
+		d.addInvalid(fmt.Sprintf(messages.FieldsImmutable, req.Kind.Kind, old.Name, strings.Join(changed, ", ")), causes...)
+	}
+	// the annotation of the update overrides the freeze, not the old one
+	timeRule(ctx, req, "freezeWindows", func() { checkFreeze(&d, req, objectMeta, log) })
+	timeRule(ctx, req, "deprecations", func() { checkDeprecations(&d, req, objectMeta) })
+	if handler := lookupKind(req); handler != nil && handler.validate != nil {
+		object, err := handler.decode(req.Object.Raw)
+		if err != nil {
+			return decodeFailed(req, err, log)
+		}
+		handler.validate(ctx, &d, req, object)
+	}
+	if response := d.response(req, old.Name); response != nil {
+		log.Infof("%s", response.Result.Message)
+		return response
+	}
+	return d.allowed()
+}
+
+// validateDelete denies the deletion of objects labeled protected, unless
+// they are annotated to allow it.
+func validateDelete(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	// apiservers before 1.15 don't send the deleted object
+	if len(req.OldObject.Raw) == 0 {
+		log.Warningf(messages.DeletedObjectMissing, req.Kind.Kind, req.Namespace, req.Name)
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(req.OldObject.Raw, &object); err != nil {
+		return decodeFailed(req, err, log)
+	}
+	if !policy.DeletionProtected(&object.ObjectMeta) {
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	log.Infof(messages.DeletionProtected, req.Kind.Kind, object.Name, policy.LabelProtected, policy.AnnotationAllowDeleteKey)
+	return &v1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: fmt.Sprintf(messages.DeletionProtected, req.Kind.Kind, object.Name, policy.LabelProtected, policy.AnnotationAllowDeleteKey),
+			Details: &metav1.StatusDetails{
+				Name:  object.Name,
+				Group: req.Kind.Group,
+				Kind:  req.Kind.Kind,
+			},
+		},
+	}
+}
+
+// denial collects the violations of a request, so that users learn about
+// all of them at once, and the warnings of rules which don't deny.
+type denial struct {
+	messages []string
+	causes   []metav1.StatusCause
+	warnings []string
+	// invalid counts the violations of fields which can't take their value,
+	// denied as Invalid rather than Forbidden when there are only those
+	invalid int
+	// strict denies what the rules would only warn about, see enforce
+	strict bool
+	// audit annotations the apiserver records in the audit log, prefixed
+	// with the name of the webhook
+	auditAnnotations map[string]string
+}
+
+// newDenial returns the denial of the violations of req.
+func newDenial(req *v1.AdmissionRequest) denial {
+	return denial{strict: policy.StrictSubject(req.UserInfo)}
+}
+
+func (d *denial) add(message string, causes ...metav1.StatusCause) {
+	d.messages = append(d.messages, message)
+	d.causes = append(d.causes, causes...)
+}
+
+// addInvalid adds a violation of fields which can't take their value
+// whoever sets it, such as the immutable ones.
+func (d *denial) addInvalid(message string, causes ...metav1.StatusCause) {
+	d.add(message, causes...)
+	d.invalid++
+}
+
+// enforce denies with message and cause when enforcement is deny or the
+// request comes from a strict subject of the policy, and warns with message
+// otherwise.
+func (d *denial) enforce(enforcement policy.Enforcement, message string, cause metav1.StatusCause) {
+	if enforcement != policy.EnforceDeny && !d.strict {
+		d.warn(message)
+		return
+	}
+	d.add(message, cause)
+}
+
+// warn adds a warning kubectl shows the user whether the request is allowed
+// or not.
+func (d *denial) warn(message string) {
+	d.warnings = append(d.warnings, message)
+}
+
+// audit adds an annotation to the audit event of the request whether it is
+// allowed or not.
+func (d *denial) audit(key, value string) {
+	if d.auditAnnotations == nil {
+		d.auditAnnotations = map[string]string{}
+	}
+	d.auditAnnotations[key] = value
+}
+
+// merge adds the violations, warnings and audit annotations of other to d.
+func (d *denial) merge(other *denial) {
+	d.messages = append(d.messages, other.messages...)
+	d.causes = append(d.causes, other.causes...)
+	d.warnings = append(d.warnings, other.warnings...)
+	d.invalid += other.invalid
+	for key, value := range other.auditAnnotations {
+		d.audit(key, value)
+	}
+}
+
+// allowed admits the request with the warnings and audit annotations
+// collected.
+func (d *denial) allowed() *v1.AdmissionResponse {
+	return &v1.AdmissionResponse{
+		Allowed:          true,
+		Warnings:         d.warnings,
+		AuditAnnotations: d.auditAnnotations,
+	}
+}
+
+// response denies the object name of req with a cause per violation,
+// pointing at the field to fix, and every warning. It is nil without
+// violations.
+func (d *denial) response(req *v1.AdmissionRequest, name string) *v1.AdmissionResponse {
+	if len(d.messages) == 0 {
+		return nil
+	}
+	code, reason := int32(http.StatusForbidden), metav1.StatusReasonForbidden
+	if d.invalid == len(d.messages) {
+		code, reason = http.StatusUnprocessableEntity, metav1.StatusReasonInvalid
+	}
+	return &v1.AdmissionResponse{
+		Warnings:         d.warnings,
+		AuditAnnotations: d.auditAnnotations,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  reason,
+			Message: strings.Join(d.messages, "; "),
+			Details: &metav1.StatusDetails{
+				Name:   name,
+				Group:  req.Kind.Group,
+				Kind:   req.Kind.Kind,
+				Causes: d.causes,
+			},
+		},
+	}
+}
+
+// Mutate mutates the objects of req as the policy says: the mutations of
+// each kind are registered from the file of the kind, see registerKind,
+// and call the rules of their own files, such as resources.go or
+// sidecars.go, each recording its provenance. Updates are mutated by
+// mutateUpdate. The requests exemptSubject, self, exempt and
+// admittedThrough admit are not mutated. The policy service has the last
+// word on the kinds of the callout policy. The lookups of digests and the
+// policy service are cancelled with ctx.
+func Mutate(ctx context.Context, req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	return consult(ctx, req, mutate(ctx, req, log), true, log)
+}
+
+// mutate is Mutate without the policy service.
+func mutate(ctx context.Context, req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	if response := skipOperation(req, log); response != nil {
+		return response
+	}
+	if response := exemptSubject(req, log); response != nil {
+		return response
+	}
+	if response := self(req, log); response != nil {
+		return response
+	}
+	if response := ignoredNamespace(req, log); response != nil {
+		return response
+	}
+	// a deleted object can't be changed
+	if req.Operation == v1.Delete {
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	if response := exempt(req, log); response != nil {
+		return response
+	}
+	if response := admittedThrough(req, log); response != nil {
+		return response
+	}
+	if req.Operation == v1.Update {
+		return mutateUpdate(ctx, req, log)
+	}
+
+	log.Infof(messages.AdmissionBegin, req.Namespace, req.Kind.Kind, ObjectName(req))
+	log.Infof(">>>>>>%s", req.Kind.Kind)
+
+	handler := lookupKind(req)
+	if handler == nil || handler.mutate == nil {
+		log.Infof(messages.UnsupportedKind, req.Kind.Kind)
+		return badRequest(fmt.Sprintf(messages.UnsupportedKind, req.Kind.Kind))
+	}
+	original, _, err := handler.decodeObject(req.Object.Raw)
+	if err != nil {
+		return decodeFailed(req, err, log)
+	}
+	// the rules mutate a deep copy of the decoded object, the patch is the
+	// diff between both
+	mutated := original.DeepCopyObject()
+	objectMeta, err := metadataOf(mutated)
+	if err != nil {
+		return decodeFailed(req, err, log)
+	}
+	// controllers reconciling the object would revert the patch, the rules
+	// and their lookups aren't run for nothing
+	if by := policy.SkipMutationBy(objectMeta); by != "" {
+		log.Infof(messages.MutationSkip, req.Namespace, nameOf(objectMeta), by)
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	m := &mutation{
+		log:         log,
+		annotations: map[string]string{policy.AnnotationStatusKey: "mutated"},
+	}
+	// new namespaces are recorded by their own name
+	provenanceNamespace := req.Namespace
+	if provenanceNamespace == "" {
+		provenanceNamespace = nameOf(objectMeta)
+	}
+	m.recordRules(provenanceNamespace, mutated)
+	if response := handler.mutate(ctx, m, req, mutated); response != nil {
+		return response
+	}
+
+	m.annotateProvenance()
+	patchBytes, err := createPatch(original, mutated, objectMeta, m.annotations)
+	if err != nil {
+		return internalError(req, err.Error())
+	}
+	if patchBytes == nil {
+		return &v1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: m.warnings,
+		}
+	}
+
+	return &v1.AdmissionResponse{
+		Allowed:  true,
+		Patch:    patchBytes,
+		Warnings: m.warnings,
+		PatchType: func() *v1.PatchType {
+			pt := v1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
+
+// mutateUpdate runs the update mutations of the kind of req, those which
+// must hold over the lifetime of the object, the other mutations only apply
+// on creation. Updates of the kinds without any are allowed as they are.
+func mutateUpdate(ctx context.Context, req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	handler := lookupKind(req)
+	if handler == nil {
+		log.Infof(messages.UnsupportedKind, req.Kind.Kind)
+		return badRequest(fmt.Sprintf(messages.UnsupportedKind, req.Kind.Kind))
+	}
+	allowed := &v1.AdmissionResponse{
+		Allowed: true,
+	}
+	if handler.mutateUpdate == nil {
+		return allowed
+	}
+	original, _, err := handler.decodeObject(req.Object.Raw)
+	if err != nil {
+		return decodeFailed(req, err, log)
+	}
+
+	log.Infof(messages.AdmissionBegin, req.Namespace, req.Kind.Kind, ObjectName(req))
+
+	mutated := original.DeepCopyObject()
+	objectMeta, err := metadataOf(mutated)
+	if err != nil {
+		return decodeFailed(req, err, log)
+	}
+	if by := policy.SkipMutationBy(objectMeta); by != "" {
+		log.Infof(messages.MutationSkip, req.Namespace, nameOf(objectMeta), by)
+		return allowed
+	}
+	m := &mutation{log: log}
+	m.recordRules(req.Namespace, mutated)
+	if response := handler.mutateUpdate(ctx, m, req, mutated); response != nil {
+		return response
+	}
+	m.annotateProvenance()
+	patch.SetAnnotations(objectMeta, m.annotations)
+	mutations, err := patch.Diff(original, mutated)
+	if err != nil {
+		return internalError(req, err.Error())
+	}
+	if len(mutations) == 0 {
+		allowed.Warnings = m.warnings
+		return allowed
+	}
+
+	patchBytes, err := patch.Marshal(mutations)
+	if err != nil {
+		return internalError(req, err.Error())
+	}
+	return &v1.AdmissionResponse{
+		Allowed:  true,
+		Patch:    patchBytes,
+		Warnings: m.warnings,
+		PatchType: func() *v1.PatchType {
+			pt := v1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
+
+// createPatch diffs mutated, the mutated copy of original, against it and
+// appends the operations setting annotations on objectMeta, the metadata of
+// mutated. The mutations of the rules are recorded in the annotations too.
+// It returns nil when there is nothing to patch.
+func createPatch(original, mutated interface{}, objectMeta *metav1.ObjectMeta, annotations map[string]string) ([]byte, error) {
+	mutations, err := patch.Diff(original, mutated)
+	if err != nil {
+		return nil, err
+	}
+
+	// record the mutations next to the status, unless this is a
+	// reinvocation on the output of the webhook, e.g. with the
+	// reinvocationPolicy IfNeeded, which finds nothing left to mutate and
+	// keeps the mutations the first invocation recorded
+	reinvoked := policy.LookupValue(objectMeta.Annotations, policy.AnnotationStatusKey) == "mutated"
+	if len(mutations) > 0 || !reinvoked {
+		recorded := []byte("[]")
+		if len(mutations) > 0 {
+			if recorded, err = patch.Marshal(mutations); err != nil {
+				return nil, err
+			}
+		}
+		annotations[policy.AnnotationMutationsKey] = string(recorded)
+	}
+	// the annotations are patched after the mutations, the object isn't
+	// diffed twice
+	ops := append(mutations, patch.AnnotationOps(objectMeta, annotations)...)
+	patch.SetAnnotations(objectMeta, annotations)
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	return patch.Marshal(ops)
+}
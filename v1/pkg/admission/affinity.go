@@ -0,0 +1,45 @@
+package admission
+
+import (
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// setAntiAffinity gives the pod template of a workload in namespace a
+// preferred podAntiAffinity on its app.kubernetes.io/name label, so its
+// replicas spread across nodes, unless it has one or lacks the label.
+func setAntiAffinity(namespace string, template *corev1.PodTemplateSpec) {
+	p := &policy.ConfigFor(namespace).AntiAffinity
+	name, ok := template.Labels[policy.NameLabel]
+	if !ok || !p.Required(namespace) {
+		return
+	}
+	if template.Spec.Affinity == nil {
+		template.Spec.Affinity = &corev1.Affinity{}
+	}
+	affinity := template.Spec.Affinity
+	if affinity.PodAntiAffinity != nil {
+		return
+	}
+
+	topologyKey := p.TopologyKey
+	if topologyKey == "" {
+		topologyKey = corev1.LabelHostname
+	}
+	weight := p.Weight
+	if weight == 0 {
+		weight = 100
+	}
+	affinity.PodAntiAffinity = &corev1.PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{
+			Weight: weight,
+			PodAffinityTerm: corev1.PodAffinityTerm{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{policy.NameLabel: name},
+				},
+				TopologyKey: topologyKey,
+			},
+		}},
+	}
+}
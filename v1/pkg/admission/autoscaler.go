@@ -0,0 +1,74 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// HorizontalPodAutoscalerLister lists the HorizontalPodAutoscalers of a
+// namespace.
+type HorizontalPodAutoscalerLister func(namespace string) ([]*autoscalingv1.HorizontalPodAutoscaler, error)
+
+var autoscalers HorizontalPodAutoscalerLister
+
+// SetHorizontalPodAutoscalerLister sets where the HorizontalPodAutoscalers
+// are looked up, which should be a cache rather than the API server. The
+// replicas of autoscaled Deployments are checked and kept like the others
+// until it is set.
+func SetHorizontalPodAutoscalerLister(lister HorizontalPodAutoscalerLister) {
+	autoscalers = lister
+}
+
+// autoscaledBy returns the HorizontalPodAutoscaler of namespace targeting
+// the Deployment name, which owns its replicas then: the rules on replicas
+// would fight the autoscaler. It is nil when none does or the autoscalers
+// aren't watched.
+func autoscaledBy(namespace, name string) (*autoscalingv1.HorizontalPodAutoscaler, error) {
+	if autoscalers == nil {
+		return nil, nil
+	}
+	list, err := autoscalers(namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, hpa := range list {
+		target := hpa.Spec.ScaleTargetRef
+		gv, err := schema.ParseGroupVersion(target.APIVersion)
+		if err == nil && gv.Group == appsv1.GroupName && target.Kind == "Deployment" && target.Name == name {
+			return hpa, nil
+		}
+	}
+	return nil, nil
+}
+
+// keepAutoscaledReplicas sets the replicas of deployment, updating old, back
+// to the ones of old if the autoscaling policy keeps them and an autoscaler
+// targets it, so that applying a manifest with replicas doesn't undo the
+// scaling of the autoscaler. It returns the warning telling so, empty when
+// the replicas are left alone.
+func keepAutoscaledReplicas(namespace string, old, deployment *appsv1.Deployment, log Logger) string {
+	if !policy.CurrentConfig().Autoscaling.KeepReplicas || old.Spec.Replicas == nil {
+		return ""
+	}
+	if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == *old.Spec.Replicas {
+		return ""
+	}
+	hpa, err := autoscaledBy(namespace, deployment.Name)
+	if err != nil {
+		log.Warningf(messages.AutoscalersUnknown, namespace, err)
+		return ""
+	}
+	if hpa == nil {
+		return ""
+	}
+	replicas := *old.Spec.Replicas
+	deployment.Spec.Replicas = &replicas
+	message := fmt.Sprintf(messages.AutoscaledReplicasKept, deployment.Name, replicas, hpa.Name)
+	log.Infof("%s", message)
+	return message
+}
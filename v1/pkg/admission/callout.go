@@ -0,0 +1,125 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cnych/admission-webhook/pkg/callout"
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/patch"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DecisionCaller asks an external policy service to decide on req.
+type DecisionCaller func(ctx context.Context, req *v1.AdmissionRequest) (*callout.Decision, error)
+
+var decide DecisionCaller
+
+// SetDecisionCaller sets the policy service consulted on the kinds of the
+// callout policy, none is until it is set.
+func SetDecisionCaller(caller DecisionCaller) {
+	decide = caller
+}
+
+// consult merges the decision of the policy service on req into response,
+// what the webhook answers on its own: a denial replaces it, or is added to
+// the violations the rules denied it for, the warnings are added, and so is
+// the patch when mutating. Requests the webhook fails to process, the
+// exemption selector matches or of the objects of the webhook itself aren't
+// sent. When the service can't be reached the request is denied, unless the
+// policy fails open or the rules denied it already.
+func consult(ctx context.Context, req *v1.AdmissionRequest, response *v1.AdmissionResponse, mutating bool, log Logger) *v1.AdmissionResponse {
+	p := &policy.CurrentConfig().Callout
+	if decide == nil || response == nil || !response.Allowed && !deniedByRules(response) || !p.Applies(req.Kind.Kind) {
+		return response
+	}
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(admittedObject(req), &object); err == nil {
+		object.Namespace = req.Namespace
+		if policy.Exempt(object.Labels) || isSelf(req.Kind.Kind, &object.ObjectMeta) {
+			return response
+		}
+	}
+
+	var (
+		decision *callout.Decision
+		err      error
+	)
+	timeRule(ctx, req, "callout", func() { decision, err = decide(ctx, req) })
+	if err != nil {
+		message := fmt.Sprintf(messages.CalloutFailed, err)
+		log.Warningf("%s", message)
+		if p.FailOpen || !response.Allowed {
+			response.Warnings = append(response.Warnings, message)
+			return response
+		}
+		// the callout policy chose to deny, whatever -onInternalError says
+		return failure(http.StatusInternalServerError, metav1.StatusReasonInternalError, message)
+	}
+	response.Warnings = append(response.Warnings, decision.Warnings...)
+	if !response.Allowed {
+		// the violations of the rules and of the service in one denial
+		if !decision.Allowed {
+			message := fmt.Sprintf(messages.CalloutDenied, decision.Message)
+			log.Infof("%s", message)
+			response.Result.Message += "; " + message
+			response.Result.Code, response.Result.Reason = http.StatusForbidden, metav1.StatusReasonForbidden
+		}
+		return response
+	}
+	if !decision.Allowed {
+		message := fmt.Sprintf(messages.CalloutDenied, decision.Message)
+		log.Infof("%s", message)
+		return &v1.AdmissionResponse{
+			Warnings:         response.Warnings,
+			AuditAnnotations: response.AuditAnnotations,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusForbidden,
+				Reason:  metav1.StatusReasonForbidden,
+				Message: message,
+				Details: &metav1.StatusDetails{
+					Name:  req.Name,
+					Group: req.Kind.Group,
+					Kind:  req.Kind.Kind,
+				},
+			},
+		}
+	}
+	if !mutating || len(decision.Patch) == 0 {
+		return response
+	}
+
+	var ops []patch.Operation
+	if len(response.Patch) > 0 {
+		if err := json.Unmarshal(response.Patch, &ops); err != nil {
+			return internalError(req, err.Error())
+		}
+	}
+	// the service reads the quantities as sent, it may write them canonical
+	decided, err := patch.WithoutEquivalent(req.Object.Raw, ops, decision.Patch)
+	if err != nil {
+		return internalError(req, err.Error())
+	}
+	if len(decided) == 0 {
+		return response
+	}
+	patchBytes, err := patch.Marshal(append(ops, decided...))
+	if err != nil {
+		return internalError(req, err.Error())
+	}
+	pt := v1.PatchTypeJSONPatch
+	response.Patch, response.PatchType = patchBytes, &pt
+	return response
+}
+
+// deniedByRules reports whether the rules of the webhook denied response,
+// rather than the webhook failing to process the request: the denials of the
+// rules detail the denied object.
+func deniedByRules(response *v1.AdmissionResponse) bool {
+	return !response.Allowed && response.Result != nil && response.Result.Details != nil
+}
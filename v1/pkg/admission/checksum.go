@@ -0,0 +1,73 @@
+package admission
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ConfigDigest returns the digest of the data of the ConfigMap or Secret,
+// by kind, named name in namespace, exists is false when there is none.
+type ConfigDigest func(ctx context.Context, kind, namespace, name string) (digest string, exists bool, err error)
+
+var configDigest ConfigDigest
+
+// SetConfigDigest sets how the data of the ConfigMaps and Secrets pods
+// reference is digested, which should read the API server: the configuration
+// is often changed right before the workloads, by the same kubectl apply. No
+// checksum is set until it is set.
+func SetConfigDigest(digest ConfigDigest) {
+	configDigest = digest
+}
+
+// ConfigChecksummed reports whether the mutation of req sets the config
+// checksum, which depends on the ConfigMaps and Secrets the object
+// references rather than on the request only.
+func ConfigChecksummed(req *v1.AdmissionRequest) bool {
+	return configDigest != nil && req.Kind.Kind == "Deployment" && policy.ConfigFor(req.Namespace).ConfigChecksum.Required(req.Namespace)
+}
+
+// setConfigChecksum sets the checksum annotation of the pod template of a
+// workload in namespace to the digest of the data of the ConfigMaps and
+// Secrets it references, optional ones included, so changing them along
+// with the workload rolls its pods out, like the checksum pattern of Helm
+// charts but for every workload of the namespaces of the policy. The
+// annotation is kept when they can't be digested.
+func (m *mutation) setConfigChecksum(ctx context.Context, namespace string, template *corev1.PodTemplateSpec) {
+	if configDigest == nil || !policy.ConfigFor(namespace).ConfigChecksum.Required(namespace) {
+		return
+	}
+	hash := sha256.New()
+	referenced := false
+	for _, r := range podReferences(&template.Spec, true) {
+		if r.kind == "PersistentVolumeClaim" {
+			continue
+		}
+		referenced = true
+		digest, exists, err := configDigest(ctx, r.kind, namespace, r.name)
+		if err != nil {
+			warning := fmt.Sprintf(messages.ChecksumFailed, r, namespace, err)
+			m.log.Warningf("%s", warning)
+			m.warnings = append(m.warnings, warning)
+			return
+		}
+		// creating a missing optional one changes the checksum too
+		if !exists {
+			digest = "missing"
+		}
+		fmt.Fprintf(hash, "%s\n%s\n", r, digest)
+	}
+	if !referenced {
+		return
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[policy.AnnotationConfigChecksumKey] = hex.EncodeToString(hash.Sum(nil))
+}
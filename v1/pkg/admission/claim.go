@@ -0,0 +1,50 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func init() {
+	registerKind(corev1.SchemeGroupVersion.WithKind("PersistentVolumeClaim"), kindHandler{
+		decode: jsonDecoder(func() runtime.Object { return &corev1.PersistentVolumeClaim{} }),
+		requireLabels: func() bool {
+			return policy.CurrentConfig().PersistentVolumeClaims.RequireLabels
+		},
+		validate: func(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object) {
+			timeRule(ctx, req, "persistentVolumeClaims", func() { checkPersistentVolumeClaim(d, req.Namespace, object.(*corev1.PersistentVolumeClaim)) })
+		},
+	})
+}
+
+// checkPersistentVolumeClaim denies claims of storage classes or sizes the
+// claim policy doesn't allow in namespace.
+func checkPersistentVolumeClaim(d *denial, namespace string, claim *corev1.PersistentVolumeClaim) {
+	p := &policy.CurrentConfig().PersistentVolumeClaims
+
+	if !p.StorageClassAllowed(claim.Spec.StorageClassName) {
+		message := fmt.Sprintf(messages.StorageClassNotAllowed, *claim.Spec.StorageClassName)
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueNotSupported,
+			Message: message,
+			Field:   "spec.storageClassName",
+		})
+	}
+
+	requested, ok := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+	if max := p.MaxSize(namespace); ok && max != nil && requested.Cmp(*max) > 0 {
+		message := fmt.Sprintf(messages.ClaimTooLarge, requested.String(), max.String(), namespace)
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: message,
+			Field:   "spec.resources.requests[storage]",
+		})
+	}
+}
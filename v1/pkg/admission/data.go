@@ -0,0 +1,108 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func init() {
+	registerKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"), kindHandler{
+		decode: jsonDecoder(func() runtime.Object { return &corev1.ConfigMap{} }),
+		validate: func(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object) {
+			timeRule(ctx, req, "configData", func() { checkConfigMap(d, object.(*corev1.ConfigMap)) })
+		},
+	})
+	registerKind(corev1.SchemeGroupVersion.WithKind("Secret"), kindHandler{
+		decode: jsonDecoder(func() runtime.Object { return &corev1.Secret{} }),
+		validate: func(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object) {
+			timeRule(ctx, req, "configData", func() { checkSecret(d, object.(*corev1.Secret)) })
+		},
+	})
+}
+
+// dataField is a value of a ConfigMap or Secret and the field it is set in.
+type dataField struct {
+	field string
+	value []byte
+}
+
+// configMapData returns the values of configMap sorted by field.
+func configMapData(configMap *corev1.ConfigMap) []dataField {
+	fields := make([]dataField, 0, len(configMap.Data)+len(configMap.BinaryData))
+	for key, value := range configMap.Data {
+		fields = append(fields, dataField{field: "data[" + key + "]", value: []byte(value)})
+	}
+	for key, value := range configMap.BinaryData {
+		fields = append(fields, dataField{field: "binaryData[" + key + "]", value: value})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].field < fields[j].field })
+	return fields
+}
+
+// secretData returns the values of secret sorted by field, stringData is
+// only set on the requests creating or updating the secret.
+func secretData(secret *corev1.Secret) []dataField {
+	fields := make([]dataField, 0, len(secret.Data)+len(secret.StringData))
+	for key, value := range secret.Data {
+		fields = append(fields, dataField{field: "data[" + key + "]", value: value})
+	}
+	for key, value := range secret.StringData {
+		fields = append(fields, dataField{field: "stringData[" + key + "]", value: []byte(value)})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].field < fields[j].field })
+	return fields
+}
+
+// checkData denies ConfigMaps and Secrets whose data exceeds the maximum size
+// of the data policy, or, if scan is set, with values matching a forbidden
+// pattern. Only the field is reported, never the value, which may be secret.
+func checkData(d *denial, kind, name string, fields []dataField, scan bool) {
+	p := &policy.CurrentConfig().ConfigData
+
+	var size int64
+	for _, f := range fields {
+		size += int64(len(f.value))
+	}
+	if max := p.MaxSize; max != nil && size > max.Value() {
+		message := fmt.Sprintf(messages.DataTooLarge, kind, name, resource.NewQuantity(size, resource.BinarySI).String(), max.String())
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: message,
+			Field:   "data",
+		})
+	}
+
+	if !scan {
+		return
+	}
+	for _, f := range fields {
+		if pattern := p.Forbidden(f.value); pattern != "" {
+			message := fmt.Sprintf(messages.DataForbidden, f.field, pattern)
+			d.add(message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueInvalid,
+				Message: message,
+				Field:   f.field,
+			})
+		}
+	}
+}
+
+// checkConfigMap denies ConfigMaps not complying with the data policy.
+func checkConfigMap(d *denial, configMap *corev1.ConfigMap) {
+	checkData(d, "ConfigMap", nameOf(&configMap.ObjectMeta), configMapData(configMap), true)
+}
+
+// checkSecret denies Secrets not complying with the data policy, their values
+// are only scanned when the policy asks for it.
+func checkSecret(d *denial, secret *corev1.Secret) {
+	checkData(d, "Secret", nameOf(&secret.ObjectMeta), secretData(secret), policy.CurrentConfig().ConfigData.ScanSecrets)
+}
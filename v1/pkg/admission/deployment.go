@@ -0,0 +1,162 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func init() {
+	registerKind(appsv1.SchemeGroupVersion.WithKind("Deployment"), kindHandler{
+		decode:        jsonDecoder(func() runtime.Object { return &appsv1.Deployment{} }),
+		requireLabels: func() bool { return true },
+		validate:      validateDeployment,
+		mutate:        mutateDeployment,
+		mutateUpdate:  mutateDeploymentUpdate,
+	})
+}
+
+// validateDeployment denies deployments breaking the rules added below, one
+// per check of the policy. The replicas aren't checked when an autoscaler
+// targets the deployment.
+func validateDeployment(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object) {
+	deployment := object.(*appsv1.Deployment)
+	rules := newRuleSet(ctx, req, d)
+	rules.add("selector", func(d *denial) {
+		checkSelector(d, req, nameOf(&deployment.ObjectMeta), deployment.Spec.Selector, deployment.Spec.Template.Labels)
+	})
+	hpa, err := autoscaledBy(req.Namespace, deployment.Name)
+	if err != nil {
+		d.warn(fmt.Sprintf(messages.AutoscalersUnknown, req.Namespace, err))
+	}
+	// the replicas of the deployments an autoscaler targets are its own
+	if hpa == nil {
+		rules.add("replicas", func(d *denial) { checkReplicas(d, req.Namespace, deployment) })
+	}
+	rules.add("strategy", func(d *denial) { checkStrategy(d, req.Namespace, deployment) })
+	rules.add("podDisruptionBudget", func(d *denial) { checkPodDisruptionBudget(d, req.Namespace, deployment) })
+	rules.add("probes", func(d *denial) { checkProbes(d, req.Namespace, &deployment.Spec.Template.Spec) })
+	rules.add("networkPolicy", func(d *denial) {
+		checkNetworkPolicy(d, req.Namespace, req.Kind.Kind, nameOf(&deployment.ObjectMeta), "spec.template.metadata.labels", deployment.Spec.Template.Labels)
+	})
+	rules.add("references", func(d *denial) {
+		checkReferences(ctx, d, req.Namespace, req.Kind.Kind, nameOf(&deployment.ObjectMeta), "spec.template.spec", &deployment.Spec.Template.Spec)
+	})
+	rules.add("memoryPerCPU", func(d *denial) { checkMemoryPerCPU(d, req.Namespace, req.Kind.Kind, &deployment.Spec.Template.Spec) })
+	rules.add("containerResources", func(d *denial) {
+		checkContainerResources(d, req.Namespace, req.Kind.Kind, &deployment.Spec.Template.Spec)
+	})
+	rules.add("podResources", func(d *denial) {
+		checkPodResources(d, req.Namespace, req.Kind.Kind, nameOf(&deployment.ObjectMeta), &deployment.Spec.Template.Spec)
+	})
+	rules.add("gpus", func(d *denial) {
+		checkGPUs(d, req.Namespace, req.Kind.Kind, nameOf(&deployment.ObjectMeta), &deployment.Spec.Template.Spec)
+		checkNamespaceGPUs(d, req.Namespace, deployment)
+	})
+	rules.add("signatures", func(d *denial) { checkSignatures(ctx, d, req.Namespace, req.Kind.Kind, &deployment.Spec.Template.Spec) })
+	rules.add("vulnerabilities", func(d *denial) {
+		checkVulnerabilities(ctx, d, req.Namespace, req.Kind.Kind, &deployment.Spec.Template.Spec)
+	})
+	rules.run()
+}
+
+// mutateDeployment applies the mutations below to the pod template of
+// deployments, in order, each under the name it is enabled by. The requests
+// aren't reduced in Guaranteed namespaces.
+func mutateDeployment(ctx context.Context, m *mutation, req *v1.AdmissionRequest, object runtime.Object) *v1.AdmissionResponse {
+	deployment := object.(*appsv1.Deployment)
+	namespace, response := workloadNamespace(req.Namespace, m.log)
+	if response != nil {
+		return response
+	}
+	// reduced requests would leave the pods of Guaranteed namespaces
+	// Burstable
+	template := &deployment.Spec.Template
+	if namespace == nil || !policy.GuaranteedQoS(namespace.Labels) {
+		m.apply("requestReduction", func() {
+			m.reduceRequests(req.Namespace, req.Kind.Kind, nameOf(&deployment.ObjectMeta), &template.Spec, deployment.Annotations, &template.ObjectMeta)
+		})
+	}
+	m.mutateWorkload(namespace, &deployment.ObjectMeta, template)
+	m.apply("templateLabels", func() {
+		syncTemplateLabels(req.Namespace, &deployment.ObjectMeta, template, deployment.Spec.Selector)
+	})
+	m.apply("antiAffinity", func() { setAntiAffinity(req.Namespace, template) })
+	m.apply("gpus", func() { placeGPUs(req.Namespace, &template.Spec) })
+	m.apply("termination", func() { setTermination(req.Namespace, template, m.log) })
+	// before the images are rewritten, the upgraded ones are too
+	m.apply("sidecars", func() { updateSidecars(req.Namespace, template, m.log) })
+	m.apply("injectionTemplates", func() { m.inject(req.Namespace, template.Annotations, &template.Spec) })
+	m.apply("managedFinalizer", func() { addManagedFinalizer(&deployment.ObjectMeta, template) })
+	// after the injection, which may add references
+	m.apply("configChecksum", func() {
+		timeRule(ctx, req, "configChecksum", func() { m.setConfigChecksum(ctx, req.Namespace, template) })
+	})
+	// the annotation has to be on the template, the pods are mutated too
+	m.apply("serviceAccountToken", func() { disableTokenAutomount(req.Namespace, template.Annotations, &template.Spec) })
+	m.apply("registryMirrors", func() {
+		timeRule(ctx, req, "registryMirrors", func() { rewriteImages(ctx, &template.Spec, m.log) })
+	})
+	m.apply("imagePullSecrets", func() { addPullSecrets(req.Namespace, &template.Spec) })
+	return nil
+}
+
+// mutateDeploymentUpdate runs the mutations of updated deployments which
+// must hold over their lifetime, such as their propagated labels, sidecars,
+// managed finalizer, GPU placement, config checksum and autoscaled replicas.
+func mutateDeploymentUpdate(ctx context.Context, m *mutation, req *v1.AdmissionRequest, object runtime.Object) *v1.AdmissionResponse {
+	deployment := object.(*appsv1.Deployment)
+	config := policy.CurrentConfig()
+	templateLabels := policy.ConfigFor(req.Namespace).TemplateLabels.Required(req.Namespace)
+	sidecars := len(policy.SidecarsFor(req.Namespace)) > 0
+	checksum := configDigest != nil && policy.ConfigFor(req.Namespace).ConfigChecksum.Required(req.Namespace)
+	gpus := policy.ConfigFor(req.Namespace).GPUs.Places()
+	if len(config.PropagatedLabels) == 0 && !templateLabels && !sidecars && !managedFinalizer && !gpus && !checksum && !config.Autoscaling.KeepReplicas {
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	template := &deployment.Spec.Template
+	if len(config.PropagatedLabels) > 0 {
+		namespace, response := lookupNamespace(req.Namespace, m.log)
+		if response != nil {
+			return response
+		}
+		if namespace != nil {
+			m.apply("propagatedLabels", func() { propagateLabels(namespace, template) })
+		}
+	}
+	if templateLabels {
+		m.apply("templateLabels", func() {
+			syncTemplateLabels(req.Namespace, &deployment.ObjectMeta, template, deployment.Spec.Selector)
+		})
+	}
+	if sidecars {
+		m.apply("sidecars", func() { updateSidecars(req.Namespace, template, m.log) })
+	}
+	m.apply("managedFinalizer", func() { addManagedFinalizer(&deployment.ObjectMeta, template) })
+	if gpus {
+		m.apply("gpus", func() { placeGPUs(req.Namespace, &template.Spec) })
+	}
+	if checksum {
+		m.apply("configChecksum", func() { m.setConfigChecksum(ctx, req.Namespace, template) })
+	}
+	if config.Autoscaling.KeepReplicas && len(req.OldObject.Raw) > 0 {
+		var old appsv1.Deployment
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+			return decodeFailed(req, err, m.log)
+		}
+		m.apply("autoscaling", func() {
+			if warning := keepAutoscaledReplicas(req.Namespace, &old, deployment, m.log); warning != "" {
+				m.warnings = append(m.warnings, warning)
+			}
+		})
+	}
+	return nil
+}
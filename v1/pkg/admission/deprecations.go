@@ -0,0 +1,79 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// checkDeprecations warns about the object of req, of objectMeta, submitted
+// against a deprecated API version, which the apiserver converted to the
+// one the webhook is sent, or carrying deprecated annotations, on itself or
+// its pod template, with how to migrate. The removed ones are warned about
+// or denied depending on the policy.
+func checkDeprecations(d *denial, req *v1.AdmissionRequest, objectMeta *metav1.ObjectMeta) {
+	p := &policy.CurrentConfig().Deprecations
+	if p.KubernetesVersion == "" {
+		return
+	}
+	// the kind requested is only sent when it differs from the one admitted
+	if req.RequestKind != nil {
+		apiVersion := schema.GroupVersion{Group: req.RequestKind.Group, Version: req.RequestKind.Version}.String()
+		if deprecation := policy.DeprecatedAPI(apiVersion, req.RequestKind.Kind); deprecation != nil {
+			checkDeprecation(d, p, deprecation, "apiVersion",
+				fmt.Sprintf(messages.APIRemoved, apiVersion, req.RequestKind.Kind, deprecation.Removed, deprecation.Hint),
+				fmt.Sprintf(messages.APIDeprecated, apiVersion, req.RequestKind.Kind, deprecation.Deprecated, deprecation.Hint))
+		}
+	}
+	checkDeprecatedAnnotations(d, p, "metadata.annotations", objectMeta.Annotations)
+	var workload struct {
+		Spec struct {
+			Template struct {
+				Metadata metav1.ObjectMeta `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	// the objects without a pod template have none of its annotations
+	if json.Unmarshal(req.Object.Raw, &workload) == nil {
+		checkDeprecatedAnnotations(d, p, "spec.template.metadata.annotations", workload.Spec.Template.Metadata.Annotations)
+	}
+}
+
+// checkDeprecatedAnnotations checks the annotations at field, in the order
+// of their keys.
+func checkDeprecatedAnnotations(d *denial, p *policy.DeprecationPolicy, field string, annotations map[string]string) {
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if deprecation := policy.DeprecatedAnnotation(key); deprecation != nil {
+			checkDeprecation(d, p, deprecation, fmt.Sprintf("%s[%s]", field, key),
+				fmt.Sprintf(messages.AnnotationRemoved, key, deprecation.Removed, deprecation.Hint),
+				fmt.Sprintf(messages.AnnotationDeprecated, key, deprecation.Deprecated, deprecation.Hint))
+		}
+	}
+}
+
+// checkDeprecation enforces removed, the message of deprecation at field,
+// when the version of p removed it, and warns with deprecated when it only
+// deprecated it.
+func checkDeprecation(d *denial, p *policy.DeprecationPolicy, deprecation *policy.Deprecation, field, removed, deprecated string) {
+	switch isDeprecated, isRemoved := p.Status(deprecation); {
+	case isRemoved:
+		d.enforce(p.Enforcement, removed, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueNotSupported,
+			Message: removed,
+			Field:   field,
+		})
+	case isDeprecated:
+		d.warn(deprecated)
+	}
+}
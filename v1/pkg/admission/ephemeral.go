@@ -0,0 +1,123 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ephemeralContainersObject is the object of the ephemeralcontainers
+// subresource of a pod: the Pod since Kubernetes 1.23, an
+// EphemeralContainers before.
+type ephemeralContainersObject struct {
+	metav1.ObjectMeta   `json:"metadata,omitempty"`
+	EphemeralContainers []corev1.EphemeralContainer `json:"ephemeralContainers,omitempty"`
+	Spec                struct {
+		EphemeralContainers []corev1.EphemeralContainer `json:"ephemeralContainers,omitempty"`
+	} `json:"spec,omitempty"`
+}
+
+// containers returns the ephemeral containers of o and the path of their
+// field.
+func (o *ephemeralContainersObject) containers(kind string) ([]corev1.EphemeralContainer, string) {
+	if kind == "Pod" {
+		return o.Spec.EphemeralContainers, "spec.ephemeralContainers"
+	}
+	return o.EphemeralContainers, "ephemeralContainers"
+}
+
+// validateEphemeralContainers checks the ephemeral containers added to a pod,
+// e.g. by kubectl debug, against the ephemeral container policy: none may be
+// added in its blocked namespaces, and the others must run an allowed image
+// and, if the policy forbids it, mustn't be privileged.
+func validateEphemeralContainers(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	var object, old ephemeralContainersObject
+	if err := json.Unmarshal(req.Object.Raw, &object); err != nil {
+		return decodeFailed(req, err, log)
+	}
+	if len(req.OldObject.Raw) > 0 {
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+			return decodeFailed(req, err, log)
+		}
+	}
+
+	log.Infof(messages.AdmissionBegin, req.Namespace, req.Kind.Kind, req.Name)
+
+	if policy.Exempt(object.Labels) || !policy.ValidationRequired(policy.Ignored(), &object.ObjectMeta, log) {
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// ephemeral containers can't be changed or removed once added
+	existing := map[string]bool{}
+	oldContainers, _ := old.containers(req.Kind.Kind)
+	for _, container := range oldContainers {
+		existing[container.Name] = true
+	}
+	p := &policy.CurrentConfig().EphemeralContainers
+	d := newDenial(req)
+	containers, field := object.containers(req.Kind.Kind)
+	for i := range containers {
+		container := &containers[i].EphemeralContainerCommon
+		if existing[container.Name] {
+			continue
+		}
+		checkEphemeralContainer(&d, p, req.Namespace, container, fmt.Sprintf("%s[%d]", field, i))
+	}
+	if response := d.response(req, req.Name); response != nil {
+		return response
+	}
+	return d.allowed()
+}
+
+// checkEphemeralContainer denies container, added to a pod in namespace,
+// when p doesn't allow it.
+func checkEphemeralContainer(d *denial, p *policy.EphemeralContainerPolicy, namespace string, container *corev1.EphemeralContainerCommon, field string) {
+	if p.Blocked(namespace) {
+		message := fmt.Sprintf(messages.EphemeralNotAllowed, container.Name, namespace)
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueNotSupported,
+			Message: message,
+			Field:   field,
+		})
+		return
+	}
+	if !p.ImageAllowed(container.Image) {
+		message := fmt.Sprintf(messages.EphemeralImageDenied, container.Image)
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueNotSupported,
+			Message: message,
+			Field:   field + ".image",
+		})
+	}
+	if !p.ForbidPrivileged || container.SecurityContext == nil {
+		return
+	}
+	securityContext := container.SecurityContext
+	forbidden := func(what, subfield string) {
+		message := fmt.Sprintf(messages.EphemeralPrivileged, container.Name, what)
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: message,
+			Field:   field + ".securityContext." + subfield,
+		})
+	}
+	if securityContext.Privileged != nil && *securityContext.Privileged {
+		forbidden("be privileged", "privileged")
+	}
+	if securityContext.AllowPrivilegeEscalation != nil && *securityContext.AllowPrivilegeEscalation {
+		forbidden("allow privilege escalation", "allowPrivilegeEscalation")
+	}
+	if securityContext.RunAsUser != nil && *securityContext.RunAsUser == 0 {
+		forbidden("run as root", "runAsUser")
+	}
+	if securityContext.Capabilities != nil && len(securityContext.Capabilities.Add) > 0 {
+		forbidden("add capabilities", "capabilities.add")
+	}
+}
@@ -0,0 +1,47 @@
+package admission
+
+import (
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var managedFinalizer bool
+
+// SetManagedFinalizer makes the Deployments the webhook manages get the
+// policy.FinalizerManaged, which a controller has to remove once it recorded
+// their deletion, or they are never deleted.
+func SetManagedFinalizer(enabled bool) {
+	managedFinalizer = enabled
+}
+
+// managedTemplate reports whether the webhook manages the pod template: it
+// records the version of sidecars of the sidecars policy or asks for
+// injection templates.
+func managedTemplate(template *corev1.PodTemplateSpec) bool {
+	if policy.LookupValue(template.Annotations, policy.AnnotationInjectKey) != "" {
+		return true
+	}
+	for key := range template.Annotations {
+		if _, ok := policy.TrimKeyPrefix(key, policy.AnnotationSidecarVersionPrefix); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addManagedFinalizer adds the policy.FinalizerManaged to the workload of
+// objectMeta when the webhook manages its pod template, unless it is being
+// deleted: the update removing the finalizer mustn't add it back. The
+// workloads with the legacy finalizer keep it, the controller removes both.
+func addManagedFinalizer(objectMeta *metav1.ObjectMeta, template *corev1.PodTemplateSpec) {
+	if !managedFinalizer || objectMeta.DeletionTimestamp != nil || !managedTemplate(template) {
+		return
+	}
+	for _, finalizer := range objectMeta.Finalizers {
+		if policy.IsKey(finalizer, policy.FinalizerManaged) {
+			return
+		}
+	}
+	objectMeta.Finalizers = append(objectMeta.Finalizers, policy.FinalizerManaged)
+}
@@ -0,0 +1,39 @@
+package admission
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// auditFreezeOverride is the audit annotation of the changes overriding a
+// freeze window.
+const auditFreezeOverride = "freeze-override"
+
+// checkFreeze denies the creation and update of objects req makes while a
+// freeze window of the policy is open on their namespace, unless objectMeta
+// is annotated with the reason to override it. Overrides are warned about
+// and recorded in the audit log with the user and the reason.
+func checkFreeze(d *denial, req *v1.AdmissionRequest, objectMeta *metav1.ObjectMeta, log Logger) {
+	window, closes := policy.CurrentConfig().OpenFreezeWindow(req.Namespace, req.Kind.Kind, policy.Now())
+	if window == nil {
+		return
+	}
+	if reason := policy.FreezeOverride(objectMeta.Annotations); reason != "" {
+		message := fmt.Sprintf(messages.FreezeOverridden, window.Name, req.UserInfo.Username, reason)
+		log.Warningf("%s", message)
+		d.warn(message)
+		d.audit(auditFreezeOverride, message)
+		return
+	}
+	message := fmt.Sprintf(messages.FreezeWindowOpen, req.Kind.Kind, nameOf(objectMeta), req.Namespace, window.Name, closes.Format(time.RFC3339), policy.AnnotationFreezeOverrideKey)
+	d.add(message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueRequired,
+		Message: message,
+		Field:   "metadata.annotations[" + policy.AnnotationFreezeOverrideKey + "]",
+	})
+}
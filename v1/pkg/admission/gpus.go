@@ -0,0 +1,148 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// gpuCount returns the GPUs, the resources of p, the pods of spec request:
+// the limits of their containers, which extended resources require and
+// default the requests to, or those of the init container requesting the
+// most when it is more.
+func gpuCount(p *policy.GPUPolicy, spec *corev1.PodSpec) int64 {
+	count := func(container *corev1.Container) int64 {
+		var gpus int64
+		for _, name := range p.ResourceNames() {
+			quantity, ok := container.Resources.Limits[name]
+			if !ok {
+				quantity = container.Resources.Requests[name]
+			}
+			gpus += quantity.Value()
+		}
+		return gpus
+	}
+	var gpus int64
+	for i := range spec.Containers {
+		gpus += count(&spec.Containers[i])
+	}
+	for i := range spec.InitContainers {
+		if init := count(&spec.InitContainers[i]); init > gpus {
+			gpus = init
+		}
+	}
+	return gpus
+}
+
+// placeGPUs gives the pod spec of a workload in namespace requesting GPUs
+// the nodeSelector and tolerations of the GPU node pools of the gpus policy,
+// keeping the node labels it selects and the taints it tolerates already.
+func placeGPUs(namespace string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).GPUs
+	if !p.Places() || gpuCount(p, spec) == 0 {
+		return
+	}
+	for key, value := range p.NodeSelector {
+		if _, ok := spec.NodeSelector[key]; ok {
+			continue
+		}
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		spec.NodeSelector[key] = value
+	}
+	for i := range p.Tolerations {
+		if !tolerates(spec.Tolerations, &p.Tolerations[i]) {
+			spec.Tolerations = append(spec.Tolerations, p.Tolerations[i])
+		}
+	}
+}
+
+// tolerates reports whether tolerations have toleration, by key, operator,
+// value and effect.
+func tolerates(tolerations []corev1.Toleration, toleration *corev1.Toleration) bool {
+	for i := range tolerations {
+		if tolerations[i].MatchToleration(toleration) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGPUs warns about or denies, depending on the gpus policy, the pods of
+// the object of kind named name in namespace requesting more GPUs than the
+// limit of the namespace allows per pod.
+func checkGPUs(d *denial, namespace, kind, name string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).GPUs
+	limit := p.Limit(namespace)
+	if limit == nil || limit.PerPod == 0 {
+		return
+	}
+	gpus := gpuCount(p, spec)
+	if gpus <= limit.PerPod {
+		return
+	}
+	field := "spec.template.spec.containers"
+	if kind == "Pod" {
+		field = "spec.containers"
+	}
+	message := fmt.Sprintf(messages.GPUsPerPodExceeded, kind, name, gpus, limit.PerPod, namespace)
+	d.enforce(p.Enforcement, message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueInvalid,
+		Message: message,
+		Field:   field,
+	})
+}
+
+// checkNamespaceGPUs warns about or denies, depending on the gpus policy,
+// the deployments in namespace whose replicas bring the GPUs the replicas of
+// the Deployments of the namespace request above the limit of the
+// namespace. The Deployments are looked up with the lister of
+// SetDeploymentLister, they aren't checked until it is set. The quota of
+// the namespace would leave their pods pending instead, with the error in
+// the events of their ReplicaSet.
+func checkNamespaceGPUs(d *denial, namespace string, deployment *appsv1.Deployment) {
+	p := &policy.ConfigFor(namespace).GPUs
+	limit := p.Limit(namespace)
+	if deploymentLister == nil || limit == nil || limit.PerNamespace == 0 {
+		return
+	}
+	gpus := deploymentReplicas(deployment) * gpuCount(p, &deployment.Spec.Template.Spec)
+	if gpus == 0 {
+		return
+	}
+	list, err := deploymentLister(namespace)
+	if err != nil {
+		// the lookup failing must not block workloads
+		d.warn(fmt.Sprintf(messages.GPUsNotChecked, namespace, err))
+		return
+	}
+	for _, other := range list {
+		// the deployment replaces its previous version
+		if other.Name != deployment.Name {
+			gpus += deploymentReplicas(other) * gpuCount(p, &other.Spec.Template.Spec)
+		}
+	}
+	if gpus <= limit.PerNamespace {
+		return
+	}
+	message := fmt.Sprintf(messages.GPUsPerNamespace, nameOf(&deployment.ObjectMeta), namespace, gpus, limit.PerNamespace)
+	d.enforce(p.Enforcement, message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueInvalid,
+		Message: message,
+		Field:   "spec.replicas",
+	})
+}
+
+// deploymentReplicas returns the replicas of deployment, which runs one
+// without replicas.
+func deploymentReplicas(deployment *appsv1.Deployment) int64 {
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+	return int64(*deployment.Spec.Replicas)
+}
@@ -0,0 +1,64 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/cnych/admission-webhook/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DigestResolver returns the digest the tag of an image points to.
+type DigestResolver func(ctx context.Context, image string) (string, error)
+
+var digests DigestResolver
+
+// SetDigestResolver enables pinning images to the digest of their tag,
+// resolved by resolver, which should cache the digests and time out quickly.
+func SetDigestResolver(resolver DigestResolver) {
+	digests = resolver
+}
+
+// rewriteImages rewrites the images of the containers and init containers of
+// spec to the registry mirrors of the policy and pins them to the digest of
+// their tag if enabled. Images whose digest can't be resolved are left
+// unpinned.
+func rewriteImages(ctx context.Context, spec *corev1.PodSpec, log Logger) {
+	var containers []*corev1.Container
+	for i := range spec.InitContainers {
+		containers = append(containers, &spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		containers = append(containers, &spec.Containers[i])
+	}
+	// the digests are resolved on the ruleWorkers, every container only
+	// sets its own image
+	forEach(len(containers), func(i int) {
+		image := policy.MirrorImage(containers[i].Image)
+		if digests != nil && image != "" && !registry.Pinned(image) {
+			if digest, err := digests(ctx, image); err != nil {
+				log.Warningf(messages.DigestUnresolved, image, err)
+			} else {
+				image += "@" + digest
+			}
+		}
+		containers[i].Image = image
+	})
+}
+
+// podSpecImages calls f with the image and the field path of the containers
+// and init containers of spec, the pod spec of an object of kind.
+func podSpecImages(kind string, spec *corev1.PodSpec, f func(image, field string)) {
+	prefix := "spec.template.spec"
+	if kind == "Pod" {
+		prefix = "spec"
+	}
+	for i, container := range spec.InitContainers {
+		f(container.Image, fmt.Sprintf("%s.initContainers[%d].image", prefix, i))
+	}
+	for i, container := range spec.Containers {
+		f(container.Image, fmt.Sprintf("%s.containers[%d].image", prefix, i))
+	}
+}
@@ -0,0 +1,76 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func init() {
+	registerKind(networkingv1.SchemeGroupVersion.WithKind("Ingress"), kindHandler{
+		decode: jsonDecoder(func() runtime.Object { return &networkingv1.Ingress{} }),
+		validate: func(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object) {
+			timeRule(ctx, req, "ingress", func() { checkIngress(d, object.(*networkingv1.Ingress)) })
+		},
+	})
+}
+
+// the ingress class annotation predating spec.ingressClassName
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+// checkIngress denies ingresses not complying with the ingress policy.
+func checkIngress(d *denial, ingress *networkingv1.Ingress) {
+	p := &policy.CurrentConfig().Ingress
+
+	tlsHosts := map[string]bool{}
+	for _, tls := range ingress.Spec.TLS {
+		for _, host := range tls.Hosts {
+			tlsHosts[host] = true
+		}
+	}
+	for i, rule := range ingress.Spec.Rules {
+		if rule.Host == "" {
+			continue
+		}
+		if !p.HostAllowed(rule.Host) {
+			message := fmt.Sprintf(messages.IngressHostNotAllowed, rule.Host)
+			d.add(message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueNotSupported,
+				Message: message,
+				Field:   fmt.Sprintf("spec.rules[%d].host", i),
+			})
+		}
+		if p.RequireTLS && !tlsHosts[rule.Host] {
+			message := fmt.Sprintf(messages.IngressHostWithoutTLS, rule.Host)
+			d.add(message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueRequired,
+				Message: message,
+				Field:   "spec.tls",
+			})
+		}
+	}
+
+	if p.RequireIngressClass && ingress.Spec.IngressClassName == nil && ingress.Annotations[ingressClassAnnotation] == "" {
+		d.add(messages.IngressClassMissing, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueRequired,
+			Message: messages.IngressClassMissing,
+			Field:   "spec.ingressClassName",
+		})
+	}
+	for _, annotation := range p.RequiredAnnotations {
+		if _, ok := ingress.Annotations[annotation]; !ok {
+			message := fmt.Sprintf(messages.AnnotationMissing, annotation)
+			d.add(message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueRequired,
+				Message: message,
+				Field:   fmt.Sprintf("metadata.annotations[%s]", annotation),
+			})
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package admission
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// inject adds the volumes and mounts of the injection templates the pod
+// spec in namespace asks for with the inject annotation of annotations, the
+// annotations of its pod template or pod. It is idempotent, the volumes and
+// mounts the spec has already are kept.
+func (m *mutation) inject(namespace string, annotations map[string]string, spec *corev1.PodSpec) {
+	value, ok := policy.Lookup(annotations, policy.AnnotationInjectKey)
+	if !ok {
+		return
+	}
+	templates, unknown := policy.InjectionTemplatesFor(namespace, value)
+	if len(unknown) > 0 {
+		warning := fmt.Sprintf(messages.InjectionUnknown, strings.Join(unknown, ", "), namespace)
+		m.log.Warningf("%s", warning)
+		m.warnings = append(m.warnings, warning)
+	}
+	for _, t := range templates {
+		for _, volume := range t.Volumes {
+			if !hasVolume(spec, volume.Name) {
+				spec.Volumes = append(spec.Volumes, *volume.DeepCopy())
+			}
+		}
+		for i := range spec.InitContainers {
+			if t.MountsInto(spec.InitContainers[i].Name, true) {
+				addMounts(&spec.InitContainers[i], t.VolumeMounts)
+			}
+		}
+		for i := range spec.Containers {
+			if t.MountsInto(spec.Containers[i].Name, false) {
+				addMounts(&spec.Containers[i], t.VolumeMounts)
+			}
+		}
+	}
+}
+
+func hasVolume(spec *corev1.PodSpec, name string) bool {
+	for _, volume := range spec.Volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addMounts adds the mounts to container, but those of a volume it mounts
+// already or at a path it mounts another volume at.
+func addMounts(container *corev1.Container, mounts []corev1.VolumeMount) {
+	for _, mount := range mounts {
+		taken := false
+		for _, existing := range container.VolumeMounts {
+			if existing.Name == mount.Name || existing.MountPath == mount.MountPath {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+		}
+	}
+}
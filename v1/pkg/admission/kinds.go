@@ -0,0 +1,212 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/patch"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// decoder decodes the raw object of a request. The objects it returns embed
+// their ObjectMeta like every Kubernetes type.
+type decoder func(raw []byte) (runtime.Object, error)
+
+// jsonDecoder decodes the JSON of requests into the objects newObject
+// returns, the decoder of most kinds.
+func jsonDecoder(newObject func() runtime.Object) decoder {
+	return func(raw []byte) (runtime.Object, error) {
+		object := newObject()
+		if err := json.Unmarshal(raw, object); err != nil {
+			return nil, err
+		}
+		return object, nil
+	}
+}
+
+// kindHandler is how the rules handle the objects of one kind. Every kind
+// registers its handler from a file of its own, validate and mutate only
+// look them up.
+type kindHandler struct {
+	decode decoder
+	// requireLabels tells whether new objects must carry the
+	// policy.RequiredLabels, they needn't when nil
+	requireLabels func() bool
+	// validate adds the violations of object, created or updated by req,
+	// to d. Objects of the kind aren't validated when nil.
+	validate func(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object)
+	// mutate mutates object, a copy of the object created by req. A non-nil
+	// response answers req without mutations. Objects of the kind aren't
+	// mutated when nil.
+	mutate func(ctx context.Context, m *mutation, req *v1.AdmissionRequest, object runtime.Object) *v1.AdmissionResponse
+	// mutateUpdate mutates object, a copy of the object updated by req, with
+	// the mutations which must hold over its lifetime. A non-nil response
+	// answers req without mutations. Updates of the kind aren't mutated when
+	// nil.
+	mutateUpdate func(ctx context.Context, m *mutation, req *v1.AdmissionRequest, object runtime.Object) *v1.AdmissionResponse
+	// admittedThrough returns the object the object of objectMeta is
+	// admitted through, such as the Deployment owning a ReplicaSet, empty
+	// when it is admitted on its own. Every object of the kind is when nil.
+	admittedThrough func(objectMeta *metav1.ObjectMeta) string
+}
+
+var kinds = map[schema.GroupVersionKind]*kindHandler{}
+
+// registerKind registers the handler of the objects of gvk, from the init
+// function of the file of the kind.
+func registerKind(gvk schema.GroupVersionKind, handler kindHandler) {
+	if _, ok := kinds[gvk]; ok {
+		panic(fmt.Sprintf("kind %s registered twice", gvk))
+	}
+	kinds[gvk] = &handler
+}
+
+// lookupKind returns the handler of the kind of req, nil when it isn't
+// supported.
+func lookupKind(req *v1.AdmissionRequest) *kindHandler {
+	return kinds[schema.GroupVersionKind{Group: req.Kind.Group, Version: req.Kind.Version, Kind: req.Kind.Kind}]
+}
+
+// decodeObject decodes raw with the decoder of the handler, returning the
+// metadata of the object too.
+func (h *kindHandler) decodeObject(raw []byte) (runtime.Object, *metav1.ObjectMeta, error) {
+	object, err := h.decode(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	objectMeta, err := metadataOf(object)
+	if err != nil {
+		return nil, nil, err
+	}
+	return object, objectMeta, nil
+}
+
+// metadataOf returns the ObjectMeta object embeds.
+func metadataOf(object runtime.Object) (*metav1.ObjectMeta, error) {
+	if accessor, ok := object.(metav1.ObjectMetaAccessor); ok {
+		if objectMeta, ok := accessor.GetObjectMeta().(*metav1.ObjectMeta); ok {
+			return objectMeta, nil
+		}
+	}
+	return nil, fmt.Errorf("%T has no ObjectMeta", object)
+}
+
+// decodeMetadata decodes the metadata of raw, an object of any kind, CRDs
+// included: the object is decoded as maps, without its Go type.
+func decodeMetadata(raw []byte) (*metav1.ObjectMeta, error) {
+	object := &unstructured.Unstructured{}
+	if err := json.Unmarshal(raw, &object.Object); err != nil {
+		return nil, err
+	}
+	return &metav1.ObjectMeta{
+		Name:            object.GetName(),
+		GenerateName:    object.GetGenerateName(),
+		Namespace:       object.GetNamespace(),
+		Labels:          object.GetLabels(),
+		Annotations:     object.GetAnnotations(),
+		OwnerReferences: object.GetOwnerReferences(),
+		ManagedFields:   object.GetManagedFields(),
+	}, nil
+}
+
+// nameOf returns the name of the object of objectMeta for logs and messages.
+// Objects created with generateName only get their name once admitted, they
+// are named by the prefix followed by *, such as web-*.
+func nameOf(objectMeta *metav1.ObjectMeta) string {
+	if objectMeta.Name == "" && objectMeta.GenerateName != "" {
+		return objectMeta.GenerateName + "*"
+	}
+	return objectMeta.Name
+}
+
+// ObjectName returns the name of the object req is about for logs and
+// messages, see nameOf for the objects created with generateName, whose
+// requests carry no name.
+func ObjectName(req *v1.AdmissionRequest) string {
+	if req.Name != "" {
+		return req.Name
+	}
+	objectMeta, err := decodeMetadata(admittedObject(req))
+	if err != nil {
+		return ""
+	}
+	return nameOf(objectMeta)
+}
+
+// mutation is what the mutations of an object share: the annotations to
+// set on it, the warnings for the user and, with the provenance policy, the
+// rules which changed it.
+type mutation struct {
+	log         Logger
+	annotations map[string]string
+	warnings    []string
+	// object is the object the rules mutate when they are recorded, nil
+	// otherwise
+	object  runtime.Object
+	applied []string
+}
+
+// reduceRequests reduces the requests of the containers of spec, the init
+// containers too since they drive the requests of the pods as much, by the
+// percentage the policy or the annotations of the object set, once: the
+// object is marked with the percentage, so a reinvocation of the webhook on
+// its own output doesn't reduce them again, and so is template, the pod
+// template of spec for workloads, nil for pods, so that their pods aren't
+// reduced a second time either. A reduction lowering the QoS class of the
+// pods of the object of kind named name in namespace, such as Guaranteed
+// pods whose requests drop below their limits, is warned about and, in the
+// namespaces of the qosClass policy, skipped.
+func (m *mutation) reduceRequests(namespace, kind, name string, spec *corev1.PodSpec, annotations map[string]string, template *metav1.ObjectMeta) {
+	if _, reduced := policy.Lookup(annotations, policy.AnnotationRequestsReducedKey); reduced {
+		return
+	}
+	if template != nil {
+		if _, reduced := policy.Lookup(template.Annotations, policy.AnnotationRequestsReducedKey); reduced {
+			return
+		}
+	}
+	percent, warning := policy.RequestPercent(annotations)
+	if warning != "" {
+		m.log.Warningf("%s", warning)
+		m.warnings = append(m.warnings, warning)
+	}
+	if percent >= 100 {
+		return
+	}
+	before := qosClass(spec)
+	reduced := spec.DeepCopy()
+	patch.ResourceReduction(reduced.InitContainers, percent)
+	patch.ResourceReduction(reduced.Containers, percent)
+	if after := qosClass(reduced); qosRank(after) < qosRank(before) {
+		kept := policy.ConfigFor(namespace).QoSClass.Required(namespace)
+		if observeQoSChange != nil {
+			observeQoSChange(kind, before, after, kept)
+		}
+		warning := fmt.Sprintf(messages.QoSClassLowered, percent, kind, name, before, after, policy.AnnotationRequestReductionKey)
+		if kept {
+			warning = fmt.Sprintf(messages.QoSClassKept, percent, kind, name, before, after)
+		}
+		m.log.Warningf("%s", warning)
+		m.warnings = append(m.warnings, warning)
+		if kept {
+			return
+		}
+	}
+	spec.InitContainers, spec.Containers = reduced.InitContainers, reduced.Containers
+	m.annotations[policy.AnnotationRequestsReducedKey] = strconv.FormatInt(percent, 10)
+	if template != nil {
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		template.Annotations[policy.AnnotationRequestsReducedKey] = strconv.FormatInt(percent, 10)
+	}
+}
@@ -0,0 +1,136 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/patch"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func init() {
+	registerKind(corev1.SchemeGroupVersion.WithKind("Namespace"), kindHandler{
+		decode: jsonDecoder(func() runtime.Object { return &corev1.Namespace{} }),
+		mutate: mutateNamespace,
+	})
+}
+
+// mutateNamespace sets the default labels and annotations of the policy on
+// new namespaces.
+func mutateNamespace(ctx context.Context, m *mutation, req *v1.AdmissionRequest, object runtime.Object) *v1.AdmissionResponse {
+	namespace := object.(*corev1.Namespace)
+	// namespaces created with generateName are matched by the prefix
+	name := namespace.Name
+	if name == "" {
+		name = namespace.GenerateName
+	}
+	defaults := policy.NamespaceDefaultsFor(name)
+	if defaults == nil {
+		m.log.Infof(messages.NamespaceNoDefaults, nameOf(&namespace.ObjectMeta))
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	m.apply("namespaceDefaults", func() {
+		patch.AddMissing(&namespace.Labels, defaults.Labels)
+		// annotations set by the creator win over the defaults
+		for key, value := range defaults.Annotations {
+			if _, ok := namespace.Annotations[key]; !ok {
+				m.annotations[key] = value
+			}
+		}
+	})
+	return nil
+}
+
+// NamespaceGetter returns a namespace by name.
+type NamespaceGetter func(name string) (*corev1.Namespace, error)
+
+// ErrNamespaceCacheCold is the error, possibly wrapped, of NamespaceGetters
+// backed by a cache which hasn't synced yet or doesn't have the namespace
+// yet, such as one created just before the objects in it.
+var ErrNamespaceCacheCold = errors.New("namespace cache is cold")
+
+var (
+	namespaces         NamespaceGetter
+	namespacesFailOpen = true
+)
+
+// SetNamespaceGetter sets where namespaces are looked up, which should be a
+// cache rather than the API server. Rules depending on the labels of the
+// namespace of an object don't apply until it is set.
+func SetNamespaceGetter(getter NamespaceGetter) {
+	namespaces = getter
+}
+
+// SetNamespaceFailOpen sets whether the requests whose namespace the cache
+// doesn't have yet are admitted without the rules depending on it, true by
+// default, or answered with 503 for the client to retry once the cache has
+// caught up.
+func SetNamespaceFailOpen(failOpen bool) {
+	namespacesFailOpen = failOpen
+}
+
+// lookupNamespace returns the namespace name, nil when it can't be looked
+// up. A non-nil response answers the request instead when the namespace
+// cache is cold and doesn't fail open.
+func lookupNamespace(name string, log Logger) (*corev1.Namespace, *v1.AdmissionResponse) {
+	if namespaces == nil {
+		return nil, nil
+	}
+	namespace, err := namespaces(name)
+	switch {
+	case err == nil:
+		return namespace, nil
+	case errors.Is(err, ErrNamespaceCacheCold) && !namespacesFailOpen:
+		log.Warningf(messages.NamespaceNotCached, name, err)
+		return nil, failure(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, fmt.Sprintf(messages.NamespaceNotCached, name, err))
+	default:
+		log.Warningf(messages.NamespaceUnknown, name, err)
+		return nil, nil
+	}
+}
+
+// copyNamespaceMetadata copies the labels and annotations of the namespace
+// metadata policy from namespace onto the workload of objectMeta and its pod
+// template, unless they are set there already. The annotations of the
+// workload are added to annotations, which are set with the status.
+func copyNamespaceMetadata(namespace *corev1.Namespace, objectMeta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, annotations map[string]string) {
+	p := &policy.CurrentConfig().NamespaceMetadata
+	copiedLabels := pick(namespace.Labels, p.Labels)
+	copiedAnnotations := pick(namespace.Annotations, p.Annotations)
+
+	for key, value := range copiedAnnotations {
+		if _, ok := objectMeta.Annotations[key]; !ok {
+			annotations[key] = value
+		}
+	}
+	patch.AddMissing(&objectMeta.Labels, copiedLabels)
+	patch.AddMissing(&template.Labels, copiedLabels)
+	patch.AddMissing(&template.Annotations, copiedAnnotations)
+}
+
+// propagateLabels keeps the labels of template propagated from namespace in
+// sync with it.
+func propagateLabels(namespace *corev1.Namespace, template *corev1.PodTemplateSpec) {
+	keys := policy.CurrentConfig().PropagatedLabels
+	patch.Sync(&template.Labels, namespace.Labels, keys)
+}
+
+// pick returns the entries of values with one of keys.
+func pick(values map[string]string, keys []string) map[string]string {
+	picked := map[string]string{}
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			picked[key] = value
+		}
+	}
+	return picked
+}
@@ -0,0 +1,61 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NetworkPolicyLister lists the NetworkPolicies of a namespace.
+type NetworkPolicyLister func(namespace string) ([]*networkingv1.NetworkPolicy, error)
+
+var networkPolicies NetworkPolicyLister
+
+// SetNetworkPolicyLister sets where the NetworkPolicies are looked up, which
+// should be a cache rather than the API server. Workloads and Services aren't
+// checked for a NetworkPolicy until it is set.
+func SetNetworkPolicyLister(lister NetworkPolicyLister) {
+	networkPolicies = lister
+}
+
+// checkNetworkPolicy warns about or denies, depending on the policy, the
+// object of kind named name in namespace whose pods, labeled podLabels, none
+// of the NetworkPolicies of the namespace selects, so their traffic isn't
+// restricted at all. field is the path of podLabels. The pods of Services
+// carry the labels of their selector and maybe more, the NetworkPolicies
+// selecting them by the others aren't seen.
+func checkNetworkPolicy(d *denial, namespace, kind, name, field string, podLabels map[string]string) {
+	if networkPolicies == nil {
+		return
+	}
+	p := &policy.ConfigFor(namespace).NetworkPolicies
+	if !p.Required(namespace) {
+		return
+	}
+
+	list, err := networkPolicies(namespace)
+	if err != nil {
+		// the lookup failing must not block workloads
+		d.warn(fmt.Sprintf(messages.NetworkPoliciesUnknown, namespace, err))
+		return
+	}
+	for _, networkPolicy := range list {
+		// an empty podSelector, such as the one of a default deny, selects
+		// all the pods of the namespace
+		selector, err := metav1.LabelSelectorAsSelector(&networkPolicy.Spec.PodSelector)
+		if err == nil && selector.Matches(labels.Set(podLabels)) {
+			return
+		}
+	}
+
+	message := fmt.Sprintf(messages.NetworkPolicyMissing, kind, name, namespace)
+	d.enforce(p.Enforcement, message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueNotFound,
+		Message: message,
+		Field:   field,
+	})
+}
@@ -0,0 +1,127 @@
+package admission
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ruleWorkers is how many rules or lookups of a request run at once.
+var ruleWorkers = 1
+
+// SetRuleWorkers sets how many of the validation rules of a workload run at
+// once, and how many lookups of the images of a rule or of the digests of its
+// mutation: the registry, signature and vulnerability lookups of a request
+// then add the latency of the slowest rather than their sum. With 1, the
+// default, they run one after the other. The response is the same either way.
+func SetRuleWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	ruleWorkers = workers
+}
+
+// forEach calls f with every index from 0 to n-1 on at most ruleWorkers
+// goroutines and returns once all the calls returned. A call panicking
+// panics forEach, rather than the goroutine it ran on.
+func forEach(n int, f func(i int)) {
+	workers := ruleWorkers
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	var (
+		wg        sync.WaitGroup
+		once      sync.Once
+		recovered interface{}
+	)
+	indexes := make(chan int)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { recovered = r })
+					// the indexes left must still be taken for forEach to
+					// return
+					for range indexes {
+					}
+				}
+			}()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	if recovered != nil {
+		panic(recovered)
+	}
+}
+
+// ruleSet runs the validation rules of a request, which only read the object
+// and report to a denial of their own, on the ruleWorkers. The denials are
+// merged in the order the rules were added, so the violations and warnings
+// don't depend on the order the rules finish in.
+type ruleSet struct {
+	ctx   context.Context
+	req   *v1.AdmissionRequest
+	d     *denial
+	names []string
+	rules []func(d *denial)
+}
+
+// newRuleSet returns the rules of req, reporting to d once run.
+func newRuleSet(ctx context.Context, req *v1.AdmissionRequest, d *denial) *ruleSet {
+	return &ruleSet{ctx: ctx, req: req, d: d}
+}
+
+// add adds rule, timed as name.
+func (s *ruleSet) add(name string, rule func(d *denial)) {
+	s.names = append(s.names, name)
+	s.rules = append(s.rules, rule)
+}
+
+// run runs the rules and merges their denials into the one of the request.
+func (s *ruleSet) run() {
+	denials := make([]denial, len(s.rules))
+	forEach(len(s.rules), func(i int) {
+		denials[i].strict = s.d.strict
+		timeRule(s.ctx, s.req, s.names[i], func() { s.rules[i](&denials[i]) })
+	})
+	for i := range denials {
+		s.d.merge(&denials[i])
+	}
+}
+
+// lookupImages calls lookup with the image and the field path of the
+// containers and init containers of spec, the pod spec of an object of
+// kind, like podSpecImages but on the ruleWorkers, each reporting to a
+// denial of its own merged into d in the order of the containers.
+func lookupImages(d *denial, kind string, spec *corev1.PodSpec, lookup func(d *denial, image, field string)) {
+	var images, fields []string
+	podSpecImages(kind, spec, func(image, field string) {
+		images = append(images, image)
+		fields = append(fields, field)
+	})
+	denials := make([]denial, len(images))
+	forEach(len(images), func(i int) {
+		denials[i].strict = d.strict
+		lookup(&denials[i], images[i], fields[i])
+	})
+	for i := range denials {
+		d.merge(&denials[i])
+	}
+}
@@ -0,0 +1,63 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PodDisruptionBudgetLister lists the PodDisruptionBudgets of a namespace.
+type PodDisruptionBudgetLister func(namespace string) ([]*policyv1.PodDisruptionBudget, error)
+
+var podDisruptionBudgets PodDisruptionBudgetLister
+
+// SetPodDisruptionBudgetLister sets where the PodDisruptionBudgets are looked
+// up, which should be a cache rather than the API server. Deployments aren't
+// checked for a budget until it is set.
+func SetPodDisruptionBudgetLister(lister PodDisruptionBudgetLister) {
+	podDisruptionBudgets = lister
+}
+
+// checkPodDisruptionBudget warns about or denies, depending on the policy,
+// deployments in namespace requiring a PodDisruptionBudget none of the
+// budgets of the namespace selects the pods of.
+func checkPodDisruptionBudget(d *denial, namespace string, deployment *appsv1.Deployment) {
+	if podDisruptionBudgets == nil {
+		return
+	}
+	p := &policy.ConfigFor(namespace).PodDisruptionBudgets
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	if !p.Required(namespace, replicas) {
+		return
+	}
+
+	budgets, err := podDisruptionBudgets(namespace)
+	if err != nil {
+		// the lookup failing must not block deployments
+		d.warn(fmt.Sprintf(messages.PDBLookupFailed, namespace, err))
+		return
+	}
+	podLabels := labels.Set(deployment.Spec.Template.Labels)
+	for _, budget := range budgets {
+		selector, err := metav1.LabelSelectorAsSelector(budget.Spec.Selector)
+		// a budget without a selector selects no pods
+		if err == nil && budget.Spec.Selector != nil && selector.Matches(podLabels) {
+			return
+		}
+	}
+
+	message := fmt.Sprintf(messages.PDBMissing, replicas, nameOf(&deployment.ObjectMeta), namespace)
+	d.enforce(p.Enforcement, message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueNotFound,
+		Message: message,
+		Field:   "spec.template.metadata.labels",
+	})
+}
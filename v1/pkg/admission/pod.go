@@ -0,0 +1,58 @@
+package admission
+
+import (
+	"context"
+
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func init() {
+	registerKind(corev1.SchemeGroupVersion.WithKind("Pod"), kindHandler{
+		decode:   jsonDecoder(func() runtime.Object { return &corev1.Pod{} }),
+		validate: validatePod,
+		mutate:   mutatePod,
+	})
+}
+
+// validatePod denies pods with unsigned or vulnerable images, requesting
+// memory per cpu out of bounds, hugepages other than their limits, too much
+// ephemeral-storage or more GPUs than their namespace allows or
+// referencing missing ConfigMaps, Secrets or PersistentVolumeClaims, in the
+// namespaces of the policy.
+func validatePod(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object) {
+	pod := object.(*corev1.Pod)
+	rules := newRuleSet(ctx, req, d)
+	rules.add("signatures", func(d *denial) { checkSignatures(ctx, d, req.Namespace, req.Kind.Kind, &pod.Spec) })
+	rules.add("memoryPerCPU", func(d *denial) { checkMemoryPerCPU(d, req.Namespace, req.Kind.Kind, &pod.Spec) })
+	rules.add("containerResources", func(d *denial) { checkContainerResources(d, req.Namespace, req.Kind.Kind, &pod.Spec) })
+	rules.add("podResources", func(d *denial) {
+		checkPodResources(d, req.Namespace, req.Kind.Kind, nameOf(&pod.ObjectMeta), &pod.Spec)
+	})
+	rules.add("gpus", func(d *denial) { checkGPUs(d, req.Namespace, req.Kind.Kind, nameOf(&pod.ObjectMeta), &pod.Spec) })
+	rules.add("references", func(d *denial) {
+		checkReferences(ctx, d, req.Namespace, req.Kind.Kind, nameOf(&pod.ObjectMeta), "spec", &pod.Spec)
+	})
+	rules.add("vulnerabilities", func(d *denial) { checkVulnerabilities(ctx, d, req.Namespace, req.Kind.Kind, &pod.Spec) })
+	rules.run()
+}
+
+// mutatePod reduces the requests of the containers of pods, places those
+// requesting GPUs on the GPU node pools, injects the templates they ask for,
+// doesn't mount the service account token, pulls their images from the
+// mirrors and adds the pull secrets of the policy.
+func mutatePod(ctx context.Context, m *mutation, req *v1.AdmissionRequest, object runtime.Object) *v1.AdmissionResponse {
+	pod := object.(*corev1.Pod)
+	m.apply("requestReduction", func() {
+		m.reduceRequests(req.Namespace, req.Kind.Kind, nameOf(&pod.ObjectMeta), &pod.Spec, pod.Annotations, nil)
+	})
+	m.apply("gpus", func() { placeGPUs(req.Namespace, &pod.Spec) })
+	m.apply("injectionTemplates", func() { m.inject(req.Namespace, pod.Annotations, &pod.Spec) })
+	m.apply("serviceAccountToken", func() { disableTokenAutomount(req.Namespace, pod.Annotations, &pod.Spec) })
+	m.apply("registryMirrors", func() {
+		timeRule(ctx, req, "registryMirrors", func() { rewriteImages(ctx, &pod.Spec, m.log) })
+	})
+	m.apply("imagePullSecrets", func() { addPullSecrets(req.Namespace, &pod.Spec) })
+	return nil
+}
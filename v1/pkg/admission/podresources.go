@@ -0,0 +1,180 @@
+package admission
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NodeLister lists the nodes of the cluster.
+type NodeLister func() ([]*corev1.Node, error)
+
+var nodes NodeLister
+
+// SetNodeLister sets where the nodes are looked up, which should be a cache
+// rather than the API server. Pods aren't checked against the allocatable of
+// the nodes until it is set.
+func SetNodeLister(lister NodeLister) {
+	nodes = lister
+}
+
+// podRequests returns what a pod of spec requests as the scheduler counts
+// it: the sum of the requests of its containers or, when it is more, the
+// requests of its largest init container, since they run one at a time
+// before the containers, plus the overhead of its runtime class. The
+// requests of a container default to its limits.
+func podRequests(spec *corev1.PodSpec) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for i := range spec.Containers {
+		for name, quantity := range containerRequests(&spec.Containers[i]) {
+			sum := requests[name]
+			sum.Add(quantity)
+			requests[name] = sum
+		}
+	}
+	for i := range spec.InitContainers {
+		for name, quantity := range containerRequests(&spec.InitContainers[i]) {
+			if current, ok := requests[name]; !ok || quantity.Cmp(current) > 0 {
+				requests[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	for name, quantity := range spec.Overhead {
+		sum := requests[name]
+		sum.Add(quantity)
+		requests[name] = sum
+	}
+	return requests
+}
+
+// containerRequests returns the requests of container, its limits for the
+// resources it only limits.
+func containerRequests(container *corev1.Container) corev1.ResourceList {
+	requests := container.Resources.Requests.DeepCopy()
+	for name, limit := range container.Resources.Limits {
+		if _, ok := requests[name]; !ok {
+			if requests == nil {
+				requests = corev1.ResourceList{}
+			}
+			requests[name] = limit.DeepCopy()
+		}
+	}
+	return requests
+}
+
+// checkPodResources warns about or denies, depending on the pod resources
+// policy, the Pod or the pod template of kind named name in namespace whose
+// pods request more than the maximum per pod or, with fitNodes, more than
+// any node they can run on has allocatable: the scheduler never places them.
+func checkPodResources(d *denial, namespace, kind, name string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).PodResources
+	if !p.Required(namespace) || (len(p.Max) == 0 && !p.FitNodes) {
+		return
+	}
+	prefix := "spec.template.spec"
+	if kind == "Pod" {
+		prefix = "spec"
+	}
+	requests := podRequests(spec)
+	for _, resourceName := range resourceNames(p.Max) {
+		max := p.Max[resourceName]
+		if request, ok := requests[resourceName]; ok && request.Cmp(max) > 0 {
+			message := fmt.Sprintf(messages.PodRequestsExceeded, kind, name, request.String(), resourceName, max.String())
+			d.enforce(p.Enforcement, message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueInvalid,
+				Message: message,
+				Field:   prefix + ".containers",
+			})
+		}
+	}
+	if !p.FitNodes || nodes == nil {
+		return
+	}
+
+	list, err := nodes()
+	if err != nil {
+		// the lookup failing must not block workloads
+		d.warn(fmt.Sprintf(messages.NodesNotChecked, kind, name, err))
+		return
+	}
+	candidates := 0
+	for _, node := range list {
+		if !schedulableOn(spec, node) {
+			continue
+		}
+		candidates++
+		if allocatable(node, requests) {
+			return
+		}
+	}
+	// a cluster without a node to run the pods on yet, such as one still
+	// being provisioned, isn't told about
+	if candidates == 0 {
+		return
+	}
+	message := fmt.Sprintf(messages.PodFitsNoNode, kind, name, formatResources(requests), candidates)
+	d.enforce(p.Enforcement, message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueInvalid,
+		Message: message,
+		Field:   prefix + ".containers",
+	})
+}
+
+// schedulableOn reports whether the pods of spec can be scheduled on node,
+// as far as its nodeSelector and the taints they tolerate tell: the node
+// affinity is not considered.
+func schedulableOn(spec *corev1.PodSpec, node *corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	if !labels.SelectorFromSet(spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+		return false
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range spec.Tolerations {
+			if spec.Tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
+
+// allocatable reports whether node has the allocatable for requests, those
+// of an empty node: the pods already running there aren't counted.
+func allocatable(node *corev1.Node, requests corev1.ResourceList) bool {
+	for name, request := range requests {
+		if request.IsZero() {
+			continue
+		}
+		if available, ok := node.Status.Allocatable[name]; !ok || request.Cmp(available) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// formatResources returns list as name=quantity pairs sorted by name, such
+// as cpu=20, memory=64Gi.
+func formatResources(list corev1.ResourceList) string {
+	pairs := make([]string, 0, len(list))
+	for _, name := range resourceNames(list) {
+		quantity := list[name]
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, quantity.String()))
+	}
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,79 @@
+package admission
+
+import (
+	"github.com/cnych/admission-webhook/pkg/patch"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podTemplateMutator applies a rule to the pod template spec of a workload,
+// namespaceLabels are the labels of its namespace.
+type podTemplateMutator func(spec *corev1.PodSpec, namespaceLabels map[string]string)
+
+// podTemplateMutators are the rules depending on the namespace of the
+// workload, run in order, by the section of the policy driving them.
+var podTemplateMutators = []struct {
+	name   string
+	mutate podTemplateMutator
+}{
+	{"priorityClasses", setPriorityClass},
+	{"runtimeClasses", setRuntimeClass},
+	{"guaranteedQoSSelector", setGuaranteedQoS},
+}
+
+// workloadNamespace returns the namespace name of a workload for the rules
+// depending on it, nil when there are none or it can't be looked up. A
+// non-nil response answers the request instead, like for lookupNamespace.
+func workloadNamespace(name string, log Logger) (*corev1.Namespace, *v1.AdmissionResponse) {
+	if !policy.CurrentConfig().NamespaceDependent() {
+		return nil, nil
+	}
+	return lookupNamespace(name, log)
+}
+
+// mutateWorkload runs the rules depending on the namespace of a workload of
+// objectMeta running template: the podTemplateMutators, the copy of the
+// namespace metadata and the propagation of its labels. None run when
+// namespace is nil.
+func (m *mutation) mutateWorkload(namespace *corev1.Namespace, objectMeta *metav1.ObjectMeta, template *corev1.PodTemplateSpec) {
+	if namespace == nil {
+		return
+	}
+	for _, mutator := range podTemplateMutators {
+		m.apply(mutator.name, func() { mutator.mutate(&template.Spec, namespace.Labels) })
+	}
+	m.apply("namespaceMetadata", func() { copyNamespaceMetadata(namespace, objectMeta, template, m.annotations) })
+	m.apply("propagatedLabels", func() { propagateLabels(namespace, template) })
+}
+
+// setPriorityClass gives pod templates without a priority class the one the
+// policy derives from the labels of the namespace.
+func setPriorityClass(spec *corev1.PodSpec, namespaceLabels map[string]string) {
+	if spec.PriorityClassName == "" {
+		spec.PriorityClassName = policy.PriorityClassFor(namespaceLabels)
+	}
+}
+
+// setRuntimeClass gives pod templates without a runtime class the one the
+// policy derives from the labels of the namespace, e.g. a sandbox such as
+// gvisor or kata for untrusted workloads.
+func setRuntimeClass(spec *corev1.PodSpec, namespaceLabels map[string]string) {
+	if spec.RuntimeClassName != nil {
+		return
+	}
+	if runtimeClass := policy.RuntimeClassFor(namespaceLabels); runtimeClass != "" {
+		spec.RuntimeClassName = &runtimeClass
+	}
+}
+
+// setGuaranteedQoS sets the limits of the containers of pod templates to
+// their requests, or the other way round when the requests are missing, in
+// the namespaces the policy makes Guaranteed.
+func setGuaranteedQoS(spec *corev1.PodSpec, namespaceLabels map[string]string) {
+	if policy.GuaranteedQoS(namespaceLabels) {
+		patch.GuaranteedResources(spec.InitContainers)
+		patch.GuaranteedResources(spec.Containers)
+	}
+}
@@ -0,0 +1,38 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// checkProbes warns about or denies, depending on the probe policy, pod
+// templates in namespace with containers missing a readiness probe, or a
+// liveness probe if the policy requires one. Init containers run to
+// completion and need none.
+func checkProbes(d *denial, namespace string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).Probes
+	if !p.Required(namespace) {
+		return
+	}
+	missing := func(i int, container *corev1.Container, probe, field string) {
+		message := fmt.Sprintf(messages.ProbeMissing, container.Name, probe)
+		d.enforce(p.Enforcement, message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueRequired,
+			Message: message,
+			Field:   fmt.Sprintf("spec.template.spec.containers[%d].%s", i, field),
+		})
+	}
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		if container.ReadinessProbe == nil {
+			missing(i, container, "readiness", "readinessProbe")
+		}
+		if p.RequireLiveness && container.LivenessProbe == nil {
+			missing(i, container, "liveness", "livenessProbe")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package admission
+
+import (
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// recordRules makes m record the rules which change object, the object it
+// mutates, when the provenance policy covers namespace. The annotations of
+// the rules are set by annotateProvenance.
+func (m *mutation) recordRules(namespace string, object runtime.Object) {
+	if policy.CurrentConfig().MutationProvenance.Required(namespace) {
+		m.object = object
+	}
+}
+
+// apply runs rule, the rule of the policy section name, recording it when it
+// changes the object or the annotations m sets.
+func (m *mutation) apply(name string, rule func()) {
+	if m.object == nil {
+		rule()
+		return
+	}
+	before := m.object.DeepCopyObject()
+	annotations := make(map[string]string, len(m.annotations))
+	for key, value := range m.annotations {
+		annotations[key] = value
+	}
+	rule()
+	if equality.Semantic.DeepEqual(before, m.object) && equality.Semantic.DeepEqual(annotations, m.annotations) {
+		return
+	}
+	for _, applied := range m.applied {
+		if applied == name {
+			return
+		}
+	}
+	m.applied = append(m.applied, name)
+}
+
+// annotateProvenance adds the provenance annotation of every rule recorded
+// to the annotations m sets.
+func (m *mutation) annotateProvenance() {
+	if len(m.applied) == 0 {
+		return
+	}
+	if m.annotations == nil {
+		m.annotations = make(map[string]string, len(m.applied))
+	}
+	value := policy.Version() + "," + policy.Now().UTC().Format(time.RFC3339)
+	for _, name := range m.applied {
+		m.annotations[policy.AnnotationProvenancePrefix+name] = value
+	}
+}
@@ -0,0 +1,32 @@
+package admission
+
+import (
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addPullSecrets adds the imagePullSecrets the policy sets for the pods of
+// spec in namespace, so teams don't copy them into every workload. The
+// secrets spec lists already are kept.
+func addPullSecrets(namespace string, spec *corev1.PodSpec) {
+	var images []string
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, container := range containers {
+			images = append(images, container.Image)
+		}
+	}
+	for _, name := range policy.PullSecretsFor(namespace, images) {
+		if !hasPullSecret(spec, name) {
+			spec.ImagePullSecrets = append(spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+}
+
+func hasPullSecret(spec *corev1.PodSpec, name string) bool {
+	for _, secret := range spec.ImagePullSecrets {
+		if secret.Name == name {
+			return true
+		}
+	}
+	return false
+}
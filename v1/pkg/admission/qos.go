@@ -0,0 +1,76 @@
+package admission
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// QoSChangeObserver is told about the requests reductions lowering the QoS
+// class of the pods of an object of kind from one class to another, kept
+// when the qosClass policy skipped the reduction.
+type QoSChangeObserver func(kind string, from, to corev1.PodQOSClass, kept bool)
+
+var observeQoSChange QoSChangeObserver
+
+// SetQoSChangeObserver sets what is told about the requests reductions
+// lowering the QoS class of pods, e.g. a counter.
+func SetQoSChangeObserver(observer QoSChangeObserver) {
+	observeQoSChange = observer
+}
+
+// qosClass returns the QoS class of the pods of spec, from the cpu and
+// memory of their containers and init containers like the kubelet. The
+// requests missing default to the limits, like those of pods do once
+// admitted, pod templates aren't defaulted.
+func qosClass(spec *corev1.PodSpec) corev1.PodQOSClass {
+	requests, limits := corev1.ResourceList{}, corev1.ResourceList{}
+	guaranteed := true
+	add := func(list corev1.ResourceList, name corev1.ResourceName, quantity resource.Quantity) {
+		sum := list[name]
+		sum.Add(quantity)
+		list[name] = sum
+	}
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			resources := &containers[i].Resources
+			for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+				limit, hasLimit := resources.Limits[name]
+				request, hasRequest := resources.Requests[name]
+				if !hasRequest {
+					request, hasRequest = limit, hasLimit
+				}
+				if hasRequest && !request.IsZero() {
+					add(requests, name, request)
+				}
+				if hasLimit && !limit.IsZero() {
+					add(limits, name, limit)
+				} else {
+					guaranteed = false
+				}
+			}
+		}
+	}
+	if len(requests) == 0 && len(limits) == 0 {
+		return corev1.PodQOSBestEffort
+	}
+	if guaranteed && len(requests) == len(limits) {
+		for name, limit := range limits {
+			if request, ok := requests[name]; !ok || request.Cmp(limit) != 0 {
+				return corev1.PodQOSBurstable
+			}
+		}
+		return corev1.PodQOSGuaranteed
+	}
+	return corev1.PodQOSBurstable
+}
+
+// qosRank orders the QoS classes by how late the kubelet evicts their pods.
+func qosRank(class corev1.PodQOSClass) int {
+	switch class {
+	case corev1.PodQOSGuaranteed:
+		return 2
+	case corev1.PodQOSBurstable:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReferenceLookup reports whether the ConfigMap, Secret or
+// PersistentVolumeClaim, by kind, named name exists in namespace.
+type ReferenceLookup func(ctx context.Context, kind, namespace, name string) (bool, error)
+
+var lookupReference ReferenceLookup
+
+// SetReferenceLookup sets where the objects pods reference are looked up,
+// which should be a cache rather than the API server. References aren't
+// checked until it is set.
+func SetReferenceLookup(lookup ReferenceLookup) {
+	lookupReference = lookup
+}
+
+// reference is an object a pod needs to start.
+type reference struct {
+	kind, name string
+}
+
+func (r reference) String() string {
+	return r.kind + " " + r.name
+}
+
+// podReferences returns the ConfigMaps, Secrets and PersistentVolumeClaims
+// spec needs, in the order they appear. Those marked optional aren't needed,
+// they are returned too with withOptional.
+func podReferences(spec *corev1.PodSpec, withOptional bool) []reference {
+	var references []reference
+	seen := map[reference]bool{}
+	add := func(kind, name string, optional *bool) {
+		r := reference{kind, name}
+		if name == "" || (!withOptional && optional != nil && *optional) || seen[r] {
+			return
+		}
+		seen[r] = true
+		references = append(references, r)
+	}
+	for _, volume := range spec.Volumes {
+		switch {
+		case volume.ConfigMap != nil:
+			add("ConfigMap", volume.ConfigMap.Name, volume.ConfigMap.Optional)
+		case volume.Secret != nil:
+			add("Secret", volume.Secret.SecretName, volume.Secret.Optional)
+		case volume.PersistentVolumeClaim != nil:
+			add("PersistentVolumeClaim", volume.PersistentVolumeClaim.ClaimName, nil)
+		case volume.Projected != nil:
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					add("ConfigMap", source.ConfigMap.Name, source.ConfigMap.Optional)
+				}
+				if source.Secret != nil {
+					add("Secret", source.Secret.Name, source.Secret.Optional)
+				}
+			}
+		}
+	}
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, container := range containers {
+		for _, source := range container.EnvFrom {
+			if source.ConfigMapRef != nil {
+				add("ConfigMap", source.ConfigMapRef.Name, source.ConfigMapRef.Optional)
+			}
+			if source.SecretRef != nil {
+				add("Secret", source.SecretRef.Name, source.SecretRef.Optional)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+				add("ConfigMap", ref.Name, ref.Optional)
+			}
+			if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+				add("Secret", ref.Name, ref.Optional)
+			}
+		}
+	}
+	return references
+}
+
+// checkReferences warns about or denies, depending on the references
+// policy, the pod spec of the object of kind named name in namespace
+// referencing ConfigMaps, Secrets or PersistentVolumeClaims which don't
+// exist, its pods would fail with CreateContainerConfigError or stay
+// pending. field is the path of spec.
+func checkReferences(ctx context.Context, d *denial, namespace, kind, name, field string, spec *corev1.PodSpec) {
+	if lookupReference == nil {
+		return
+	}
+	p := &policy.ConfigFor(namespace).References
+	if !p.Required(namespace) {
+		return
+	}
+	var missing []string
+	for _, r := range podReferences(spec, false) {
+		exists, err := lookupReference(ctx, r.kind, namespace, r.name)
+		if err != nil {
+			// the lookup failing must not block workloads
+			d.warn(fmt.Sprintf(messages.ReferenceLookupFailed, r, namespace, err))
+			continue
+		}
+		if !exists {
+			missing = append(missing, r.String())
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	message := fmt.Sprintf(messages.ReferencesMissing, kind, name, strings.Join(missing, ", "), namespace)
+	d.enforce(p.Enforcement, message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueNotFound,
+		Message: message,
+		Field:   field,
+	})
+}
@@ -0,0 +1,45 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// checkReplicas denies deployments in namespace whose replicas are out of
+// the replica bounds of the policy. Deployments without replicas run one.
+// Scaling through the scale subresource is checked by validateScale.
+func checkReplicas(d *denial, namespace string, deployment *appsv1.Deployment) {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	checkReplicaCount(d, namespace, deployment.Labels, replicas)
+}
+
+// checkReplicaCount denies replicas of a Deployment in namespace labeled
+// with deploymentLabels out of the replica bounds of the policy.
+func checkReplicaCount(d *denial, namespace string, deploymentLabels map[string]string, replicas int32) {
+	bounds := policy.ReplicaBoundsFor(namespace, deploymentLabels)
+	if bounds == nil {
+		return
+	}
+
+	var message string
+	switch {
+	case bounds.Min != nil && replicas < *bounds.Min:
+		message = fmt.Sprintf(messages.ReplicasTooFew, replicas, *bounds.Min)
+	case bounds.Max != nil && replicas > *bounds.Max:
+		message = fmt.Sprintf(messages.ReplicasTooMany, replicas, *bounds.Max)
+	default:
+		return
+	}
+	d.add(message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueInvalid,
+		Message: message,
+		Field:   "spec.replicas",
+	})
+}
@@ -0,0 +1,110 @@
+package admission
+
+import (
+	"context"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func init() {
+	registerKind(appsv1.SchemeGroupVersion.WithKind("ReplicaSet"), kindHandler{
+		decode:          jsonDecoder(func() runtime.Object { return &appsv1.ReplicaSet{} }),
+		requireLabels:   func() bool { return true },
+		validate:        validateReplicaSet,
+		mutate:          mutateReplicaSet,
+		admittedThrough: deploymentOwner,
+	})
+}
+
+// deploymentOwner returns the Deployment controlling the ReplicaSet of
+// objectMeta, empty when it was created directly. The pod template of the
+// ReplicaSets of a Deployment is the one of the Deployment, admitted with
+// it already.
+func deploymentOwner(objectMeta *metav1.ObjectMeta) string {
+	ref := metav1.GetControllerOf(objectMeta)
+	if ref == nil || ref.Kind != "Deployment" {
+		return ""
+	}
+	if gv, err := schema.ParseGroupVersion(ref.APIVersion); err != nil || gv.Group != appsv1.GroupName {
+		return ""
+	}
+	return "Deployment " + ref.Name
+}
+
+// validateReplicaSet denies the ReplicaSets created directly like their
+// Deployments: whose selector doesn't match their pod template or changes,
+// running replicas out of their bounds and, in the namespaces of the policy,
+// without probes or NetworkPolicy, referencing missing ConfigMaps, Secrets or
+// PersistentVolumeClaims, with unsigned or vulnerable images, requesting
+// memory per cpu out of bounds, hugepages other than their limits, too much
+// ephemeral-storage or more GPUs per pod than their namespace allows.
+func validateReplicaSet(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object) {
+	replicaSet := object.(*appsv1.ReplicaSet)
+	rules := newRuleSet(ctx, req, d)
+	rules.add("selector", func(d *denial) {
+		checkSelector(d, req, nameOf(&replicaSet.ObjectMeta), replicaSet.Spec.Selector, replicaSet.Spec.Template.Labels)
+	})
+	replicas := int32(1)
+	if replicaSet.Spec.Replicas != nil {
+		replicas = *replicaSet.Spec.Replicas
+	}
+	rules.add("replicas", func(d *denial) { checkReplicaCount(d, req.Namespace, replicaSet.Labels, replicas) })
+	rules.add("probes", func(d *denial) { checkProbes(d, req.Namespace, &replicaSet.Spec.Template.Spec) })
+	rules.add("networkPolicy", func(d *denial) {
+		checkNetworkPolicy(d, req.Namespace, req.Kind.Kind, nameOf(&replicaSet.ObjectMeta), "spec.template.metadata.labels", replicaSet.Spec.Template.Labels)
+	})
+	rules.add("references", func(d *denial) {
+		checkReferences(ctx, d, req.Namespace, req.Kind.Kind, nameOf(&replicaSet.ObjectMeta), "spec.template.spec", &replicaSet.Spec.Template.Spec)
+	})
+	rules.add("memoryPerCPU", func(d *denial) { checkMemoryPerCPU(d, req.Namespace, req.Kind.Kind, &replicaSet.Spec.Template.Spec) })
+	rules.add("containerResources", func(d *denial) {
+		checkContainerResources(d, req.Namespace, req.Kind.Kind, &replicaSet.Spec.Template.Spec)
+	})
+	rules.add("podResources", func(d *denial) {
+		checkPodResources(d, req.Namespace, req.Kind.Kind, nameOf(&replicaSet.ObjectMeta), &replicaSet.Spec.Template.Spec)
+	})
+	rules.add("gpus", func(d *denial) {
+		checkGPUs(d, req.Namespace, req.Kind.Kind, nameOf(&replicaSet.ObjectMeta), &replicaSet.Spec.Template.Spec)
+	})
+	rules.add("signatures", func(d *denial) { checkSignatures(ctx, d, req.Namespace, req.Kind.Kind, &replicaSet.Spec.Template.Spec) })
+	rules.add("vulnerabilities", func(d *denial) {
+		checkVulnerabilities(ctx, d, req.Namespace, req.Kind.Kind, &replicaSet.Spec.Template.Spec)
+	})
+	rules.run()
+}
+
+// mutateReplicaSet mutates the ReplicaSets created directly like
+// Deployments, see mutateDeployment.
+func mutateReplicaSet(ctx context.Context, m *mutation, req *v1.AdmissionRequest, object runtime.Object) *v1.AdmissionResponse {
+	replicaSet := object.(*appsv1.ReplicaSet)
+	namespace, response := workloadNamespace(req.Namespace, m.log)
+	if response != nil {
+		return response
+	}
+	template := &replicaSet.Spec.Template
+	if namespace == nil || !policy.GuaranteedQoS(namespace.Labels) {
+		m.apply("requestReduction", func() {
+			m.reduceRequests(req.Namespace, req.Kind.Kind, nameOf(&replicaSet.ObjectMeta), &template.Spec, replicaSet.Annotations, &template.ObjectMeta)
+		})
+	}
+	m.mutateWorkload(namespace, &replicaSet.ObjectMeta, template)
+	m.apply("templateLabels", func() {
+		syncTemplateLabels(req.Namespace, &replicaSet.ObjectMeta, template, replicaSet.Spec.Selector)
+	})
+	m.apply("antiAffinity", func() { setAntiAffinity(req.Namespace, template) })
+	m.apply("gpus", func() { placeGPUs(req.Namespace, &template.Spec) })
+	m.apply("termination", func() { setTermination(req.Namespace, template, m.log) })
+	m.apply("sidecars", func() { updateSidecars(req.Namespace, template, m.log) })
+	m.apply("injectionTemplates", func() { m.inject(req.Namespace, template.Annotations, &template.Spec) })
+	m.apply("serviceAccountToken", func() { disableTokenAutomount(req.Namespace, template.Annotations, &template.Spec) })
+	m.apply("registryMirrors", func() {
+		timeRule(ctx, req, "registryMirrors", func() { rewriteImages(ctx, &template.Spec, m.log) })
+	})
+	m.apply("imagePullSecrets", func() { addPullSecrets(req.Namespace, &template.Spec) })
+	return nil
+}
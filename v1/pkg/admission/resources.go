@@ -0,0 +1,158 @@
+package admission
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// checkMemoryPerCPU warns about or denies, depending on the ratio policy,
+// containers of a Pod or a pod template in namespace requesting memory per
+// core of cpu out of its bounds.
+func checkMemoryPerCPU(d *denial, namespace, kind string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).MemoryPerCPU
+	if !p.Required(namespace) || (p.Min == nil && p.Max == nil) {
+		return
+	}
+	prefix := "spec.template.spec"
+	if kind == "Pod" {
+		prefix = "spec"
+	}
+	check := func(container *corev1.Container, field string) {
+		cpu, hasCPU := container.Resources.Requests[corev1.ResourceCPU]
+		memory, hasMemory := container.Resources.Requests[corev1.ResourceMemory]
+		if !hasCPU || !hasMemory || cpu.MilliValue() == 0 {
+			return
+		}
+		perCPU := resource.NewQuantity(memory.Value()*1000/cpu.MilliValue(), resource.BinarySI)
+		var message string
+		switch {
+		case p.Min != nil && perCPU.Cmp(*p.Min) < 0:
+			message = fmt.Sprintf(messages.MemoryPerCPUTooLow, container.Name, perCPU.String(), p.Min.String())
+		case p.Max != nil && perCPU.Cmp(*p.Max) > 0:
+			message = fmt.Sprintf(messages.MemoryPerCPUTooHigh, container.Name, perCPU.String(), p.Max.String())
+		default:
+			return
+		}
+		d.enforce(p.Enforcement, message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: message,
+			Field:   field,
+		})
+	}
+	for i := range spec.InitContainers {
+		check(&spec.InitContainers[i], fmt.Sprintf("%s.initContainers[%d].resources.requests", prefix, i))
+	}
+	for i := range spec.Containers {
+		check(&spec.Containers[i], fmt.Sprintf("%s.containers[%d].resources.requests", prefix, i))
+	}
+}
+
+// checkContainerResources warns about or denies, depending on the container
+// resources policy, containers of a Pod or a pod template in namespace
+// requesting more than their limits or hugepages other than their limits or
+// not in pages, which the apiserver rejects or the scheduler never places, or
+// more ephemeral-storage than the maximum.
+func checkContainerResources(d *denial, namespace, kind string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).ContainerResources
+	if !p.Required(namespace) || (!p.HugePages && !p.RequestsWithinLimits && p.MaxEphemeralStorage == nil) {
+		return
+	}
+	prefix := "spec.template.spec"
+	if kind == "Pod" {
+		prefix = "spec"
+	}
+	violate := func(message, field string) {
+		d.enforce(p.Enforcement, message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: message,
+			Field:   field,
+		})
+	}
+	check := func(container *corev1.Container, field string) {
+		resources := &container.Resources
+		if max := p.MaxEphemeralStorage; max != nil {
+			storage, ok := resources.Requests[corev1.ResourceEphemeralStorage]
+			if !ok {
+				storage, ok = resources.Limits[corev1.ResourceEphemeralStorage]
+			}
+			if ok && storage.Cmp(*max) > 0 {
+				violate(fmt.Sprintf(messages.EphemeralStorageTooBig, container.Name, storage.String(), max.String()),
+					fmt.Sprintf("%s.resources.requests[%s]", field, corev1.ResourceEphemeralStorage))
+			}
+		}
+		if p.RequestsWithinLimits {
+			for _, name := range resourceNames(resources.Requests) {
+				// the hugepages must equal their limits, checked below
+				if p.HugePages && strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix) {
+					continue
+				}
+				request := resources.Requests[name]
+				if limit, ok := resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+					violate(fmt.Sprintf(messages.RequestAboveLimit, container.Name, request.String(), name, limit.String()),
+						fmt.Sprintf("%s.resources.requests[%s]", field, name))
+				}
+			}
+		}
+		if !p.HugePages {
+			return
+		}
+		for _, name := range hugePageResources(resources) {
+			request, hasRequest := resources.Requests[name]
+			limit, hasLimit := resources.Limits[name]
+			// the requests default to the limits
+			if !hasRequest {
+				request = limit
+			}
+			if !hasLimit || limit.Cmp(request) != 0 {
+				violate(fmt.Sprintf(messages.HugePagesUnequal, container.Name, request.String(), name, limit.String()),
+					fmt.Sprintf("%s.resources.limits[%s]", field, name))
+				continue
+			}
+			pageSize, err := resource.ParseQuantity(strings.TrimPrefix(string(name), corev1.ResourceHugePagesPrefix))
+			if err == nil && pageSize.Value() > 0 && request.Value()%pageSize.Value() != 0 {
+				violate(fmt.Sprintf(messages.HugePagesNotMultiple, container.Name, request.String(), name, pageSize.String()),
+					fmt.Sprintf("%s.resources.requests[%s]", field, name))
+			}
+		}
+	}
+	for i := range spec.InitContainers {
+		check(&spec.InitContainers[i], fmt.Sprintf("%s.initContainers[%d]", prefix, i))
+	}
+	for i := range spec.Containers {
+		check(&spec.Containers[i], fmt.Sprintf("%s.containers[%d]", prefix, i))
+	}
+}
+
+// resourceNames returns the resources of list, sorted.
+func resourceNames(list corev1.ResourceList) []corev1.ResourceName {
+	names := make([]corev1.ResourceName, 0, len(list))
+	for name := range list {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// hugePageResources returns the hugepages-<size> resources requested or
+// limited in resources, sorted.
+func hugePageResources(resources *corev1.ResourceRequirements) []corev1.ResourceName {
+	seen := map[corev1.ResourceName]bool{}
+	var names []corev1.ResourceName
+	for _, list := range []corev1.ResourceList{resources.Requests, resources.Limits} {
+		for name := range list {
+			if strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix) && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
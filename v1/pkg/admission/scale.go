@@ -0,0 +1,85 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DeploymentGetter returns the Deployment name of namespace.
+type DeploymentGetter func(namespace, name string) (*appsv1.Deployment, error)
+
+var deployments DeploymentGetter
+
+// SetDeploymentGetter sets where the Deployments scaled through their scale
+// subresource are looked up, which should be a cache rather than the API
+// server. A Scale carries neither the labels nor the annotations of its
+// Deployment, replica bounds with a selector can't be checked on scaling
+// until it is set.
+func SetDeploymentGetter(getter DeploymentGetter) {
+	deployments = getter
+}
+
+// validateScale checks the replicas set through the scale subresource of a
+// Deployment, e.g. by kubectl scale, against the replica bounds of the
+// policy. The replicas of Deployments an autoscaler targets are its own and
+// aren't checked.
+func validateScale(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	var scale autoscalingv1.Scale
+	if err := json.Unmarshal(req.Object.Raw, &scale); err != nil {
+		return decodeFailed(req, err, log)
+	}
+
+	log.Infof(messages.AdmissionBegin, req.Namespace, req.Kind.Kind, req.Name)
+
+	d := newDenial(req)
+	objectMeta := &metav1.ObjectMeta{Namespace: req.Namespace, Name: req.Name}
+	deployment, err := lookupDeployment(req.Namespace, req.Name)
+	switch {
+	case err == nil:
+		objectMeta = &deployment.ObjectMeta
+		if policy.Exempt(deployment.Labels) {
+			return &v1.AdmissionResponse{
+				Allowed: true,
+			}
+		}
+	case policy.ConfigFor(req.Namespace).ReplicaBoundsSelectDeployments():
+		log.Warningf(messages.ScaleNotChecked, req.Namespace, req.Name, err)
+		d.warn(fmt.Sprintf(messages.ScaleNotChecked, req.Namespace, req.Name, err))
+		return d.allowed()
+	}
+	if !policy.ValidationRequired(policy.Ignored(), objectMeta, log) {
+		log.Infof(messages.ValidationSkip, req.Namespace, req.Name)
+		return &v1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// the autoscaler scales its target through the subresource itself
+	hpa, err := autoscaledBy(req.Namespace, req.Name)
+	if err != nil {
+		log.Warningf(messages.AutoscalersUnknown, req.Namespace, err)
+		d.warn(fmt.Sprintf(messages.AutoscalersUnknown, req.Namespace, err))
+	}
+	if hpa == nil {
+		checkReplicaCount(&d, req.Namespace, objectMeta.Labels, scale.Spec.Replicas)
+	}
+	if response := d.response(req, req.Name); response != nil {
+		return response
+	}
+	return d.allowed()
+}
+
+// lookupDeployment returns the Deployment name of namespace.
+func lookupDeployment(namespace, name string) (*appsv1.Deployment, error) {
+	if deployments == nil {
+		return nil, fmt.Errorf("deployments are not watched")
+	}
+	return deployments(namespace, name)
+}
@@ -0,0 +1,92 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"k8s.io/api/admission/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// checkSelector denies the workloads of req named name whose selector is
+// empty or doesn't match the labels of their pod template and, on UPDATE,
+// the changes of their selector, which is immutable in apps/v1. The
+// apiserver rejects them all anyway, with errors which don't tell what to
+// fix.
+func checkSelector(d *denial, req *v1.AdmissionRequest, name string, selector *metav1.LabelSelector, templateLabels map[string]string) {
+	kind := req.Kind.Kind
+	if selector == nil || (len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0) {
+		message := fmt.Sprintf(messages.SelectorMissing, kind, name)
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueRequired,
+			Message: message,
+			Field:   "spec.selector",
+		})
+		return
+	}
+
+	if mismatched := unmatchedRequirements(selector, templateLabels); len(mismatched) > 0 {
+		message := fmt.Sprintf(messages.SelectorMismatch, kind, name, strings.Join(mismatched, ", "))
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: message,
+			Field:   "spec.selector",
+		})
+	}
+
+	if req.Operation != v1.Update || len(req.OldObject.Raw) == 0 {
+		return
+	}
+	var old struct {
+		Spec struct {
+			Selector *metav1.LabelSelector `json:"selector"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil || old.Spec.Selector == nil {
+		return
+	}
+	if !apiequality.Semantic.DeepEqual(old.Spec.Selector, selector) {
+		message := fmt.Sprintf(messages.SelectorChanged, kind, name,
+			metav1.FormatLabelSelector(old.Spec.Selector), metav1.FormatLabelSelector(selector))
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: message,
+			Field:   "spec.selector",
+		})
+	}
+}
+
+// unmatchedRequirements returns the requirements of selector the labels of
+// a pod template don't meet: the matchLabels, by key, then the
+// matchExpressions.
+func unmatchedRequirements(selector *metav1.LabelSelector, templateLabels map[string]string) []string {
+	var unmatched []string
+	keys := make([]string, 0, len(selector.MatchLabels))
+	for key := range selector.MatchLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := selector.MatchLabels[key]
+		if actual, ok := templateLabels[key]; !ok {
+			unmatched = append(unmatched, fmt.Sprintf("%s=%s (not in the template)", key, value))
+		} else if actual != value {
+			unmatched = append(unmatched, fmt.Sprintf("%s=%s (template: %s)", key, value, actual))
+		}
+	}
+	for _, requirement := range selector.MatchExpressions {
+		expression := &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{requirement}}
+		s, err := metav1.LabelSelectorAsSelector(expression)
+		if err != nil {
+			unmatched = append(unmatched, err.Error())
+		} else if !s.Matches(labels.Set(templateLabels)) {
+			unmatched = append(unmatched, s.String())
+		}
+	}
+	return unmatched
+}
@@ -0,0 +1,70 @@
+package admission
+
+import (
+	"encoding/json"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// the workloads of the webhook itself, see SetSelf
+var (
+	selfNamespace      string
+	selfService        string
+	selfSelector       labels.Selector
+	selfWholeNamespace bool
+)
+
+// SetSelf sets the objects of the webhook itself, which are admitted
+// unchanged before any rule runs, so the webhook never blocks or mutates its
+// own Deployment during an upgrade: those of namespace matching selector,
+// which may be nil, and its Service named service, or with wholeNamespace
+// every object of namespace.
+func SetSelf(namespace, service string, selector labels.Selector, wholeNamespace bool) {
+	selfNamespace = namespace
+	selfService = service
+	selfSelector = selector
+	selfWholeNamespace = wholeNamespace
+}
+
+// isSelf reports whether the object of kind and objectMeta belongs to the
+// webhook itself.
+func isSelf(kind string, objectMeta *metav1.ObjectMeta) bool {
+	if selfNamespace == "" || objectMeta.Namespace != selfNamespace {
+		return false
+	}
+	if selfWholeNamespace {
+		return true
+	}
+	if kind == "Service" && objectMeta.Name == selfService {
+		return true
+	}
+	return selfSelector != nil && !selfSelector.Empty() && selfSelector.Matches(labels.Set(objectMeta.Labels))
+}
+
+// self admits req unchanged when its object belongs to the webhook itself,
+// as SetSelf sets them, before any rule of Validate or Mutate runs, so that
+// a policy too strict or a broken rule can't block the rollout fixing it.
+// Subresources are admitted too: the Scale of a Deployment carries none of
+// its labels, it is only told apart in the whole namespace. It returns nil
+// otherwise.
+func self(req *v1.AdmissionRequest, log Logger) *v1.AdmissionResponse {
+	if selfNamespace == "" || req.Namespace != selfNamespace {
+		return nil
+	}
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(admittedObject(req), &object); err != nil {
+		return nil
+	}
+	// the objects created with generateName may not carry their namespace
+	object.Namespace = req.Namespace
+	if !isSelf(req.Kind.Kind, &object.ObjectMeta) {
+		return nil
+	}
+	log.Infof(messages.SelfAdmitted, req.Kind.Kind, req.Namespace, nameOf(&object.ObjectMeta))
+	return &v1.AdmissionResponse{
+		Allowed: true,
+	}
+}
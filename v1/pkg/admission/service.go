@@ -0,0 +1,138 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeploymentLister lists the Deployments of a namespace.
+type DeploymentLister func(namespace string) ([]*appsv1.Deployment, error)
+
+var deploymentLister DeploymentLister
+
+// SetDeploymentLister sets where the Deployments the selectors of Services
+// are checked against are looked up, which should be a cache rather than the
+// API server. Selectors aren't checked until it is set.
+func SetDeploymentLister(lister DeploymentLister) {
+	deploymentLister = lister
+}
+
+func init() {
+	registerKind(corev1.SchemeGroupVersion.WithKind("Service"), kindHandler{
+		decode:        jsonDecoder(func() runtime.Object { return &corev1.Service{} }),
+		requireLabels: func() bool { return true },
+		validate: func(ctx context.Context, d *denial, req *v1.AdmissionRequest, object runtime.Object) {
+			service := object.(*corev1.Service)
+			timeRule(ctx, req, "serviceType", func() { checkServiceType(d, req.Namespace, service) })
+			timeRule(ctx, req, "serviceSelector", func() { checkServiceSelector(d, req.Namespace, service) })
+			timeRule(ctx, req, "servicePorts", func() { checkServicePorts(d, req.Namespace, service) })
+			// the Services without a selector don't expose pods of the
+			// namespace
+			if len(service.Spec.Selector) > 0 {
+				timeRule(ctx, req, "networkPolicy", func() {
+					checkNetworkPolicy(d, req.Namespace, req.Kind.Kind, nameOf(&service.ObjectMeta), "spec.selector", service.Spec.Selector)
+				})
+			}
+		},
+	})
+}
+
+// checkServiceType denies service types restricted to other namespaces.
+func checkServiceType(d *denial, namespace string, service *corev1.Service) {
+	if !policy.ServiceTypeAllowed(namespace, string(service.Spec.Type)) {
+		message := fmt.Sprintf(messages.ServiceTypeRestricted, service.Spec.Type, namespace)
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueNotSupported,
+			Message: message,
+			Field:   "spec.type",
+		})
+	}
+}
+
+// checkServiceSelector denies, if the service policy requires it, Services
+// in namespace whose selector matches the pod template of none of the
+// Deployments of the namespace, so they'd never have endpoints.
+func checkServiceSelector(d *denial, namespace string, service *corev1.Service) {
+	p := &policy.CurrentConfig().Services
+	if deploymentLister == nil || !p.RequireSelectedPods || !p.Checked(namespace) || len(service.Spec.Selector) == 0 {
+		return
+	}
+	list, err := deploymentLister(namespace)
+	if err != nil {
+		// the lookup failing must not block services
+		d.warn(fmt.Sprintf(messages.ServiceNotChecked, nameOf(&service.ObjectMeta), "Deployments", namespace, err))
+		return
+	}
+	selector := labels.SelectorFromSet(service.Spec.Selector)
+	for _, deployment := range list {
+		if selector.Matches(labels.Set(deployment.Spec.Template.Labels)) {
+			return
+		}
+	}
+	message := fmt.Sprintf(messages.ServiceSelectsNothing, selector.String(), namespace)
+	d.add(message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueInvalid,
+		Message: message,
+		Field:   "spec.selector",
+	})
+}
+
+// checkServicePorts denies, if the service policy requires unique ports,
+// Services in namespace using the nodePort of another Service of the
+// namespace, or exposing the port of another Service with the same selector,
+// which would only duplicate it.
+func checkServicePorts(d *denial, namespace string, service *corev1.Service) {
+	p := &policy.CurrentConfig().Services
+	if services == nil || !p.UniquePorts || !p.Checked(namespace) {
+		return
+	}
+	list, err := services(namespace)
+	if err != nil {
+		d.warn(fmt.Sprintf(messages.ServiceNotChecked, nameOf(&service.ObjectMeta), "Services", namespace, err))
+		return
+	}
+	for i, port := range service.Spec.Ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		for _, other := range list {
+			// an update is checked against the other Services only
+			if other.Name == service.Name {
+				continue
+			}
+			for _, used := range other.Spec.Ports {
+				usedProtocol := used.Protocol
+				if usedProtocol == "" {
+					usedProtocol = corev1.ProtocolTCP
+				}
+				if port.NodePort != 0 && port.NodePort == used.NodePort {
+					message := fmt.Sprintf(messages.ServiceNodePortUsed, port.NodePort, other.Name)
+					d.add(message, metav1.StatusCause{
+						Type:    metav1.CauseTypeFieldValueDuplicate,
+						Message: message,
+						Field:   fmt.Sprintf("spec.ports[%d].nodePort", i),
+					})
+				}
+				if len(service.Spec.Selector) > 0 && port.Port == used.Port && protocol == usedProtocol &&
+					labels.Equals(service.Spec.Selector, other.Spec.Selector) {
+					message := fmt.Sprintf(messages.ServicePortUsed, port.Port, protocol, other.Name)
+					d.add(message, metav1.StatusCause{
+						Type:    metav1.CauseTypeFieldValueDuplicate,
+						Message: message,
+						Field:   fmt.Sprintf("spec.ports[%d].port", i),
+					})
+				}
+			}
+		}
+	}
+}
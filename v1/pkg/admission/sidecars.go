@@ -0,0 +1,73 @@
+package admission
+
+import (
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// updateSidecars brings the injected containers of the pod template of a
+// workload in namespace to the version of the sidecars policy: the
+// containers, or init containers for the native sidecars, matching a rule
+// get its image or are removed unless the template records the version of
+// the rule already, and the template records it. The version is recorded
+// rather than the image compared, the images are rewritten to the mirrors
+// and pinned to digests afterwards.
+func updateSidecars(namespace string, template *corev1.PodTemplateSpec, log Logger) {
+	for _, rule := range policy.SidecarsFor(namespace) {
+		key := policy.AnnotationSidecarVersionPrefix + rule.Name
+		if policy.LookupValue(template.Annotations, key) == rule.Version {
+			continue
+		}
+		updated := false
+		for _, containers := range []*[]corev1.Container{&template.Spec.InitContainers, &template.Spec.Containers} {
+			kept := (*containers)[:0]
+			for _, container := range *containers {
+				if !sidecarMatches(&rule, &container) {
+					kept = append(kept, container)
+					continue
+				}
+				updated = true
+				if rule.Remove {
+					log.Infof(messages.SidecarRemoved, container.Name, rule.Version)
+					continue
+				}
+				log.Infof(messages.SidecarUpgraded, container.Name, rule.Version, rule.Image)
+				container.Image = rule.Image
+				kept = append(kept, container)
+			}
+			if len(kept) == 0 {
+				kept = nil
+			}
+			*containers = kept
+		}
+		// the templates without the sidecar don't record it
+		if !updated {
+			continue
+		}
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		template.Annotations[key] = rule.Version
+		// the legacy key would record the previous version
+		if legacy, ok := policy.LegacyKey(key); ok {
+			delete(template.Annotations, legacy)
+		}
+	}
+}
+
+// sidecarMatches reports whether container is the sidecar of rule, by its
+// name or its image.
+func sidecarMatches(rule *policy.SidecarRule, container *corev1.Container) bool {
+	if container.Name == rule.Name {
+		return true
+	}
+	for _, prefix := range rule.ImagePrefixes {
+		if strings.HasPrefix(container.Image, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package admission
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SignatureVerifier checks that one of keys signed image.
+type SignatureVerifier func(ctx context.Context, image string, keys []crypto.PublicKey) error
+
+var signatures SignatureVerifier
+
+// SetSignatureVerifier sets how the signatures of images are verified, it
+// should cache the results by digest. Images aren't verified until it is set.
+func SetSignatureVerifier(verifier SignatureVerifier) {
+	signatures = verifier
+}
+
+// checkSignatures denies pod specs in namespace, of an object of kind, with
+// images not signed by the keys of the signature policy. Images which can't
+// be verified, e.g. because the registry is down, are denied too.
+func checkSignatures(ctx context.Context, d *denial, namespace, kind string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).Signatures
+	if signatures == nil || !p.Required(namespace) {
+		return
+	}
+	lookupImages(d, kind, spec, func(d *denial, image, field string) {
+		if err := signatures(ctx, image, p.Keys()); err != nil {
+			message := fmt.Sprintf(messages.ImageNotSigned, image, err)
+			d.add(message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueInvalid,
+				Message: message,
+				Field:   field,
+			})
+		}
+	})
+}
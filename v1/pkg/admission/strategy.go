@@ -0,0 +1,77 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// defaultRollingBound is the maxUnavailable and maxSurge of the rolling
+// updates which don't set them.
+var defaultRollingBound = intstr.FromString("25%")
+
+// checkStrategy denies deployments recreating their pods in the production
+// namespaces of the strategy policy or when labeled zero-downtime, and
+// deployments there whose rolling updates take more pods down or up at once
+// than the policy bounds.
+func checkStrategy(d *denial, namespace string, deployment *appsv1.Deployment) {
+	p := &policy.ConfigFor(namespace).Strategy
+	strategy := &deployment.Spec.Strategy
+	if strategy.Type == appsv1.RecreateDeploymentStrategyType {
+		if p.Required(namespace) || p.ZeroDowntime(deployment.Labels) {
+			message := fmt.Sprintf(messages.StrategyRecreate, nameOf(&deployment.ObjectMeta))
+			d.add(message, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueNotSupported,
+				Message: message,
+				Field:   "spec.strategy.type",
+			})
+		}
+		return
+	}
+	if !p.Required(namespace) {
+		return
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	rolling := strategy.RollingUpdate
+	if rolling == nil {
+		rolling = &appsv1.RollingUpdateDeployment{}
+	}
+	// like the deployment controller, unavailable pods round down and surging
+	// ones up
+	checkRollingBound(d, "maxUnavailable", rolling.MaxUnavailable, p.MaxUnavailable, replicas, false)
+	checkRollingBound(d, "maxSurge", rolling.MaxSurge, p.MaxSurge, replicas, true)
+}
+
+// checkRollingBound denies the rolling update field whose value, as a number
+// of pods of replicas, exceeds bound.
+func checkRollingBound(d *denial, field string, value, bound *intstr.IntOrString, replicas int32, roundUp bool) {
+	if bound == nil {
+		return
+	}
+	if value == nil {
+		value = &defaultRollingBound
+	}
+	pods, err := intstr.GetScaledValueFromIntOrPercent(value, int(replicas), roundUp)
+	if err != nil {
+		// the apiserver rejects the invalid values itself
+		return
+	}
+	max, err := intstr.GetScaledValueFromIntOrPercent(bound, int(replicas), roundUp)
+	if err != nil || pods <= max {
+		return
+	}
+	message := fmt.Sprintf(messages.StrategyBoundExceeded, field, value.String(), pods, replicas, bound.String())
+	d.add(message, metav1.StatusCause{
+		Type:    metav1.CauseTypeFieldValueInvalid,
+		Message: message,
+		Field:   "spec.strategy.rollingUpdate." + field,
+	})
+}
@@ -0,0 +1,47 @@
+package admission
+
+import (
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// syncTemplateLabels copies the policy.RequiredLabels of the workload of
+// objectMeta in namespace onto its pod template where the template lacks
+// them or has other values, so the services and network policies selecting
+// them match its pods. The labels of selector are left alone: the template
+// must keep matching it and it can't change on updates.
+func syncTemplateLabels(namespace string, objectMeta *metav1.ObjectMeta, template *corev1.PodTemplateSpec, selector *metav1.LabelSelector) {
+	if !policy.ConfigFor(namespace).TemplateLabels.Required(namespace) {
+		return
+	}
+	for _, key := range policy.RequiredLabels {
+		value, ok := objectMeta.Labels[key]
+		if !ok || selects(selector, key) {
+			continue
+		}
+		if current, ok := template.Labels[key]; ok && current == value {
+			continue
+		}
+		if template.Labels == nil {
+			template.Labels = map[string]string{}
+		}
+		template.Labels[key] = value
+	}
+}
+
+// selects reports whether selector has a requirement on the label key.
+func selects(selector *metav1.LabelSelector, key string) bool {
+	if selector == nil {
+		return false
+	}
+	if _, ok := selector.MatchLabels[key]; ok {
+		return true
+	}
+	for _, requirement := range selector.MatchExpressions {
+		if requirement.Key == key {
+			return true
+		}
+	}
+	return false
+}
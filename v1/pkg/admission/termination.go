@@ -0,0 +1,75 @@
+package admission
+
+import (
+	"strconv"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ServiceLister lists the Services of a namespace.
+type ServiceLister func(namespace string) ([]*corev1.Service, error)
+
+var services ServiceLister
+
+// SetServiceLister sets where the Services are looked up, which should be a
+// cache rather than the API server. No preStop hook is added until it is set.
+func SetServiceLister(lister ServiceLister) {
+	services = lister
+}
+
+// setTermination defaults the termination of the pod template of a
+// Deployment in namespace: the grace period the policy sets replaces the
+// default one, and the containers of pods a Service selects get a preStop
+// sleep, so the endpoints are removed before they get SIGTERM and rolling
+// updates don't drop connections.
+func setTermination(namespace string, template *corev1.PodTemplateSpec, log Logger) {
+	p := &policy.ConfigFor(namespace).Termination
+	if !p.Required(namespace) {
+		return
+	}
+	// the mutation runs after the defaulting of the apiserver, the default
+	// can't be told from the same value set by the template
+	grace := template.Spec.TerminationGracePeriodSeconds
+	if p.GracePeriodSeconds > 0 && (grace == nil || *grace == policy.DefaultGracePeriodSeconds) {
+		seconds := p.GracePeriodSeconds
+		template.Spec.TerminationGracePeriodSeconds = &seconds
+	}
+	if p.PreStopSleepSeconds == 0 || !selectedByService(namespace, template.Labels, log) {
+		return
+	}
+	sleep := []string{"sleep", strconv.FormatInt(p.PreStopSleepSeconds, 10)}
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Lifecycle == nil {
+			container.Lifecycle = &corev1.Lifecycle{}
+		}
+		if container.Lifecycle.PreStop == nil {
+			container.Lifecycle.PreStop = &corev1.Handler{
+				Exec: &corev1.ExecAction{Command: sleep},
+			}
+		}
+	}
+}
+
+// selectedByService reports whether a Service of namespace selects the pods
+// labeled with podLabels, false when the Services can't be looked up.
+func selectedByService(namespace string, podLabels map[string]string, log Logger) bool {
+	if services == nil {
+		return false
+	}
+	list, err := services(namespace)
+	if err != nil {
+		log.Warningf(messages.ServicesUnknown, namespace, err)
+		return false
+	}
+	for _, service := range list {
+		// a Service without a selector has its endpoints managed by hand
+		if len(service.Spec.Selector) > 0 && labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(podLabels)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package admission
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/api/admission/v1"
+)
+
+// RuleObserver is told how long rule took on a request for an object of
+// kind. ctx is the context of the request, carrying its span.
+type RuleObserver func(ctx context.Context, kind, rule string, elapsed time.Duration)
+
+var observeRule RuleObserver
+
+// SetRuleObserver sets what is told how long every rule takes, e.g. a
+// histogram, so the rules adding the most latency can be found. Rules aren't
+// timed until it is set.
+func SetRuleObserver(observer RuleObserver) {
+	observeRule = observer
+}
+
+// timeRule runs rule, named name, on req and tells the RuleObserver how long
+// it took.
+func timeRule(ctx context.Context, req *v1.AdmissionRequest, name string, rule func()) {
+	if observeRule == nil {
+		rule()
+		return
+	}
+	start := time.Now()
+	rule()
+	observeRule(ctx, req.Kind.Kind, name, time.Since(start))
+}
@@ -0,0 +1,19 @@
+package admission
+
+import (
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// disableTokenAutomount sets automountServiceAccountToken to false on the
+// pod spec of pods in namespace annotated with annotations, unless the spec
+// sets it or the pods are annotated to keep the token. Most pods never talk
+// to the apiserver, a mounted token is only a credential to steal then.
+func disableTokenAutomount(namespace string, annotations map[string]string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).ServiceAccountToken
+	if !p.Required(namespace) || spec.AutomountServiceAccountToken != nil || policy.KeepServiceAccountToken(annotations) {
+		return
+	}
+	automount := false
+	spec.AutomountServiceAccountToken = &automount
+}
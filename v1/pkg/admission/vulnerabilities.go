@@ -0,0 +1,54 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VulnerabilityScanner returns the number of critical vulnerabilities a
+// scanner found in an image.
+type VulnerabilityScanner func(ctx context.Context, image string) (int, error)
+
+var scanner VulnerabilityScanner
+
+// SetVulnerabilityScanner sets the scanner images are checked with, it should
+// cache the results by image. Images aren't checked until it is set.
+func SetVulnerabilityScanner(s VulnerabilityScanner) {
+	scanner = s
+}
+
+// checkVulnerabilities denies pod specs in namespace, of an object of kind,
+// with images having more critical vulnerabilities than the vulnerability
+// policy allows. Images the scanner has no result for are denied as well,
+// unless the policy fails open, which warns about them.
+func checkVulnerabilities(ctx context.Context, d *denial, namespace, kind string, spec *corev1.PodSpec) {
+	p := &policy.ConfigFor(namespace).Vulnerabilities
+	if scanner == nil || !p.Required(namespace) {
+		return
+	}
+	lookupImages(d, kind, spec, func(d *denial, image, field string) {
+		critical, err := scanner(ctx, image)
+		var message string
+		switch {
+		case err != nil && p.FailOpen:
+			d.warn(fmt.Sprintf(messages.ImageNotScanned, image, err))
+			return
+		case err != nil:
+			message = fmt.Sprintf(messages.ImageNotScanned, image, err)
+		case critical > p.MaxCritical:
+			message = fmt.Sprintf(messages.ImageVulnerable, image, critical, p.MaxCritical)
+		default:
+			return
+		}
+		d.add(message, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: message,
+			Field:   field,
+		})
+	})
+}
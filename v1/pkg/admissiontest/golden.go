@@ -0,0 +1,555 @@
+// Package admissiontest runs AdmissionReview fixtures through the webhook and
+// compares the responses against golden files, so policy changes show up as
+// reviewable diffs. A downstream test only needs
+//
+//	func TestGolden(t *testing.T) {
+//		admissiontest.Run(t, "testdata/golden")
+//	}
+//
+// The fixtures are AdmissionReview JSON files in the mutate and validate
+// subdirectories of dir, each next to a <name>.golden file holding the
+// expected response. The fixtures run at the fixed time Clock in the cluster
+// Cluster, with the policy config in dir/policy.yaml, the namespaces listed
+// in dir/namespaces.yaml, the Services listed in dir/services.yaml, the
+// Deployments listed in dir/deployments.yaml, the HorizontalPodAutoscalers
+// listed in dir/horizontalpodautoscalers.yaml, the NetworkPolicies listed in
+// dir/networkpolicies.yaml, the nodes listed in dir/nodes.yaml, the
+// ConfigMaps listed in dir/configmaps.yaml and the image digests of
+// dir/digests.yaml, if there are, with the managed finalizer and with the
+// webhook itself in SelfNamespace. The mutate fixtures run a second time on
+// their own output, which must need no patch, see Reinvoked. Setting
+// UPDATE_GOLDEN=1 rewrites the golden files from the current behaviour
+// instead of comparing.
+package admissiontest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// UpdateEnv is the environment variable enabling the golden file update.
+const UpdateEnv = "UPDATE_GOLDEN"
+
+// PolicyFile is the policy config in the fixture directory.
+const PolicyFile = "policy.yaml"
+
+// NamespacesFile is the v1 List of the namespaces the fixtures see in the
+// fixture directory.
+const NamespacesFile = "namespaces.yaml"
+
+// ServicesFile is the v1 List of the Services the fixtures see in the
+// fixture directory.
+const ServicesFile = "services.yaml"
+
+// DeploymentsFile is the v1 List of the Deployments the fixtures see in the
+// fixture directory.
+const DeploymentsFile = "deployments.yaml"
+
+// HorizontalPodAutoscalersFile is the v1 List of the
+// HorizontalPodAutoscalers the fixtures see in the fixture directory.
+const HorizontalPodAutoscalersFile = "horizontalpodautoscalers.yaml"
+
+// NetworkPoliciesFile is the v1 List of the NetworkPolicies the fixtures see
+// in the fixture directory.
+const NetworkPoliciesFile = "networkpolicies.yaml"
+
+// NodesFile is the v1 List of the nodes the fixtures see in the fixture
+// directory.
+const NodesFile = "nodes.yaml"
+
+// ConfigMapsFile is the v1 List of the ConfigMaps the config checksums of
+// the fixtures digest in the fixture directory.
+const ConfigMapsFile = "configmaps.yaml"
+
+// DigestsFile maps the images the fixtures pin to their digest in the
+// fixture directory. The other images can't be resolved and stay unpinned.
+const DigestsFile = "digests.yaml"
+
+// Clock is the time the fixtures run at, so that the schedules of the policy
+// config give the same responses every run: Saturday, 9 October 2021, noon
+// UTC.
+var Clock = time.Date(2021, time.October, 9, 12, 0, 0, 0, time.UTC)
+
+// SelfNamespace is the namespace of the webhook itself in the fixtures, its
+// Service admission-webhook-example-svc and its objects labeled
+// app=admission-webhook-example there are admitted unchanged.
+const SelfNamespace = "admission-webhook"
+
+// Cluster is the name of the cluster the fixtures run in, the clusters
+// sections of the policy config naming it apply.
+const Cluster = "dev"
+
+// Handler processes a decoded admission request.
+type Handler func(ctx context.Context, req *v1.AdmissionRequest, log admission.Logger) *v1.AdmissionResponse
+
+// Handlers are the handlers fixtures are run through, by subdirectory.
+var Handlers = map[string]Handler{
+	"mutate":   admission.Mutate,
+	"validate": admission.Validate,
+}
+
+// Reinvoked are the subdirectories whose fixtures are run through their
+// handler a second time with the patch of the first response applied, like
+// the apiserver does with the reinvocationPolicy IfNeeded. The second run
+// must not patch the object again.
+var Reinvoked = map[string]bool{
+	"mutate": true,
+}
+
+// Case is a fixture and its golden file.
+type Case struct {
+	Name      string
+	Handler   Handler
+	Fixture   string
+	Golden    string
+	Reinvoked bool
+}
+
+// Cases lists the fixtures below dir, sorted by name.
+func Cases(dir string) ([]Case, error) {
+	var cases []Case
+	for sub, handler := range Handlers {
+		fixtures, err := filepath.Glob(filepath.Join(dir, sub, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, fixture := range fixtures {
+			name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+			cases = append(cases, Case{
+				Name:      sub + "/" + name,
+				Handler:   handler,
+				Fixture:   fixture,
+				Golden:    strings.TrimSuffix(fixture, ".json") + ".golden",
+				Reinvoked: Reinvoked[sub],
+			})
+		}
+	}
+	sort.Slice(cases, func(i, j int) bool { return cases[i].Name < cases[j].Name })
+	return cases, nil
+}
+
+// Response runs the fixture through its handler and renders the response
+// the way it is stored in the golden file.
+func (c Case) Response() ([]byte, error) {
+	response, err := c.response()
+	if err != nil {
+		return nil, err
+	}
+	return render(response)
+}
+
+// response runs the fixture through its handler, and a second time when
+// reinvoked.
+func (c Case) response() (*v1.AdmissionResponse, error) {
+	body, err := ioutil.ReadFile(c.Fixture)
+	if err != nil {
+		return nil, err
+	}
+	ar, err := admission.Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %v", c.Fixture, err)
+	}
+	if ar.Request == nil {
+		return nil, fmt.Errorf("%s has no request", c.Fixture)
+	}
+	response := c.Handler(context.Background(), ar.Request, discard{})
+	if c.Reinvoked {
+		if err := c.reinvoke(ar.Request, response); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// reinvoke runs req through the handler again with the patch of response
+// applied to its object, failing if the handler patches its own output.
+func (c Case) reinvoke(req *v1.AdmissionRequest, response *v1.AdmissionResponse) error {
+	if len(response.Patch) == 0 {
+		return nil
+	}
+	ops, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		return fmt.Errorf("decode patch: %v", err)
+	}
+	patched, err := ops.Apply(req.Object.Raw)
+	if err != nil {
+		return fmt.Errorf("apply patch: %v", err)
+	}
+	again := req.DeepCopy()
+	again.Object = runtime.RawExtension{Raw: patched}
+	if second := c.Handler(context.Background(), again, discard{}); len(second.Patch) > 0 {
+		return fmt.Errorf("reinvoked on its own output, the handler patches it again: %s", second.Patch)
+	}
+	return nil
+}
+
+// Check compares the response of every fixture below dir with its golden
+// file, or rewrites the golden files when update is set.
+func Check(dir string, update bool) error {
+	cases, err := Cases(dir)
+	if err != nil {
+		return err
+	}
+	if len(cases) == 0 {
+		return fmt.Errorf("no fixtures in %s", dir)
+	}
+	if err := setPolicy(dir); err != nil {
+		return err
+	}
+	var failed []string
+	for _, c := range cases {
+		if err := c.check(update); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", c.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// Run is Check as a test, with a subtest per fixture.
+func Run(t *testing.T, dir string) {
+	t.Helper()
+	cases, err := Cases(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatalf("no fixtures in %s", dir)
+	}
+	if err := setPolicy(dir); err != nil {
+		t.Fatal(err)
+	}
+	update := os.Getenv(UpdateEnv) != ""
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			if err := c.check(update); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// setPolicy sets the policy config, the namespaces, the Services, the
+// Deployments, the HorizontalPodAutoscalers, the NetworkPolicies, the nodes,
+// the ConfigMaps and the image digests of dir, the default config when it
+// has none, and the webhook itself.
+func setPolicy(dir string) error {
+	if err := setNamespaces(dir); err != nil {
+		return err
+	}
+	if err := setServices(dir); err != nil {
+		return err
+	}
+	if err := setDeployments(dir); err != nil {
+		return err
+	}
+	if err := setHorizontalPodAutoscalers(dir); err != nil {
+		return err
+	}
+	if err := setNetworkPolicies(dir); err != nil {
+		return err
+	}
+	if err := setNodes(dir); err != nil {
+		return err
+	}
+	if err := setConfigMaps(dir); err != nil {
+		return err
+	}
+	if err := setDigests(dir); err != nil {
+		return err
+	}
+	admission.SetManagedFinalizer(true)
+	admission.SetSelf(SelfNamespace, "admission-webhook-example-svc", labels.SelectorFromSet(labels.Set{"app": "admission-webhook-example"}), false)
+	policy.SetClock(func() time.Time { return Clock })
+	config := &policy.Config{}
+	file := filepath.Join(dir, PolicyFile)
+	if _, err := os.Stat(file); err == nil {
+		loaded, err := policy.LoadConfig(file)
+		if err != nil {
+			return err
+		}
+		if config, err = loaded.ForCluster(Cluster); err != nil {
+			return err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	policy.SetConfig(config)
+	return nil
+}
+
+func setNamespaces(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, NamespacesFile))
+	if os.IsNotExist(err) {
+		admission.SetNamespaceGetter(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list corev1.NamespaceList
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", NamespacesFile, err)
+	}
+	byName := make(map[string]*corev1.Namespace, len(list.Items))
+	for i := range list.Items {
+		byName[list.Items[i].Name] = &list.Items[i]
+	}
+	admission.SetNamespaceGetter(func(name string) (*corev1.Namespace, error) {
+		if namespace, ok := byName[name]; ok {
+			return namespace, nil
+		}
+		return nil, fmt.Errorf("namespace %s not found", name)
+	})
+	return nil
+}
+
+func setServices(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ServicesFile))
+	if os.IsNotExist(err) {
+		admission.SetServiceLister(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list corev1.ServiceList
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", ServicesFile, err)
+	}
+	byNamespace := map[string][]*corev1.Service{}
+	for i := range list.Items {
+		service := &list.Items[i]
+		byNamespace[service.Namespace] = append(byNamespace[service.Namespace], service)
+	}
+	admission.SetServiceLister(func(namespace string) ([]*corev1.Service, error) {
+		return byNamespace[namespace], nil
+	})
+	return nil
+}
+
+func setDeployments(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, DeploymentsFile))
+	if os.IsNotExist(err) {
+		admission.SetDeploymentLister(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list appsv1.DeploymentList
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", DeploymentsFile, err)
+	}
+	byNamespace := map[string][]*appsv1.Deployment{}
+	for i := range list.Items {
+		deployment := &list.Items[i]
+		byNamespace[deployment.Namespace] = append(byNamespace[deployment.Namespace], deployment)
+	}
+	admission.SetDeploymentLister(func(namespace string) ([]*appsv1.Deployment, error) {
+		return byNamespace[namespace], nil
+	})
+	return nil
+}
+
+func setHorizontalPodAutoscalers(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, HorizontalPodAutoscalersFile))
+	if os.IsNotExist(err) {
+		admission.SetHorizontalPodAutoscalerLister(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list autoscalingv1.HorizontalPodAutoscalerList
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", HorizontalPodAutoscalersFile, err)
+	}
+	byNamespace := map[string][]*autoscalingv1.HorizontalPodAutoscaler{}
+	for i := range list.Items {
+		hpa := &list.Items[i]
+		byNamespace[hpa.Namespace] = append(byNamespace[hpa.Namespace], hpa)
+	}
+	admission.SetHorizontalPodAutoscalerLister(func(namespace string) ([]*autoscalingv1.HorizontalPodAutoscaler, error) {
+		return byNamespace[namespace], nil
+	})
+	return nil
+}
+
+func setNetworkPolicies(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, NetworkPoliciesFile))
+	if os.IsNotExist(err) {
+		admission.SetNetworkPolicyLister(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list networkingv1.NetworkPolicyList
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", NetworkPoliciesFile, err)
+	}
+	byNamespace := map[string][]*networkingv1.NetworkPolicy{}
+	for i := range list.Items {
+		networkPolicy := &list.Items[i]
+		byNamespace[networkPolicy.Namespace] = append(byNamespace[networkPolicy.Namespace], networkPolicy)
+	}
+	admission.SetNetworkPolicyLister(func(namespace string) ([]*networkingv1.NetworkPolicy, error) {
+		return byNamespace[namespace], nil
+	})
+	return nil
+}
+
+func setNodes(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, NodesFile))
+	if os.IsNotExist(err) {
+		admission.SetNodeLister(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list corev1.NodeList
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", NodesFile, err)
+	}
+	nodes := make([]*corev1.Node, len(list.Items))
+	for i := range list.Items {
+		nodes[i] = &list.Items[i]
+	}
+	admission.SetNodeLister(func() ([]*corev1.Node, error) {
+		return nodes, nil
+	})
+	return nil
+}
+
+func setConfigMaps(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ConfigMapsFile))
+	if os.IsNotExist(err) {
+		admission.SetConfigDigest(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list corev1.ConfigMapList
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", ConfigMapsFile, err)
+	}
+	digests := map[string]string{}
+	for i := range list.Items {
+		configMap := &list.Items[i]
+		keys := make([]string, 0, len(configMap.Data))
+		for key := range configMap.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		hash := sha256.New()
+		for _, key := range keys {
+			fmt.Fprintf(hash, "%s\n%s\n", key, configMap.Data[key])
+		}
+		digests[configMap.Namespace+"/"+configMap.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+	admission.SetConfigDigest(func(ctx context.Context, kind, namespace, name string) (string, bool, error) {
+		if kind != "ConfigMap" {
+			return "", false, nil
+		}
+		digest, exists := digests[namespace+"/"+name]
+		return digest, exists, nil
+	})
+	return nil
+}
+
+func setDigests(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, DigestsFile))
+	if os.IsNotExist(err) {
+		admission.SetDigestResolver(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var digests map[string]string
+	if err := yaml.UnmarshalStrict(data, &digests); err != nil {
+		return fmt.Errorf("%s: %v", DigestsFile, err)
+	}
+	admission.SetDigestResolver(func(ctx context.Context, image string) (string, error) {
+		if digest, ok := digests[image]; ok {
+			return digest, nil
+		}
+		return "", fmt.Errorf("no digest for %s", image)
+	})
+	return nil
+}
+
+func (c Case) check(update bool) error {
+	got, err := c.Response()
+	if err != nil {
+		return err
+	}
+	if update {
+		return ioutil.WriteFile(c.Golden, got, 0644)
+	}
+	want, err := ioutil.ReadFile(c.Golden)
+	if err != nil {
+		return fmt.Errorf("%v, run with %s=1 to create it", err, UpdateEnv)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("response differs from %s\n--- want\n%s--- got\n%s", c.Golden, want, got)
+	}
+	return nil
+}
+
+// golden is the stored form of an AdmissionResponse, with the patch decoded
+// so that changes to it diff line by line.
+type golden struct {
+	Allowed          bool              `json:"allowed"`
+	Result           *metav1.Status    `json:"status,omitempty"`
+	PatchType        *v1.PatchType     `json:"patchType,omitempty"`
+	Patch            json.RawMessage   `json:"patch,omitempty"`
+	Warnings         []string          `json:"warnings,omitempty"`
+	AuditAnnotations map[string]string `json:"auditAnnotations,omitempty"`
+}
+
+func render(response *v1.AdmissionResponse) ([]byte, error) {
+	g := golden{
+		Allowed:          response.Allowed,
+		Result:           response.Result,
+		PatchType:        response.PatchType,
+		Patch:            response.Patch,
+		Warnings:         response.Warnings,
+		AuditAnnotations: response.AuditAnnotations,
+	}
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// discard drops the handler logs.
+type discard struct{}
+
+func (discard) Infof(format string, args ...interface{})    {}
+func (discard) Warningf(format string, args ...interface{}) {}
+func (discard) Errorf(format string, args ...interface{})   {}
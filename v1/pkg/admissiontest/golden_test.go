@@ -0,0 +1,218 @@
+package admissiontest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestGolden(t *testing.T) {
+	Run(t, "testdata")
+}
+
+// reinvokedRules are the mutating rules, by the name their provenance is
+// recorded with, and the mutate fixtures they patch: TestGolden reinvokes
+// the handler on the output of every one of them.
+var reinvokedRules = map[string][]string{
+	"requestReduction":      {"deployment-request-reduction", "pod-request-reduction-clamped"},
+	"priorityClasses":       {"deployment-priority-class"},
+	"runtimeClasses":        {"deployment-runtime-class"},
+	"guaranteedQoSSelector": {"deployment-guaranteed-qos"},
+	"namespaceMetadata":     {"deployment-namespace-metadata"},
+	"propagatedLabels":      {"deployment-update-propagated-labels"},
+	"templateLabels":        {"deployment-template-labels"},
+	"antiAffinity":          {"deployment-anti-affinity"},
+	"gpus":                  {"pod-gpu"},
+	"termination":           {"deployment-termination"},
+	"sidecars":              {"deployment-sidecars", "deployment-update-provenance"},
+	"injectionTemplates":    {"pod-injection"},
+	"managedFinalizer":      {"deployment-managed-finalizer"},
+	"configChecksum":        {"deployment-config-checksum"},
+	"serviceAccountToken":   {"pod-service-account-token"},
+	"registryMirrors":       {"pod-mirrored-images", "pod-pinned-images"},
+	"imagePullSecrets":      {"pod-image-pull-secrets"},
+	"autoscaling":           {"deployment-update-autoscaled"},
+	"namespaceDefaults":     {"namespace"},
+}
+
+// TestReinvokedRules checks every mutating rule has a fixture it patches,
+// so that the reinvocation of TestGolden covers its output.
+func TestReinvokedRules(t *testing.T) {
+	cases, err := Cases("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]Case, len(cases))
+	for _, c := range cases {
+		byName[c.Name] = c
+	}
+	if err := setPolicy("testdata"); err != nil {
+		t.Fatal(err)
+	}
+	for rule, fixtures := range reinvokedRules {
+		for _, fixture := range fixtures {
+			c, ok := byName["mutate/"+fixture]
+			if !ok {
+				t.Errorf("%s: no fixture mutate/%s", rule, fixture)
+				continue
+			}
+			if !c.Reinvoked {
+				t.Errorf("%s: %s isn't reinvoked", rule, c.Name)
+			}
+			response, err := c.response()
+			if err != nil {
+				t.Errorf("%s: %s: %v", rule, c.Name, err)
+			} else if len(response.Patch) == 0 {
+				t.Errorf("%s: %s isn't patched, its reinvocation checks nothing", rule, c.Name)
+			}
+		}
+	}
+}
+
+// TestSkippedMutation checks the objects left to their controller are
+// admitted without running the mutating rules: the image of
+// mutate/pod-skipped-owner would be pinned otherwise.
+func TestSkippedMutation(t *testing.T) {
+	cases, err := Cases("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setPolicy("testdata"); err != nil {
+		t.Fatal(err)
+	}
+	defer admission.SetDigestResolver(nil)
+	for _, c := range cases {
+		var lookups int32
+		admission.SetDigestResolver(func(ctx context.Context, image string) (string, error) {
+			atomic.AddInt32(&lookups, 1)
+			return "", fmt.Errorf("no digest for %s", image)
+		})
+		switch c.Name {
+		case "mutate/pod-pinned-images":
+			if _, err := c.response(); err != nil {
+				t.Fatal(err)
+			}
+			if lookups == 0 {
+				t.Errorf("%s: no digest looked up, the check below checks nothing", c.Name)
+			}
+		case "mutate/pod-skipped-owner":
+			response, err := c.response()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lookups != 0 {
+				t.Errorf("%s: %d digests looked up for an object left to its controller", c.Name, lookups)
+			}
+			if !response.Allowed || len(response.Patch) > 0 {
+				t.Errorf("%s: want allowed without patch, got allowed %v, patch %s", c.Name, response.Allowed, response.Patch)
+			}
+		}
+	}
+}
+
+// TestGoldenParallel checks the fixtures get byte-identical responses with
+// their rules and lookups on 8 workers as on 1, so run it with -race too.
+func TestGoldenParallel(t *testing.T) {
+	cases, err := Cases("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setPolicy("testdata"); err != nil {
+		t.Fatal(err)
+	}
+	serial := make([][]byte, len(cases))
+	for i, c := range cases {
+		if serial[i], err = c.Response(); err != nil {
+			t.Fatalf("%s: %v", c.Name, err)
+		}
+	}
+	admission.SetRuleWorkers(8)
+	defer admission.SetRuleWorkers(1)
+	for i, c := range cases {
+		parallel, err := c.Response()
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name, err)
+		}
+		if !bytes.Equal(parallel, serial[i]) {
+			t.Errorf("%s: response differs on 8 workers\n--- 1 worker\n%s--- 8 workers\n%s", c.Name, serial[i], parallel)
+		}
+	}
+}
+
+// TestReducedDeploymentPods checks the pods of a Deployment whose requests
+// the webhook reduced aren't reduced a second time: mutate/deployment-
+// request-reduction is mutated, then a Pod of its mutated template.
+func TestReducedDeploymentPods(t *testing.T) {
+	if err := setPolicy("testdata"); err != nil {
+		t.Fatal(err)
+	}
+	c := Case{Name: "mutate/deployment-request-reduction", Handler: admission.Mutate, Fixture: "testdata/mutate/deployment-request-reduction.json"}
+	body, err := ioutil.ReadFile(c.Fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := admission.Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := c.response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := ops.Apply(ar.Request.Object.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deployment appsv1.Deployment
+	if err := json.Unmarshal(patched, &deployment); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployment.Spec.Template.Spec.Containers) == 0 || deployment.Spec.Template.Spec.Containers[0].Resources.Requests.Cpu().Cmp(resource.MustParse("5m")) != 0 {
+		t.Fatalf("the Deployment isn't reduced: %s", response.Patch)
+	}
+
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: *deployment.Spec.Template.ObjectMeta.DeepCopy(),
+		Spec:       *deployment.Spec.Template.Spec.DeepCopy(),
+	}
+	pod.Name, pod.Namespace = deployment.Name+"-5d8f7c9b6-x2k4q", deployment.Namespace
+	raw, err := json.Marshal(&pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &v1.AdmissionRequest{
+		UID:       "f0000000-0000-0000-0000-000000000070",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Operation: v1.Create,
+		UserInfo:  ar.Request.UserInfo,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	podResponse := admission.Mutate(context.Background(), req, discard{})
+	if !podResponse.Allowed {
+		t.Fatalf("pod denied: %v", podResponse.Result)
+	}
+	if bytes.Contains(podResponse.Patch, []byte("/resources/requests")) {
+		t.Errorf("the requests of the pods of the reduced Deployment are reduced again: %s", podResponse.Patch)
+	}
+}
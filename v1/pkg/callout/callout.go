@@ -0,0 +1,96 @@
+// Package callout asks an external policy service to decide on admission
+// requests.
+package callout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/patch"
+	v1 "k8s.io/api/admission/v1"
+)
+
+// Decision is the answer of the policy service to an admission request.
+type Decision struct {
+	// Allowed admits the request, it is denied with Message otherwise.
+	Allowed bool   `json:"allowed"`
+	Message string `json:"message,omitempty"`
+	// Patch is merged into the patch of the mutation, it is ignored on
+	// validation.
+	Patch    []patch.Operation `json:"patch,omitempty"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+// Client posts admission requests to the policy service.
+type Client struct {
+	url     string
+	client  *http.Client
+	retries int
+	backoff time.Duration
+}
+
+// NewClient returns the client of the policy service at rawURL. Each attempt
+// times out after timeout, failed ones are retried retries times.
+func NewClient(rawURL string, timeout time.Duration, retries int) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid policy service URL %q", rawURL)
+	}
+	return &Client{
+		url:     u.String(),
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+		backoff: 100 * time.Millisecond,
+	}, nil
+}
+
+// Decide posts req, with the object it is about, to the policy service and
+// returns its decision. Network errors and server errors are retried until
+// ctx is done.
+func (c *Client) Decide(ctx context.Context, req *v1.AdmissionRequest) (*Decision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		decision, retry, err := c.post(ctx, body)
+		if err == nil || !retry || attempt >= c.retries {
+			return decision, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(c.backoff << uint(attempt)):
+		}
+	}
+}
+
+// post makes one attempt, retry reports whether a failed one may be retried.
+func (c *Client) post(ctx context.Context, body []byte) (decision *Decision, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("policy service answered %s", resp.Status)
+	}
+	decision = &Decision{}
+	if err := json.NewDecoder(resp.Body).Decode(decision); err != nil {
+		return nil, false, fmt.Errorf("can't decode the decision of the policy service: %v", err)
+	}
+	return decision, false, nil
+}
@@ -0,0 +1,178 @@
+// Package client submits manifests to the /check API of the webhook, so CI
+// plugins and operators written in Go get the verdicts, warnings and patches
+// of their objects as types rather than posting them by hand.
+//
+//	c, err := client.NewClient("https://admission-webhook.example.com", token, nil)
+//	result, err := c.Check(ctx, manifests, client.CheckOptions{Namespace: "team-a"})
+//	for _, verdict := range result.Denied() {
+//		fmt.Printf("%s %s/%s: %s\n", verdict.Kind, verdict.Namespace, verdict.Name, verdict.Message)
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/patch"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// The formats of the kustomize patches /check returns besides the JSON patch.
+const (
+	// PatchFormatJSON6902 is an entry of the patches of a kustomization.yaml
+	// with the JSON patch inline.
+	PatchFormatJSON6902 = "json6902"
+	// PatchFormatStrategicMerge is a strategic merge patch file.
+	PatchFormatStrategicMerge = "strategic-merge"
+)
+
+// Verdict is what the webhook answers about one object of the manifests.
+type Verdict struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Allowed   bool   `json:"allowed"`
+	// DeniedBy is mutate or validate when denied
+	DeniedBy string   `json:"deniedBy,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// Patch is the JSON patch of the mutation, none when it changes nothing
+	Patch []patch.Operation `json:"patch,omitempty"`
+	// KustomizePatch is the mutation as a kustomize patch of the
+	// CheckOptions.PatchFormat, when asked for
+	KustomizePatch string `json:"kustomizePatch,omitempty"`
+}
+
+// CheckResult is the answer of /check: the verdicts of the objects in the
+// order of the manifests, Allowed being false as soon as one is denied.
+type CheckResult struct {
+	Allowed bool       `json:"allowed"`
+	Results []*Verdict `json:"results"`
+}
+
+// Denied returns the verdicts of the objects denied.
+func (r *CheckResult) Denied() []*Verdict {
+	var denied []*Verdict
+	for _, verdict := range r.Results {
+		if !verdict.Allowed {
+			denied = append(denied, verdict)
+		}
+	}
+	return denied
+}
+
+// CheckOptions are the parameters of a check.
+type CheckOptions struct {
+	// Namespace is the namespace of the objects without one
+	Namespace string
+	// PatchFormat, PatchFormatJSON6902 or PatchFormatStrategicMerge, adds
+	// the mutations as kustomize patches to the verdicts, none when empty
+	PatchFormat string
+}
+
+// StatusError is the error of a check the webhook refused, such as one
+// without a valid token (401), by a user who isn't allowed (403) or with
+// manifests it can't parse (400).
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook answered %d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// Client submits manifests to the /check API of a webhook.
+type Client struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewClient returns the client of the webhook at rawURL, such as
+// https://admission-webhook.example.com, authenticating with token, read
+// from -checkTokenFile or one the apiserver authenticates with
+// -checkTokenReview. The requests are made with httpClient, which should
+// trust the CA of the webhook and set a timeout, http.DefaultClient when
+// nil.
+func NewClient(rawURL, token string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", rawURL)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/check"
+	return &Client{
+		url:    u.String(),
+		token:  token,
+		client: httpClient,
+	}, nil
+}
+
+// Check submits manifests, one or more YAML documents or JSON objects, Lists
+// included, to the webhook, which runs every object through its mutation and
+// validation as if it were created. The objects aren't created. An error is
+// returned when the webhook can't answer, a *StatusError when it refuses the
+// check, not when it denies objects.
+func (c *Client) Check(ctx context.Context, manifests []byte, options CheckOptions) (*CheckResult, error) {
+	query := url.Values{}
+	if options.Namespace != "" {
+		query.Set("namespace", options.Namespace)
+	}
+	if options.PatchFormat != "" {
+		query.Set("patchFormat", options.PatchFormat)
+	}
+	target := c.url
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(manifests))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, &StatusError{Code: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	result := &CheckResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("can't decode the answer of the webhook: %v", err)
+	}
+	return result, nil
+}
+
+// CheckObjects is Check for objects, which must carry their apiVersion and
+// kind: the typed objects of client-go don't when they were read from the
+// apiserver.
+func (c *Client) CheckObjects(ctx context.Context, objects []runtime.Object, options CheckOptions) (*CheckResult, error) {
+	var manifests bytes.Buffer
+	for i, object := range objects {
+		if object.GetObjectKind().GroupVersionKind().Kind == "" {
+			return nil, fmt.Errorf("object %d has no kind", i)
+		}
+		data, err := json.Marshal(object)
+		if err != nil {
+			return nil, fmt.Errorf("object %d: %v", i, err)
+		}
+		manifests.Write(data)
+		manifests.WriteByte('\n')
+	}
+	return c.Check(ctx, manifests.Bytes(), options)
+}
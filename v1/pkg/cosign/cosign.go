@@ -0,0 +1,177 @@
+// Package cosign verifies the cosign signatures of images against public
+// keys. The signatures are read from the registry like cosign stores them:
+// as layers of the sha256-<digest>.sig tag of the image repository, each a
+// simple signing payload with its signature in an annotation.
+package cosign
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/registry"
+)
+
+// the annotation of a signature layer holding the base64 signature
+const signatureAnnotation = "dev.cosignproject.cosign/signature"
+
+var signatureManifestTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type manifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// payload is the simple signing document cosign signs.
+type payload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// ParsePublicKey parses a PEM encoded ECDSA, RSA or Ed25519 public key, as
+// written by cosign generate-key-pair.
+func ParsePublicKey(data string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", key)
+}
+
+// Verifier verifies images and caches the digests verified.
+type Verifier struct {
+	registry *registry.Resolver
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	verified map[string]time.Time
+}
+
+// NewVerifier returns a Verifier reading images from r and caching the
+// verified digests for ttl.
+func NewVerifier(r *registry.Resolver, ttl time.Duration) *Verifier {
+	return &Verifier{
+		registry: r,
+		ttl:      ttl,
+		verified: map[string]time.Time{},
+	}
+}
+
+// Verify checks that one of keys signed the digest image refers to, the
+// registry requests are cancelled with ctx.
+func (v *Verifier) Verify(ctx context.Context, image string, keys []crypto.PublicKey) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("no public keys configured")
+	}
+	digest, err := v.registry.Digest(ctx, image)
+	if err != nil {
+		return err
+	}
+	// keyed by the keys too, a verification with keys removed since doesn't count
+	cacheKey := digest + "/" + fingerprint(keys)
+	v.mu.Lock()
+	expires, ok := v.verified[cacheKey]
+	v.mu.Unlock()
+	if ok && time.Now().Before(expires) {
+		return nil
+	}
+
+	if err := v.verify(ctx, image, digest, keys); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.verified[cacheKey] = time.Now().Add(v.ttl)
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *Verifier) verify(ctx context.Context, image, digest string, keys []crypto.PublicKey) error {
+	signatures := registry.Repository(image) + ":" + strings.Replace(digest, ":", "-", 1) + ".sig"
+	data, err := v.registry.Manifest(ctx, signatures, signatureManifestTypes...)
+	if err != nil {
+		return fmt.Errorf("no signatures: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("invalid signature manifest: %v", err)
+	}
+	for _, layer := range m.Layers {
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[signatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+		body, err := v.registry.Blob(ctx, signatures, layer.Digest)
+		if err != nil {
+			return err
+		}
+		if sum := sha256.Sum256(body); "sha256:"+hex.EncodeToString(sum[:]) != layer.Digest {
+			continue
+		}
+		var p payload
+		if json.Unmarshal(body, &p) != nil || p.Critical.Image.DockerManifestDigest != digest {
+			continue
+		}
+		for _, key := range keys {
+			if verifySignature(key, body, signature) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no signature of %s by the configured keys", digest)
+}
+
+func verifySignature(key crypto.PublicKey, body, signature []byte) bool {
+	sum := sha256.Sum256(body)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(signature, &rs); err != nil || len(rest) > 0 {
+			return false
+		}
+		return ecdsa.Verify(key, sum[:], rs.R, rs.S)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, body, signature)
+	}
+	return false
+}
+
+func fingerprint(keys []crypto.PublicKey) string {
+	h := sha256.New()
+	for _, key := range keys {
+		der, _ := x509.MarshalPKIXPublicKey(key)
+		h.Write(der)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
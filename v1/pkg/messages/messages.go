@@ -0,0 +1,274 @@
+// Package messages is the catalog of the messages the webhook logs and
+// returns. Messages are English format strings, which is what AdmissionResponse
+// results always carry since users of any team read them in kubectl output.
+// Logs are written in the language set by SetLanguage.
+package messages
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// response and log messages
+const (
+	UnsupportedKind        = "unsupported kind %s"
+	DecodeObjectFailed     = "can't decode %s: %v"
+	DecodeReviewFailed     = "can't decode AdmissionReview: %v"
+	LabelsMissing          = "required labels are not set: %s"
+	LabelMissing           = "required label %s is not set"
+	ObjectExempt           = "%s %s/%s admitted without checks, its labels match the exemption selector %s"
+	SubjectExempt          = "%s %s/%s admitted without checks, %s is an exempt subject"
+	SelfAdmitted           = "%s %s/%s admitted without checks, it belongs to the webhook itself"
+	DeletionProtected      = "%s %s is protected by the label %s=true, annotate it with %s=true to delete it"
+	FieldsImmutable        = "%s %s can't be updated, immutable fields changed: %s"
+	FieldImmutable         = "field %s is immutable"
+	ServiceTypeRestricted  = "Services of type %s are not allowed in namespace %s"
+	ServiceSelectsNothing  = "selector %s matches the pods of no Deployment in namespace %s"
+	ServiceNodePortUsed    = "nodePort %d is already used by Service %s"
+	ServicePortUsed        = "port %d/%s is already exposed by Service %s with the same selector"
+	ServiceNotChecked      = "Service %s is not checked against the %s of namespace %s, can't look them up: %v"
+	IngressHostNotAllowed  = "host %s is not allowed"
+	IngressHostWithoutTLS  = "host %s is not listed in a TLS section"
+	IngressClassMissing    = "ingress class is not set"
+	AnnotationMissing      = "required annotation %s is not set"
+	AnnotationInvalid      = "annotation %s=%q doesn't match %s"
+	StorageClassNotAllowed = "storage class %s is not allowed"
+	ClaimTooLarge          = "requested storage %s exceeds the maximum of %s in namespace %s"
+	ReductionInvalid       = "annotation %s=%s is not a percentage from 1 to 100 or off, %d%% of the requests are kept"
+	ReductionClamped       = "annotation %s=%s is below the minimum, %d%% of the requests are kept"
+	QoSClassLowered        = "requests reduced to %d%% lower the QoS class of %s %s from %s to %s, evicted sooner under node pressure; annotate it with %s=off to keep its requests"
+	QoSClassKept           = "requests not reduced to %d%%, it would lower the QoS class of %s %s from %s to %s"
+	ReplicasTooFew         = "replicas %d are below the minimum of %d"
+	ReplicasTooMany        = "replicas %d exceed the maximum of %d"
+	PDBMissing             = "no PodDisruptionBudget selects the pods of the %d replicas of Deployment %s in namespace %s"
+	PDBLookupFailed        = "can't look up the PodDisruptionBudgets of namespace %s: %v"
+	NetworkPolicyMissing   = "no NetworkPolicy selects the pods of %s %s in namespace %s, their traffic isn't restricted"
+	NetworkPoliciesUnknown = "can't look up the NetworkPolicies of namespace %s: %v"
+	APIDeprecated          = "%s %s is deprecated since Kubernetes %s, %s"
+	APIRemoved             = "%s %s is removed in Kubernetes %s, %s"
+	AnnotationDeprecated   = "annotation %s is deprecated since Kubernetes %s, %s"
+	AnnotationRemoved      = "annotation %s is ignored from Kubernetes %s, %s"
+	ScaleNotChecked        = "replicas of Deployment %s/%s are not checked, can't look it up: %v"
+	AutoscalersUnknown     = "can't look up the HorizontalPodAutoscalers of namespace %s, replicas are handled as if none targets the Deployment: %v"
+	AutoscaledReplicasKept = "replicas of Deployment %s are kept at %d, the HorizontalPodAutoscaler %s owns them"
+	ProbeMissing           = "container %s has no %s probe"
+	SelectorMissing        = "%s %s has no selector, it must select the labels of its pod template"
+	SelectorMismatch       = "selector of %s %s doesn't match the labels of its pod template: %s"
+	SelectorChanged        = "selector of %s %s can't be changed from %s to %s, it is immutable: delete and recreate it, or create one with another name"
+	ReferencesMissing      = "%s %s references %s, which don't exist in namespace %s"
+	ReferenceLookupFailed  = "can't look up %s in namespace %s, it is not checked: %v"
+	StrategyRecreate       = "Deployment %s must use the RollingUpdate strategy, Recreate stops all its pods at once"
+	StrategyBoundExceeded  = "%s %s is %d pods of the %d replicas, above the maximum of %s"
+	MemoryPerCPUTooLow     = "container %s requests %s of memory per cpu core, below the minimum of %s"
+	MemoryPerCPUTooHigh    = "container %s requests %s of memory per cpu core, above the maximum of %s"
+	RequestAboveLimit      = "container %s requests %s of %s, above its limit %s"
+	HugePagesUnequal       = "container %s requests %s of %s, hugepages requests must equal their limit %s"
+	HugePagesNotMultiple   = "container %s requests %s of %s, not a multiple of the page size %s"
+	EphemeralStorageTooBig = "container %s requests %s of ephemeral-storage, above the maximum of %s"
+	PodRequestsExceeded    = "%s %s requests %s of %s per pod, above the maximum of %s"
+	PodFitsNoNode          = "%s %s requests %s per pod, none of the %d schedulable nodes it can run on has that allocatable, its pods would stay Pending"
+	NodesNotChecked        = "the requests of %s %s are not checked against the nodes, can't list them: %v"
+	GPUsPerPodExceeded     = "%s %s requests %d GPUs per pod, above the maximum of %d in namespace %s"
+	GPUsPerNamespace       = "the replicas of Deployment %s bring the GPUs of the Deployments of namespace %s to %d, above the maximum of %d"
+	GPUsNotChecked         = "GPUs of namespace %s are not checked, can't look up its Deployments: %v"
+	ImageNotSigned         = "image %s is not signed: %v"
+	ImageVulnerable        = "image %s has %d critical vulnerabilities, at most %d are allowed"
+	ImageNotScanned        = "image %s can't be checked for vulnerabilities: %v"
+	EphemeralNotAllowed    = "ephemeral container %s can't be added, namespace %s doesn't allow ephemeral containers"
+	EphemeralImageDenied   = "image %s is not allowed for ephemeral containers"
+	EphemeralPrivileged    = "ephemeral container %s must not %s"
+	DataTooLarge           = "data of %s %s is %s, exceeds the maximum of %s"
+	DataForbidden          = "%s matches the forbidden pattern %s"
+	FreezeWindowOpen       = "%s %s can't be changed in namespace %s while the freeze window %s is open, until %s; annotate it with %s=<reason> to override the freeze in an emergency"
+	FreezeOverridden       = "freeze window %s overridden by %s: %s"
+	CalloutDenied          = "denied by the policy service: %s"
+	CalloutFailed          = "can't consult the policy service: %v"
+	DeadlineAllowed        = "admitted without the checks of the webhook, they didn't finish in time: %v"
+	DeadlineDenied         = "denied, the checks of the webhook didn't finish in time: %v"
+	InternalErrorAllowed   = "admitted without the checks of the webhook, it failed to process the request: %s"
+	NamespaceRateLimited   = "too many requests from namespace %s, at most %g per second are admitted, retry later"
+	NamespaceNotCached     = "namespace %s is not cached by the webhook yet, retry later: %v"
+	MethodNotAllowed       = "method %s not allowed"
+	ReadBodyFailed         = "can't read body: %v"
+	EmptyBody              = "empty body"
+	ConvertYAMLFailed      = "can't convert YAML body: %v"
+	UnsupportedContentType = "unsupported Content-Type %s, expect application/json, application/yaml or %s"
+	EncodeResponseFailed   = "can't encode response: %v"
+	WriteResponseFailed    = "can't write response: %v"
+	NoResponse             = "the webhook didn't answer the request"
+)
+
+// log only messages
+const (
+	AdmissionBegin       = "======begin Admission for Namespace=[%v], Kind=[%v], Name=[%v]======"
+	AdmissionEnd         = "======ended Admission, response written======"
+	RequestPath          = "path: %s"
+	WritingResponse      = "writing response"
+	ResponsePatch        = "AdmissionResponse: patch=%v"
+	PatchLarge           = "patch of %s %s/%s is %d bytes, above the warning threshold of %d bytes"
+	NamespaceIgnored     = "skip %v, namespace %v is ignored"
+	ValidationPolicy     = "validation policy for %v/%v: required:%v"
+	ValidationSkip       = "skip validation for %s/%s due to policy check"
+	LabelsAvailable      = "available labels: %s"
+	LabelsRequired       = "required labels: %s"
+	MutationSkip         = "skip mutation of %s/%s, it is reconciled by %s"
+	AdmittedThrough      = "skip %s %s/%s, it is admitted through %s"
+	DeletedObjectMissing = "no deleted object sent for %s %s/%s, deletion protection is skipped"
+	OldObjectMissing     = "no old object sent for %s %s/%s, immutable fields aren't checked"
+	NamespaceNoDefaults  = "no namespace defaults match %s"
+	NamespaceUnknown     = "can't look up namespace %s, rules depending on its labels don't apply: %v"
+	DigestUnresolved     = "image %s is not pinned to a digest: %v"
+	OperationSkipped     = "skip %s of %s %s/%s, the operation isn't checked"
+	ServicesUnknown      = "can't look up the Services of namespace %s, no preStop hook is added: %v"
+	SidecarUpgraded      = "sidecar %s upgraded to version %s, image %s"
+	SidecarRemoved       = "sidecar %s removed by version %s"
+	InjectionUnknown     = "injection templates %s don't exist for namespace %s, they are not injected"
+	ChecksumFailed       = "can't digest %s in namespace %s, the config checksum is kept: %v"
+)
+
+// translations of the messages by language, English needs none
+var catalog = map[string]map[string]string{
+	"zh": {
+		UnsupportedKind:        "不支持的资源类型 %s",
+		DecodeObjectFailed:     "无法解析 %s: %v",
+		DecodeReviewFailed:     "无法解析 AdmissionReview: %v",
+		LabelsMissing:          "缺少必需的标签: %s",
+		LabelMissing:           "缺少必需的标签 %s",
+		ObjectExempt:           "%s %s/%s 的标签匹配豁免选择器 %s，未经检查直接放行",
+		SubjectExempt:          "%[4]s 是豁免的用户，%[1]s %[2]s/%[3]s 未经检查直接放行",
+		SelfAdmitted:           "%s %s/%s 属于 webhook 自身，未经检查直接放行",
+		DeletionProtected:      "%s %s 受标签 %s=true 保护，添加注解 %s=true 后才能删除",
+		FieldsImmutable:        "%s %s 无法更新，修改了不可变字段: %s",
+		FieldImmutable:         "字段 %s 不可修改",
+		ServiceTypeRestricted:  "命名空间 %[2]s 中不允许 %[1]s 类型的 Service",
+		ServiceSelectsNothing:  "选择器 %s 没有选中命名空间 %s 中任何 Deployment 的 Pod",
+		ServiceNodePortUsed:    "nodePort %d 已被 Service %s 使用",
+		ServicePortUsed:        "端口 %d/%s 已由选择器相同的 Service %s 暴露",
+		ServiceNotChecked:      "无法查询命名空间 %[3]s 的 %[2]s，没有检查 Service %[1]s: %[4]v",
+		IngressHostNotAllowed:  "不允许使用域名 %s",
+		IngressHostWithoutTLS:  "域名 %s 没有配置 TLS",
+		IngressClassMissing:    "没有设置 ingress class",
+		AnnotationMissing:      "缺少必需的注解 %s",
+		AnnotationInvalid:      "注解 %s=%q 不匹配 %s",
+		StorageClassNotAllowed: "不允许使用存储类 %s",
+		ClaimTooLarge:          "申请的存储 %s 超过了命名空间 %[3]s 的上限 %[2]s",
+		ReductionInvalid:       "注解 %s=%s 不是 1 到 100 的百分比或 off，保留 %d%% 的资源申请",
+		ReductionClamped:       "注解 %s=%s 低于下限，保留 %d%% 的资源申请",
+		QoSClassLowered:        "资源申请降低到 %d%% 会使 %s %s 的 QoS 等级从 %s 降为 %s，节点资源紧张时会更早被驱逐；添加注解 %s=off 可以保留原来的申请",
+		QoSClassKept:           "没有把资源申请降低到 %d%%，否则 %s %s 的 QoS 等级会从 %s 降为 %s",
+		ReplicasTooFew:         "副本数 %d 低于下限 %d",
+		ReplicasTooMany:        "副本数 %d 超过了上限 %d",
+		PDBMissing:             "命名空间 %[3]s 中没有 PodDisruptionBudget 选中 Deployment %[2]s 的 %[1]d 个副本",
+		PDBLookupFailed:        "无法查询命名空间 %s 的 PodDisruptionBudget: %v",
+		NetworkPolicyMissing:   "命名空间 %[3]s 中没有 NetworkPolicy 选中 %[1]s %[2]s 的 pod，它们的流量不受任何限制",
+		NetworkPoliciesUnknown: "无法查询命名空间 %s 的 NetworkPolicy: %v",
+		APIDeprecated:          "%s %s 自 Kubernetes %s 起已弃用，%s",
+		APIRemoved:             "%s %s 已在 Kubernetes %s 中移除，%s",
+		AnnotationDeprecated:   "注解 %s 自 Kubernetes %s 起已弃用，%s",
+		AnnotationRemoved:      "注解 %s 自 Kubernetes %s 起不再生效，%s",
+		ScaleNotChecked:        "无法查询 Deployment %s/%s，没有检查副本数: %v",
+		AutoscalersUnknown:     "无法查询命名空间 %s 的 HorizontalPodAutoscaler，按没有 HPA 处理 Deployment 的副本数: %v",
+		AutoscaledReplicasKept: "Deployment %s 的副本数保持为 %d，由 HorizontalPodAutoscaler %s 管理",
+		ProbeMissing:           "容器 %s 没有配置 %s 探针",
+		SelectorMissing:        "%s %s 没有选择器，它必须选择其 Pod 模板的标签",
+		SelectorMismatch:       "%s %s 的选择器与其 Pod 模板的标签不匹配: %s",
+		SelectorChanged:        "%s %s 的选择器不可修改（从 %s 改为 %s）：需要删除后重新创建，或以其他名称创建",
+		ReferencesMissing:      "%s %s 引用的 %s 在命名空间 %s 中不存在",
+		ReferenceLookupFailed:  "无法在命名空间 %[2]s 中查询 %[1]s，不做检查: %[3]v",
+		StrategyRecreate:       "Deployment %s 必须使用 RollingUpdate 策略，Recreate 会同时停止它的所有 Pod",
+		StrategyBoundExceeded:  "%[1]s %[2]s 相当于 %[4]d 个副本中的 %[3]d 个 Pod，超过了上限 %[5]s",
+		MemoryPerCPUTooLow:     "容器 %s 每核 CPU 申请的内存为 %s，低于下限 %s",
+		MemoryPerCPUTooHigh:    "容器 %s 每核 CPU 申请的内存为 %s，超过了上限 %s",
+		RequestAboveLimit:      "容器 %s 申请了 %s 的 %s，超过了其限制 %s",
+		HugePagesUnequal:       "容器 %s 申请了 %s 的 %s，大页的申请必须等于其限制 %s",
+		HugePagesNotMultiple:   "容器 %s 申请了 %s 的 %s，不是页大小 %s 的整数倍",
+		EphemeralStorageTooBig: "容器 %s 申请了 %s 的 ephemeral-storage，超过了上限 %s",
+		PodRequestsExceeded:    "%s %s 每个 Pod 申请了 %s 的 %s，超过了上限 %s",
+		PodFitsNoNode:          "%s %s 每个 Pod 申请 %s，它可以运行的 %d 个可调度节点都没有这么多可分配资源，其 Pod 会一直处于 Pending 状态",
+		NodesNotChecked:        "无法列出节点，没有按节点检查 %s %s 的申请: %v",
+		GPUsPerPodExceeded:     "%s %s 每个 Pod 申请 %d 个 GPU，超过了命名空间 %[5]s 的上限 %[4]d",
+		GPUsPerNamespace:       "Deployment %s 的副本使命名空间 %s 中 Deployment 申请的 GPU 达到 %d 个，超过了上限 %d",
+		GPUsNotChecked:         "无法查询命名空间 %s 的 Deployment，没有检查其 GPU: %v",
+		ImageNotSigned:         "镜像 %s 没有有效的签名: %v",
+		ImageVulnerable:        "镜像 %s 有 %d 个严重漏洞，最多允许 %d 个",
+		ImageNotScanned:        "无法检查镜像 %s 的漏洞: %v",
+		EphemeralNotAllowed:    "无法添加临时容器 %s，命名空间 %s 不允许临时容器",
+		EphemeralImageDenied:   "临时容器不允许使用镜像 %s",
+		EphemeralPrivileged:    "临时容器 %s 不能 %s",
+		DataTooLarge:           "%s %s 的数据大小为 %s，超过了上限 %s",
+		DataForbidden:          "%s 匹配了禁止的模式 %s",
+		FreezeWindowOpen:       "冻结窗口 %[4]s 开启期间（直到 %[5]s）不能修改命名空间 %[3]s 中的 %[1]s %[2]s；紧急情况下添加注解 %[6]s=<原因> 跳过冻结",
+		FreezeOverridden:       "%[2]s 跳过了冻结窗口 %[1]s: %[3]s",
+		CalloutDenied:          "被策略服务拒绝: %s",
+		CalloutFailed:          "无法访问策略服务: %v",
+		DeadlineAllowed:        "webhook 的检查没有及时完成，未经检查直接放行: %v",
+		DeadlineDenied:         "webhook 的检查没有及时完成，拒绝请求: %v",
+		InternalErrorAllowed:   "webhook 处理请求失败，未经检查直接放行: %s",
+		NamespaceRateLimited:   "命名空间 %s 的请求过多，每秒最多准入 %g 个，请稍后重试",
+		NamespaceNotCached:     "webhook 还没有缓存命名空间 %s，请稍后重试: %v",
+		MethodNotAllowed:       "不允许的请求方法 %s",
+		ReadBodyFailed:         "无法读取请求体: %v",
+		EmptyBody:              "请求体为空",
+		ConvertYAMLFailed:      "无法转换 YAML 请求体: %v",
+		UnsupportedContentType: "不支持的 Content-Type %s，只接受 application/json、application/yaml 或 %s",
+		EncodeResponseFailed:   "无法编码响应: %v",
+		WriteResponseFailed:    "无法写入响应: %v",
+		NoResponse:             "webhook没有给出应答",
+		AdmissionBegin:         "======开始准入 Namespace=[%v], Kind=[%v], Name=[%v]======",
+		AdmissionEnd:           "======准入结束，响应已写入======",
+		RequestPath:            "请求路径: %s",
+		WritingResponse:        "正在写入响应",
+		ResponsePatch:          "AdmissionResponse: patch=%v",
+		PatchLarge:             "%s %s/%s 的 patch 有 %d 字节，超过了告警阈值 %d 字节",
+		NamespaceIgnored:       "跳过 %v，命名空间 %v 被忽略",
+		ValidationPolicy:       "%v/%v 的校验策略: required:%v",
+		ValidationSkip:         "策略检查跳过 %s/%s 的校验",
+		LabelsAvailable:        "已有标签: %s",
+		LabelsRequired:         "必需标签: %s",
+		MutationSkip:           "跳过 %s/%s 的修改，它由 %s 调谐",
+		AdmittedThrough:        "跳过 %s %s/%s，它已随 %s 准入",
+		DeletedObjectMissing:   "请求中没有 %s %s/%s 被删除的对象，跳过删除保护",
+		OldObjectMissing:       "请求中没有 %s %s/%s 的旧对象，跳过不可变字段检查",
+		NamespaceNoDefaults:    "没有匹配命名空间 %s 的默认配置",
+		NamespaceUnknown:       "无法查询命名空间 %s，依赖其标签的规则不生效: %v",
+		OperationSkipped:       "跳过 %[2]s %[3]s/%[4]s 的 %[1]s 操作，该操作不做检查",
+		DigestUnresolved:       "镜像 %s 没有固定到 digest: %v",
+		ServicesUnknown:        "无法查询命名空间 %s 的 Service，不添加 preStop 钩子: %v",
+		SidecarUpgraded:        "sidecar %s 已升级到版本 %s，镜像 %s",
+		SidecarRemoved:         "sidecar %s 已按版本 %s 移除",
+		InjectionUnknown:       "命名空间 %[2]s 没有注入模板 %[1]s，不做注入",
+		ChecksumFailed:         "无法计算命名空间 %[2]s 中 %[1]s 的摘要，保留原有的配置校验和: %[3]v",
+	},
+}
+
+var language = "en"
+
+// Languages lists the supported languages.
+func Languages() []string {
+	languages := []string{"en"}
+	for l := range catalog {
+		languages = append(languages, l)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// SetLanguage sets the language of the logs. It is not safe to call while
+// messages are being logged.
+func SetLanguage(l string) error {
+	if _, ok := catalog[l]; !ok && l != "en" {
+		return fmt.Errorf("unsupported language %q, expect one of %s", l, strings.Join(Languages(), ", "))
+	}
+	language = l
+	return nil
+}
+
+// Localize returns format in the log language, unchanged when it has no
+// translation.
+func Localize(format string) string {
+	if translated, ok := catalog[language][format]; ok {
+		return translated
+	}
+	return format
+}
@@ -0,0 +1,149 @@
+// Package notify reports denied admission requests to Slack or to a generic
+// HTTP endpoint.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// Formats of the notifications.
+const (
+	// FormatSlack posts {"text": message} to a Slack incoming webhook.
+	FormatSlack = "slack"
+	// FormatWebhook posts the Denial with the rendered message as JSON.
+	FormatWebhook = "webhook"
+)
+
+// DefaultTemplate renders the message when no template is configured.
+const DefaultTemplate = `{{.User}} was denied to {{.Operation}} {{.Kind}} {{if .Namespace}}{{.Namespace}}/{{end}}{{.Name}}: {{.Reason}}`
+
+// queueSize is the number of notifications waiting to be sent, further ones
+// are dropped.
+const queueSize = 100
+
+// Denial is a denied admission request, the data of the message template.
+type Denial struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Operation string `json:"operation"`
+	User      string `json:"user"`
+	Reason    string `json:"reason"`
+	// Message is the rendered template, it is only set in the webhook
+	// format.
+	Message string `json:"message,omitempty"`
+}
+
+// Notifier sends the notifications in the background, at most perMinute of
+// them with bursts of burst.
+type Notifier struct {
+	url     string
+	format  string
+	tmpl    *template.Template
+	client  *http.Client
+	limiter flowcontrol.RateLimiter
+	queue   chan Denial
+}
+
+// NewNotifier returns the notifier posting to rawURL in format, the message
+// is rendered from the text/template text.
+func NewNotifier(rawURL, format, text string, perMinute, burst int, timeout time.Duration) (*Notifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid notification URL %q", rawURL)
+	}
+	if format != FormatSlack && format != FormatWebhook {
+		return nil, fmt.Errorf("unknown notification format %q, must be %s or %s", format, FormatSlack, FormatWebhook)
+	}
+	if perMinute <= 0 || burst <= 0 {
+		return nil, fmt.Errorf("notification rate and burst must be positive")
+	}
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New("notification").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(ioutil.Discard, Denial{}); err != nil {
+		return nil, err
+	}
+	return &Notifier{
+		url:     u.String(),
+		format:  format,
+		tmpl:    tmpl,
+		client:  &http.Client{Timeout: timeout},
+		limiter: flowcontrol.NewTokenBucketRateLimiter(float32(perMinute)/60, burst),
+		queue:   make(chan Denial, queueSize),
+	}, nil
+}
+
+// Notify queues the notification of d without blocking, it reports false
+// when d is dropped because of the rate limit or a full queue.
+func (n *Notifier) Notify(d Denial) bool {
+	if !n.limiter.TryAccept() {
+		return false
+	}
+	select {
+	case n.queue <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run sends the queued notifications until ctx is done, failed ones are
+// passed to report.
+func (n *Notifier) Run(ctx context.Context, report func(Denial, error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-n.queue:
+			if err := n.send(d); err != nil {
+				report(d, err)
+			}
+		}
+	}
+}
+
+func (n *Notifier) send(d Denial) error {
+	body, err := n.body(d)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// body renders the message of d and wraps it in the payload of the format.
+func (n *Notifier) body(d Denial) ([]byte, error) {
+	var message bytes.Buffer
+	if err := n.tmpl.Execute(&message, d); err != nil {
+		return nil, err
+	}
+	if n.format == FormatSlack {
+		return json.Marshal(map[string]string{"text": message.String()})
+	}
+	d.Message = message.String()
+	return json.Marshal(d)
+}
@@ -0,0 +1,189 @@
+// Package patch builds the JSON patch returned by the mutating webhook: the
+// rules mutate a deep copy of the object, which is diffed against the
+// original.
+package patch
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/wI2L/jsondiff"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Operation is a single RFC 6902 JSON patch operation.
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Marshal encodes ops as the body of an AdmissionResponse patch.
+func Marshal(ops []Operation) ([]byte, error) {
+	return json.Marshal(ops)
+}
+
+// Diff returns the operations turning original into mutated, both encoded
+// as JSON, with escaped paths in a stable order. Encoding writes the
+// quantities canonical, 1000m as 1 and 1024Mi as 1Gi, and the quantities
+// mutated holds in another format for the same amount, such as 1073741824
+// for 1Gi, are left unchanged: the patch doesn't rewrite them to no effect,
+// which would mutate the object again on every admission.
+func Diff(original, mutated interface{}) ([]Operation, error) {
+	source, err := decode(original)
+	if err != nil {
+		return nil, err
+	}
+	target, err := decode(mutated)
+	if err != nil {
+		return nil, err
+	}
+	keepEquivalent(source, target)
+	diff, err := jsondiff.Compare(source, target)
+	if err != nil {
+		return nil, err
+	}
+	if len(diff) == 0 {
+		return nil, nil
+	}
+	// Operation is what the rest of the webhook and the policy service deal
+	// with, the values of jsondiff are decoded JSON already. Compare only
+	// adds, removes and replaces.
+	ops := make([]Operation, len(diff))
+	for i, op := range diff {
+		ops[i] = Operation{Op: op.Type, Path: string(op.Path), Value: op.Value}
+	}
+	return ops, nil
+}
+
+// SetAnnotations sets the annotations of meta to added, keeping the other
+// annotations.
+func SetAnnotations(meta *metav1.ObjectMeta, added map[string]string) {
+	if len(added) == 0 {
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string, len(added))
+	}
+	for key, value := range added {
+		meta.Annotations[key] = value
+	}
+}
+
+// AnnotationOps returns the operations setting the annotations of meta, the
+// metadata of the object once patched, to added, in the order of their keys.
+// The annotations meta has already are left out. SetAnnotations then brings
+// meta up to date.
+func AnnotationOps(meta *metav1.ObjectMeta, added map[string]string) []Operation {
+	if len(meta.Annotations) == 0 {
+		if len(added) == 0 {
+			return nil
+		}
+		return []Operation{{Op: "add", Path: "/metadata/annotations", Value: added}}
+	}
+	keys := make([]string, 0, len(added))
+	for key := range added {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var ops []Operation
+	for _, key := range keys {
+		op := "add"
+		if value, ok := meta.Annotations[key]; ok {
+			if value == added[key] {
+				continue
+			}
+			op = "replace"
+		}
+		ops = append(ops, Operation{Op: op, Path: "/metadata/annotations/" + escapePointer.Replace(key), Value: added[key]})
+	}
+	return ops
+}
+
+// escapePointer escapes a key as a JSON pointer segment.
+var escapePointer = strings.NewReplacer("~", "~0", "/", "~1")
+
+// AddMissing adds the entries of added missing from target, the entries
+// already set are kept.
+func AddMissing(target *map[string]string, added map[string]string) {
+	for key, value := range added {
+		if _, ok := (*target)[key]; ok {
+			continue
+		}
+		if *target == nil {
+			*target = make(map[string]string, len(added))
+		}
+		(*target)[key] = value
+	}
+}
+
+// Sync makes the entries of target with one of keys equal to those of
+// values: they are added, replaced or removed when values lacks them.
+func Sync(target *map[string]string, values map[string]string, keys []string) {
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			delete(*target, key)
+			continue
+		}
+		if *target == nil {
+			*target = make(map[string]string, len(keys))
+		}
+		(*target)[key] = value
+	}
+}
+
+// GuaranteedResources sets the cpu and memory limits of containers to their
+// requests, and the requests missing to their limits, for the pod to be in
+// the Guaranteed QoS class.
+func GuaranteedResources(containers []corev1.Container) {
+	for i := range containers {
+		resources := &containers[i].Resources
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			request, hasRequest := resources.Requests[name]
+			limit, hasLimit := resources.Limits[name]
+			switch {
+			case hasRequest && (!hasLimit || limit.Cmp(request) != 0):
+				if resources.Limits == nil {
+					resources.Limits = corev1.ResourceList{}
+				}
+				resources.Limits[name] = request
+			case !hasRequest && hasLimit:
+				if resources.Requests == nil {
+					resources.Requests = corev1.ResourceList{}
+				}
+				resources.Requests[name] = limit
+			}
+		}
+	}
+}
+
+// ResourceReduction reduces the cpu, memory and ephemeral-storage requests
+// of all containers to percent of their value. The requests of hugepages
+// and of extended resources such as nvidia.com/gpu must equal their limits,
+// they are left alone.
+func ResourceReduction(containers []corev1.Container, percent int64) {
+	if percent >= 100 {
+		return
+	}
+	for i := range containers {
+		requests := containers[i].Resources.Requests
+		for name, quantity := range requests {
+			if !reducible(name) {
+				continue
+			}
+			// percent of the original value, in the format of the original
+			reducedValue := quantity.MilliValue() * percent / 100
+			requests[name] = *resource.NewMilliQuantity(reducedValue, quantity.Format)
+		}
+	}
+}
+
+// reducible reports whether the requests of the resource name may be below
+// its limits.
+func reducible(name corev1.ResourceName) bool {
+	return name == corev1.ResourceCPU || name == corev1.ResourceMemory || name == corev1.ResourceEphemeralStorage
+}
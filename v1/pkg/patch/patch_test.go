@@ -0,0 +1,54 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAnnotationOps(t *testing.T) {
+	added := map[string]string{"example.com/status": "mutated", "example.com/a~b": "1"}
+	for _, c := range []struct {
+		name     string
+		existing map[string]string
+	}{
+		{name: "no annotations"},
+		{name: "other annotations", existing: map[string]string{"team": "payments"}},
+		{name: "some set already", existing: map[string]string{"example.com/status": "mutated", "example.com/a~b": "0"}},
+		{name: "all set already", existing: added},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			meta := metav1.ObjectMeta{Name: "web", Annotations: c.existing}
+			document, err := json.Marshal(map[string]interface{}{"metadata": meta})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops := AnnotationOps(&meta, added)
+			if len(c.existing) == len(added) && reflect.DeepEqual(c.existing, added) && len(ops) != 0 {
+				t.Errorf("got %+v, want no operation", ops)
+			}
+			data, err := Marshal(ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := jsonpatch.DecodePatch(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if document, err = p.Apply(document); err != nil {
+				t.Fatalf("%s doesn't apply: %v", data, err)
+			}
+			var patched struct{ Metadata metav1.ObjectMeta }
+			if err := json.Unmarshal(document, &patched); err != nil {
+				t.Fatal(err)
+			}
+			SetAnnotations(&meta, added)
+			if !reflect.DeepEqual(patched.Metadata.Annotations, meta.Annotations) {
+				t.Errorf("patched annotations %v, want %v", patched.Metadata.Annotations, meta.Annotations)
+			}
+		})
+	}
+}
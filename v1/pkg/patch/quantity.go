@@ -0,0 +1,187 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// quantityLists are the fields mapping resource names to quantities: the
+// requests and limits of containers and claims, the overhead of pods, the
+// hard limits of quotas and the capacity of volumes.
+var quantityLists = map[string]bool{
+	"requests": true,
+	"limits":   true,
+	"overhead": true,
+	"hard":     true,
+	"capacity": true,
+}
+
+// quantityFields are the fields holding a single quantity, such as the
+// sizeLimit of emptyDir volumes.
+var quantityFields = map[string]bool{
+	"sizeLimit": true,
+}
+
+// decode returns the JSON of object decoded as maps and slices, numbers
+// kept as json.Number so that the large integers survive.
+func decode(object interface{}) (interface{}, error) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// keepEquivalent sets back the quantities of mutated, a decoded JSON
+// document, equal to those of original at the same path to the value of
+// original: a rule writing 1Gi where the object has 1024Mi, or 1073741824,
+// changes nothing.
+func keepEquivalent(original, mutated interface{}) {
+	switch mutated := mutated.(type) {
+	case map[string]interface{}:
+		original, ok := original.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range mutated {
+			old, ok := original[key]
+			if !ok {
+				continue
+			}
+			if list, ok := value.(map[string]interface{}); ok && quantityLists[key] {
+				if oldList, ok := old.(map[string]interface{}); ok {
+					for name, quantity := range list {
+						if oldQuantity, ok := oldList[name]; ok && equivalent(oldQuantity, quantity) {
+							list[name] = oldQuantity
+						}
+					}
+					continue
+				}
+			}
+			if quantityFields[key] && equivalent(old, value) {
+				mutated[key] = old
+				continue
+			}
+			keepEquivalent(old, value)
+		}
+	case []interface{}:
+		original, ok := original.([]interface{})
+		if !ok {
+			return
+		}
+		for i := range mutated {
+			if i < len(original) {
+				keepEquivalent(original[i], mutated[i])
+			}
+		}
+	}
+}
+
+// equivalent reports whether a and b, JSON values, are quantities of the
+// same amount.
+func equivalent(a, b interface{}) bool {
+	x, ok := parseQuantity(a)
+	if !ok {
+		return false
+	}
+	y, ok := parseQuantity(b)
+	return ok && x.Cmp(y) == 0
+}
+
+// parseQuantity parses value, a quantity written as a JSON string or
+// number.
+func parseQuantity(value interface{}) (resource.Quantity, bool) {
+	var s string
+	switch value := value.(type) {
+	case string:
+		s = value
+	case json.Number:
+		s = value.String()
+	default:
+		return resource.Quantity{}, false
+	}
+	quantity, err := resource.ParseQuantity(s)
+	return quantity, err == nil
+}
+
+// WithoutEquivalent returns ops without those adding or replacing a
+// quantity of a resource list with the amount it has in document already,
+// the JSON of the object once patched with applied, such as the operations
+// of the policy service which reads the object as sent, e.g. 1000m, and
+// writes the quantity canonical, 1.
+func WithoutEquivalent(document []byte, applied []Operation, ops []Operation) ([]Operation, error) {
+	if len(applied) > 0 {
+		data, err := Marshal(applied)
+		if err != nil {
+			return nil, err
+		}
+		p, err := jsonpatch.DecodePatch(data)
+		if err != nil {
+			return nil, err
+		}
+		if document, err = p.Apply(document); err != nil {
+			return nil, err
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var object interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+	var kept []Operation
+	for _, op := range ops {
+		if op.Op == "add" || op.Op == "replace" {
+			if current, ok := quantityAt(object, op.Path); ok && equivalent(current, op.Value) {
+				continue
+			}
+		}
+		kept = append(kept, op)
+	}
+	return kept, nil
+}
+
+// quantityAt returns the value at pointer, a JSON pointer, in object when
+// it points to a quantity of a resource list or a quantity field.
+func quantityAt(object interface{}, pointer string) (interface{}, bool) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, false
+	}
+	segments := strings.Split(pointer[1:], "/")
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for i := range segments {
+		segments[i] = unescape.Replace(segments[i])
+	}
+	last := len(segments) - 1
+	if !quantityFields[segments[last]] && (last == 0 || !quantityLists[segments[last-1]]) {
+		return nil, false
+	}
+	value := object
+	for _, segment := range segments {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			list, isList := value.([]interface{})
+			index, err := strconv.Atoi(segment)
+			if !isList || err != nil || index < 0 || index >= len(list) {
+				return nil, false
+			}
+			value = list[index]
+			continue
+		}
+		if value, ok = m[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
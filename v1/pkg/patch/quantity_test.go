@@ -0,0 +1,178 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decoded returns document decoded the way keepEquivalent and
+// WithoutEquivalent read it, numbers as json.Number.
+func decoded(t *testing.T, document string) interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(bytes.NewReader([]byte(document)))
+	decoder.UseNumber()
+	var object interface{}
+	if err := decoder.Decode(&object); err != nil {
+		t.Fatalf("decoding %s: %v", document, err)
+	}
+	return object
+}
+
+func TestKeepEquivalent(t *testing.T) {
+	for _, c := range []struct {
+		name              string
+		original, mutated string
+		want              string
+	}{{
+		name:     "millicores",
+		original: `{"resources":{"requests":{"cpu":"1000m"}}}`,
+		mutated:  `{"resources":{"requests":{"cpu":"1"}}}`,
+		want:     `{"resources":{"requests":{"cpu":"1000m"}}}`,
+	}, {
+		name:     "binary suffixes",
+		original: `{"resources":{"limits":{"memory":"1024Mi"}}}`,
+		mutated:  `{"resources":{"limits":{"memory":"1Gi"}}}`,
+		want:     `{"resources":{"limits":{"memory":"1024Mi"}}}`,
+	}, {
+		name:     "plain number",
+		original: `{"resources":{"limits":{"memory":1073741824}}}`,
+		mutated:  `{"resources":{"limits":{"memory":"1Gi"}}}`,
+		want:     `{"resources":{"limits":{"memory":1073741824}}}`,
+	}, {
+		name:     "smaller amount",
+		original: `{"resources":{"requests":{"cpu":"1"}}}`,
+		mutated:  `{"resources":{"requests":{"cpu":"900m"}}}`,
+		want:     `{"resources":{"requests":{"cpu":"900m"}}}`,
+	}, {
+		name:     "larger amount",
+		original: `{"resources":{"requests":{"cpu":"900m"}}}`,
+		mutated:  `{"resources":{"requests":{"cpu":"1"}}}`,
+		want:     `{"resources":{"requests":{"cpu":"1"}}}`,
+	}, {
+		name:     "added resource",
+		original: `{"resources":{"requests":{"cpu":"1"}}}`,
+		mutated:  `{"resources":{"requests":{"cpu":"1","memory":"1Gi"}}}`,
+		want:     `{"resources":{"requests":{"cpu":"1","memory":"1Gi"}}}`,
+	}, {
+		name:     "overhead",
+		original: `{"spec":{"overhead":{"cpu":"250m","memory":"120Mi"}}}`,
+		mutated:  `{"spec":{"overhead":{"cpu":"0.25","memory":"125829120"}}}`,
+		want:     `{"spec":{"overhead":{"cpu":"250m","memory":"120Mi"}}}`,
+	}, {
+		name:     "sizeLimit",
+		original: `{"volumes":[{"name":"cache","emptyDir":{"sizeLimit":"1024Mi"}},{"name":"tmp","emptyDir":{"sizeLimit":"500Mi"}}]}`,
+		mutated:  `{"volumes":[{"name":"cache","emptyDir":{"sizeLimit":"1Gi"}},{"name":"tmp","emptyDir":{"sizeLimit":"1Gi"}}]}`,
+		want:     `{"volumes":[{"name":"cache","emptyDir":{"sizeLimit":"1024Mi"}},{"name":"tmp","emptyDir":{"sizeLimit":"1Gi"}}]}`,
+	}, {
+		name:     "containers of the list",
+		original: `{"containers":[{"resources":{"requests":{"cpu":"500m"}}}]}`,
+		mutated:  `{"containers":[{"resources":{"requests":{"cpu":"0.5"}}},{"resources":{"requests":{"cpu":"0.5"}}}]}`,
+		want:     `{"containers":[{"resources":{"requests":{"cpu":"500m"}}},{"resources":{"requests":{"cpu":"0.5"}}}]}`,
+	}, {
+		name:     "not a quantity",
+		original: `{"metadata":{"labels":{"cpu":"1000m"}},"requests":{"cpu":"large"}}`,
+		mutated:  `{"metadata":{"labels":{"cpu":"1"}},"requests":{"cpu":"1"}}`,
+		want:     `{"metadata":{"labels":{"cpu":"1"}},"requests":{"cpu":"1"}}`,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			mutated := decoded(t, c.mutated)
+			keepEquivalent(decoded(t, c.original), mutated)
+			if want := decoded(t, c.want); !reflect.DeepEqual(mutated, want) {
+				got, _ := json.Marshal(mutated)
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDiffOfEquivalentQuantities(t *testing.T) {
+	original := json.RawMessage(`{"resources":{"requests":{"cpu":"1000m","memory":"1Gi"}}}`)
+	mutated := json.RawMessage(`{"resources":{"requests":{"cpu":"1","memory":"1073741824"}}}`)
+	ops, err := Diff(original, mutated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 0 {
+		t.Errorf("got %+v, want no operation", ops)
+	}
+
+	mutated = json.RawMessage(`{"resources":{"requests":{"cpu":"900m","memory":"1Gi"}}}`)
+	if ops, err = Diff(original, mutated); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Path != "/resources/requests/cpu" || ops[0].Value != "900m" {
+		t.Errorf("got %+v, want the cpu replaced by 900m", ops)
+	}
+}
+
+func TestWithoutEquivalent(t *testing.T) {
+	document := []byte(`{"spec":{` +
+		`"containers":[{"resources":{"requests":{"cpu":"1000m","memory":"1Gi","nvidia.com/gpu":"1"}}}],` +
+		`"overhead":{"cpu":"250m"},` +
+		`"volumes":[{"emptyDir":{"sizeLimit":"1024Mi"}}]},` +
+		`"metadata":{"labels":{"cpu":"1000m"}}}`)
+	requests := "/spec/containers/0/resources/requests/"
+	for _, c := range []struct {
+		name    string
+		applied []Operation
+		op      Operation
+		kept    bool
+	}{
+		{name: "millicores", op: Operation{Op: "replace", Path: requests + "cpu", Value: "1"}},
+		{name: "bytes", op: Operation{Op: "add", Path: requests + "memory", Value: "1073741824"}},
+		{name: "escaped name", op: Operation{Op: "replace", Path: requests + "nvidia.com~1gpu", Value: "1000m"}},
+		{name: "overhead", op: Operation{Op: "replace", Path: "/spec/overhead/cpu", Value: "0.25"}},
+		{name: "sizeLimit", op: Operation{Op: "replace", Path: "/spec/volumes/0/emptyDir/sizeLimit", Value: "1Gi"}},
+		{name: "smaller amount", op: Operation{Op: "replace", Path: requests + "cpu", Value: "900m"}, kept: true},
+		{name: "larger sizeLimit", op: Operation{Op: "replace", Path: "/spec/volumes/0/emptyDir/sizeLimit", Value: "2Gi"}, kept: true},
+		{name: "removal", op: Operation{Op: "remove", Path: requests + "cpu"}, kept: true},
+		{name: "missing resource", op: Operation{Op: "add", Path: requests + "ephemeral-storage", Value: "1Gi"}, kept: true},
+		{name: "missing container", op: Operation{Op: "add", Path: "/spec/containers/1/resources/requests/cpu", Value: "1"}, kept: true},
+		{name: "not a quantity", op: Operation{Op: "replace", Path: "/metadata/labels/cpu", Value: "1"}, kept: true},
+		{
+			name:    "after the applied operations",
+			applied: []Operation{{Op: "replace", Path: requests + "memory", Value: "2Gi"}},
+			op:      Operation{Op: "replace", Path: requests + "memory", Value: "2048Mi"},
+		},
+		{
+			name:    "undone by the applied operations",
+			applied: []Operation{{Op: "replace", Path: requests + "memory", Value: "2Gi"}},
+			op:      Operation{Op: "replace", Path: requests + "memory", Value: "1Gi"},
+			kept:    true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			kept, err := WithoutEquivalent(document, c.applied, []Operation{c.op})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(kept) == 1; got != c.kept {
+				t.Errorf("%s %s %v kept: %t, want %t", c.op.Op, c.op.Path, c.op.Value, got, c.kept)
+			}
+		})
+	}
+}
+
+func TestQuantityAt(t *testing.T) {
+	object := decoded(t, `{"spec":{"containers":[{"resources":{"limits":{"nvidia.com/gpu":2,"cpu":"1"}}}],"sizeLimit":"1Gi","replicas":3}}`)
+	for _, c := range []struct {
+		pointer string
+		want    interface{}
+	}{
+		{pointer: "/spec/containers/0/resources/limits/cpu", want: "1"},
+		{pointer: "/spec/containers/0/resources/limits/nvidia.com~1gpu", want: json.Number("2")},
+		{pointer: "/spec/sizeLimit", want: "1Gi"},
+		{pointer: "/spec/containers/0/resources/limits/memory"},
+		{pointer: "/spec/containers/1/resources/limits/cpu"},
+		{pointer: "/spec/containers/-1/resources/limits/cpu"},
+		{pointer: "/spec/replicas"},
+		{pointer: "spec/sizeLimit"},
+	} {
+		got, ok := quantityAt(object, c.pointer)
+		if ok != (c.want != nil) || got != c.want {
+			t.Errorf("%s: got %v, %t, want %v", c.pointer, got, ok, c.want)
+		}
+	}
+}
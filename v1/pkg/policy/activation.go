@@ -0,0 +1,124 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"sigs.k8s.io/yaml"
+)
+
+// mergeActivations parses the windows of the activations of c and merges
+// their policy over c, into the configs they activate.
+func (c *Config) mergeActivations() error {
+	if len(c.Activations) == 0 {
+		return nil
+	}
+	base := *c
+	base.Activations = nil
+	original, err := json.Marshal(&base)
+	if err != nil {
+		return fmt.Errorf("activations: %v", err)
+	}
+	names := map[string]bool{}
+	for i := range c.Activations {
+		a := &c.Activations[i]
+		if a.Name == "" {
+			return fmt.Errorf("activations[%d]: name required", i)
+		}
+		if names[a.Name] {
+			return fmt.Errorf("activations[%d]: name %q used twice", i, a.Name)
+		}
+		names[a.Name] = true
+		if err := a.Window.parse(); err != nil {
+			return fmt.Errorf("activations[%d]: %v", i, err)
+		}
+		config, err := mergePolicy(original, a.Policy, "activations")
+		if err != nil {
+			return fmt.Errorf("activations[%d].policy: %v", i, err)
+		}
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("activations[%d].policy: %v", i, err)
+		}
+		a.config = config
+	}
+	return nil
+}
+
+// mergePolicy merges patch, a JSON merge patch of the config which can't
+// set the key nested, over original, the JSON of a config.
+func mergePolicy(original []byte, patch json.RawMessage, nested string) (*Config, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &keys); err != nil || keys == nil {
+		return nil, fmt.Errorf("expect a map of the config")
+	}
+	if _, ok := keys[nested]; ok {
+		return nil, fmt.Errorf("%s can't be nested", nested)
+	}
+	merged, err := jsonpatch.MergePatch(original, patch)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(merged, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// at returns the config the first activation of c open at t activates, c
+// when none is open.
+func (c *Config) at(t time.Time) *Config {
+	return c.resolve(t).config
+}
+
+// activeConfig is the config the activations of base resolve to from from
+// until until, so CurrentConfig doesn't walk the schedules of every
+// activation on every call.
+type activeConfig struct {
+	base, config *Config
+	from, until  time.Time
+}
+
+// resolve returns the config of c at t and how long it holds: until the
+// activation open closes, and at most until the next minute, when another
+// one may open.
+func (c *Config) resolve(t time.Time) *activeConfig {
+	a := &activeConfig{base: c, config: c, from: t, until: t.Truncate(time.Minute).Add(time.Minute)}
+	for i := range c.Activations {
+		if closes, ok := c.Activations[i].ClosesAt(t); ok {
+			a.config = c.Activations[i].config
+			if closes.Before(a.until) {
+				a.until = closes
+			}
+			break
+		}
+	}
+	return a
+}
+
+// OpenWindows returns the names of the activation and the freeze windows of
+// the current policy open now, the decisions made under other windows may
+// not hold anymore.
+func OpenWindows() []string {
+	c := loadState().config
+	if c == nil {
+		return nil
+	}
+	now := Now()
+	var open []string
+	active := c.at(now)
+	for _, a := range c.Activations {
+		if a.config == active {
+			open = append(open, "activation/"+a.Name)
+			break
+		}
+	}
+	for i := range active.FreezeWindows {
+		if _, ok := active.FreezeWindows[i].ClosesAt(now); ok {
+			open = append(open, "freeze/"+active.FreezeWindows[i].Name)
+		}
+	}
+	return open
+}
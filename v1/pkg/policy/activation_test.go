@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// activationConfig has an activation open for 90s at 12:00 every day, and
+// one open all weekend.
+const activationConfig = `
+ignoredNamespaces: [base]
+activations:
+  - name: noon
+    schedule: "0 12 * * *"
+    duration: 90s
+    policy:
+      ignoredNamespaces: [noon]
+  - name: weekend
+    schedule: "0 0 * * 6"
+    duration: 48h
+    policy:
+      ignoredNamespaces: [weekend]
+`
+
+func setActivationConfig(t testing.TB) {
+	t.Helper()
+	config := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(activationConfig), config); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	SetConfig(config)
+}
+
+func TestCurrentConfigActivations(t *testing.T) {
+	setActivationConfig(t)
+	now := time.Date(2021, time.October, 8, 11, 59, 30, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	// Friday 8 October 2021, then Saturday, times in order and back
+	steps := []struct {
+		at   string
+		want string
+	}{
+		{"2021-10-08T11:59:30Z", "base"},
+		{"2021-10-08T11:59:59Z", "base"},
+		{"2021-10-08T12:00:00Z", "noon"},
+		{"2021-10-08T12:01:29Z", "noon"},
+		// closes within the minute
+		{"2021-10-08T12:01:30Z", "base"},
+		{"2021-10-08T12:01:59Z", "base"},
+		{"2021-10-09T00:00:00Z", "weekend"},
+		// the first activation open wins
+		{"2021-10-09T12:00:30Z", "noon"},
+		{"2021-10-09T12:01:30Z", "weekend"},
+		// the clock going back
+		{"2021-10-08T12:00:10Z", "noon"},
+		{"2021-10-08T11:00:00Z", "base"},
+	}
+	for _, step := range steps {
+		at, err := time.Parse(time.RFC3339, step.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = at
+		if got := CurrentConfig().IgnoredNamespaces; len(got) != 1 || got[0] != step.want {
+			t.Errorf("at %s: got the config ignoring %v, want %s", step.at, got, step.want)
+		}
+	}
+
+	// a config set replaces the cached one at once
+	now = time.Date(2021, time.October, 8, 12, 0, 30, 0, time.UTC)
+	CurrentConfig()
+	SetConfig(&Config{IgnoredNamespaces: []string{"replaced"}})
+	if got := CurrentConfig().IgnoredNamespaces; len(got) != 1 || got[0] != "replaced" {
+		t.Errorf("after SetConfig: got the config ignoring %v, want replaced", got)
+	}
+}
+
+func BenchmarkCurrentConfig(b *testing.B) {
+	setActivationConfig(b)
+	now := time.Date(2021, time.October, 9, 12, 0, 30, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CurrentConfig()
+	}
+}
@@ -0,0 +1,69 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// ForCluster returns the config of the cluster name: c with the policy of
+// every ClusterPolicy naming the cluster merged over it, in order. It is c
+// when none names the cluster. The config returned is to be validated.
+func (c *Config) ForCluster(name string) (*Config, error) {
+	config := c
+	for i, cluster := range c.Clusters {
+		// the patterns match cluster names like namespaces
+		if !matchNamespace(cluster.Names, name) {
+			continue
+		}
+		merged, err := config.withoutClusters().merge(cluster.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("clusters[%d].policy: %v", i, err)
+		}
+		config = merged
+	}
+	return config, nil
+}
+
+// checkClusters checks the policy of every ClusterPolicy of c gives a valid
+// config, for a mistake in the policy of a cluster not to show only once the
+// config is deployed there.
+func (c *Config) checkClusters() error {
+	if len(c.Clusters) == 0 {
+		return nil
+	}
+	base := c.withoutClusters()
+	for i, cluster := range c.Clusters {
+		if len(cluster.Names) == 0 {
+			return fmt.Errorf("clusters[%d]: names required", i)
+		}
+		for _, pattern := range cluster.Names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("clusters[%d].names: invalid pattern %q", i, pattern)
+			}
+		}
+		config, err := base.merge(cluster.Policy)
+		if err != nil {
+			return fmt.Errorf("clusters[%d].policy: %v", i, err)
+		}
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("clusters[%d].policy: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) withoutClusters() *Config {
+	base := *c
+	base.Clusters = nil
+	return &base
+}
+
+// merge merges patch, the policy of a ClusterPolicy, over c.
+func (c *Config) merge(patch json.RawMessage) (*Config, error) {
+	original, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return mergePolicy(original, patch, "clusters")
+}
@@ -0,0 +1,1643 @@
+package policy
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cnych/admission-webhook/pkg/cosign"
+	"github.com/cnych/admission-webhook/pkg/messages"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the part of the policy which can change at runtime, loaded from
+// the policy config file and swapped as a whole on reload.
+type Config struct {
+	// IgnoredNamespaces are neither validated nor mutated, in addition to
+	// the built-in IgnoredNamespaces, as path.Match patterns such as
+	// "istio-*".
+	IgnoredNamespaces []string `json:"ignoredNamespaces,omitempty"`
+	// Operations limit the operations checked on a registered resource, such
+	// as deployments or deployments/scale, to the listed ones: CREATE,
+	// UPDATE, DELETE or CONNECT. The others are admitted unchecked. Every
+	// operation registered is checked on resources not listed.
+	Operations map[string][]string `json:"operations,omitempty"`
+	// ExemptSelector is a label selector, such as
+	// "policy.webhook/exempt=true", of the objects admitted without running
+	// any rule. None are exempt when empty.
+	ExemptSelector string `json:"exemptSelector,omitempty"`
+	// Subjects exempts the requests of trusted users, groups and service
+	// accounts and makes the rules stricter for others.
+	Subjects SubjectPolicy `json:"subjects,omitempty"`
+	// SkipMutationOwners are the owner kinds, "Kind" or "group/Kind" such
+	// as "argoproj.io/Rollout", whose objects aren't mutated since their
+	// controller would revert the patch on every reconcile.
+	SkipMutationOwners []string `json:"skipMutationOwners,omitempty"`
+	// SkipMutationManagers are the field managers, such as
+	// "rollouts-controller", whose objects aren't mutated for the same reason.
+	SkipMutationManagers []string `json:"skipMutationManagers,omitempty"`
+	// ImmutableFields are the field paths which updates can't change, such
+	// as metadata.labels[app.kubernetes.io/name] or
+	// spec.template.spec.nodeSelector[kubernetes.io/os].
+	ImmutableFields []string `json:"immutableFields,omitempty"`
+	// RestrictedServiceTypes are the Service types, such as NodePort and
+	// LoadBalancer, only allowed in the ServiceTypeNamespaces.
+	RestrictedServiceTypes []string `json:"restrictedServiceTypes,omitempty"`
+	// ServiceTypeNamespaces are path.Match patterns of the namespaces allowed
+	// to create Services of the RestrictedServiceTypes.
+	ServiceTypeNamespaces []string `json:"serviceTypeNamespaces,omitempty"`
+	// Services checks Services against the Deployments and the other
+	// Services of their namespace, catching broken ones before they go live.
+	Services ServicePolicy `json:"services,omitempty"`
+	// RequiredAnnotations must be set, alongside the RequiredLabels, on the
+	// objects whose labels are required, e.g. owner or change-ticket.
+	RequiredAnnotations []RequiredAnnotation `json:"requiredAnnotations,omitempty"`
+	// Ingress is enforced on Ingresses.
+	Ingress IngressPolicy `json:"ingress,omitempty"`
+	// PersistentVolumeClaims is enforced on PersistentVolumeClaims.
+	PersistentVolumeClaims ClaimPolicy `json:"persistentVolumeClaims,omitempty"`
+	// RequestReduction is how much of their resource requests the containers
+	// of Deployments and Pods keep.
+	RequestReduction ReductionPolicy `json:"requestReduction,omitempty"`
+	// QoSClass keeps the requests of the pods whose QoS class their
+	// reduction would lower.
+	QoSClass QoSClassPolicy `json:"qosClass,omitempty"`
+	// ReplicaBounds limit spec.replicas of Deployments, the first one
+	// matching a Deployment applies.
+	ReplicaBounds []ReplicaBounds `json:"replicaBounds,omitempty"`
+	// Autoscaling is how the replicas of the Deployments a
+	// HorizontalPodAutoscaler targets are handled, the replicaBounds never
+	// apply to them.
+	Autoscaling AutoscalingPolicy `json:"autoscaling,omitempty"`
+	// PodDisruptionBudgets requires larger Deployments to be covered by a
+	// PodDisruptionBudget.
+	PodDisruptionBudgets DisruptionBudgetPolicy `json:"podDisruptionBudgets,omitempty"`
+	// NetworkPolicies requires the pods of Deployments, ReplicaSets and
+	// Services to be selected by a NetworkPolicy.
+	NetworkPolicies NetworkPolicyRequirement `json:"networkPolicies,omitempty"`
+	// Deprecations warns about the deprecated API versions and annotations
+	// objects use, and enforces the removed ones.
+	Deprecations DeprecationPolicy `json:"deprecations,omitempty"`
+	// Probes requires the containers of Deployments to have probes.
+	Probes ProbePolicy `json:"probes,omitempty"`
+	// References requires the ConfigMaps, Secrets and
+	// PersistentVolumeClaims the pods of Deployments and Pods reference to
+	// exist.
+	References ReferencePolicy `json:"references,omitempty"`
+	// Strategy bounds how Deployments roll their pods out on updates.
+	Strategy StrategyPolicy `json:"strategy,omitempty"`
+	// MemoryPerCPU bounds the ratio of the memory to the cpu containers of
+	// Deployments and Pods request.
+	MemoryPerCPU RatioPolicy `json:"memoryPerCPU,omitempty"`
+	// ContainerResources checks the hugepages and ephemeral-storage the
+	// containers of Deployments, ReplicaSets and Pods request.
+	ContainerResources ContainerResourcePolicy `json:"containerResources,omitempty"`
+	// PodResources bounds what the pods of Deployments, ReplicaSets and Pods
+	// request in total.
+	PodResources PodResourcePolicy `json:"podResources,omitempty"`
+	// PriorityClasses set the priorityClassName of pod templates without one
+	// by the labels of their namespace, the first one matching applies.
+	PriorityClasses []PriorityClassRule `json:"priorityClasses,omitempty"`
+	// RuntimeClasses set the runtimeClassName of pod templates without one by
+	// the labels of their namespace, e.g. gvisor for untrusted workloads.
+	RuntimeClasses []RuntimeClassRule `json:"runtimeClasses,omitempty"`
+	// RegistryMirrors map registries such as docker.io or quay.io to the
+	// pull-through mirror, e.g. mirror.example.com/dockerhub, the images of
+	// pods are pulled from instead.
+	RegistryMirrors map[string]string `json:"registryMirrors,omitempty"`
+	// ImagePullSecrets are added to the pod specs of Deployments and Pods
+	// the rules match, every rule which matches adds its secrets.
+	ImagePullSecrets []PullSecretRule `json:"imagePullSecrets,omitempty"`
+	// Sidecars upgrade or remove the containers injected into the pod
+	// templates of Deployments and ReplicaSets.
+	Sidecars []SidecarRule `json:"sidecars,omitempty"`
+	// InjectionTemplates add volumes and their mounts to the pods annotated
+	// to ask for them.
+	InjectionTemplates []InjectionTemplate `json:"injectionTemplates,omitempty"`
+	// GPUs places the pods requesting GPUs on the GPU node pools and limits
+	// the GPUs they request.
+	GPUs GPUPolicy `json:"gpus,omitempty"`
+	// Signatures requires the images of pods to be signed with cosign.
+	Signatures SignaturePolicy `json:"signatures,omitempty"`
+	// Vulnerabilities limits the critical vulnerabilities of the images of
+	// pods, as found by the scanner.
+	Vulnerabilities VulnerabilityPolicy `json:"vulnerabilities,omitempty"`
+	// EphemeralContainers is enforced on the ephemeral containers added to
+	// pods, e.g. by kubectl debug.
+	EphemeralContainers EphemeralContainerPolicy `json:"ephemeralContainers,omitempty"`
+	// NamespaceMetadata is copied from their namespace onto Deployments and
+	// their pod templates.
+	NamespaceMetadata NamespaceMetadata `json:"namespaceMetadata,omitempty"`
+	// PropagatedLabels are the keys of the namespace labels kept in sync on
+	// the pod templates of Deployments, on creation and on every update.
+	PropagatedLabels []string `json:"propagatedLabels,omitempty"`
+	// GuaranteedQoSSelector is a label selector, such as "qos=guaranteed", of
+	// the namespaces whose Deployments are made Guaranteed: the cpu and
+	// memory limits of their containers are set to the requests. None when
+	// empty.
+	GuaranteedQoSSelector string `json:"guaranteedQoSSelector,omitempty"`
+	// AntiAffinity spreads the replicas of Deployments across nodes by
+	// default.
+	AntiAffinity AntiAffinityPolicy `json:"antiAffinity,omitempty"`
+	// TemplateLabels copies the app.kubernetes.io labels of Deployments and
+	// ReplicaSets onto their pod templates.
+	TemplateLabels TemplateLabelPolicy `json:"templateLabels,omitempty"`
+	// ConfigChecksum annotates the pod templates of Deployments with the
+	// checksum of the ConfigMaps and Secrets they reference.
+	ConfigChecksum ConfigChecksumPolicy `json:"configChecksum,omitempty"`
+	// ServiceAccountToken disables the automount of the service account
+	// token in the pods of Deployments and Pods which don't ask for it.
+	ServiceAccountToken TokenPolicy `json:"serviceAccountToken,omitempty"`
+	// Termination defaults the termination of the pods of Deployments, so
+	// their rolling updates don't drop the connections of their Services.
+	Termination TerminationPolicy `json:"termination,omitempty"`
+	// FreezeWindows deny the changes of workloads in their namespaces while
+	// they are open, e.g. on weekends or during a release freeze.
+	FreezeWindows []FreezeWindow `json:"freezeWindows,omitempty"`
+	// ConfigData is enforced on ConfigMaps and Secrets.
+	ConfigData DataPolicy `json:"configData,omitempty"`
+	// Callout sends the objects of some kinds to the external policy service.
+	Callout CalloutPolicy `json:"callout,omitempty"`
+	// NamespaceDefaults are applied to new namespaces, the first one whose
+	// pattern matches the name wins.
+	NamespaceDefaults []NamespaceDefaults `json:"namespaceDefaults,omitempty"`
+	// MetadataResources are the resources without rules of their own, CRDs
+	// included, which only get the rules on metadata: the RequiredLabels,
+	// the ImmutableFields and the deletion protection. Their objects are
+	// decoded as maps, no Go type is needed.
+	MetadataResources []MetadataResource `json:"metadataResources,omitempty"`
+	// MutationProvenance records which rules mutated the objects of its
+	// namespaces on them.
+	MutationProvenance ProvenancePolicy `json:"mutationProvenance,omitempty"`
+	// NamespaceOverrides bound what the WebhookPolicyOverrides of a
+	// namespace can change of the policy of the namespace.
+	NamespaceOverrides OverridePolicy `json:"namespaceOverrides,omitempty"`
+	// Activations change the policy while their window is open, e.g. for
+	// stricter rules during business hours. Only the first one open at the
+	// time of a request applies.
+	Activations []Activation `json:"activations,omitempty"`
+	// Clusters change the policy of the clusters they name, so that one
+	// config drives the dev, stage and prod clusters, see ForCluster.
+	Clusters []ClusterPolicy `json:"clusters,omitempty"`
+
+	exempt        labels.Selector
+	immutable     [][]string
+	guaranteedQoS labels.Selector
+}
+
+// RequiredAnnotation is an annotation objects must carry with a value
+// matching Pattern.
+type RequiredAnnotation struct {
+	// Key of the annotation, such as oncall-channel.
+	Key string `json:"key"`
+	// Pattern is a regular expression the whole value must match, such as
+	// "#[a-z0-9-]+", any value but an empty one when empty.
+	Pattern string `json:"pattern,omitempty"`
+	// Namespaces are path.Match patterns of the namespaces where the
+	// annotation is required, every namespace when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Applies reports whether the annotation is required in namespace.
+func (a *RequiredAnnotation) Applies(namespace string) bool {
+	return len(a.Namespaces) == 0 || matchNamespace(a.Namespaces, namespace)
+}
+
+// Matches reports whether value is a valid value of the annotation.
+func (a *RequiredAnnotation) Matches(value string) bool {
+	if a.pattern == nil {
+		return value != ""
+	}
+	return a.pattern.MatchString(value)
+}
+
+// ServicePolicy is how Services are checked against the objects of their
+// namespace, looked up in the cache of the webhook.
+type ServicePolicy struct {
+	// Namespaces are path.Match patterns of the namespaces whose Services
+	// are checked, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// RequireSelectedPods denies Services whose selector matches the pod
+	// template of no Deployment of their namespace, such as one with a typo
+	// in a label. Services without a selector have their endpoints managed
+	// by hand and aren't checked.
+	RequireSelectedPods bool `json:"requireSelectedPods,omitempty"`
+	// UniquePorts denies Services using a nodePort another Service of their
+	// namespace uses, or exposing the same port and protocol as another
+	// Service with the same selector.
+	UniquePorts bool `json:"uniquePorts,omitempty"`
+}
+
+// Checked reports whether the Services of namespace are checked.
+func (p *ServicePolicy) Checked(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// IngressPolicy is what Ingresses must comply with, nothing is enforced when
+// it is empty.
+type IngressPolicy struct {
+	// RequireTLS requires every host to be listed in a TLS section.
+	RequireTLS bool `json:"requireTLS,omitempty"`
+	// AllowedHosts are path.Match patterns such as "*.apps.example.com" of
+	// the hosts Ingresses may route, any host when empty.
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	// RequireIngressClass requires spec.ingressClassName or the legacy
+	// kubernetes.io/ingress.class annotation.
+	RequireIngressClass bool `json:"requireIngressClass,omitempty"`
+	// RequiredAnnotations must be set on every Ingress.
+	RequiredAnnotations []string `json:"requiredAnnotations,omitempty"`
+}
+
+// HostAllowed reports whether host matches the AllowedHosts of p.
+func (p *IngressPolicy) HostAllowed(host string) bool {
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowedHosts {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ClaimPolicy is what PersistentVolumeClaims must comply with, nothing is
+// enforced when it is empty.
+type ClaimPolicy struct {
+	// AllowedStorageClasses are the storage classes claims may use, any when
+	// empty. Claims without a class get the default one and are allowed.
+	AllowedStorageClasses []string `json:"allowedStorageClasses,omitempty"`
+	// MaxSizes limit the storage a single claim requests, by namespace.
+	MaxSizes []ClaimSizeLimit `json:"maxSizes,omitempty"`
+	// RequireLabels requires the RequiredLabels on claims.
+	RequireLabels bool `json:"requireLabels,omitempty"`
+}
+
+// ClaimSizeLimit is the maximum storage requested by a claim in the
+// namespaces matching Namespace.
+type ClaimSizeLimit struct {
+	// Namespace is a path.Match pattern, "*" for any namespace.
+	Namespace string            `json:"namespace"`
+	Max       resource.Quantity `json:"max"`
+}
+
+// StorageClassAllowed reports whether p allows claims of storageClass, nil
+// for the default class.
+func (p *ClaimPolicy) StorageClassAllowed(storageClass *string) bool {
+	if storageClass == nil || len(p.AllowedStorageClasses) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedStorageClasses {
+		if allowed == *storageClass {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxSize returns the maximum storage a claim in namespace may request, the
+// first of the MaxSizes matching it, nil without a limit.
+func (p *ClaimPolicy) MaxSize(namespace string) *resource.Quantity {
+	for i := range p.MaxSizes {
+		if matched, _ := path.Match(p.MaxSizes[i].Namespace, namespace); matched {
+			return &p.MaxSizes[i].Max
+		}
+	}
+	return nil
+}
+
+// ReplicaBounds are the minimum and maximum replicas of the Deployments in
+// the namespaces matching Namespace whose labels match Selector.
+type ReplicaBounds struct {
+	// Namespace is a path.Match pattern, any namespace when empty.
+	Namespace string `json:"namespace,omitempty"`
+	// Selector is a label selector such as "tier=frontend", any Deployment
+	// when empty.
+	Selector string `json:"selector,omitempty"`
+	// Min and Max are inclusive, unbounded when unset.
+	Min *int32 `json:"min,omitempty"`
+	Max *int32 `json:"max,omitempty"`
+
+	selector labels.Selector
+}
+
+// ReplicaBoundsFor returns the first ReplicaBounds of the policy of
+// namespace matching a Deployment there with deploymentLabels, nil when none
+// does.
+func ReplicaBoundsFor(namespace string, deploymentLabels map[string]string) *ReplicaBounds {
+	config := ConfigFor(namespace)
+	for i := range config.ReplicaBounds {
+		bounds := &config.ReplicaBounds[i]
+		if bounds.Namespace != "" {
+			if matched, _ := path.Match(bounds.Namespace, namespace); !matched {
+				continue
+			}
+		}
+		if bounds.selector != nil && !bounds.selector.Matches(labels.Set(deploymentLabels)) {
+			continue
+		}
+		return bounds
+	}
+	return nil
+}
+
+// AutoscalingPolicy is how the replicas of autoscaled Deployments are
+// handled.
+type AutoscalingPolicy struct {
+	// KeepReplicas keeps the replicas of autoscaled Deployments on updates
+	// setting others, such as applying a manifest with replicas, so the
+	// HorizontalPodAutoscaler owns them.
+	KeepReplicas bool `json:"keepReplicas,omitempty"`
+}
+
+// Enforcement is what a rule does with the objects violating it.
+type Enforcement string
+
+const (
+	// EnforceWarn admits them with a warning, the default.
+	EnforceWarn Enforcement = "warn"
+	// EnforceDeny denies them.
+	EnforceDeny Enforcement = "deny"
+)
+
+func (e Enforcement) validate() error {
+	switch e {
+	case "", EnforceWarn, EnforceDeny:
+		return nil
+	}
+	return fmt.Errorf("invalid enforcement %q, expect %s or %s", e, EnforceWarn, EnforceDeny)
+}
+
+// DisruptionBudgetPolicy is which Deployments need a PodDisruptionBudget
+// selecting their pods.
+type DisruptionBudgetPolicy struct {
+	// Namespaces are path.Match patterns of the production namespaces, the
+	// policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// MinReplicas is the number of replicas Deployments need more of to
+	// require a budget.
+	MinReplicas int32 `json:"minReplicas,omitempty"`
+	// Enforcement of the policy, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// Required reports whether a Deployment of replicas in namespace needs a
+// PodDisruptionBudget.
+func (p *DisruptionBudgetPolicy) Required(namespace string, replicas int32) bool {
+	return replicas > p.MinReplicas && matchNamespace(p.Namespaces, namespace)
+}
+
+// NetworkPolicyRequirement is where the pods of workloads and Services need
+// a NetworkPolicy selecting them, such as the hardened namespaces meant to
+// deny the traffic not allowed explicitly.
+type NetworkPolicyRequirement struct {
+	// Namespaces are path.Match patterns of the namespaces where a
+	// NetworkPolicy is required, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Enforcement of the policy, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// Required reports whether the pods of workloads and Services in namespace
+// need a NetworkPolicy.
+func (p *NetworkPolicyRequirement) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// ProbePolicy is which probes the containers of Deployments need.
+type ProbePolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where containers
+	// need a readiness probe, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// RequireLiveness requires a liveness probe too.
+	RequireLiveness bool `json:"requireLiveness,omitempty"`
+	// Enforcement of the policy, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// Required reports whether the containers of Deployments in namespace need
+// probes.
+func (p *ProbePolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// ReferencePolicy is where the ConfigMaps, Secrets and
+// PersistentVolumeClaims pods reference must exist, pods referencing missing
+// ones fail with CreateContainerConfigError or stay pending.
+type ReferencePolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where references
+	// are checked, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Enforcement of the policy, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// Required reports whether the references of pods in namespace are checked.
+func (p *ReferencePolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// StrategyPolicy is how Deployments must update their pods.
+type StrategyPolicy struct {
+	// Namespaces are path.Match patterns of the production namespaces, where
+	// Deployments must use the RollingUpdate strategy within the bounds. The
+	// policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// MaxUnavailable bounds spec.strategy.rollingUpdate.maxUnavailable of
+	// the Deployments there, a number of pods or a percentage of the
+	// replicas such as 25%, unbounded when unset.
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// MaxSurge bounds spec.strategy.rollingUpdate.maxSurge the same way.
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
+	// ZeroDowntimeSelector is a label selector, such as
+	// "availability=zero-downtime", of the Deployments which can't use the
+	// Recreate strategy in any namespace, it stops all their pods at once.
+	// None when empty.
+	ZeroDowntimeSelector string `json:"zeroDowntimeSelector,omitempty"`
+
+	zeroDowntime labels.Selector
+}
+
+// Required reports whether Deployments in namespace must use the
+// RollingUpdate strategy within the bounds.
+func (p *StrategyPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// ZeroDowntime reports whether a Deployment labeled with deploymentLabels
+// can't be recreated.
+func (p *StrategyPolicy) ZeroDowntime(deploymentLabels map[string]string) bool {
+	return p.zeroDowntime != nil && p.zeroDowntime.Matches(labels.Set(deploymentLabels))
+}
+
+// PriorityClassRule is the priority class of the pods in the namespaces
+// matching NamespaceSelector.
+type PriorityClassRule struct {
+	// NamespaceSelector is a label selector such as "tier=critical", every
+	// namespace when empty.
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	PriorityClassName string `json:"priorityClassName"`
+
+	selector labels.Selector
+}
+
+// OperationChecked reports whether operation is checked on resource.
+func (c *Config) OperationChecked(resource, operation string) bool {
+	operations, ok := c.Operations[resource]
+	if !ok {
+		return true
+	}
+	for _, checked := range operations {
+		if strings.EqualFold(checked, operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplicaBoundsSelectDeployments reports whether ReplicaBounds select
+// Deployments by their labels.
+func (c *Config) ReplicaBoundsSelectDeployments() bool {
+	for _, bounds := range c.ReplicaBounds {
+		if bounds.Selector != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// PriorityClassFor returns the priority class the current policy gives the
+// pods of a namespace with namespaceLabels, empty when no rule matches.
+func PriorityClassFor(namespaceLabels map[string]string) string {
+	config := CurrentConfig()
+	for _, rule := range config.PriorityClasses {
+		if rule.selector.Matches(labels.Set(namespaceLabels)) {
+			return rule.PriorityClassName
+		}
+	}
+	return ""
+}
+
+// RuntimeClassRule is the runtime class of the pods in the namespaces
+// matching NamespaceSelector.
+type RuntimeClassRule struct {
+	// NamespaceSelector is a label selector such as
+	// "untrusted-workload=true", every namespace when empty.
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	RuntimeClassName  string `json:"runtimeClassName"`
+
+	selector labels.Selector
+}
+
+// RuntimeClassFor returns the runtime class the current policy gives the
+// pods of a namespace with namespaceLabels, empty when no rule matches.
+func RuntimeClassFor(namespaceLabels map[string]string) string {
+	config := CurrentConfig()
+	for _, rule := range config.RuntimeClasses {
+		if rule.selector.Matches(labels.Set(namespaceLabels)) {
+			return rule.RuntimeClassName
+		}
+	}
+	return ""
+}
+
+// SignaturePolicy is which images need a cosign signature by whom.
+type SignaturePolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where the images
+	// of pods must be signed, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// PublicKeys are the PEM encoded cosign public keys, a signature by one
+	// of them is enough.
+	PublicKeys []string `json:"publicKeys,omitempty"`
+
+	keys []crypto.PublicKey
+}
+
+// Required reports whether the images of pods in namespace must be signed.
+func (p *SignaturePolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// Keys returns the parsed PublicKeys.
+func (p *SignaturePolicy) Keys() []crypto.PublicKey {
+	return p.keys
+}
+
+// VulnerabilityPolicy is how many critical vulnerabilities images may have.
+type VulnerabilityPolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where the images
+	// of pods are checked, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// MaxCritical is the number of critical vulnerabilities allowed.
+	MaxCritical int `json:"maxCritical,omitempty"`
+	// FailOpen admits images with a warning when the scanner has no result
+	// for them, instead of denying them.
+	FailOpen bool `json:"failOpen,omitempty"`
+}
+
+// Required reports whether the images of pods in namespace are checked.
+func (p *VulnerabilityPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// EphemeralContainerPolicy is what the ephemeral containers added to pods
+// must comply with, nothing is enforced when it is empty.
+type EphemeralContainerPolicy struct {
+	// BlockedNamespaces are path.Match patterns of the hardened namespaces
+	// where no ephemeral container may be added.
+	BlockedNamespaces []string `json:"blockedNamespaces,omitempty"`
+	// AllowedImages are path.Match patterns such as
+	// "registry.example.com/debug/*" of the images ephemeral containers may
+	// run, any image when empty.
+	AllowedImages []string `json:"allowedImages,omitempty"`
+	// ForbidPrivileged denies ephemeral containers which are privileged,
+	// allow privilege escalation, run as root or add capabilities.
+	ForbidPrivileged bool `json:"forbidPrivileged,omitempty"`
+}
+
+// Blocked reports whether no ephemeral container may be added in namespace.
+func (p *EphemeralContainerPolicy) Blocked(namespace string) bool {
+	return matchNamespace(p.BlockedNamespaces, namespace)
+}
+
+// ImageAllowed reports whether ephemeral containers may run image.
+func (p *EphemeralContainerPolicy) ImageAllowed(image string) bool {
+	if len(p.AllowedImages) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowedImages {
+		if matched, _ := path.Match(pattern, image); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CalloutPolicy is when the external policy service decides on admission
+// requests too.
+type CalloutPolicy struct {
+	// Kinds such as Deployment of the objects sent to the service, none
+	// when empty.
+	Kinds []string `json:"kinds,omitempty"`
+	// FailOpen admits requests with a warning when the service can't be
+	// reached, they are denied otherwise.
+	FailOpen bool `json:"failOpen,omitempty"`
+}
+
+// Applies reports whether the objects of kind are sent to the service.
+func (p *CalloutPolicy) Applies(kind string) bool {
+	for _, k := range p.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// FreezeWindow is a Window during which the objects of its Kinds can't be
+// created or updated in its Namespaces, unless they are annotated with the
+// reason to override it.
+type FreezeWindow struct {
+	// Name identifies the window in denials and audit annotations.
+	Name string `json:"name"`
+	// Namespaces are path.Match patterns of the frozen namespaces.
+	Namespaces []string `json:"namespaces"`
+	// Kinds such as Deployment of the frozen objects, Deployment when empty.
+	Kinds []string `json:"kinds,omitempty"`
+	Window
+}
+
+// Applies reports whether the objects of kind in namespace are frozen by
+// the window when it is open.
+func (w *FreezeWindow) Applies(namespace, kind string) bool {
+	if !matchNamespace(w.Namespaces, namespace) {
+		return false
+	}
+	if len(w.Kinds) == 0 {
+		return kind == "Deployment"
+	}
+	for _, k := range w.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Activation is a Window during which the requests are admitted with the
+// Policy merged over the rest of the config.
+type Activation struct {
+	// Name identifies the activation in the logs.
+	Name string `json:"name"`
+	Window
+	// Policy is the part of the config the activation changes, as a JSON
+	// merge patch: maps are merged, lists and values replaced and null
+	// removes a key. It can't hold activations of its own.
+	Policy json.RawMessage `json:"policy"`
+
+	config *Config
+}
+
+// ClusterPolicy is the Policy merged over the rest of the config in the
+// clusters it names.
+type ClusterPolicy struct {
+	// Names are path.Match patterns of the names of the clusters, as set by
+	// -clusterName.
+	Names []string `json:"names"`
+	// Policy is the part of the config which differs in the clusters, as a
+	// JSON merge patch like the one of an Activation. It can't hold clusters
+	// of its own.
+	Policy json.RawMessage `json:"policy"`
+}
+
+// MetadataResource is a resource validated on its metadata only, such as
+// group argoproj.io, version v1alpha1 and resource rollouts.
+type MetadataResource struct {
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// RequireLabels requires the RequiredLabels on new objects.
+	RequireLabels bool `json:"requireLabels,omitempty"`
+}
+
+// MetadataResource returns the MetadataResources entry of the resource of
+// group, version and resource, nil when there is none.
+func (c *Config) MetadataResource(group, version, resource string) *MetadataResource {
+	for i := range c.MetadataResources {
+		r := &c.MetadataResources[i]
+		if r.Group == group && r.Version == version && r.Resource == resource {
+			return r
+		}
+	}
+	return nil
+}
+
+// NamespaceMetadata are the keys of the labels and annotations, e.g. team,
+// cost-center or environment for chargeback, copied from the namespace unless
+// the Deployment or its pod template sets them.
+type NamespaceMetadata struct {
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// NamespaceDependent reports whether c has rules depending on the namespace
+// of Deployments, which must be looked up then.
+func (c *Config) NamespaceDependent() bool {
+	return len(c.PriorityClasses) > 0 || len(c.RuntimeClasses) > 0 ||
+		len(c.NamespaceMetadata.Labels) > 0 || len(c.NamespaceMetadata.Annotations) > 0 ||
+		len(c.PropagatedLabels) > 0 || c.GuaranteedQoSSelector != ""
+}
+
+// AntiAffinityPolicy gives the pod templates labeled with NameLabel and
+// without a podAntiAffinity a preferred one on that label.
+type AntiAffinityPolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where the
+	// podAntiAffinity is set, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// TopologyKey is the node label the replicas spread across,
+	// kubernetes.io/hostname when empty.
+	TopologyKey string `json:"topologyKey,omitempty"`
+	// Weight of the preferred term from 1 to 100, 100 when 0.
+	Weight int32 `json:"weight,omitempty"`
+}
+
+// Required reports whether pod templates in namespace get a podAntiAffinity.
+func (p *AntiAffinityPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// TemplateLabelPolicy copies the RequiredLabels of workloads onto their pod
+// templates, except those of their selector.
+type TemplateLabelPolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where the labels
+	// are copied, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Required reports whether the labels of workloads in namespace are copied
+// onto their pod templates.
+func (p *TemplateLabelPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// ConfigChecksumPolicy rolls the pods of Deployments out when the
+// ConfigMaps and Secrets they reference change along with them.
+type ConfigChecksumPolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where the
+	// checksum is set, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Required reports whether the pod templates of Deployments in namespace
+// get the checksum of their configuration.
+func (p *ConfigChecksumPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// PullSecretRule adds the Secrets to the pods in Namespaces, or, with
+// Registries, to the pods there with an image pulled from one of them.
+type PullSecretRule struct {
+	// Namespaces are path.Match patterns of the namespaces of the pods, any
+	// namespace when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Registries are the hosts, such as registry.example.com, of the
+	// images, after the registryMirrors, any image when empty.
+	Registries []string `json:"registries,omitempty"`
+	// Secrets are the names of the docker registry Secrets in the namespace
+	// of the pods.
+	Secrets []string `json:"secrets"`
+}
+
+// TokenPolicy sets automountServiceAccountToken to false on the pod specs
+// which don't set it, unless their pods are annotated to keep the token.
+type TokenPolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where the token
+	// isn't mounted by default, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Required reports whether the token automount is disabled in namespace.
+func (p *TokenPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// DefaultGracePeriodSeconds is the terminationGracePeriodSeconds the
+// apiserver defaults pod specs to.
+const DefaultGracePeriodSeconds = 30
+
+// TerminationPolicy defaults the terminationGracePeriodSeconds of the pod
+// templates of Deployments and gives their containers a preStop sleep when
+// a Service selects them, for the endpoints to be removed before the
+// containers get SIGTERM.
+type TerminationPolicy struct {
+	// Namespaces are path.Match patterns of the namespaces where the
+	// termination is defaulted, the policy applies to none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// GracePeriodSeconds replaces the terminationGracePeriodSeconds of pod
+	// templates which keep the default of 30, unchanged when 0.
+	GracePeriodSeconds int64 `json:"gracePeriodSeconds,omitempty"`
+	// PreStopSleepSeconds is how long the preStop hook added to containers
+	// without one sleeps, no hook is added when 0.
+	PreStopSleepSeconds int64 `json:"preStopSleepSeconds,omitempty"`
+}
+
+// Required reports whether the termination of pods in namespace is
+// defaulted.
+func (p *TerminationPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// ReductionPolicy is the percentage of their resource requests containers
+// keep, which workloads can override with their request-reduction
+// annotation within bounds.
+type ReductionPolicy struct {
+	// Percent of the requests kept, 90 when 0.
+	Percent int64 `json:"percent,omitempty"`
+	// MinPercent is the least percentage workloads can set, 50 when 0.
+	MinPercent int64 `json:"minPercent,omitempty"`
+}
+
+// QoSClassPolicy is what becomes of the requests reductions lowering the
+// QoS class of pods, e.g. from Guaranteed to Burstable, which the kubelet
+// evicts sooner under node pressure. They are warned about anyway.
+type QoSClassPolicy struct {
+	// Namespaces are path.Match patterns of the namespaces the requests
+	// are not reduced in when the reduction would lower the QoS class of
+	// the pods, none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Required reports whether the QoS class of the pods in namespace is kept.
+func (p *QoSClassPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// RequestPercent returns the percentage of the resource requests kept by the
+// containers of a workload annotated with annotations. The warning is set
+// when its annotation is invalid or below the MinPercent.
+func RequestPercent(annotations map[string]string) (percent int64, warning string) {
+	p := &CurrentConfig().RequestReduction
+	percent, min := p.Percent, p.MinPercent
+	if percent == 0 {
+		percent = 90
+	}
+	if min == 0 {
+		min = 50
+	}
+	value, ok := Lookup(annotations, AnnotationRequestReductionKey)
+	if !ok {
+		return percent, ""
+	}
+	if strings.EqualFold(value, "off") {
+		return 100, ""
+	}
+	set, err := strconv.ParseInt(strings.TrimSuffix(value, "%"), 10, 64)
+	switch {
+	case err != nil || set <= 0 || set > 100:
+		return percent, fmt.Sprintf(messages.ReductionInvalid, AnnotationRequestReductionKey, value, percent)
+	case set < min:
+		return min, fmt.Sprintf(messages.ReductionClamped, AnnotationRequestReductionKey, value, min)
+	}
+	return set, ""
+}
+
+// RatioPolicy bounds the memory containers request per core of cpu, e.g. a
+// Min of 256Mi allows no more than 1 core per 256Mi. Containers not
+// requesting both are not checked.
+type RatioPolicy struct {
+	// Namespaces are path.Match patterns of the namespaces the bounds apply
+	// in, none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Min is the least memory requested per core, unbounded when unset.
+	Min *resource.Quantity `json:"min,omitempty"`
+	// Max is the most memory requested per core, unbounded when unset.
+	Max *resource.Quantity `json:"max,omitempty"`
+	// Enforcement of the policy, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// Required reports whether containers in namespace are checked.
+func (p *RatioPolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// ContainerResourcePolicy checks the resources containers request which the
+// requests reduction leaves alone or can't bound.
+type ContainerResourcePolicy struct {
+	// Namespaces are path.Match patterns of the namespaces the checks apply
+	// in, none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// HugePages requires the hugepages-<size> requests of containers to
+	// equal their limits and to be multiples of the page size, or the pods
+	// are rejected or never scheduled.
+	HugePages bool `json:"hugePages,omitempty"`
+	// RequestsWithinLimits requires the requests of containers, the init
+	// containers included, not to exceed their limits.
+	RequestsWithinLimits bool `json:"requestsWithinLimits,omitempty"`
+	// MaxEphemeralStorage caps the ephemeral-storage a container requests,
+	// or limits when it requests none, unlimited when unset.
+	MaxEphemeralStorage *resource.Quantity `json:"maxEphemeralStorage,omitempty"`
+	// Enforcement of the policy, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// Required reports whether containers in namespace are checked.
+func (p *ContainerResourcePolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// PodResourcePolicy bounds the requests of whole pods, as the scheduler
+// counts them: the sum of the requests of their containers, or those of the
+// largest init container when they are more, plus the overhead. A pod no
+// node can allocate stays Pending forever.
+type PodResourcePolicy struct {
+	// Namespaces are path.Match patterns of the namespaces the checks apply
+	// in, none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Max caps what a pod requests by resource, e.g. cpu: "16" and memory:
+	// 64Gi, the resources not listed are unlimited.
+	Max corev1.ResourceList `json:"max,omitempty"`
+	// FitNodes requires a node of the cluster to have the allocatable for
+	// what a pod requests, among the schedulable nodes its nodeSelector
+	// selects and whose taints it tolerates. The nodes are only known with
+	// -watchNodes. Node pools the cluster autoscaler can scale up from zero
+	// have no node to fit, such clusters shouldn't set it.
+	FitNodes bool `json:"fitNodes,omitempty"`
+	// Enforcement of the policy, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// Required reports whether pods in namespace are checked.
+func (p *PodResourcePolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// DataPolicy is what the data of ConfigMaps and Secrets must comply with,
+// nothing is enforced when it is empty.
+type DataPolicy struct {
+	// MaxSize limits the total size of the values of a ConfigMap or Secret,
+	// e.g. 256Ki, unlimited when unset.
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+	// ForbiddenPatterns are regular expressions ConfigMap values must not
+	// match, such as "-----BEGIN [A-Z ]*PRIVATE KEY-----" for keys which
+	// belong in a Secret.
+	ForbiddenPatterns []string `json:"forbiddenPatterns,omitempty"`
+	// ScanSecrets checks the values of Secrets for the ForbiddenPatterns too.
+	ScanSecrets bool `json:"scanSecrets,omitempty"`
+
+	forbidden []*regexp.Regexp
+}
+
+// Forbidden returns the first of the ForbiddenPatterns value matches, empty
+// when there is none.
+func (p *DataPolicy) Forbidden(value []byte) string {
+	for i, pattern := range p.forbidden {
+		if pattern.Match(value) {
+			return p.ForbiddenPatterns[i]
+		}
+	}
+	return ""
+}
+
+// ProvenancePolicy annotates the objects the webhook mutates with the rules
+// which changed them, an annotation per rule named after the section of the
+// policy driving it, such as provenance.<domain>/sidecars, holding the
+// Version of the policy and the time of the change: "<version>,<RFC 3339
+// time>". Users find why an object differs from its manifest, and tools
+// which fields to clean up once a rule is dropped.
+type ProvenancePolicy struct {
+	// Namespaces are path.Match patterns of the namespaces whose objects are
+	// annotated, new namespaces by their own name, none when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Required reports whether the mutations of objects in namespace are
+// recorded.
+func (p *ProvenancePolicy) Required(namespace string) bool {
+	return matchNamespace(p.Namespaces, namespace)
+}
+
+// NamespaceDefaults are the labels and annotations, e.g. team, cost-center or
+// quota hints, set on new namespaces whose name matches Pattern unless the
+// creator set them.
+type NamespaceDefaults struct {
+	// Pattern is a path.Match pattern such as "team-payments-*".
+	Pattern     string            `json:"pattern"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// LoadConfig reads a YAML or JSON Config from file, unknown fields are
+// rejected so typos don't silently disable a setting.
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return config, nil
+}
+
+// Validate checks the patterns and selectors of c are well formed and
+// compiles them.
+func (c *Config) Validate() error {
+	for resource, operations := range c.Operations {
+		for _, operation := range operations {
+			switch strings.ToUpper(operation) {
+			case "CREATE", "UPDATE", "DELETE", "CONNECT":
+			default:
+				return fmt.Errorf("operations: invalid operation %q of %s", operation, resource)
+			}
+		}
+	}
+	for _, pattern := range c.IgnoredNamespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ignoredNamespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range c.ServiceTypeNamespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("serviceTypeNamespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range c.Services.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("services.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range c.Ingress.AllowedHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ingress.allowedHosts: invalid pattern %q", pattern)
+		}
+	}
+	for _, limit := range c.PersistentVolumeClaims.MaxSizes {
+		if _, err := path.Match(limit.Namespace, ""); err != nil || limit.Namespace == "" {
+			return fmt.Errorf("persistentVolumeClaims.maxSizes: invalid namespace pattern %q", limit.Namespace)
+		}
+	}
+	for _, defaults := range c.NamespaceDefaults {
+		if _, err := path.Match(defaults.Pattern, ""); err != nil || defaults.Pattern == "" {
+			return fmt.Errorf("namespaceDefaults: invalid pattern %q", defaults.Pattern)
+		}
+	}
+	for i := range c.ReplicaBounds {
+		bounds := &c.ReplicaBounds[i]
+		if _, err := path.Match(bounds.Namespace, ""); err != nil {
+			return fmt.Errorf("replicaBounds: invalid namespace pattern %q", bounds.Namespace)
+		}
+		bounds.selector = nil
+		if bounds.Selector != "" {
+			selector, err := labels.Parse(bounds.Selector)
+			if err != nil {
+				return fmt.Errorf("replicaBounds: %v", err)
+			}
+			bounds.selector = selector
+		}
+		if bounds.Min != nil && bounds.Max != nil && *bounds.Min > *bounds.Max {
+			return fmt.Errorf("replicaBounds: min %d exceeds max %d", *bounds.Min, *bounds.Max)
+		}
+	}
+	for _, pattern := range c.PodDisruptionBudgets.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("podDisruptionBudgets.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	if err := c.PodDisruptionBudgets.Enforcement.validate(); err != nil {
+		return fmt.Errorf("podDisruptionBudgets.enforcement: %v", err)
+	}
+	for _, pattern := range c.NetworkPolicies.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("networkPolicies.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	if err := c.NetworkPolicies.Enforcement.validate(); err != nil {
+		return fmt.Errorf("networkPolicies.enforcement: %v", err)
+	}
+	if err := c.Deprecations.validate(); err != nil {
+		return fmt.Errorf("deprecations.%v", err)
+	}
+	for _, pattern := range c.Probes.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("probes.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	if err := c.Probes.Enforcement.validate(); err != nil {
+		return fmt.Errorf("probes.enforcement: %v", err)
+	}
+	for _, pattern := range c.References.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("references.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	if err := c.References.Enforcement.validate(); err != nil {
+		return fmt.Errorf("references.enforcement: %v", err)
+	}
+	if err := c.Subjects.Exempt.validate(); err != nil {
+		return fmt.Errorf("subjects.exempt.%v", err)
+	}
+	if err := c.Subjects.Strict.validate(); err != nil {
+		return fmt.Errorf("subjects.strict.%v", err)
+	}
+	for _, pattern := range c.Strategy.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("strategy.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for name, bound := range map[string]*intstr.IntOrString{"maxUnavailable": c.Strategy.MaxUnavailable, "maxSurge": c.Strategy.MaxSurge} {
+		if bound == nil {
+			continue
+		}
+		if n, err := intstr.GetScaledValueFromIntOrPercent(bound, 100, false); err != nil || n < 0 {
+			return fmt.Errorf("strategy.%s: invalid %s, expect a number of pods or a percentage", name, bound.String())
+		}
+	}
+	c.Strategy.zeroDowntime = nil
+	if c.Strategy.ZeroDowntimeSelector != "" {
+		selector, err := labels.Parse(c.Strategy.ZeroDowntimeSelector)
+		if err != nil {
+			return fmt.Errorf("strategy.zeroDowntimeSelector: %v", err)
+		}
+		c.Strategy.zeroDowntime = selector
+	}
+	if percent, min := c.RequestReduction.Percent, c.RequestReduction.MinPercent; percent < 0 || percent > 100 || min < 0 || min > 100 {
+		return fmt.Errorf("requestReduction: percentages must be within 1 and 100")
+	} else if percent != 0 && percent < min {
+		return fmt.Errorf("requestReduction: percent %d is below minPercent %d", percent, min)
+	}
+	for _, pattern := range c.QoSClass.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("qosClass.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range c.MemoryPerCPU.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("memoryPerCPU.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	if min, max := c.MemoryPerCPU.Min, c.MemoryPerCPU.Max; min != nil && max != nil && min.Cmp(*max) > 0 {
+		return fmt.Errorf("memoryPerCPU: min %s exceeds max %s", min.String(), max.String())
+	}
+	if err := c.MemoryPerCPU.Enforcement.validate(); err != nil {
+		return fmt.Errorf("memoryPerCPU.enforcement: %v", err)
+	}
+	for _, pattern := range c.ContainerResources.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("containerResources.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	if max := c.ContainerResources.MaxEphemeralStorage; max != nil && max.Sign() <= 0 {
+		return fmt.Errorf("containerResources.maxEphemeralStorage: must be positive, got %s", max.String())
+	}
+	if err := c.ContainerResources.Enforcement.validate(); err != nil {
+		return fmt.Errorf("containerResources.enforcement: %v", err)
+	}
+	for _, pattern := range c.PodResources.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("podResources.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for name, max := range c.PodResources.Max {
+		if max.Sign() <= 0 {
+			return fmt.Errorf("podResources.max: %s must be positive, got %s", name, max.String())
+		}
+	}
+	if err := c.PodResources.Enforcement.validate(); err != nil {
+		return fmt.Errorf("podResources.enforcement: %v", err)
+	}
+	for _, pattern := range c.MutationProvenance.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("mutationProvenance.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for i := range c.PriorityClasses {
+		rule := &c.PriorityClasses[i]
+		if rule.PriorityClassName == "" {
+			return fmt.Errorf("priorityClasses: priorityClassName is not set")
+		}
+		selector, err := labels.Parse(rule.NamespaceSelector)
+		if err != nil {
+			return fmt.Errorf("priorityClasses: %v", err)
+		}
+		rule.selector = selector
+	}
+	for i := range c.RuntimeClasses {
+		rule := &c.RuntimeClasses[i]
+		if rule.RuntimeClassName == "" {
+			return fmt.Errorf("runtimeClasses: runtimeClassName is not set")
+		}
+		selector, err := labels.Parse(rule.NamespaceSelector)
+		if err != nil {
+			return fmt.Errorf("runtimeClasses: %v", err)
+		}
+		rule.selector = selector
+	}
+	for registry, mirror := range c.RegistryMirrors {
+		if registry == "" || mirror == "" || strings.HasSuffix(mirror, "/") {
+			return fmt.Errorf("registryMirrors: invalid mirror %q of registry %q", mirror, registry)
+		}
+	}
+	for _, pattern := range c.EphemeralContainers.BlockedNamespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ephemeralContainers.blockedNamespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range c.EphemeralContainers.AllowedImages {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ephemeralContainers.allowedImages: invalid pattern %q", pattern)
+		}
+	}
+	for _, key := range c.PropagatedLabels {
+		if key == "" {
+			return fmt.Errorf("propagatedLabels: empty key")
+		}
+		// the copy would only add the label the propagation replaces
+		for _, copied := range c.NamespaceMetadata.Labels {
+			if copied == key {
+				return fmt.Errorf("propagatedLabels: %q is copied by namespaceMetadata.labels too", key)
+			}
+		}
+	}
+	for _, pattern := range c.AntiAffinity.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("antiAffinity.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range c.TemplateLabels.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("templateLabels.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range c.ConfigChecksum.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("configChecksum.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for i, rule := range c.ImagePullSecrets {
+		if len(rule.Secrets) == 0 {
+			return fmt.Errorf("imagePullSecrets[%d]: secrets required", i)
+		}
+		if len(rule.Namespaces) == 0 && len(rule.Registries) == 0 {
+			return fmt.Errorf("imagePullSecrets[%d]: namespaces or registries required", i)
+		}
+		for _, pattern := range rule.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("imagePullSecrets[%d].namespaces: invalid pattern %q", i, pattern)
+			}
+		}
+	}
+	sidecars := map[string]bool{}
+	for i := range c.Sidecars {
+		rule := &c.Sidecars[i]
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("sidecars[%d]: %v", i, err)
+		}
+		if sidecars[rule.Name] {
+			return fmt.Errorf("sidecars[%d]: name %q used twice", i, rule.Name)
+		}
+		sidecars[rule.Name] = true
+	}
+	if err := c.GPUs.validate(); err != nil {
+		return fmt.Errorf("gpus: %v", err)
+	}
+	templates := map[string]bool{}
+	for i := range c.InjectionTemplates {
+		t := &c.InjectionTemplates[i]
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("injectionTemplates[%d]: %v", i, err)
+		}
+		if templates[t.Name] {
+			return fmt.Errorf("injectionTemplates[%d]: name %q used twice", i, t.Name)
+		}
+		templates[t.Name] = true
+	}
+	keys := map[string]bool{}
+	for i := range c.RequiredAnnotations {
+		a := &c.RequiredAnnotations[i]
+		if a.Key == "" {
+			return fmt.Errorf("requiredAnnotations[%d]: key required", i)
+		}
+		if keys[a.Key] {
+			return fmt.Errorf("requiredAnnotations[%d]: key %q used twice", i, a.Key)
+		}
+		keys[a.Key] = true
+		for _, pattern := range a.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("requiredAnnotations[%d].namespaces: invalid pattern %q", i, pattern)
+			}
+		}
+		a.pattern = nil
+		if a.Pattern != "" {
+			// the whole value must match, not a part of it
+			compiled, err := regexp.Compile("^(?:" + a.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("requiredAnnotations[%d].pattern: %v", i, err)
+			}
+			a.pattern = compiled
+		}
+	}
+	for _, pattern := range c.ServiceAccountToken.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("serviceAccountToken.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range c.Termination.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("termination.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	if t := c.Termination; t.GracePeriodSeconds < 0 || t.PreStopSleepSeconds < 0 {
+		return fmt.Errorf("termination: negative gracePeriodSeconds or preStopSleepSeconds")
+	}
+	// the kubelet kills the containers still sleeping when the grace period
+	// is over
+	if grace := c.Termination.GracePeriodSeconds; c.Termination.PreStopSleepSeconds > 0 {
+		if grace == 0 {
+			grace = DefaultGracePeriodSeconds
+		}
+		if c.Termination.PreStopSleepSeconds >= grace {
+			return fmt.Errorf("termination: preStopSleepSeconds %d is not less than the grace period of %d seconds", c.Termination.PreStopSleepSeconds, grace)
+		}
+	}
+	names := map[string]bool{}
+	for i := range c.FreezeWindows {
+		w := &c.FreezeWindows[i]
+		if w.Name == "" {
+			return fmt.Errorf("freezeWindows[%d]: name required", i)
+		}
+		if names[w.Name] {
+			return fmt.Errorf("freezeWindows[%d]: name %q used twice", i, w.Name)
+		}
+		names[w.Name] = true
+		if len(w.Namespaces) == 0 {
+			return fmt.Errorf("freezeWindows[%d]: namespaces required", i)
+		}
+		for _, pattern := range w.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("freezeWindows[%d].namespaces: invalid pattern %q", i, pattern)
+			}
+		}
+		if err := w.Window.parse(); err != nil {
+			return fmt.Errorf("freezeWindows[%d]: %v", i, err)
+		}
+	}
+	if weight := c.AntiAffinity.Weight; weight < 0 || weight > 100 {
+		return fmt.Errorf("antiAffinity.weight: %d is not within 1 and 100", weight)
+	}
+	for _, pattern := range c.Signatures.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("signatures.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	c.Signatures.keys = nil
+	for i, data := range c.Signatures.PublicKeys {
+		key, err := cosign.ParsePublicKey(data)
+		if err != nil {
+			return fmt.Errorf("signatures.publicKeys[%d]: %v", i, err)
+		}
+		c.Signatures.keys = append(c.Signatures.keys, key)
+	}
+	if len(c.Signatures.Namespaces) > 0 && len(c.Signatures.keys) == 0 {
+		return fmt.Errorf("signatures: no publicKeys to verify with")
+	}
+	for _, pattern := range c.Vulnerabilities.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("vulnerabilities.namespaces: invalid pattern %q", pattern)
+		}
+	}
+	if c.Vulnerabilities.MaxCritical < 0 {
+		return fmt.Errorf("vulnerabilities.maxCritical: must not be negative")
+	}
+	c.ConfigData.forbidden = nil
+	for _, pattern := range c.ConfigData.ForbiddenPatterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("configData.forbiddenPatterns: %v", err)
+		}
+		c.ConfigData.forbidden = append(c.ConfigData.forbidden, compiled)
+	}
+	if max := c.ConfigData.MaxSize; max != nil && max.Sign() <= 0 {
+		return fmt.Errorf("configData.maxSize: must be positive, got %s", max.String())
+	}
+	for _, r := range c.MetadataResources {
+		if r.Version == "" || r.Resource == "" || strings.Contains(r.Resource, "/") {
+			return fmt.Errorf("metadataResources: version and resource required, got %q/%q/%q", r.Group, r.Version, r.Resource)
+		}
+	}
+	c.immutable = nil
+	for _, path := range c.ImmutableFields {
+		segments, err := parseFieldPath(path)
+		if err != nil {
+			return fmt.Errorf("immutableFields: %v", err)
+		}
+		c.immutable = append(c.immutable, segments)
+	}
+	c.exempt = labels.Nothing()
+	if c.ExemptSelector != "" {
+		selector, err := labels.Parse(c.ExemptSelector)
+		if err != nil {
+			return fmt.Errorf("exemptSelector: %v", err)
+		}
+		c.exempt = selector
+	}
+	c.guaranteedQoS = labels.Nothing()
+	if c.GuaranteedQoSSelector != "" {
+		selector, err := labels.Parse(c.GuaranteedQoSSelector)
+		if err != nil {
+			return fmt.Errorf("guaranteedQoSSelector: %v", err)
+		}
+		c.guaranteedQoS = selector
+	}
+	if err := c.NamespaceOverrides.validate(); err != nil {
+		return fmt.Errorf("namespaceOverrides.%v", err)
+	}
+	if err := c.checkClusters(); err != nil {
+		return err
+	}
+	return c.mergeActivations()
+}
+
+// configState is the Config last set with its version and generation, they
+// are stored together so that no reader sees the config of one SetConfig
+// with the version or the generation of another.
+type configState struct {
+	config     *Config
+	version    string
+	generation uint64
+}
+
+var (
+	state atomic.Value // *configState
+	// stateMu serializes the changes of state, each one bumps the
+	// generation of the last
+	stateMu sync.Mutex
+)
+
+// loadState returns the state last stored, an empty one before that.
+func loadState() *configState {
+	if s, ok := state.Load().(*configState); ok {
+		return s
+	}
+	return &configState{}
+}
+
+// SetConfig replaces the current Config.
+func SetConfig(c *Config) {
+	version := configVersion(c)
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state.Store(&configState{config: c, version: version, generation: loadState().generation + 1})
+}
+
+// bumpGeneration starts a generation under the current Config.
+func bumpGeneration() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := *loadState()
+	s.generation++
+	state.Store(&s)
+}
+
+// configVersion returns the first 12 hex digits of the SHA-256 of the JSON
+// of c, empty when it can't be marshaled.
+func configVersion(c *Config) string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Version returns the version of the Config last set, a digest of its
+// content: unlike the Generation, the same config has the same version on
+// every replica of the webhook and across restarts.
+func Version() string {
+	return loadState().version
+}
+
+// Generation counts the calls of SetConfig, decisions made under another
+// generation may not hold anymore.
+func Generation() uint64 {
+	return loadState().generation
+}
+
+// active caches the config the activations of the current one resolve to.
+var active atomic.Value // *activeConfig
+
+// CurrentConfig returns the Config last set, an empty one before that, as
+// the activation open now changes it. The activations are resolved once a
+// minute at most, the rules call it many times per request.
+func CurrentConfig() *Config {
+	c := loadState().config
+	if c == nil {
+		return &Config{}
+	}
+	if len(c.Activations) == 0 {
+		return c
+	}
+	now := Now()
+	// the cache of a config replaced since doesn't hold
+	if a, ok := active.Load().(*activeConfig); ok && a.base == c && !now.Before(a.from) && now.Before(a.until) {
+		return a.config
+	}
+	a := c.resolve(now)
+	active.Store(a)
+	return a.config
+}
+
+// Ignored returns the namespace patterns skipped by the current policy, the
+// built-in IgnoredNamespaces and the configured ones.
+func Ignored() []string {
+	configured := CurrentConfig().IgnoredNamespaces
+	ignored := make([]string, 0, len(IgnoredNamespaces)+len(configured))
+	ignored = append(ignored, IgnoredNamespaces...)
+	return append(ignored, configured...)
+}
+
+// NamespaceIgnored reports whether namespace matches one of the Ignored
+// patterns.
+func NamespaceIgnored(namespace string) bool {
+	return matchNamespace(Ignored(), namespace)
+}
+
+// Exempt reports whether objectLabels match the ExemptSelector of the current
+// policy.
+func Exempt(objectLabels map[string]string) bool {
+	config := CurrentConfig()
+	if config.exempt == nil {
+		return false
+	}
+	return config.exempt.Matches(labels.Set(objectLabels))
+}
+
+// GuaranteedQoS reports whether the pods of a namespace with namespaceLabels
+// are made Guaranteed by the current policy.
+func GuaranteedQoS(namespaceLabels map[string]string) bool {
+	config := CurrentConfig()
+	if config.guaranteedQoS == nil {
+		return false
+	}
+	return config.guaranteedQoS.Matches(labels.Set(namespaceLabels))
+}
+
+// NamespaceDefaultsFor returns the NamespaceDefaults of the current policy
+// for the namespace name, nil when none matches.
+func NamespaceDefaultsFor(name string) *NamespaceDefaults {
+	config := CurrentConfig()
+	for i := range config.NamespaceDefaults {
+		if matched, _ := path.Match(config.NamespaceDefaults[i].Pattern, name); matched {
+			return &config.NamespaceDefaults[i]
+		}
+	}
+	return nil
+}
+
+// ServiceTypeAllowed reports whether the current policy allows Services of
+// serviceType in namespace. Services without a type are ClusterIP.
+func ServiceTypeAllowed(namespace, serviceType string) bool {
+	if serviceType == "" {
+		serviceType = "ClusterIP"
+	}
+	config := CurrentConfig()
+	for _, restricted := range config.RestrictedServiceTypes {
+		if restricted == serviceType {
+			return matchNamespace(config.ServiceTypeNamespaces, namespace)
+		}
+	}
+	return true
+}
+
+// SkipMutationBy returns the owner reference or field manager of metadata
+// the current policy leaves the object to, empty when there is none.
+func SkipMutationBy(metadata *metav1.ObjectMeta) string {
+	config := CurrentConfig()
+	for _, ref := range metadata.OwnerReferences {
+		gv, _ := schema.ParseGroupVersion(ref.APIVersion)
+		for _, owner := range config.SkipMutationOwners {
+			if owner == ref.Kind || owner == gv.Group+"/"+ref.Kind {
+				return fmt.Sprintf("owner %s %s", owner, ref.Name)
+			}
+		}
+	}
+	for _, entry := range metadata.ManagedFields {
+		for _, manager := range config.SkipMutationManagers {
+			if manager == entry.Manager {
+				return "field manager " + manager
+			}
+		}
+	}
+	return ""
+}
+
+// matchNamespace reports whether namespace matches one of the patterns.
+func matchNamespace(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
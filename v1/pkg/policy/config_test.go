@@ -0,0 +1,54 @@
+package policy
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSetConfigState(t *testing.T) {
+	a := &Config{IgnoredNamespaces: []string{"a"}}
+	b := &Config{IgnoredNamespaces: []string{"b"}}
+	SetConfig(a)
+	generation := Generation()
+	if Version() != configVersion(a) || CurrentConfig() != a {
+		t.Fatalf("got version %s, want the config set and its version %s", Version(), configVersion(a))
+	}
+	SetNamespaceOverrides(nil)
+	if Generation() != generation+1 || Version() != configVersion(a) || CurrentConfig() != a {
+		t.Errorf("overrides set: got generation %d and version %s, want generation %d under the same config", Generation(), Version(), generation+1)
+	}
+
+	// the readers see the config, version and generation of the same change
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if i%2 == 0 {
+				SetConfig(a)
+			} else {
+				SetConfig(b)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		last := uint64(0)
+		for i := 0; i < 1000; i++ {
+			s := loadState()
+			if s.version != configVersion(s.config) {
+				t.Errorf("version %s isn't the one of the config ignoring %v", s.version, s.config.IgnoredNamespaces)
+				return
+			}
+			if s.generation < last {
+				t.Errorf("generation went back from %d to %d", last, s.generation)
+				return
+			}
+			last = s.generation
+		}
+	}()
+	wg.Wait()
+	if want := generation + 1001; Generation() != want {
+		t.Errorf("got generation %d, want %d", Generation(), want)
+	}
+}
@@ -0,0 +1,172 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DeprecationPolicy warns about the objects submitted against deprecated
+// API versions, which the apiserver converts, or carrying legacy
+// annotations, with how to migrate them, ahead of the upgrade of the
+// cluster to KubernetesVersion.
+type DeprecationPolicy struct {
+	// KubernetesVersion is the minor version, such as 1.25, the cluster
+	// runs or is upgraded to next. The APIs and annotations deprecated by
+	// then get a warning, those removed by then get the Enforcement. The
+	// policy applies to none when empty.
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+	// Enforcement of the removed APIs and annotations, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+
+	version minorVersion
+}
+
+func (p *DeprecationPolicy) validate() error {
+	if err := p.Enforcement.validate(); err != nil {
+		return fmt.Errorf("enforcement: %v", err)
+	}
+	if p.KubernetesVersion == "" {
+		return nil
+	}
+	version, err := parseMinorVersion(p.KubernetesVersion)
+	if err != nil {
+		return fmt.Errorf("kubernetesVersion: %v", err)
+	}
+	p.version = version
+	return nil
+}
+
+// Deprecation is an API version or an annotation and when Kubernetes
+// deprecated and removed it.
+type Deprecation struct {
+	// Deprecated and Removed are the minor versions, Removed is empty while
+	// it is still served or honoured.
+	Deprecated, Removed string
+	// Hint is how to migrate.
+	Hint string
+}
+
+// Status returns whether d is deprecated and removed by the version of p,
+// neither when p doesn't apply.
+func (p *DeprecationPolicy) Status(d *Deprecation) (deprecated, removed bool) {
+	if p.KubernetesVersion == "" {
+		return false, false
+	}
+	return !p.version.before(mustParseMinorVersion(d.Deprecated)),
+		d.Removed != "" && !p.version.before(mustParseMinorVersion(d.Removed))
+}
+
+// deprecatedAPIs are the deprecated API versions of the kinds, by
+// group/version and kind.
+var deprecatedAPIs = map[string]map[string]Deprecation{
+	"extensions/v1beta1": {
+		"Deployment":    {"1.8", "1.16", "use apps/v1, which requires spec.selector to match the labels of the template"},
+		"DaemonSet":     {"1.8", "1.16", "use apps/v1, which requires spec.selector to match the labels of the template"},
+		"ReplicaSet":    {"1.8", "1.16", "use apps/v1, which requires spec.selector to match the labels of the template"},
+		"NetworkPolicy": {"1.9", "1.16", "use networking.k8s.io/v1"},
+		"Ingress":       {"1.14", "1.22", "use networking.k8s.io/v1: spec.backend becomes spec.defaultBackend, serviceName and servicePort become service.name and service.port.number or .name, and pathType is required"},
+	},
+	"apps/v1beta1": {
+		"Deployment":  {"1.9", "1.16", "use apps/v1, which requires spec.selector to match the labels of the template"},
+		"StatefulSet": {"1.9", "1.16", "use apps/v1, which requires spec.selector to match the labels of the template"},
+	},
+	"apps/v1beta2": {
+		"Deployment":  {"1.9", "1.16", "use apps/v1"},
+		"StatefulSet": {"1.9", "1.16", "use apps/v1"},
+		"DaemonSet":   {"1.9", "1.16", "use apps/v1"},
+		"ReplicaSet":  {"1.9", "1.16", "use apps/v1"},
+	},
+	"networking.k8s.io/v1beta1": {
+		"Ingress":      {"1.19", "1.22", "use networking.k8s.io/v1: spec.backend becomes spec.defaultBackend, serviceName and servicePort become service.name and service.port.number or .name, and pathType is required"},
+		"IngressClass": {"1.19", "1.22", "use networking.k8s.io/v1"},
+	},
+	"policy/v1beta1": {
+		"PodDisruptionBudget": {"1.21", "1.25", "use policy/v1, where an empty spec.selector selects all the pods of the namespace instead of none"},
+		"PodSecurityPolicy":   {"1.21", "1.25", "use the Pod Security Admission labels of the namespace instead"},
+	},
+	"batch/v1beta1": {
+		"CronJob": {"1.21", "1.25", "use batch/v1"},
+	},
+	"autoscaling/v2beta1": {
+		"HorizontalPodAutoscaler": {"1.22", "1.25", "use autoscaling/v2: targetAverageUtilization and targetAverageValue become target.averageUtilization and target.averageValue"},
+	},
+	"autoscaling/v2beta2": {
+		"HorizontalPodAutoscaler": {"1.23", "1.26", "use autoscaling/v2"},
+	},
+	"discovery.k8s.io/v1beta1": {
+		"EndpointSlice": {"1.21", "1.25", "use discovery.k8s.io/v1: topology[\"kubernetes.io/hostname\"] becomes nodeName"},
+	},
+	"storage.k8s.io/v1beta1": {
+		"CSIStorageCapacity": {"1.24", "1.27", "use storage.k8s.io/v1"},
+	},
+}
+
+// deprecatedAnnotations are the legacy annotations, by key or, for those
+// ending with /, key prefix.
+var deprecatedAnnotations = map[string]Deprecation{
+	"kubernetes.io/ingress.class":                            {"1.18", "", "set spec.ingressClassName instead"},
+	"volume.beta.kubernetes.io/storage-class":                {"1.6", "", "set spec.storageClassName instead"},
+	"scheduler.alpha.kubernetes.io/critical-pod":             {"1.13", "1.16", "set spec.priorityClassName to system-cluster-critical or system-node-critical instead"},
+	"seccomp.security.alpha.kubernetes.io/pod":               {"1.19", "1.27", "set securityContext.seccompProfile of the pod instead"},
+	"container.seccomp.security.alpha.kubernetes.io/":        {"1.19", "1.27", "set securityContext.seccompProfile of the container instead"},
+	"container.apparmor.security.beta.kubernetes.io/":        {"1.30", "", "set securityContext.appArmorProfile of the container instead"},
+	"service.alpha.kubernetes.io/tolerate-unready-endpoints": {"1.11", "", "set spec.publishNotReadyAddresses instead"},
+}
+
+// DeprecatedAPI returns the deprecation of the API version apiVersion, such
+// as extensions/v1beta1, of kind, nil when it isn't deprecated.
+func DeprecatedAPI(apiVersion, kind string) *Deprecation {
+	if d, ok := deprecatedAPIs[apiVersion][kind]; ok {
+		return &d
+	}
+	return nil
+}
+
+// DeprecatedAnnotation returns the deprecation of the annotation key, nil
+// when it isn't deprecated.
+func DeprecatedAnnotation(key string) *Deprecation {
+	if d, ok := deprecatedAnnotations[key]; ok {
+		return &d
+	}
+	if i := strings.Index(key, "/"); i >= 0 {
+		if d, ok := deprecatedAnnotations[key[:i+1]]; ok {
+			return &d
+		}
+	}
+	return nil
+}
+
+// minorVersion is a Kubernetes version without the patch, such as 1.25.
+type minorVersion struct {
+	major, minor int
+}
+
+func parseMinorVersion(s string) (minorVersion, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) != 2 {
+		return minorVersion{}, fmt.Errorf("invalid version %q, expect a minor version such as 1.25", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return minorVersion{}, fmt.Errorf("invalid version %q, expect a minor version such as 1.25", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return minorVersion{}, fmt.Errorf("invalid version %q, expect a minor version such as 1.25", s)
+	}
+	return minorVersion{major, minor}, nil
+}
+
+// mustParseMinorVersion parses the versions of the tables of deprecations.
+func mustParseMinorVersion(s string) minorVersion {
+	version, err := parseMinorVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return version
+}
+
+func (v minorVersion) before(other minorVersion) bool {
+	return v.major < other.major || (v.major == other.major && v.minor < other.minor)
+}
@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Change is a difference between two configs: a field added, removed or
+// changed.
+type Change struct {
+	// Path of the field, such as probes.enforcement or sidecars[1].image.
+	Path string
+	// Old and New are the JSON values of the field, Old is empty when it is
+	// added and New when it is removed.
+	Old, New string
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("added %s: %s", c.Path, c.New)
+	case c.New == "":
+		return fmt.Sprintf("removed %s: %s", c.Path, c.Old)
+	}
+	return fmt.Sprintf("changed %s: %s -> %s", c.Path, c.Old, c.New)
+}
+
+// Diff returns the changes from old to new, by path: the fields of the
+// sections and the entries of their maps and lists, the lists of strings
+// such as namespace patterns as a whole.
+func Diff(old, new *Config) ([]Change, error) {
+	var before, after interface{}
+	for _, c := range []struct {
+		config *Config
+		value  *interface{}
+	}{{old, &before}, {new, &after}} {
+		data, err := json.Marshal(c.config)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, c.value); err != nil {
+			return nil, err
+		}
+	}
+	var changes []Change
+	diffValues("", before, after, &changes)
+	return changes, nil
+}
+
+func diffValues(path string, before, after interface{}, changes *[]Change) {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		if a, ok := after.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(b)+len(a))
+			for key := range b {
+				keys = append(keys, key)
+			}
+			for key := range a {
+				if _, ok := b[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				field := key
+				if path != "" {
+					field = path + "." + key
+				}
+				diffValues(field, b[key], a[key], changes)
+			}
+			return
+		}
+	case []interface{}:
+		if a, ok := after.([]interface{}); ok && !scalars(b) && !scalars(a) {
+			for i := 0; i < len(b) || i < len(a); i++ {
+				var bi, ai interface{}
+				if i < len(b) {
+					bi = b[i]
+				}
+				if i < len(a) {
+					ai = a[i]
+				}
+				diffValues(fmt.Sprintf("%s[%d]", path, i), bi, ai, changes)
+			}
+			return
+		}
+	}
+	old, new := jsonValue(before), jsonValue(after)
+	if old != new {
+		*changes = append(*changes, Change{Path: path, Old: old, New: new})
+	}
+}
+
+// scalars reports whether the list holds strings, numbers or booleans only.
+func scalars(list []interface{}) bool {
+	for _, item := range list {
+		switch item.(type) {
+		case map[string]interface{}, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+// jsonValue encodes v, empty when it is missing.
+func jsonValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,144 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// LegacyAnnotationDomain is the domain of the keys of the annotations,
+// labels and finalizer of the webhook unless SetAnnotationDomain sets
+// another one.
+const LegacyAnnotationDomain = "admission-webhook-example.qikqiak.com"
+
+// domainKeys are the keys under the annotation domain.
+var domainKeys = []*string{
+	&AnnotationValidateKey,
+	&AnnotationMutateKey,
+	&AnnotationStatusKey,
+	&AnnotationMutationsKey,
+	&LabelProtected,
+	&AnnotationAllowDeleteKey,
+	&AnnotationRequestReductionKey,
+	&AnnotationRequestsReducedKey,
+	&AnnotationKeepServiceAccountTokenKey,
+	&AnnotationFreezeOverrideKey,
+	&AnnotationInjectKey,
+	&FinalizerManaged,
+	&AnnotationSidecarVersionPrefix,
+	&AnnotationProvenancePrefix,
+}
+
+var (
+	annotationDomain = LegacyAnnotationDomain
+	// readLegacyKeys tells whether the keys under LegacyAnnotationDomain are
+	// read too when the domain is another one
+	readLegacyKeys   bool
+	observeLegacyKey LegacyKeyObserver
+)
+
+// LegacyKeyObserver is told about the legacy keys read, in place of the key
+// under the annotation domain the object doesn't have.
+type LegacyKeyObserver func(legacyKey string)
+
+// SetLegacyKeyObserver sets what is told about the legacy keys read, e.g. a
+// counter telling when the objects are migrated.
+func SetLegacyKeyObserver(observer LegacyKeyObserver) {
+	observeLegacyKey = observer
+}
+
+// SetAnnotationDomain puts the keys of the annotations, labels and finalizer
+// of the webhook under domain, such as webhook.example.com/mutate. With
+// readLegacy the keys under LegacyAnnotationDomain are read where the objects
+// don't have those under domain, for the objects annotated before the domain
+// changed. The webhook always writes the keys under domain.
+func SetAnnotationDomain(domain string, readLegacy bool) error {
+	if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+		return fmt.Errorf("invalid annotation domain %q: %s", domain, strings.Join(errs, ", "))
+	}
+	for _, key := range domainKeys {
+		*key = withDomain(*key, annotationDomain, domain)
+	}
+	annotationDomain = domain
+	readLegacyKeys = readLegacy && domain != LegacyAnnotationDomain
+	return nil
+}
+
+// AnnotationDomain returns the domain of the keys of the webhook.
+func AnnotationDomain() string {
+	return annotationDomain
+}
+
+// withDomain returns key, a key or key prefix under from such as
+// from/mutate or sidecar.from/, under to.
+func withDomain(key, from, to string) string {
+	prefix, name := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		prefix, name = key[:i], key[i:]
+	}
+	if prefix == from {
+		return to + name
+	}
+	if strings.HasSuffix(prefix, "."+from) {
+		return strings.TrimSuffix(prefix, from) + to + name
+	}
+	return key
+}
+
+// LegacyKey returns key, under the annotation domain, under
+// LegacyAnnotationDomain, false when the legacy keys aren't read.
+func LegacyKey(key string) (string, bool) {
+	if !readLegacyKeys {
+		return "", false
+	}
+	legacy := withDomain(key, annotationDomain, LegacyAnnotationDomain)
+	return legacy, legacy != key
+}
+
+// Lookup returns the value of key, a key under the annotation domain, in
+// values, the annotations or labels of an object, or the value of the legacy
+// key where the object doesn't have key.
+func Lookup(values map[string]string, key string) (string, bool) {
+	if value, ok := values[key]; ok {
+		return value, true
+	}
+	legacy, ok := LegacyKey(key)
+	if !ok {
+		return "", false
+	}
+	value, ok := values[legacy]
+	if ok && observeLegacyKey != nil {
+		observeLegacyKey(legacy)
+	}
+	return value, ok
+}
+
+// LookupValue is Lookup without telling whether key is set.
+func LookupValue(values map[string]string, key string) string {
+	value, _ := Lookup(values, key)
+	return value
+}
+
+// IsKey reports whether candidate, such as a finalizer, is key or its legacy
+// key.
+func IsKey(candidate, key string) bool {
+	if candidate == key {
+		return true
+	}
+	legacy, ok := LegacyKey(key)
+	return ok && candidate == legacy
+}
+
+// TrimKeyPrefix returns the name of key following prefix, a key prefix under
+// the annotation domain such as AnnotationSidecarVersionPrefix, or its
+// legacy prefix, false when key has neither.
+func TrimKeyPrefix(key, prefix string) (string, bool) {
+	if strings.HasPrefix(key, prefix) {
+		return strings.TrimPrefix(key, prefix), true
+	}
+	if legacy, ok := LegacyKey(prefix); ok && strings.HasPrefix(key, legacy) {
+		return strings.TrimPrefix(key, legacy), true
+	}
+	return "", false
+}
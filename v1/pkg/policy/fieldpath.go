@@ -0,0 +1,77 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// parseFieldPath splits a field path such as
+// spec.template.spec.nodeSelector[kubernetes.io/os] into its segments, map
+// keys containing dots go in brackets.
+func parseFieldPath(path string) ([]string, error) {
+	var segments []string
+	rest := path
+	for rest != "" {
+		var segment string
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid field path %q: unclosed [", path)
+			}
+			segment, rest = rest[1:end], rest[end+1:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			segment, rest = rest[:end], rest[end:]
+		}
+		if segment == "" {
+			return nil, fmt.Errorf("invalid field path %q: empty field", path)
+		}
+		segments = append(segments, segment)
+		rest = strings.TrimPrefix(rest, ".")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty field path")
+	}
+	return segments, nil
+}
+
+// lookupField returns the value at segments in object, nil when it isn't set.
+func lookupField(object interface{}, segments []string) interface{} {
+	for _, segment := range segments {
+		fields, ok := object.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		object = fields[segment]
+	}
+	return object
+}
+
+// ChangedImmutableFields returns the ImmutableFields of the current policy
+// whose value differs between the JSON encoded oldObject and object.
+func ChangedImmutableFields(oldObject, object []byte) ([]string, error) {
+	config := CurrentConfig()
+	if len(config.ImmutableFields) == 0 {
+		return nil, nil
+	}
+	var before, after map[string]interface{}
+	if err := json.Unmarshal(oldObject, &before); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(object, &after); err != nil {
+		return nil, err
+	}
+	var changed []string
+	for i, path := range config.ImmutableFields {
+		segments := config.immutable[i]
+		if !reflect.DeepEqual(lookupField(before, segments), lookupField(after, segments)) {
+			changed = append(changed, path)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,28 @@
+package policy
+
+import (
+	"strings"
+	"time"
+)
+
+// OpenFreezeWindow returns the first freeze window of the policy which is
+// open at t and freezes the objects of kind in namespace, with the time it
+// closes. The window is nil when none is.
+func (c *Config) OpenFreezeWindow(namespace, kind string, t time.Time) (*FreezeWindow, time.Time) {
+	for i := range c.FreezeWindows {
+		w := &c.FreezeWindows[i]
+		if !w.Applies(namespace, kind) {
+			continue
+		}
+		if closes, ok := w.ClosesAt(t); ok {
+			return w, closes
+		}
+	}
+	return nil, time.Time{}
+}
+
+// FreezeOverride returns the reason the freeze-override annotation gives,
+// empty when objects with annotations don't override the freeze windows.
+func FreezeOverride(annotations map[string]string) string {
+	return strings.TrimSpace(LookupValue(annotations, AnnotationFreezeOverrideKey))
+}
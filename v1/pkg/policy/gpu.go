@@ -0,0 +1,107 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// DefaultGPUResource is the extended resource counted as GPUs when the gpus
+// policy doesn't list any.
+const DefaultGPUResource corev1.ResourceName = "nvidia.com/gpu"
+
+// GPUPolicy places the pods requesting GPUs on the GPU node pools and
+// limits the GPUs they request.
+type GPUPolicy struct {
+	// Resources are the extended resources counted as GPUs,
+	// DefaultGPUResource when empty.
+	Resources []corev1.ResourceName `json:"resources,omitempty"`
+	// NodeSelector selects the nodes of the GPU node pools, the pods
+	// requesting GPUs get the labels they don't select already.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations of the taints of the GPU node pools, the pods requesting
+	// GPUs get those they don't have already.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Limits cap the GPUs requested, by namespace.
+	Limits []GPULimit `json:"limits,omitempty"`
+	// Enforcement of the limits, warn when empty.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// GPULimit is the maximum of GPUs requested in the namespaces matching
+// Namespace.
+type GPULimit struct {
+	// Namespace is a path.Match pattern, "*" for any namespace.
+	Namespace string `json:"namespace"`
+	// PerPod is the maximum of GPUs a pod requests, unlimited when 0.
+	PerPod int64 `json:"perPod,omitempty"`
+	// PerNamespace is the maximum of GPUs the replicas of the Deployments
+	// of the namespace request together, unlimited when 0.
+	PerNamespace int64 `json:"perNamespace,omitempty"`
+}
+
+func (p *GPUPolicy) validate() error {
+	for _, name := range p.Resources {
+		if name == "" {
+			return fmt.Errorf("resources: empty resource name")
+		}
+	}
+	if _, err := labels.ValidatedSelectorFromSet(p.NodeSelector); err != nil {
+		return fmt.Errorf("nodeSelector: %v", err)
+	}
+	for i, toleration := range p.Tolerations {
+		switch toleration.Operator {
+		case "", corev1.TolerationOpEqual:
+		case corev1.TolerationOpExists:
+			if toleration.Value != "" {
+				return fmt.Errorf("tolerations[%d]: value must be empty with the operator Exists", i)
+			}
+		default:
+			return fmt.Errorf("tolerations[%d]: invalid operator %q, expect Equal or Exists", i, toleration.Operator)
+		}
+		switch toleration.Effect {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return fmt.Errorf("tolerations[%d]: invalid effect %q", i, toleration.Effect)
+		}
+	}
+	for i, limit := range p.Limits {
+		if _, err := path.Match(limit.Namespace, ""); err != nil || limit.Namespace == "" {
+			return fmt.Errorf("limits[%d]: invalid namespace pattern %q", i, limit.Namespace)
+		}
+		if limit.PerPod < 0 || limit.PerNamespace < 0 {
+			return fmt.Errorf("limits[%d]: perPod and perNamespace must not be negative", i)
+		}
+	}
+	if err := p.Enforcement.validate(); err != nil {
+		return fmt.Errorf("enforcement: %v", err)
+	}
+	return nil
+}
+
+// ResourceNames returns the resources counted as GPUs.
+func (p *GPUPolicy) ResourceNames() []corev1.ResourceName {
+	if len(p.Resources) == 0 {
+		return []corev1.ResourceName{DefaultGPUResource}
+	}
+	return p.Resources
+}
+
+// Places reports whether the pods requesting GPUs get a nodeSelector or
+// tolerations.
+func (p *GPUPolicy) Places() bool {
+	return len(p.NodeSelector) > 0 || len(p.Tolerations) > 0
+}
+
+// Limit returns the limit of the GPUs requested in namespace, the first of
+// the Limits matching it, nil without a limit.
+func (p *GPUPolicy) Limit(namespace string) *GPULimit {
+	for i := range p.Limits {
+		if matched, _ := path.Match(p.Limits[i].Namespace, namespace); matched {
+			return &p.Limits[i]
+		}
+	}
+	return nil
+}
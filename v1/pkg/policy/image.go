@@ -0,0 +1,47 @@
+package policy
+
+import "github.com/cnych/admission-webhook/pkg/registry"
+
+// MirrorImage returns image pulled from the mirror the current policy maps
+// its registry to, keeping the repository path and the tag or digest, image
+// itself when the registry isn't mirrored.
+func MirrorImage(image string) string {
+	mirrors := CurrentConfig().RegistryMirrors
+	if len(mirrors) == 0 || image == "" {
+		return image
+	}
+	host, repository := registry.SplitImage(image)
+	if mirror, ok := mirrors[host]; ok {
+		return mirror + "/" + repository
+	}
+	return image
+}
+
+// PullSecretsFor returns the imagePullSecrets the current policy adds to the
+// pods in namespace pulling images, in the order of the rules.
+func PullSecretsFor(namespace string, images []string) []string {
+	var secrets []string
+	for _, rule := range CurrentConfig().ImagePullSecrets {
+		if len(rule.Namespaces) > 0 && !matchNamespace(rule.Namespaces, namespace) {
+			continue
+		}
+		if len(rule.Registries) > 0 && !pullsFrom(images, rule.Registries) {
+			continue
+		}
+		secrets = append(secrets, rule.Secrets...)
+	}
+	return secrets
+}
+
+// pullsFrom reports whether one of images is pulled from one of registries.
+func pullsFrom(images, registries []string) bool {
+	for _, image := range images {
+		host, _ := registry.SplitImage(image)
+		for _, r := range registries {
+			if host == r {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// InjectionTemplate is a named set of volumes, and mounts of them, added to
+// the pods which ask for it with the inject annotation, such as the CA
+// bundle of the company or a scratch directory, so teams don't copy them
+// into every workload.
+type InjectionTemplate struct {
+	// Name the pods ask for the template by.
+	Name string `json:"name"`
+	// Namespaces are path.Match patterns of the namespaces of the pods
+	// which can ask for the template, any namespace when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Volumes added to the pods, ConfigMap, Secret, emptyDir or projected
+	// ones such as a service account token for another audience. The pods
+	// with a volume of the same name keep theirs.
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+	// VolumeMounts of the Volumes added to the containers, the containers
+	// with a mount of the same volume or path keep theirs.
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+	// Containers are path.Match patterns of the names of the containers and
+	// init containers the VolumeMounts are added to, all the containers,
+	// not the init ones, when empty.
+	Containers []string `json:"containers,omitempty"`
+}
+
+func (t *InjectionTemplate) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("name required")
+	}
+	for _, pattern := range t.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("namespaces: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range t.Containers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("containers: invalid pattern %q", pattern)
+		}
+	}
+	volumes := map[string]bool{}
+	for i, volume := range t.Volumes {
+		if volume.Name == "" {
+			return fmt.Errorf("volumes[%d]: name required", i)
+		}
+		if volumes[volume.Name] {
+			return fmt.Errorf("volumes[%d]: name %q used twice", i, volume.Name)
+		}
+		volumes[volume.Name] = true
+		source := volume.VolumeSource
+		if source != (corev1.VolumeSource{ConfigMap: source.ConfigMap, Secret: source.Secret, EmptyDir: source.EmptyDir, Projected: source.Projected}) {
+			return fmt.Errorf("volumes[%d]: expect a configMap, secret, emptyDir or projected volume", i)
+		}
+		if source.ConfigMap == nil && source.Secret == nil && source.EmptyDir == nil && source.Projected == nil {
+			return fmt.Errorf("volumes[%d]: source required", i)
+		}
+	}
+	for i, mount := range t.VolumeMounts {
+		if !volumes[mount.Name] {
+			return fmt.Errorf("volumeMounts[%d]: volume %q is not one of the template", i, mount.Name)
+		}
+		if !strings.HasPrefix(mount.MountPath, "/") {
+			return fmt.Errorf("volumeMounts[%d]: mountPath %q is not absolute", i, mount.MountPath)
+		}
+	}
+	return nil
+}
+
+// MountsInto reports whether the VolumeMounts of t are added to the
+// container named name, an init container if init.
+func (t *InjectionTemplate) MountsInto(name string, init bool) bool {
+	if len(t.Containers) == 0 {
+		return !init
+	}
+	return matchPattern(t.Containers, name)
+}
+
+// InjectionTemplatesFor returns the templates of the current policy the
+// pods in namespace annotated with the inject annotation value ask for, in
+// the order of the annotation, and the names of those unknown there.
+func InjectionTemplatesFor(namespace, value string) (templates []*InjectionTemplate, unknown []string) {
+	config := CurrentConfig()
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		var found *InjectionTemplate
+		for i := range config.InjectionTemplates {
+			t := &config.InjectionTemplates[i]
+			if t.Name == name && (len(t.Namespaces) == 0 || matchNamespace(t.Namespaces, namespace)) {
+				found = t
+				break
+			}
+		}
+		if found == nil {
+			unknown = append(unknown, name)
+			continue
+		}
+		templates = append(templates, found)
+	}
+	return templates, unknown
+}
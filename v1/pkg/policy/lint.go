@@ -0,0 +1,158 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Lint returns the warnings about the rules of c which are valid but can't
+// work as written: rules limited to ignored namespaces, rules shadowed by an
+// earlier one of a first-match list and bounds no object can satisfy. The
+// policy of its clusters and activations is linted too. c must have been
+// validated. The warnings of a cluster or an activation already given for c
+// aren't repeated.
+func (c *Config) Lint() []string {
+	warnings := c.lint()
+	seen := map[string]bool{}
+	for _, warning := range warnings {
+		seen[warning] = true
+	}
+	add := func(prefix string, config *Config) {
+		for _, warning := range config.lint() {
+			if !seen[warning] {
+				warnings = append(warnings, prefix+warning)
+			}
+		}
+	}
+	if len(c.Clusters) > 0 {
+		base := c.withoutClusters()
+		for i, cluster := range c.Clusters {
+			if config, err := base.merge(cluster.Policy); err == nil {
+				add(fmt.Sprintf("clusters[%d].policy: ", i), config)
+			}
+		}
+	}
+	for i, a := range c.Activations {
+		if a.config != nil {
+			add(fmt.Sprintf("activations[%d].policy: ", i), a.config)
+		}
+	}
+	return warnings
+}
+
+func (c *Config) lint() []string {
+	var warnings []string
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	ignored := append(append([]string{}, IgnoredNamespaces...), c.IgnoredNamespaces...)
+	type section struct {
+		name       string
+		namespaces []string
+	}
+	sections := []section{
+		{"services.namespaces", c.Services.Namespaces},
+		{"podDisruptionBudgets.namespaces", c.PodDisruptionBudgets.Namespaces},
+		{"networkPolicies.namespaces", c.NetworkPolicies.Namespaces},
+		{"probes.namespaces", c.Probes.Namespaces},
+		{"references.namespaces", c.References.Namespaces},
+		{"strategy.namespaces", c.Strategy.Namespaces},
+		{"qosClass.namespaces", c.QoSClass.Namespaces},
+		{"memoryPerCPU.namespaces", c.MemoryPerCPU.Namespaces},
+		{"containerResources.namespaces", c.ContainerResources.Namespaces},
+		{"podResources.namespaces", c.PodResources.Namespaces},
+		{"mutationProvenance.namespaces", c.MutationProvenance.Namespaces},
+		{"antiAffinity.namespaces", c.AntiAffinity.Namespaces},
+		{"templateLabels.namespaces", c.TemplateLabels.Namespaces},
+		{"configChecksum.namespaces", c.ConfigChecksum.Namespaces},
+		{"serviceAccountToken.namespaces", c.ServiceAccountToken.Namespaces},
+		{"termination.namespaces", c.Termination.Namespaces},
+		{"signatures.namespaces", c.Signatures.Namespaces},
+		{"vulnerabilities.namespaces", c.Vulnerabilities.Namespaces},
+	}
+	for i, a := range c.RequiredAnnotations {
+		sections = append(sections, section{fmt.Sprintf("requiredAnnotations[%d].namespaces", i), a.Namespaces})
+	}
+	for i, w := range c.FreezeWindows {
+		sections = append(sections, section{fmt.Sprintf("freezeWindows[%d].namespaces", i), w.Namespaces})
+	}
+	for i, rule := range c.ImagePullSecrets {
+		sections = append(sections, section{fmt.Sprintf("imagePullSecrets[%d].namespaces", i), rule.Namespaces})
+	}
+	for i, rule := range c.Sidecars {
+		sections = append(sections, section{fmt.Sprintf("sidecars[%d].namespaces", i), rule.Namespaces})
+	}
+	for i, t := range c.InjectionTemplates {
+		sections = append(sections, section{fmt.Sprintf("injectionTemplates[%d].namespaces", i), t.Namespaces})
+	}
+	for _, section := range sections {
+		for _, pattern := range section.namespaces {
+			// a pattern matching the pattern matches every namespace it does
+			if matchNamespace(ignored, pattern) {
+				warn("%s: %q is ignored, remove it or its pattern from ignoredNamespaces", section.name, pattern)
+			}
+		}
+	}
+
+	for j, later := range c.ReplicaBounds {
+		for i, earlier := range c.ReplicaBounds[:j] {
+			if earlier.Selector != "" {
+				continue
+			}
+			if matched, _ := path.Match(earlier.Namespace, later.Namespace); earlier.Namespace == "" || matched {
+				warn("replicaBounds[%d]: never applies, replicaBounds[%d] matches its Deployments first, move it before", j, i)
+				break
+			}
+		}
+	}
+	sizes := c.PersistentVolumeClaims.MaxSizes
+	for j, later := range sizes {
+		for i, earlier := range sizes[:j] {
+			if matched, _ := path.Match(earlier.Namespace, later.Namespace); matched {
+				warn("persistentVolumeClaims.maxSizes[%d]: never applies, maxSizes[%d] matches its namespaces first, move it before", j, i)
+				break
+			}
+		}
+	}
+	for j, later := range c.GPUs.Limits {
+		for i, earlier := range c.GPUs.Limits[:j] {
+			if matched, _ := path.Match(earlier.Namespace, later.Namespace); matched {
+				warn("gpus.limits[%d]: never applies, limits[%d] matches its namespaces first, move it before", j, i)
+				break
+			}
+		}
+	}
+	for j, later := range c.NamespaceDefaults {
+		for i, earlier := range c.NamespaceDefaults[:j] {
+			if matched, _ := path.Match(earlier.Pattern, later.Pattern); matched {
+				warn("namespaceDefaults[%d]: never applies, namespaceDefaults[%d] matches its namespaces first, move it before", j, i)
+				break
+			}
+		}
+	}
+	for i, rule := range c.PriorityClasses {
+		if rule.NamespaceSelector == "" && i < len(c.PriorityClasses)-1 {
+			warn("priorityClasses[%d]: matches every namespace, the rules after it never apply, move it last", i)
+			break
+		}
+	}
+	for i, rule := range c.RuntimeClasses {
+		if rule.NamespaceSelector == "" && i < len(c.RuntimeClasses)-1 {
+			warn("runtimeClasses[%d]: matches every namespace, the rules after it never apply, move it last", i)
+			break
+		}
+	}
+
+	// the apiserver rejects rolling updates with both bounds at 0
+	if s := c.Strategy; s.MaxUnavailable != nil && s.MaxSurge != nil && len(s.Namespaces) > 0 {
+		unavailable, _ := intstr.GetScaledValueFromIntOrPercent(s.MaxUnavailable, 100, false)
+		surge, _ := intstr.GetScaledValueFromIntOrPercent(s.MaxSurge, 100, true)
+		if unavailable == 0 && surge == 0 {
+			warn("strategy: maxUnavailable and maxSurge are both 0, no rolling update can be admitted, raise either")
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,174 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// OverridableSections are the sections of the config the
+// WebhookPolicyOverrides of a namespace can change, those of the rules
+// which look the config of the namespace up with ConfigFor.
+var OverridableSections = []string{
+	"antiAffinity",
+	"configChecksum",
+	"containerResources",
+	"gpus",
+	"memoryPerCPU",
+	"networkPolicies",
+	"podDisruptionBudgets",
+	"podResources",
+	"probes",
+	"qosClass",
+	"references",
+	"replicaBounds",
+	"serviceAccountToken",
+	"signatures",
+	"strategy",
+	"templateLabels",
+	"termination",
+	"vulnerabilities",
+}
+
+// OverridePolicy bounds what the owners of a namespace can change of the
+// policy of their namespace with WebhookPolicyOverrides.
+type OverridePolicy struct {
+	// Sections are those of the OverridableSections the overrides can
+	// change, relaxing or tightening them, none when empty.
+	Sections []string `json:"sections,omitempty"`
+}
+
+func (p *OverridePolicy) validate() error {
+	for _, section := range p.Sections {
+		if !containsString(OverridableSections, section) {
+			return fmt.Errorf("sections: %q can't be overridden, expect one of %s", section, strings.Join(OverridableSections, ", "))
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// the policies of the WebhookPolicyOverrides, by namespace
+	overrides        atomic.Value // map[string][]json.RawMessage
+	overridesVersion uint64
+
+	// the configs of the namespaces with overrides, by namespace
+	namespaceConfigs sync.Map // string -> *namespaceConfig
+)
+
+// namespaceConfig is the config of a namespace merged from base and the
+// overrides of version.
+type namespaceConfig struct {
+	base    *Config
+	version uint64
+	config  *Config
+}
+
+// SetNamespaceOverrides replaces the overrides of the namespaces: by
+// namespace, the policies of its WebhookPolicyOverrides, merged in order
+// over the config of the cluster.
+func SetNamespaceOverrides(policies map[string][]json.RawMessage) {
+	overrides.Store(policies)
+	atomic.AddUint64(&overridesVersion, 1)
+	// the decisions made under the previous overrides may not hold anymore
+	bumpGeneration()
+}
+
+// ConfigFor returns the config of namespace: the current config with the
+// sections its overrides may change merged over it. It is the current
+// config when the namespace has no overrides or they don't give a valid
+// config, see CheckOverrides.
+func ConfigFor(namespace string) *Config {
+	base := CurrentConfig()
+	policies, _ := overrides.Load().(map[string][]json.RawMessage)
+	if len(policies[namespace]) == 0 || len(base.NamespaceOverrides.Sections) == 0 {
+		return base
+	}
+	version := atomic.LoadUint64(&overridesVersion)
+	if cached, ok := namespaceConfigs.Load(namespace); ok {
+		if c := cached.(*namespaceConfig); c.base == base && c.version == version {
+			return c.config
+		}
+	}
+	config, err := base.withOverrides(policies[namespace])
+	if err != nil {
+		config = base
+	}
+	namespaceConfigs.Store(namespace, &namespaceConfig{base: base, version: version, config: config})
+	return config
+}
+
+// CheckOverrides returns why policies, the policies of the
+// WebhookPolicyOverrides of a namespace, don't give a valid config with the
+// current config, nil when they do. The sections they can't change are
+// ignored and reported too.
+func CheckOverrides(policies []json.RawMessage) error {
+	base := CurrentConfig()
+	var ignored []string
+	for _, p := range policies {
+		var sections map[string]json.RawMessage
+		if err := json.Unmarshal(p, &sections); err != nil {
+			return fmt.Errorf("expect a map of the config")
+		}
+		for section := range sections {
+			if !containsString(base.NamespaceOverrides.Sections, section) {
+				ignored = append(ignored, section)
+			}
+		}
+	}
+	if _, err := base.withOverrides(policies); err != nil {
+		return fmt.Errorf("not applied, the namespace keeps the policy of the cluster: %v", err)
+	}
+	if len(ignored) > 0 {
+		sort.Strings(ignored)
+		return fmt.Errorf("%s ignored, namespaceOverrides.sections allows %s only", strings.Join(ignored, ", "), strings.Join(base.NamespaceOverrides.Sections, ", "))
+	}
+	return nil
+}
+
+// withOverrides merges the sections of policies c allows to override over
+// c, in order.
+func (c *Config) withOverrides(policies []json.RawMessage) (*Config, error) {
+	base := *c
+	base.Activations, base.Clusters = nil, nil
+	config := &base
+	for _, p := range policies {
+		var sections map[string]json.RawMessage
+		if err := json.Unmarshal(p, &sections); err != nil {
+			return nil, fmt.Errorf("expect a map of the config")
+		}
+		allowed := map[string]json.RawMessage{}
+		for section, value := range sections {
+			if containsString(c.NamespaceOverrides.Sections, section) {
+				allowed[section] = value
+			}
+		}
+		patch, err := json.Marshal(allowed)
+		if err != nil {
+			return nil, err
+		}
+		original, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		if config, err = mergePolicy(original, patch, "namespaceOverrides"); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,153 @@
+// Package policy decides which objects the webhook admits and what it
+// requires of them. The Set functions configure the package at startup, none
+// of them is safe to call while requests are being admitted.
+package policy
+
+import (
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/messages"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The keys of the annotations, labels and finalizer of the webhook are under
+// the domain SetAnnotationDomain sets, LegacyAnnotationDomain by default.
+var (
+	AnnotationValidateKey = LegacyAnnotationDomain + "/validate"
+	AnnotationMutateKey   = LegacyAnnotationDomain + "/mutate"
+	AnnotationStatusKey   = LegacyAnnotationDomain + "/status"
+	// the patch applied by the last mutation, for GitOps tools to ignore the
+	// fields the webhook owns and for auditors
+	AnnotationMutationsKey = LegacyAnnotationDomain + "/last-applied-mutations"
+	// the prefix of the annotations recording the rules which mutated an
+	// object, see ProvenancePolicy
+	AnnotationProvenancePrefix = "provenance." + LegacyAnnotationDomain + "/"
+	// objects labeled protected=true can only be deleted once annotated
+	// allow-delete=true
+	LabelProtected           = LegacyAnnotationDomain + "/protected"
+	AnnotationAllowDeleteKey = LegacyAnnotationDomain + "/allow-delete"
+	// the percentage of their resource requests the containers of a workload
+	// keep, or off, overriding the request reduction of the policy
+	AnnotationRequestReductionKey = LegacyAnnotationDomain + "/request-reduction"
+	// the percentage of their resource requests the containers of a workload
+	// were reduced to, which marks them as reduced already
+	AnnotationRequestsReducedKey = LegacyAnnotationDomain + "/requests-reduced"
+	// pods annotated keep-service-account-token=true keep the token mounted
+	// where the policy disables its automount
+	AnnotationKeepServiceAccountTokenKey = LegacyAnnotationDomain + "/keep-service-account-token"
+	// the reason objects are changed while a freeze window is open, which
+	// overrides it in an emergency and is audited
+	AnnotationFreezeOverrideKey = LegacyAnnotationDomain + "/freeze-override"
+	// the comma separated names of the injectionTemplates of the policy the
+	// pods ask for
+	AnnotationInjectKey = LegacyAnnotationDomain + "/inject"
+	// the finalizer of the Deployments whose sidecars or injection templates
+	// the webhook manages, removed once their deletion is recorded
+	FinalizerManaged = LegacyAnnotationDomain + "/managed"
+)
+
+const (
+	// the digest of the ConfigMaps and Secrets the pods of a workload
+	// reference, the key of the checksum pattern of Helm charts
+	AnnotationConfigChecksumKey = "checksum/config"
+
+	NameLabel      = "app.kubernetes.io/name"
+	InstanceLabel  = "app.kubernetes.io/instance"
+	VersionLabel   = "app.kubernetes.io/version"
+	ComponentLabel = "app.kubernetes.io/component"
+	PartOfLabel    = "app.kubernetes.io/part-of"
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+
+	NA = "not_available"
+)
+
+var (
+	IgnoredNamespaces = []string{
+		metav1.NamespaceSystem,
+		metav1.NamespacePublic,
+	}
+	RequiredLabels = []string{
+		NameLabel,
+		InstanceLabel,
+		VersionLabel,
+		ComponentLabel,
+		PartOfLabel,
+		ManagedByLabel,
+	}
+	AddLabels = map[string]string{
+		NameLabel:      NA,
+		InstanceLabel:  NA,
+		VersionLabel:   NA,
+		ComponentLabel: NA,
+		PartOfLabel:    NA,
+		ManagedByLabel: NA,
+	}
+)
+
+// Logger receives the policy decisions.
+type Logger interface {
+	Infof(format string, args ...interface{})
+}
+
+// AdmissionRequired reports whether an object is subject to admission: its
+// namespace matches none of the ignoredList patterns and
+// admissionAnnotationKey does not opt it out.
+func AdmissionRequired(ignoredList []string, admissionAnnotationKey string, metadata *metav1.ObjectMeta, log Logger) bool {
+	// skip special kubernetes system namespaces
+	if matchNamespace(ignoredList, metadata.Namespace) {
+		log.Infof(messages.NamespaceIgnored, metadata.Name, metadata.Namespace)
+		return false
+	}
+
+	annotations := metadata.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	var required bool
+	switch strings.ToLower(LookupValue(annotations, admissionAnnotationKey)) {
+	default:
+		required = true
+	case "n", "no", "false", "off":
+		required = false
+	}
+	return required
+}
+
+// ValidationRequired is AdmissionRequired for validation.
+func ValidationRequired(ignoredList []string, metadata *metav1.ObjectMeta, log Logger) bool {
+	required := AdmissionRequired(ignoredList, AnnotationValidateKey, metadata, log)
+	log.Infof(messages.ValidationPolicy, metadata.Namespace, metadata.Name, required)
+	return required
+}
+
+// MissingLabels returns the required labels which are not set in labels.
+func MissingLabels(labels map[string]string, required []string) []string {
+	var missing []string
+	for _, rl := range required {
+		if _, ok := labels[rl]; !ok {
+			missing = append(missing, rl)
+		}
+	}
+	return missing
+}
+
+// DeletionProtected reports whether the object of metadata is labeled
+// protected and not annotated to allow its deletion.
+func DeletionProtected(metadata *metav1.ObjectMeta) bool {
+	return isTrue(LookupValue(metadata.Labels, LabelProtected)) && !isTrue(LookupValue(metadata.Annotations, AnnotationAllowDeleteKey))
+}
+
+// KeepServiceAccountToken reports whether the pods annotated with
+// annotations opt out of the policy disabling the token automount.
+func KeepServiceAccountToken(annotations map[string]string) bool {
+	return isTrue(LookupValue(annotations, AnnotationKeepServiceAccountTokenKey))
+}
+
+func isTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "y", "yes", "true", "on":
+		return true
+	}
+	return false
+}
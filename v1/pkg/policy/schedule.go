@@ -0,0 +1,214 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var clock = time.Now
+
+// SetClock sets the clock the schedules of the policy are evaluated with,
+// time.Now by default, e.g. a fixed time for golden tests.
+func SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	clock = now
+}
+
+// Now returns the time of the clock of the policy.
+func Now() time.Time {
+	return clock()
+}
+
+// Window is a time window opening on every match of its Schedule and
+// staying open for its Duration.
+type Window struct {
+	// Schedule is the cron schedule, such as "0 18 * * 5", of the times the
+	// window opens.
+	Schedule string `json:"schedule"`
+	// Duration the window stays open for, such as 63h.
+	Duration metav1.Duration `json:"duration"`
+	// TimeZone is the IANA name, such as Asia/Shanghai, of the location the
+	// Schedule is in, UTC when empty.
+	TimeZone string `json:"timeZone,omitempty"`
+
+	schedule *Schedule
+	location *time.Location
+}
+
+// parse parses the Schedule and loads the TimeZone of w.
+func (w *Window) parse() error {
+	if w.Duration.Duration <= 0 {
+		return fmt.Errorf("positive duration required")
+	}
+	schedule, err := ParseSchedule(w.Schedule)
+	if err != nil {
+		return err
+	}
+	// LoadLocation returns UTC for the empty name
+	location, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return fmt.Errorf("timeZone: %v", err)
+	}
+	w.schedule, w.location = schedule, location
+	return nil
+}
+
+// ClosesAt returns when the window open at t closes, false when it isn't
+// open at t.
+func (w *Window) ClosesAt(t time.Time) (time.Time, bool) {
+	opened, ok := w.schedule.Last(t.In(w.location), w.Duration.Duration)
+	if !ok || !t.Before(opened.Add(w.Duration.Duration)) {
+		return time.Time{}, false
+	}
+	return opened.Add(w.Duration.Duration), true
+}
+
+// Schedule is a cron schedule of five fields: minute, hour, day of month,
+// month and day of week, such as "0 18 * * 5" for Fridays at 18:00. Fields
+// are *, numbers, ranges like 1-5 and steps like */15 or 8-18/2, separated
+// by commas. Sunday is 0 or 7. Like cron, a day matches either of the day
+// fields when both are restricted.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// scheduleFields are the bounds of the fields of a Schedule.
+var scheduleFields = [5]struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseSchedule parses the cron schedule spec.
+func ParseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(scheduleFields) {
+		return nil, fmt.Errorf("schedule %q has %d fields, expect minute, hour, day of month, month and day of week", spec, len(fields))
+	}
+	var bits [5]uint64
+	for i, field := range fields {
+		b, err := parseScheduleField(field, scheduleFields[i].min, scheduleFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %s: %v", spec, scheduleFields[i].name, err)
+		}
+		bits[i] = b
+	}
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}, nil
+}
+
+// parseScheduleField returns the bits of the values field matches within
+// min and max.
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		values, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			values, step = part[:i], n
+		}
+		from, to := min, max
+		switch {
+		case values == "*":
+		case strings.Contains(values, "-"):
+			bounds := strings.SplitN(values, "-", 2)
+			var err1, err2 error
+			from, err1 = strconv.Atoi(bounds[0])
+			to, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || from > to {
+				return 0, fmt.Errorf("invalid range %q", values)
+			}
+		default:
+			n, err := strconv.Atoi(values)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", values)
+			}
+			from = n
+			// a single value only stands for the values up to max with a
+			// step, such as 5/15
+			if step == 1 {
+				to = n
+			}
+		}
+		if from < min || to > max {
+			return 0, fmt.Errorf("%q is not within %d and %d", values, min, max)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	if s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDom || s.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Last returns the latest time the schedule matches, in the location of t,
+// which is not after t and not before t less within. It is false when there
+// is none.
+func (s *Schedule) Last(t time.Time, within time.Duration) (time.Time, bool) {
+	earliest := t.Add(-within)
+	// walk the days back from t, the first match found is the latest
+	for day := t; ; day = day.AddDate(0, 0, -1) {
+		y, m, d := day.Date()
+		if time.Date(y, m, d, 23, 59, 0, 0, t.Location()).Before(earliest) {
+			return time.Time{}, false
+		}
+		if !s.matchesDay(day) {
+			continue
+		}
+		for hour := 23; hour >= 0; hour-- {
+			if s.hour&(1<<uint(hour)) == 0 {
+				continue
+			}
+			for minute := 59; minute >= 0; minute-- {
+				if s.minute&(1<<uint(minute)) == 0 {
+					continue
+				}
+				match := time.Date(y, m, d, hour, minute, 0, 0, t.Location())
+				if match.After(t) {
+					continue
+				}
+				if match.Before(earliest) {
+					return time.Time{}, false
+				}
+				return match, true
+			}
+		}
+	}
+}
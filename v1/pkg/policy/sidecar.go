@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+)
+
+// AnnotationSidecarVersionPrefix prefixes the annotations of pod templates
+// recording the version of the sidecars the sidecars policy manages, by the
+// name of the sidecar, such as
+// sidecar.admission-webhook-example.qikqiak.com/log-agent: "2.1", under the
+// domain SetAnnotationDomain sets.
+var AnnotationSidecarVersionPrefix = "sidecar." + LegacyAnnotationDomain + "/"
+
+// SidecarRule upgrades or removes an injected container in the pod
+// templates of the workloads: the templates which don't record Version yet
+// get the Image of the version, or lose the container with Remove.
+type SidecarRule struct {
+	// Name of the container.
+	Name string `json:"name"`
+	// ImagePrefixes match the container by its image when it was injected
+	// under another name, such as registry.example.com/log-agent:.
+	ImagePrefixes []string `json:"imagePrefixes,omitempty"`
+	// Namespaces are path.Match patterns of the namespaces of the
+	// workloads, any namespace when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Version of the sidecar the templates are brought to, changing it rolls
+	// the new version out with the next change of every workload.
+	Version string `json:"version"`
+	// Image of the version, required unless the container is removed.
+	Image string `json:"image,omitempty"`
+	// Remove removes the container instead.
+	Remove bool `json:"remove,omitempty"`
+}
+
+func (r *SidecarRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name required")
+	}
+	if r.Version == "" {
+		return fmt.Errorf("version required")
+	}
+	if r.Image == "" && !r.Remove {
+		return fmt.Errorf("image required unless remove is set")
+	}
+	for _, pattern := range r.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("namespaces: invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// SidecarsFor returns the rules of the current policy for the sidecars of
+// the workloads in namespace.
+func SidecarsFor(namespace string) []SidecarRule {
+	var rules []SidecarRule
+	for _, rule := range CurrentConfig().Sidecars {
+		if len(rule.Namespaces) == 0 || matchNamespace(rule.Namespaces, namespace) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
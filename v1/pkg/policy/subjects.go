@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// serviceAccountPrefix prefixes the user names of service accounts,
+// system:serviceaccount:<namespace>:<name>.
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// SubjectPolicy treats admission requests by who sends them, the UserInfo
+// the apiserver authenticated.
+type SubjectPolicy struct {
+	// Exempt are admitted without running any rule, like the objects of
+	// the exemptSelector, such as the service accounts of cluster operators
+	// and GitOps controllers.
+	Exempt Subjects `json:"exempt,omitempty"`
+	// Strict are denied where the rules only warn, whatever the enforcement
+	// of the rule. They aren't exempt even when they match Exempt too, say
+	// by a group of theirs.
+	Strict Subjects `json:"strict,omitempty"`
+	// StrictHumans makes every human user strict: the users which aren't
+	// service accounts nor system: components such as the controller
+	// manager or the nodes.
+	StrictHumans bool `json:"strictHumans,omitempty"`
+}
+
+// Subjects are users, groups and service accounts, by path.Match patterns.
+type Subjects struct {
+	// Users are patterns of user names, such as alice@example.com.
+	Users []string `json:"users,omitempty"`
+	// Groups are patterns of group names, such as system:masters.
+	Groups []string `json:"groups,omitempty"`
+	// ServiceAccounts are namespace/name patterns of service accounts, such
+	// as argocd/argocd-application-controller or flux-system/*.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+}
+
+func (s *Subjects) validate() error {
+	for _, pattern := range s.Users {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("users: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range s.Groups {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("groups: invalid pattern %q", pattern)
+		}
+	}
+	for _, pattern := range s.ServiceAccounts {
+		if _, err := path.Match(pattern, ""); err != nil || strings.Count(pattern, "/") != 1 {
+			return fmt.Errorf("serviceAccounts: invalid pattern %q, expect namespace/name", pattern)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether user is one of s.
+func (s *Subjects) Matches(user authenticationv1.UserInfo) bool {
+	if matchPattern(s.Users, user.Username) {
+		return true
+	}
+	for _, group := range user.Groups {
+		if matchPattern(s.Groups, group) {
+			return true
+		}
+	}
+	if namespace, name, ok := serviceAccount(user.Username); ok {
+		return matchPattern(s.ServiceAccounts, namespace+"/"+name)
+	}
+	return false
+}
+
+// serviceAccount returns the namespace and name of the service account of
+// username, ok is false when it isn't one.
+func serviceAccount(username string) (namespace, name string, ok bool) {
+	if !strings.HasPrefix(username, serviceAccountPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(username, serviceAccountPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// matchPattern reports whether s matches one of the path.Match patterns.
+func matchPattern(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ExemptSubject reports whether the requests of user are admitted without
+// running any rule under the current policy: the strict subjects aren't.
+func ExemptSubject(user authenticationv1.UserInfo) bool {
+	p := &CurrentConfig().Subjects
+	return p.Exempt.Matches(user) && !p.Strict.Matches(user)
+}
+
+// StrictSubject reports whether the rules deny the requests of user where
+// they would only warn under the current policy.
+func StrictSubject(user authenticationv1.UserInfo) bool {
+	p := &CurrentConfig().Subjects
+	if p.StrictHumans && user.Username != "" && !strings.HasPrefix(user.Username, "system:") {
+		return true
+	}
+	return p.Strict.Matches(user)
+}
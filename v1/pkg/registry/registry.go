@@ -0,0 +1,258 @@
+// Package registry resolves image tags to digests with the OCI distribution
+// API, anonymously, which covers public registries and pull-through mirrors.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// docker.io is known by these names too
+var dockerHubAliases = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// SplitImage splits an image reference into its registry and the repository
+// path with the tag or digest, completing the implicit docker.io registry
+// and library namespace the way the container runtime does.
+func SplitImage(image string) (registry, repository string) {
+	registry, repository = "docker.io", image
+	if i := strings.IndexByte(image, '/'); i >= 0 {
+		// the first component is a registry if it looks like a host
+		if first := image[:i]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			registry, repository = first, image[i+1:]
+		}
+	}
+	if dockerHubAliases[registry] {
+		registry = "docker.io"
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+	return registry, repository
+}
+
+// Repository returns the repository of image, its registry and path without
+// the tag or digest.
+func Repository(image string) string {
+	registry, repository := SplitImage(image)
+	_, name, _ := splitReference(registry + "/" + repository)
+	return registry + "/" + name
+}
+
+// Pinned reports whether image already refers to a digest.
+func Pinned(image string) bool {
+	return strings.Contains(image, "@")
+}
+
+// the manifest types a tag may point to, indexes first so multi-arch images
+// resolve to the digest of the index rather than of one platform
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type cached struct {
+	digest  string
+	expires time.Time
+}
+
+// Resolver looks up the digests of image tags and caches them, and reads
+// manifests and blobs.
+type Resolver struct {
+	client *http.Client
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+// NewResolver returns a Resolver giving up on a registry after timeout and
+// caching the digests for ttl.
+func NewResolver(timeout, ttl time.Duration) *Resolver {
+	return &Resolver{
+		client: &http.Client{Timeout: timeout},
+		ttl:    ttl,
+		cache:  map[string]cached{},
+	}
+}
+
+// Digest returns the digest the tag of image, latest when it has none,
+// currently points to. The lookup is cancelled with ctx.
+func (r *Resolver) Digest(ctx context.Context, image string) (string, error) {
+	if Pinned(image) {
+		return image[strings.IndexByte(image, '@')+1:], nil
+	}
+	r.mu.Lock()
+	entry, ok := r.cache[image]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.digest, nil
+	}
+
+	digest, err := r.lookup(ctx, image)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %v", image, err)
+	}
+	r.mu.Lock()
+	r.cache[image] = cached{digest: digest, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return digest, nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, image string) (string, error) {
+	resp, err := r.fetch(ctx, http.MethodHead, manifestURL(image), manifestTypes)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("%s: no Docker-Content-Digest header", manifestURL(image))
+	}
+	return digest, nil
+}
+
+// Manifest returns the manifest image refers to, uncached.
+func (r *Resolver) Manifest(ctx context.Context, image string, accept ...string) ([]byte, error) {
+	resp, err := r.fetch(ctx, http.MethodGet, manifestURL(image), accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxBody))
+}
+
+// Blob returns the blob digest of the repository of image, uncached.
+func (r *Resolver) Blob(ctx context.Context, image, digest string) ([]byte, error) {
+	host, name, _ := splitReference(image)
+	resp, err := r.fetch(ctx, http.MethodGet, fmt.Sprintf("https://%s/v2/%s/blobs/%s", host, name, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxBody))
+}
+
+// manifests and blobs read are small JSON documents
+const maxBody = 4 << 20
+
+// splitReference splits image into the registry host serving it, the
+// repository name and the tag or digest.
+func splitReference(image string) (host, name, reference string) {
+	registry, repository := SplitImage(image)
+	name, reference = repository, "latest"
+	if i := strings.IndexByte(repository, '@'); i >= 0 {
+		name, reference = repository[:i], repository[i+1:]
+	} else if i := strings.LastIndexByte(repository, ':'); i >= 0 {
+		name, reference = repository[:i], repository[i+1:]
+	}
+	host = registry
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	return host, name, reference
+}
+
+func manifestURL(image string) string {
+	host, name, reference := splitReference(image)
+	return fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, name, reference)
+}
+
+// fetch requests target, authenticating with an anonymous token when the
+// registry asks for one. The response status is OK.
+func (r *Resolver) fetch(ctx context.Context, method, target string, accept []string) (*http.Response, error) {
+	resp, err := r.do(ctx, method, target, accept, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		token, err := r.token(ctx, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = r.do(ctx, method, target, accept, token); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	return resp, nil
+}
+
+func (r *Resolver) do(ctx context.Context, method, target string, accept []string, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r.client.Do(req)
+}
+
+// token gets an anonymous pull token from the realm of the Bearer challenge.
+func (r *Resolver) token(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	params := map[string]string{}
+	for _, param := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid authentication realm %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", realm.Host, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	return body.Token, nil
+}
@@ -0,0 +1,139 @@
+// Package scan looks up the vulnerabilities of images in a scanner.
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cnych/admission-webhook/pkg/registry"
+)
+
+// Harbor reads the vulnerability scans, e.g. by Trivy, Harbor runs of the
+// images it stores and caches them by image.
+type Harbor struct {
+	url                *url.URL
+	username, password string
+	client             *http.Client
+	ttl                time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+type cached struct {
+	critical int
+	expires  time.Time
+}
+
+// NewHarbor returns the Harbor at rawURL, authenticating with credentials,
+// "username:password" of a robot account, anonymously when empty. Requests
+// time out after timeout, scans are cached for ttl.
+func NewHarbor(rawURL, credentials string, timeout, ttl time.Duration) (*Harbor, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid Harbor URL %q", rawURL)
+	}
+	h := &Harbor{
+		url:    u,
+		client: &http.Client{Timeout: timeout},
+		ttl:    ttl,
+		cache:  map[string]cached{},
+	}
+	if credentials != "" {
+		i := strings.IndexByte(credentials, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid Harbor credentials, expect username:password")
+		}
+		h.username, h.password = credentials[:i], credentials[i+1:]
+	}
+	return h, nil
+}
+
+// artifact is the part of a Harbor artifact with its scan overview needed.
+type artifact struct {
+	ScanOverview map[string]struct {
+		ScanStatus string `json:"scan_status"`
+		Summary    struct {
+			Summary map[string]int `json:"summary"`
+		} `json:"summary"`
+	} `json:"scan_overview"`
+}
+
+// Critical returns the number of critical vulnerabilities found in image,
+// which must be stored in this Harbor and scanned. The lookup is cancelled
+// with ctx.
+func (h *Harbor) Critical(ctx context.Context, image string) (int, error) {
+	h.mu.Lock()
+	entry, ok := h.cache[image]
+	h.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.critical, nil
+	}
+
+	critical, err := h.lookup(ctx, image)
+	if err != nil {
+		return 0, fmt.Errorf("scan of %s: %v", image, err)
+	}
+	h.mu.Lock()
+	h.cache[image] = cached{critical: critical, expires: time.Now().Add(h.ttl)}
+	h.mu.Unlock()
+	return critical, nil
+}
+
+func (h *Harbor) lookup(ctx context.Context, image string) (int, error) {
+	host, repository := registry.SplitImage(image)
+	if host != h.url.Host {
+		return 0, fmt.Errorf("not stored in Harbor %s", h.url.Host)
+	}
+	reference := "latest"
+	if i := strings.IndexByte(repository, '@'); i >= 0 {
+		repository, reference = repository[:i], repository[i+1:]
+	} else if i := strings.LastIndexByte(repository, ':'); i >= 0 {
+		repository, reference = repository[:i], repository[i+1:]
+	}
+	i := strings.IndexByte(repository, '/')
+	if i < 0 {
+		return 0, fmt.Errorf("no Harbor project in %s", repository)
+	}
+	// repository names with a / are URL encoded twice
+	project, name := repository[:i], url.PathEscape(url.PathEscape(repository[i+1:]))
+	target := fmt.Sprintf("%s/api/v2.0/projects/%s/repositories/%s/artifacts/%s?with_scan_overview=true",
+		strings.TrimSuffix(h.url.String(), "/"), url.PathEscape(project), name, url.PathEscape(reference))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if h.username != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var a artifact
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		return 0, err
+	}
+	for _, report := range a.ScanOverview {
+		if report.ScanStatus != "Success" {
+			return 0, fmt.Errorf("scan status %s", report.ScanStatus)
+		}
+		return report.Summary.Summary["Critical"], nil
+	}
+	return 0, fmt.Errorf("not scanned")
+}
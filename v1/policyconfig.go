@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/golang/glog"
+)
+
+// policyReloader sets the policy.Config from the -ignoredNamespaces,
+// -exemptSelector, -skipMutation*, -immutableFields and service type flags
+// and the -policyConfigFile, reloading the file whenever it changes so a
+// mounted ConfigMap can be edited without a restart. The clusters sections of
+// the file naming -clusterName apply.
+type policyReloader struct {
+	file              string
+	clusterName       string
+	ignoredNamespaces []string
+	exemptSelector    string
+	owners            []string
+	managers          []string
+	immutableFields   []string
+	serviceTypes      []string
+	serviceNamespaces []string
+
+	// the config loaded last, the changes are logged against
+	loaded *policy.Config
+}
+
+func newPolicyReloader(parameters *WhSvrParameters) *policyReloader {
+	return &policyReloader{
+		file:              parameters.policyConfigFile,
+		clusterName:       parameters.clusterName,
+		ignoredNamespaces: splitList(parameters.ignoredNamespaces),
+		exemptSelector:    parameters.exemptSelector,
+		owners:            splitList(parameters.skipMutationOwners),
+		managers:          splitList(parameters.skipMutationManagers),
+		immutableFields:   splitList(parameters.immutableFields),
+		serviceTypes:      splitList(parameters.restrictedServiceTypes),
+		serviceNamespaces: splitList(parameters.serviceTypeNamespaces),
+	}
+}
+
+// reload loads the config file, the previous config is kept on failure.
+// The changes from the previous config are logged, for the changes of the
+// decisions to be traced back to the change of the policy.
+func (r *policyReloader) reload() error {
+	config, err := r.load()
+	if err != nil {
+		return err
+	}
+	previous := r.loaded
+	r.loaded = config
+	policy.SetConfig(config)
+	glog.Infof("Loaded policy config of cluster %q, generation %d, ignored namespaces: %v, exempt selector: %q", r.clusterName, policy.Generation(), policy.Ignored(), config.ExemptSelector)
+	if previous == nil {
+		return nil
+	}
+	changes, err := policy.Diff(previous, config)
+	if err != nil {
+		glog.Warningf("Can't diff the policy config against the previous one: %v", err)
+		return nil
+	}
+	for _, change := range changes {
+		glog.Infof("Policy config generation %d: %s", policy.Generation(), change)
+	}
+	if len(changes) == 0 {
+		glog.Infof("Policy config generation %d: unchanged", policy.Generation())
+	}
+	return nil
+}
+
+// load returns the validated config of the file and the flags.
+func (r *policyReloader) load() (*policy.Config, error) {
+	config := &policy.Config{}
+	if r.file != "" {
+		loaded, err := policy.LoadConfig(r.file)
+		if err != nil {
+			return nil, err
+		}
+		if config, err = loaded.ForCluster(r.clusterName); err != nil {
+			return nil, err
+		}
+	}
+	config.IgnoredNamespaces = append(append([]string{}, r.ignoredNamespaces...), config.IgnoredNamespaces...)
+	config.SkipMutationOwners = append(append([]string{}, r.owners...), config.SkipMutationOwners...)
+	config.SkipMutationManagers = append(append([]string{}, r.managers...), config.SkipMutationManagers...)
+	config.ImmutableFields = append(append([]string{}, r.immutableFields...), config.ImmutableFields...)
+	config.RestrictedServiceTypes = append(append([]string{}, r.serviceTypes...), config.RestrictedServiceTypes...)
+	config.ServiceTypeNamespaces = append(append([]string{}, r.serviceNamespaces...), config.ServiceTypeNamespaces...)
+	// the file wins over the flag
+	if config.ExemptSelector == "" {
+		config.ExemptSelector = r.exemptSelector
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// watch reloads the config file until ctx is done.
+func (r *policyReloader) watch(ctx context.Context) error {
+	if r.file == "" {
+		return nil
+	}
+	return watchFiles(ctx, "policy config", []string{r.file}, r.reload)
+}
+
+// loadPolicy sets the policy config once, for the commands running the
+// policies without serving.
+func loadPolicy(parameters *WhSvrParameters) {
+	setAnnotationDomain(parameters)
+	if err := newPolicyReloader(parameters).reload(); err != nil {
+		glog.Exitf("Failed to load policy config: %v", err)
+	}
+}
+
+// setAnnotationDomain puts the keys of the webhook under -annotationDomain.
+func setAnnotationDomain(parameters *WhSvrParameters) {
+	if err := policy.SetAnnotationDomain(parameters.annotationDomain, parameters.readLegacyAnnotations); err != nil {
+		glog.Exitf("Invalid -annotationDomain: %v", err)
+	}
+	if parameters.annotationDomain != policy.LegacyAnnotationDomain {
+		glog.Infof("Annotation domain %s, legacy keys read: %v", parameters.annotationDomain, parameters.readLegacyAnnotations)
+	}
+}
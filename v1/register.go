@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/golang/glog"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// names of the webhooks inside their configurations
+const (
+	mutatingWebhookName   = "mutating-example.qikqiak.com"
+	namespaceWebhookName  = "namespaces.mutating-example.qikqiak.com"
+	validatingWebhookName = "required-labels.qikqiak.com"
+)
+
+// webhookSettings are the registration knobs shared by both configurations.
+type webhookSettings struct {
+	failurePolicy     admissionregistrationv1.FailurePolicyType
+	timeoutSeconds    int32
+	namespaceSelector *metav1.LabelSelector
+	// objectSelector leaves the objects of the webhook itself out, nil when
+	// -selfSelector can't be negated by one
+	objectSelector   *metav1.LabelSelector
+	caBundle         []byte
+	mutateNamespaces bool
+}
+
+func newWebhookSettings(parameters *WhSvrParameters, caBundle []byte) (*webhookSettings, error) {
+	failurePolicy := admissionregistrationv1.FailurePolicyType(parameters.failurePolicy)
+	if failurePolicy != admissionregistrationv1.Ignore && failurePolicy != admissionregistrationv1.Fail {
+		return nil, fmt.Errorf("unsupported failurePolicy %q, expect Ignore or Fail", parameters.failurePolicy)
+	}
+	if parameters.webhookTimeoutSeconds < 1 || parameters.webhookTimeoutSeconds > 30 {
+		return nil, fmt.Errorf("webhookTimeoutSeconds must be between 1 and 30, got %d", parameters.webhookTimeoutSeconds)
+	}
+	var selector *metav1.LabelSelector
+	if parameters.namespaceSelector != "" {
+		var err error
+		if selector, err = metav1.ParseToLabelSelector(parameters.namespaceSelector); err != nil {
+			return nil, fmt.Errorf("invalid namespaceSelector: %v", err)
+		}
+	}
+	// the API server doesn't call the webhook about itself, so it can
+	// restart its own pods while it is unavailable
+	if parameters.selfNamespace {
+		if selector == nil {
+			selector = &metav1.LabelSelector{}
+		}
+		selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      corev1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{parameters.serviceNamespace},
+		})
+	}
+	objectSelector, err := selfObjectSelector(parameters.selfSelector)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookSettings{
+		failurePolicy:     failurePolicy,
+		timeoutSeconds:    int32(parameters.webhookTimeoutSeconds),
+		namespaceSelector: selector,
+		objectSelector:    objectSelector,
+		caBundle:          caBundle,
+		mutateNamespaces:  parameters.mutateNamespaces,
+	}, nil
+}
+
+// selfObjectSelector returns the objectSelector leaving the objects of
+// selfSelector out, nil when it is empty or has several requirements, whose
+// negation isn't a selector: those objects are only admitted unchanged by
+// the webhook then, see admission.SetSelf. Unlike the webhook, the
+// objectSelector leaves out the objects of every namespace.
+func selfObjectSelector(selfSelector string) (*metav1.LabelSelector, error) {
+	selector, err := labels.Parse(selfSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selfSelector: %v", err)
+	}
+	requirements, _ := selector.Requirements()
+	if len(requirements) != 1 {
+		return nil, nil
+	}
+	requirement := requirements[0]
+	negated := metav1.LabelSelectorRequirement{Key: requirement.Key()}
+	switch requirement.Operator() {
+	case selection.Equals, selection.DoubleEquals, selection.In:
+		negated.Operator, negated.Values = metav1.LabelSelectorOpNotIn, requirement.Values().List()
+	case selection.NotEquals, selection.NotIn:
+		negated.Operator, negated.Values = metav1.LabelSelectorOpIn, requirement.Values().List()
+	case selection.Exists:
+		negated.Operator = metav1.LabelSelectorOpDoesNotExist
+	case selection.DoesNotExist:
+		negated.Operator = metav1.LabelSelectorOpExists
+	default:
+		return nil, nil
+	}
+	return &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{negated}}, nil
+}
+
+func (s *webhookSettings) clientConfig(parameters *WhSvrParameters, path string) admissionregistrationv1.WebhookClientConfig {
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Namespace: parameters.serviceNamespace,
+			Name:      parameters.serviceName,
+			Path:      &path,
+		},
+		CABundle: s.caBundle,
+	}
+}
+
+func (s *webhookSettings) mutatingWebhookConfiguration(parameters *WhSvrParameters) *admissionregistrationv1.MutatingWebhookConfiguration {
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	failurePolicy := s.failurePolicy
+	timeoutSeconds := s.timeoutSeconds
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admissionregistration.k8s.io/v1",
+			Kind:       "MutatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   parameters.mutatingWebhookConfigName,
+			Labels: map[string]string{"app": "admission-webhook-example"},
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name:                    mutatingWebhookName,
+			ClientConfig:            s.clientConfig(parameters, "/mutate"),
+			Rules:                   admission.MutateRules,
+			FailurePolicy:           &failurePolicy,
+			NamespaceSelector:       s.namespaceSelector,
+			ObjectSelector:          s.objectSelector,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeoutSeconds,
+			AdmissionReviewVersions: []string{"v1"},
+		}},
+	}
+	// a new namespace doesn't carry the labels of the namespaceSelector yet,
+	// so namespaces go to a webhook without one
+	if s.mutateNamespaces {
+		config.Webhooks = append(config.Webhooks, admissionregistrationv1.MutatingWebhook{
+			Name:                    namespaceWebhookName,
+			ClientConfig:            s.clientConfig(parameters, "/mutate"),
+			Rules:                   admission.NamespaceMutateRules,
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeoutSeconds,
+			AdmissionReviewVersions: []string{"v1"},
+		})
+	}
+	return config
+}
+
+func (s *webhookSettings) validatingWebhookConfiguration(parameters *WhSvrParameters) *admissionregistrationv1.ValidatingWebhookConfiguration {
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	failurePolicy := s.failurePolicy
+	timeoutSeconds := s.timeoutSeconds
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admissionregistration.k8s.io/v1",
+			Kind:       "ValidatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   parameters.validatingWebhookConfigName,
+			Labels: map[string]string{"app": "admission-webhook-example"},
+		},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{{
+			Name:                    validatingWebhookName,
+			ClientConfig:            s.clientConfig(parameters, "/validate"),
+			Rules:                   admission.ValidateRulesFor(policy.CurrentConfig()),
+			FailurePolicy:           &failurePolicy,
+			NamespaceSelector:       s.namespaceSelector,
+			ObjectSelector:          s.objectSelector,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeoutSeconds,
+			AdmissionReviewVersions: []string{"v1"},
+		}},
+	}
+}
+
+// registerWebhooks creates or updates the webhook configurations. Without a
+// caBundle the one already registered is kept, e.g. when it is injected by
+// cert-manager's cainjector.
+func registerWebhooks(ctx context.Context, client kubernetes.Interface, parameters *WhSvrParameters, settings *webhookSettings) error {
+	configs := client.AdmissionregistrationV1()
+
+	if parameters.mutatingWebhookConfigName != "" {
+		desired := settings.mutatingWebhookConfiguration(parameters)
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			current, err := configs.MutatingWebhookConfigurations().Get(ctx, desired.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				_, err = configs.MutatingWebhookConfigurations().Create(ctx, desired, metav1.CreateOptions{})
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			if settings.caBundle == nil && len(current.Webhooks) > 0 {
+				desired.Webhooks[0].ClientConfig.CABundle = current.Webhooks[0].ClientConfig.CABundle
+			}
+			desired.ResourceVersion = current.ResourceVersion
+			_, err = configs.MutatingWebhookConfigurations().Update(ctx, desired, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		glog.Infof("Registered MutatingWebhookConfiguration %s", desired.Name)
+	}
+
+	if parameters.validatingWebhookConfigName != "" {
+		desired := settings.validatingWebhookConfiguration(parameters)
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			current, err := configs.ValidatingWebhookConfigurations().Get(ctx, desired.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				_, err = configs.ValidatingWebhookConfigurations().Create(ctx, desired, metav1.CreateOptions{})
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			if settings.caBundle == nil && len(current.Webhooks) > 0 {
+				desired.Webhooks[0].ClientConfig.CABundle = current.Webhooks[0].ClientConfig.CABundle
+			}
+			desired.ResourceVersion = current.ResourceVersion
+			_, err = configs.ValidatingWebhookConfigurations().Update(ctx, desired, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		glog.Infof("Registered ValidatingWebhookConfiguration %s", desired.Name)
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/cnych/admission-webhook/pkg/policy"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/spf13/cobra"
+	"k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// auditEvent is the part of an audit.k8s.io/v1 Event replay needs. The
+// request object and the webhook annotations are only logged at the Request
+// and RequestResponse audit levels.
+type auditEvent struct {
+	Kind           string                    `json:"kind"`
+	AuditID        string                    `json:"auditID"`
+	Stage          string                    `json:"stage"`
+	Verb           string                    `json:"verb"`
+	User           authenticationv1.UserInfo `json:"user"`
+	ObjectRef      *auditObjectRef           `json:"objectRef"`
+	ResponseStatus *metav1.Status            `json:"responseStatus"`
+	RequestObject  json.RawMessage           `json:"requestObject"`
+	Annotations    map[string]string         `json:"annotations"`
+	Items          []json.RawMessage         `json:"items"`
+}
+
+type auditObjectRef struct {
+	Resource    string `json:"resource"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	APIGroup    string `json:"apiGroup"`
+	APIVersion  string `json:"apiVersion"`
+	Subresource string `json:"subresource"`
+}
+
+// auditWebhookAnnotation is the value of the patch.webhook.admission.k8s.io
+// annotations the apiserver records for every patch applied by a webhook.
+type auditWebhookAnnotation struct {
+	Webhook string          `json:"webhook"`
+	Patch   json.RawMessage `json:"patch"`
+}
+
+const auditPatchAnnotationPrefix = "patch.webhook.admission.k8s.io/"
+
+// replayCase is a recorded admission request and the decisions originally
+// taken for it, as far as the record tells.
+type replayCase struct {
+	source  string
+	request *v1.AdmissionRequest
+	// original patch of the mutating webhook, nil when unknown
+	patch []byte
+	// original verdict of the validating webhook, nil when unknown
+	allowed *bool
+}
+
+// replay implements the replay command: it re-runs recorded admission
+// requests, from audit logs or saved AdmissionReviews, through the current
+// policies and reports every decision or patch that changed. It exits with 1
+// when there are differences.
+//
+//	admission-webhook replay -f /var/log/kubernetes/audit.log
+func replay(parameters *WhSvrParameters, files []string) {
+	loadPolicy(parameters)
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	var cases []replayCase
+	for _, file := range files {
+		c, err := readReplayCases(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", file, err)
+			os.Exit(1)
+		}
+		cases = append(cases, c...)
+	}
+
+	var mutations, validations, diffs int
+	for _, c := range cases {
+		log := newRequestLogger(c.request)
+		if c.patch != nil && handles(admission.MutateRules, c.request) {
+			mutations++
+			response := admission.Mutate(context.Background(), c.request, log)
+			if !samePatch(c.request.Object.Raw, c.patch, response.Patch) {
+				diffs++
+				fmt.Printf("DIFF %s %s: mutate patch changed\n  before: %s\n  after:  %s\n", c.source, describeRequest(c.request), c.patch, response.Patch)
+			}
+		}
+		if c.allowed != nil && handles(admission.ValidateRulesFor(policy.CurrentConfig()), c.request) {
+			validations++
+			// validating webhooks see the object as originally mutated
+			request := c.request
+			if mutated, err := applyPatch(c.request.Object.Raw, c.patch); err == nil {
+				copied := *c.request
+				copied.Object.Raw = mutated
+				request = &copied
+			}
+			response := admission.Validate(context.Background(), request, log)
+			if response.Allowed != *c.allowed {
+				diffs++
+				fmt.Printf("DIFF %s %s: validate %s -> %s %s\n", c.source, describeRequest(c.request), verdict(*c.allowed), verdict(response.Allowed), responseMessage(response))
+			}
+		}
+	}
+	fmt.Printf("replayed %d requests: %d mutations and %d validations compared, %d differences\n", len(cases), mutations, validations, diffs)
+	if diffs > 0 {
+		os.Exit(1)
+	}
+}
+
+// newReplayCommand returns the replay command.
+func newReplayCommand(parameters *WhSvrParameters) *cobra.Command {
+	var files []string
+	command := &cobra.Command{
+		Use:   "replay",
+		Short: "Replay recorded admission requests and report the changed decisions",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			replay(parameters, files)
+		},
+	}
+	command.Flags().StringArrayVarP(&files, "file", "f", nil, "Audit log (JSON lines) or AdmissionReview JSON file to replay, - for stdin. Can be repeated.")
+	return command
+}
+
+func readReplayCases(file string) ([]replayCase, error) {
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var cases []replayCase
+	decoder := json.NewDecoder(in)
+	for i := 1; ; i++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return cases, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+		c, err := replayCasesFrom(fmt.Sprintf("%s#%d", file, i), raw)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+		cases = append(cases, c...)
+	}
+}
+
+func replayCasesFrom(source string, raw json.RawMessage) ([]replayCase, error) {
+	var event auditEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+	switch event.Kind {
+	case "AdmissionReview":
+		ar, err := admission.Decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		if ar.Request == nil {
+			return nil, nil
+		}
+		c := replayCase{source: source, request: ar.Request}
+		// only mutate answers with a patch type
+		if response := ar.Response; response != nil {
+			if response.PatchType != nil {
+				c.patch = response.Patch
+				if c.patch == nil {
+					c.patch = []byte{}
+				}
+			} else {
+				allowed := response.Allowed
+				c.allowed = &allowed
+			}
+		}
+		return []replayCase{c}, nil
+	case "EventList":
+		var cases []replayCase
+		for i, item := range event.Items {
+			c, err := replayCasesFrom(fmt.Sprintf("%s/%d", source, i), item)
+			if err != nil {
+				return nil, err
+			}
+			cases = append(cases, c...)
+		}
+		return cases, nil
+	case "Event":
+		if c := replayCaseFromAudit(source, &event); c != nil {
+			return []replayCase{*c}, nil
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported kind %q, expect an audit Event or an AdmissionReview", event.Kind)
+	}
+}
+
+// replayCaseFromAudit rebuilds the AdmissionRequest the apiserver sent for a
+// completed create or update, nil for events which never reached admission.
+func replayCaseFromAudit(source string, event *auditEvent) *replayCase {
+	if event.Stage != "ResponseComplete" || event.ObjectRef == nil || event.ObjectRef.Subresource != "" || len(event.RequestObject) == 0 {
+		return nil
+	}
+	var operation v1.Operation
+	switch event.Verb {
+	case "create":
+		operation = v1.Create
+	case "update":
+		operation = v1.Update
+	default:
+		return nil
+	}
+	ref := event.ObjectRef
+	var kind string
+	for k, resource := range simulateResources {
+		if resource.Group == ref.APIGroup && resource.Resource == ref.Resource {
+			kind = k
+		}
+	}
+	if kind == "" {
+		return nil
+	}
+
+	name := ref.Name
+	if name == "" {
+		var meta metav1.PartialObjectMetadata
+		if err := json.Unmarshal(event.RequestObject, &meta); err == nil {
+			name = meta.Name
+		}
+	}
+	c := &replayCase{
+		source: source + " " + event.AuditID,
+		request: &v1.AdmissionRequest{
+			UID:       types.UID(event.AuditID),
+			Kind:      metav1.GroupVersionKind{Group: ref.APIGroup, Version: ref.APIVersion, Kind: kind},
+			Resource:  metav1.GroupVersionResource{Group: ref.APIGroup, Version: ref.APIVersion, Resource: ref.Resource},
+			Name:      name,
+			Namespace: ref.Namespace,
+			Operation: operation,
+			UserInfo:  event.User,
+		},
+	}
+	c.request.Object.Raw = event.RequestObject
+
+	// the patch the mutating webhook applied, none when it didn't patch
+	c.patch = []byte{}
+	for key, value := range event.Annotations {
+		if !strings.HasPrefix(key, auditPatchAnnotationPrefix) {
+			continue
+		}
+		var annotation auditWebhookAnnotation
+		if err := json.Unmarshal([]byte(value), &annotation); err == nil && annotation.Webhook == mutatingWebhookName {
+			c.patch = annotation.Patch
+		}
+	}
+
+	// denials of the validating webhook end up in the response status
+	allowed := true
+	if status := event.ResponseStatus; status != nil && status.Code >= 400 {
+		if !strings.Contains(status.Message, fmt.Sprintf("admission webhook %q denied the request", validatingWebhookName)) {
+			// rejected before or by something else, the webhook verdict is unknown
+			return c
+		}
+		allowed = false
+	}
+	c.allowed = &allowed
+	return c
+}
+
+// handles reports whether rules cover the resource and operation of req.
+func handles(rules []admissionregistrationv1.RuleWithOperations, req *v1.AdmissionRequest) bool {
+	for _, rule := range rules {
+		resource := req.Resource.Resource
+		if req.SubResource != "" {
+			resource += "/" + req.SubResource
+		}
+		if !contains(rule.APIGroups, req.Resource.Group) || !contains(rule.Resources, resource) {
+			continue
+		}
+		for _, op := range rule.Operations {
+			if op == admissionregistrationv1.OperationAll || string(op) == string(req.Operation) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// samePatch compares the effect of both patches on object rather than the
+// patches themselves, which may differ in order only.
+func samePatch(object, before, after []byte) bool {
+	a, errA := applyPatch(object, before)
+	b, errB := applyPatch(object, after)
+	if errA != nil || errB != nil {
+		return bytes.Equal(before, after)
+	}
+	return jsonpatch.Equal(a, b)
+}
+
+func applyPatch(object, patch []byte) ([]byte, error) {
+	if len(patch) == 0 {
+		return object, nil
+	}
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Apply(object)
+}
+
+func describeRequest(req *v1.AdmissionRequest) string {
+	return fmt.Sprintf("%s %s %s/%s", req.Operation, req.Kind.Kind, req.Namespace, admission.ObjectName(req))
+}
+
+func verdict(allowed bool) string {
+	if allowed {
+		return "allowed"
+	}
+	return "denied"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// selfTestDeployment is the sample object mutated by the self-test.
+func selfTestDeployment() *appsv1.Deployment {
+	labels := map[string]string{"app": "self-test"}
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "self-test", Namespace: "default", Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "self-test",
+						Image: "busybox",
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("100m"),
+								corev1.ResourceMemory: resource.MustParse("100Mi"),
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// selfTest posts a canned AdmissionReview for a sample Deployment through
+// handler, the webhook's own handler chain, and checks the response carries
+// a patch which applies cleanly, then posts one which doesn't decode and
+// checks it is denied with an AdmissionReview answering its uid all the
+// same, so a broken policy, schema or response regression fails readiness
+// instead of real admission requests.
+func selfTest(handler http.Handler) error {
+	object, err := json.Marshal(selfTestDeployment())
+	if err != nil {
+		return err
+	}
+	review := v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &v1.AdmissionRequest{
+			UID:       "self-test",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			Name:      "self-test",
+			Namespace: "default",
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: object},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+
+	response, err := postReview(handler, body, review.Request.UID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !response.Allowed:
+		return fmt.Errorf("sample Deployment denied: %v", response.Result)
+	case len(response.Patch) == 0:
+		return errors.New("sample Deployment got no patch")
+	}
+	patch, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		return fmt.Errorf("invalid JSON patch: %v", err)
+	}
+	if _, err := patch.Apply(object); err != nil {
+		return fmt.Errorf("patch doesn't apply to the sample Deployment: %v", err)
+	}
+
+	// an operation which isn't a string doesn't decode
+	malformed := []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"self-test-malformed","operation":0}}`)
+	if response, err = postReview(handler, malformed, "self-test-malformed"); err != nil {
+		return fmt.Errorf("malformed AdmissionReview: %v", err)
+	}
+	if response.Allowed || response.Result == nil || response.Result.Code != http.StatusBadRequest {
+		return fmt.Errorf("malformed AdmissionReview not denied as a bad request: %v", response.Result)
+	}
+	return nil
+}
+
+// postReview posts body, an AdmissionReview, to the /mutate of handler and
+// returns the response of the AdmissionReview answered, checking it is one
+// answering the request of uid.
+func postReview(handler http.Handler, body []byte, uid types.UID) (*v1.AdmissionResponse, error) {
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("/mutate answered %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var answer v1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		return nil, fmt.Errorf("invalid AdmissionReview response: %v", err)
+	}
+	switch {
+	case answer.APIVersion != v1.SchemeGroupVersion.String() || answer.Kind != "AdmissionReview":
+		return nil, fmt.Errorf("response is a %s %s, not an admission.k8s.io/v1 AdmissionReview", answer.APIVersion, answer.Kind)
+	case answer.Response == nil:
+		return nil, errors.New("AdmissionReview has no response")
+	case answer.Response.UID != uid:
+		return nil, fmt.Errorf("response UID %q doesn't match request UID %q", answer.Response.UID, uid)
+	}
+	return answer.Response, nil
+}
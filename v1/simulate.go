@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/spf13/cobra"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+// resources simulate builds AdmissionRequests for, by kind
+var simulateResources = map[string]metav1.GroupVersionResource{
+	"Deployment":            {Group: "apps", Version: "v1", Resource: "deployments"},
+	"ReplicaSet":            {Group: "apps", Version: "v1", Resource: "replicasets"},
+	"Pod":                   {Group: "", Version: "v1", Resource: "pods"},
+	"Service":               {Group: "", Version: "v1", Resource: "services"},
+	"Namespace":             {Group: "", Version: "v1", Resource: "namespaces"},
+	"Ingress":               {Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"},
+	"PersistentVolumeClaim": {Group: "", Version: "v1", Resource: "persistentvolumeclaims"},
+	"ConfigMap":             {Group: "", Version: "v1", Resource: "configmaps"},
+	"Secret":                {Group: "", Version: "v1", Resource: "secrets"},
+}
+
+// simulate implements the simulate command: it runs a manifest through the
+// same mutate and validate code the server uses, the validation seeing the
+// mutated object like the apiserver would, and prints the JSON patch, the
+// final object and the verdict. It exits with 1 when the object is denied.
+// With a patchFormat it prints the mutations of the objects of the manifest
+// as kustomize patches instead.
+//
+//	admission-webhook simulate -f deployment.yaml
+//	admission-webhook simulate -f manifests.yaml --patch-format strategic-merge
+func simulate(parameters *WhSvrParameters, file, patchFormat string) {
+	loadPolicy(parameters)
+
+	var (
+		data []byte
+		err  error
+	)
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read manifest: %v\n", err)
+		os.Exit(1)
+	}
+
+	if patchFormat != "" {
+		if err := validatePatchFormat(patchFormat); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if !exportPatches(data, patchFormat, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	allowed, err := simulateAdmission(data, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to simulate admission: %v\n", err)
+		os.Exit(1)
+	}
+	if !allowed {
+		os.Exit(1)
+	}
+}
+
+// newSimulateCommand returns the simulate command.
+func newSimulateCommand(parameters *WhSvrParameters) *cobra.Command {
+	var file, patchFormat string
+	command := &cobra.Command{
+		Use:   "simulate",
+		Short: "Admit a manifest offline and print the patch, the object and the verdict",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			simulate(parameters, file, patchFormat)
+		},
+	}
+	command.Flags().StringVarP(&file, "file", "f", "-", "Deployment, ReplicaSet, Pod, Service, Ingress, PersistentVolumeClaim, ConfigMap, Secret or Namespace manifest to admit, - for stdin.")
+	command.Flags().StringVar(&patchFormat, "patch-format", "", "Print the mutations of the objects of the manifest as kustomize patches instead: json6902 for the patches entries of a kustomization.yaml, strategic-merge for patch files.")
+	return command
+}
+
+func simulateAdmission(manifest []byte, out io.Writer) (bool, error) {
+	object, err := yaml.YAMLToJSON(manifest)
+	if err != nil {
+		return false, err
+	}
+	verdict, err := admitManifest(context.Background(), object, "")
+	if err != nil {
+		return false, err
+	}
+	if verdict.DeniedBy == "mutate" {
+		fmt.Fprintf(out, "verdict: denied by mutate: %s\n", verdict.Message)
+		return false, nil
+	}
+	if verdict.mutated {
+		fmt.Fprintf(out, "patch: %s\n", verdict.Patch)
+	}
+	final, err := yaml.JSONToYAML(verdict.object)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(out, "---\n%s---\n", final)
+	if !verdict.Allowed {
+		fmt.Fprintf(out, "verdict: denied by validate: %s\n", verdict.Message)
+		return false, nil
+	}
+	fmt.Fprintln(out, "verdict: allowed")
+	return true, nil
+}
+
+// exportPatches prints the mutations of the objects of manifest, YAML
+// documents or JSON objects, as kustomize patches in format. Denied objects
+// are reported on stderr, it returns false when there are any.
+func exportPatches(manifest []byte, format string, out io.Writer) bool {
+	objects, err := splitManifests(manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse manifest: %v\n", err)
+		return false
+	}
+	allowed := true
+	var patches []string
+	for i, object := range objects {
+		verdict, err := admitManifest(context.Background(), object, "")
+		if err == nil && verdict.Allowed {
+			verdict.KustomizePatch, err = kustomizePatch(verdict, format)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to simulate admission of object %d: %v\n", i, err)
+			allowed = false
+			continue
+		}
+		if !verdict.Allowed {
+			fmt.Fprintf(os.Stderr, "%s %s/%s denied by %s: %s\n", verdict.Kind, verdict.Namespace, verdict.Name, verdict.DeniedBy, verdict.Message)
+			allowed = false
+			continue
+		}
+		if verdict.KustomizePatch != "" {
+			patches = append(patches, verdict.KustomizePatch)
+		}
+	}
+	if format == patchFormatJSON6902 {
+		if len(patches) > 0 {
+			fmt.Fprintf(out, "patches:\n%s", strings.Join(patches, ""))
+		}
+	} else {
+		fmt.Fprint(out, strings.Join(patches, "---\n"))
+	}
+	return allowed
+}
+
+// manifestVerdict is the outcome of admitting a manifest offline.
+type manifestVerdict struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Allowed   bool   `json:"allowed"`
+	// DeniedBy is mutate or validate when denied
+	DeniedBy string   `json:"deniedBy,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// Patch is the JSON patch of the mutation, none when it changes nothing
+	Patch json.RawMessage `json:"patch,omitempty"`
+
+	// KustomizePatch is the mutation as a kustomize patch, when asked for
+	KustomizePatch string `json:"kustomizePatch,omitempty"`
+
+	// mutated tells whether the kind is mutated at all
+	mutated bool
+	// original is the object as given
+	original []byte
+	// object is the mutated object, as validated
+	object []byte
+}
+
+// admitManifest runs object, the JSON of a manifest, through the same
+// mutate and validate code the server uses, the validation seeing the
+// mutated object like the apiserver would. Objects without a namespace are
+// admitted in namespace.
+func admitManifest(ctx context.Context, object []byte, namespace string) (*manifestVerdict, error) {
+	var meta struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(object, &meta); err != nil {
+		return nil, err
+	}
+	resource, ok := simulateResources[meta.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q, expect Deployment, ReplicaSet, Pod, Service, Ingress, PersistentVolumeClaim, ConfigMap, Secret or Namespace", meta.Kind)
+	}
+	if meta.Namespace == "" && meta.Kind != "Namespace" {
+		meta.Namespace = namespace
+	}
+	gvk := meta.GroupVersionKind()
+	request := &v1.AdmissionRequest{
+		UID:       types.UID("simulate"),
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Resource:  resource,
+		Name:      meta.Name,
+		Namespace: meta.Namespace,
+		Operation: v1.Create,
+	}
+	verdict := &manifestVerdict{
+		Kind:      meta.Kind,
+		Namespace: meta.Namespace,
+		Name:      admission.ObjectName(&v1.AdmissionRequest{Name: meta.Name, Object: runtime.RawExtension{Raw: object}}),
+		Allowed:   true,
+		original:  object,
+		object:    object,
+	}
+	// mutate first, for the resources registered for it
+	if handles(admission.MutateRules, request) || handles(admission.NamespaceMutateRules, request) {
+		verdict.mutated = true
+		request.Object.Raw = object
+		response := admission.Mutate(ctx, request, newRequestLogger(request))
+		verdict.Warnings = append(verdict.Warnings, response.Warnings...)
+		if !response.Allowed {
+			verdict.Allowed, verdict.DeniedBy, verdict.Message = false, "mutate", responseMessage(response)
+			return verdict, nil
+		}
+		verdict.Patch = response.Patch
+		if len(response.Patch) > 0 {
+			patch, err := jsonpatch.DecodePatch(response.Patch)
+			if err != nil {
+				return nil, err
+			}
+			if verdict.object, err = patch.Apply(object); err != nil {
+				return nil, fmt.Errorf("patch does not apply: %v", err)
+			}
+		}
+	}
+
+	if handles(admission.ValidateRules, request) {
+		request.Object.Raw = verdict.object
+		response := admission.Validate(ctx, request, newRequestLogger(request))
+		verdict.Warnings = append(verdict.Warnings, response.Warnings...)
+		if !response.Allowed {
+			verdict.Allowed, verdict.DeniedBy, verdict.Message = false, "validate", responseMessage(response)
+		}
+	}
+	return verdict, nil
+}
+
+func responseMessage(response *v1.AdmissionResponse) string {
+	if response.Result == nil {
+		return ""
+	}
+	if response.Result.Message != "" {
+		return response.Result.Message
+	}
+	return string(response.Result.Reason)
+}
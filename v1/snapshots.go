@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// snapshotFlushPeriod is how often the snapshots recorded since the last
+// flush are written to -snapshotDir.
+const snapshotFlushPeriod = 10 * time.Second
+
+// snapshot is an admission request and the response the webhook returned,
+// an AdmissionReview with the handler and the time it was answered at: the
+// replay command reads the snapshots as AdmissionReviews.
+type snapshot struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *v1.AdmissionRequest  `json:"request"`
+	Response        *v1.AdmissionResponse `json:"response"`
+	Handler         string                `json:"handler"`
+	Time            time.Time             `json:"time"`
+}
+
+// snapshotRing keeps the last snapshots of a kind, next overwriting the
+// oldest once full.
+type snapshotRing struct {
+	entries []*snapshot
+	next    int
+}
+
+func (r *snapshotRing) add(s *snapshot, size int) {
+	if len(r.entries) < size {
+		r.entries = append(r.entries, s)
+		return
+	}
+	r.entries[r.next] = s
+	r.next = (r.next + 1) % size
+}
+
+// newest returns the snapshots of the ring, the newest first.
+func (r *snapshotRing) newest() []*snapshot {
+	snapshots := make([]*snapshot, 0, len(r.entries))
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		snapshots = append(snapshots, r.entries[(r.next+i)%len(r.entries)])
+	}
+	return snapshots
+}
+
+// snapshotStore keeps the last admission requests and responses of every
+// kind, to reconstruct what the webhook saw and returned during an incident.
+// With a dir the snapshots are written there, a file of JSON lines per kind,
+// and read back on startup so they survive restarts.
+type snapshotStore struct {
+	size int
+	dir  string
+
+	mu    sync.Mutex
+	rings map[string]*snapshotRing
+	// dirty are the kinds recorded since the last flush
+	dirty map[string]bool
+}
+
+// newSnapshotStore returns a store of the last size snapshots of every kind,
+// nil when size is 0 and snapshots are disabled.
+func newSnapshotStore(size int, dir string) (*snapshotStore, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	s := &snapshotStore{size: size, dir: dir, rings: make(map[string]*snapshotRing), dirty: make(map[string]bool)}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// snapshotKind returns the kind snapshots of req are kept under, such as
+// Deployment.apps.
+func snapshotKind(req *v1.AdmissionRequest) string {
+	return schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind}.String()
+}
+
+// record keeps req and the response handler returned to it. The data of
+// Secrets is dropped, the snapshots are readable by whoever debugs the
+// webhook.
+func (s *snapshotStore) record(handler string, req *v1.AdmissionRequest, response *v1.AdmissionResponse) {
+	if s == nil || req == nil {
+		return
+	}
+	if req.Kind.Group == "" && req.Kind.Kind == "Secret" {
+		redacted := *req
+		redacted.Object.Raw = withoutSecretData(req.Object.Raw)
+		redacted.OldObject.Raw = withoutSecretData(req.OldObject.Raw)
+		redacted.Object.Object, redacted.OldObject.Object = nil, nil
+		req = &redacted
+	}
+	entry := &snapshot{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+		Response: response,
+		Handler:  handler,
+		Time:     time.Now().UTC(),
+	}
+	kind := snapshotKind(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ring, ok := s.rings[kind]
+	if !ok {
+		ring = &snapshotRing{}
+		s.rings[kind] = ring
+	}
+	ring.add(entry, s.size)
+	s.dirty[kind] = true
+}
+
+// withoutSecretData returns raw, the JSON of a Secret, without its data and
+// stringData.
+func withoutSecretData(raw []byte) []byte {
+	if len(raw) == 0 {
+		return raw
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil
+	}
+	delete(object, "data")
+	delete(object, "stringData")
+	redacted, err := json.Marshal(object)
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// snapshotFilter selects snapshots by the fields of their request, an empty
+// field selecting any.
+type snapshotFilter struct {
+	kind      string
+	namespace string
+	name      string
+	uid       string
+	handler   string
+	// denied selects the requests denied only
+	denied bool
+}
+
+func (f *snapshotFilter) matches(s *snapshot) bool {
+	req := s.Request
+	switch {
+	case f.kind != "" && !strings.EqualFold(f.kind, req.Kind.Kind) && !strings.EqualFold(f.kind, snapshotKind(req)):
+		return false
+	case f.namespace != "" && f.namespace != req.Namespace:
+		return false
+	case f.name != "" && f.name != req.Name:
+		return false
+	case f.uid != "" && f.uid != string(req.UID):
+		return false
+	case f.handler != "" && f.handler != s.Handler:
+		return false
+	case f.denied && (s.Response == nil || s.Response.Allowed):
+		return false
+	}
+	return true
+}
+
+// list returns up to limit snapshots filter selects, the newest first, all
+// of them when limit is 0.
+func (s *snapshotStore) list(filter *snapshotFilter, limit int) []*snapshot {
+	s.mu.Lock()
+	var snapshots []*snapshot
+	for _, ring := range s.rings {
+		for _, entry := range ring.newest() {
+			if filter.matches(entry) {
+				snapshots = append(snapshots, entry)
+			}
+		}
+	}
+	s.mu.Unlock()
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.After(snapshots[j].Time) })
+	if limit > 0 && len(snapshots) > limit {
+		snapshots = snapshots[:limit]
+	}
+	return snapshots
+}
+
+// snapshotFile returns the file the snapshots of kind are written to.
+func (s *snapshotStore) snapshotFile(kind string) string {
+	return filepath.Join(s.dir, strings.ToLower(kind)+".jsonl")
+}
+
+// load reads the snapshots written by the previous run, the oldest first.
+func (s *snapshotStore) load() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		decoder := json.NewDecoder(f)
+		for decoder.More() {
+			entry := &snapshot{}
+			if err := decoder.Decode(entry); err != nil {
+				glog.Warningf("Ignoring the rest of the snapshots of %s: %v", file, err)
+				break
+			}
+			if entry.Request == nil {
+				continue
+			}
+			kind := snapshotKind(entry.Request)
+			ring, ok := s.rings[kind]
+			if !ok {
+				ring = &snapshotRing{}
+				s.rings[kind] = ring
+			}
+			ring.add(entry, s.size)
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// flush writes the snapshots of the kinds recorded since the last flush,
+// replacing the file of every kind at once so a crash leaves the previous
+// one.
+func (s *snapshotStore) flush() error {
+	s.mu.Lock()
+	snapshots := make(map[string][]*snapshot, len(s.dirty))
+	for kind := range s.dirty {
+		snapshots[kind] = s.rings[kind].newest()
+	}
+	s.dirty = make(map[string]bool)
+	s.mu.Unlock()
+
+	for kind, entries := range snapshots {
+		file := s.snapshotFile(kind)
+		tmp, err := ioutil.TempFile(s.dir, ".snapshots-")
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(tmp)
+		for i := len(entries) - 1; i >= 0 && err == nil; i-- {
+			err = encoder.Encode(entries[i])
+		}
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("failed to write %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// run flushes the snapshots every snapshotFlushPeriod until ctx is done, the
+// last ones are flushed on shutdown.
+func (s *snapshotStore) run(ctx context.Context) {
+	ticker := time.NewTicker(snapshotFlushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				glog.Warningf("Failed to write the snapshots: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// snapshotHandler serves the snapshots as JSON lines, the newest first,
+// selected by the kind, namespace, name, uid and handler query parameters,
+// denied=true for the denied requests only, and limit, e.g.
+//
+//	curl -k -H "Authorization: Bearer $TOKEN" "https://webhook/debug/snapshots?kind=Deployment&namespace=prod&limit=20"
+//
+// The calls are authenticated like those of /debug/loglevel, see
+// endpointAuth. The output can be replayed through the current policies with
+// the replay command.
+type snapshotHandler struct {
+	store *snapshotStore
+}
+
+func (h *snapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter := &snapshotFilter{
+		kind:      query.Get("kind"),
+		namespace: query.Get("namespace"),
+		name:      query.Get("name"),
+		uid:       query.Get("uid"),
+		handler:   query.Get("handler"),
+	}
+	if v := query.Get("denied"); v != "" {
+		denied, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid denied %q: %v", v, err), http.StatusBadRequest)
+			return
+		}
+		filter.denied = denied
+	}
+	var limit int
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	for _, entry := range h.store.list(filter, limit) {
+		if err := encoder.Encode(entry); err != nil {
+			return
+		}
+	}
+}
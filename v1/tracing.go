@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/api/admission/v1"
+)
+
+const tracerName = "github.com/cnych/admission-webhook"
+
+// tracer creates the spans for admission requests. It delegates to the global
+// TracerProvider, so it stays a no-op until initTracer installs an exporter.
+var tracer = otel.Tracer(tracerName)
+
+// initTracer exports spans to the OTLP/gRPC collector listening on endpoint and
+// honours the W3C trace context sent by the apiserver. The returned func flushes
+// pending spans and must be called on shutdown.
+func initTracer(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "admission-webhook"),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	// the policy service, registry, Harbor and notification clients use the
+	// default transport
+	http.DefaultTransport = traceTransport(http.DefaultTransport)
+	return provider.Shutdown, nil
+}
+
+// tracingTransport traces the outbound requests made while answering an
+// admission request, in a client span child of the span of the request, and
+// propagates the trace context to the server. The requests without a span
+// in their context, like the watches of the informers, aren't traced.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// traceTransport wraps base in a tracingTransport, it suits rest.Config.Wrap.
+func traceTransport(base http.RoundTripper) http.RoundTripper {
+	return &tracingTransport{base: base}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		return t.base.RoundTrip(req)
+	}
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.host", req.URL.Host),
+			attribute.String("http.target", req.URL.Path),
+		))
+	defer span.End()
+
+	// a RoundTripper must not modify the request it is given
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+// admissionAttributes describes the admission request on a span, the UID being
+// the key to correlate with the apiserver's own trace and audit log.
+func admissionAttributes(req *v1.AdmissionRequest) []attribute.KeyValue {
+	if req == nil {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attribute.String("admission.uid", string(req.UID)),
+		attribute.String("admission.kind", req.Kind.Kind),
+		attribute.String("admission.namespace", req.Namespace),
+		attribute.String("admission.name", admission.ObjectName(req)),
+		attribute.String("admission.operation", string(req.Operation)),
+	}
+}
+
+// traceAdmission runs handler inside a child span of ctx named after the
+// admission stage (mutate/validate), passing it the context of the span, and
+// records the verdict on it.
+func traceAdmission(ctx context.Context, name string, req *v1.AdmissionRequest, handler func(ctx context.Context) *v1.AdmissionResponse) *v1.AdmissionResponse {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(admissionAttributes(req)...))
+	defer span.End()
+
+	resp := handler(ctx)
+	if resp != nil {
+		span.SetAttributes(attribute.Bool("admission.allowed", resp.Allowed))
+		if !resp.Allowed && resp.Result != nil && resp.Result.Message != "" {
+			span.SetStatus(codes.Error, resp.Result.Message)
+		}
+	}
+	return resp
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingTransport(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: traceTransport(http.DefaultTransport)}
+
+	get := func(ctx context.Context) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v2/library/nginx/manifests/1.21", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// the watches of the informers have no span
+	get(context.Background())
+	if traceparent != "" || len(recorder.Ended()) != 0 {
+		t.Errorf("request without span traced: traceparent %q, %d spans", traceparent, len(recorder.Ended()))
+	}
+
+	ctx, span := tracer.Start(context.Background(), "mutate")
+	get(ctx)
+	span.End()
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "HTTP GET" {
+		t.Fatalf("got %d spans, want the HTTP GET span and the mutate one", len(spans))
+	}
+	clientSpan := spans[0]
+	if clientSpan.Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("HTTP GET span isn't a child of the mutate span")
+	}
+	want := "00-" + clientSpan.SpanContext().TraceID().String() + "-" + clientSpan.SpanContext().SpanID().String() + "-01"
+	if traceparent != want {
+		t.Errorf("traceparent is %q, want %q", traceparent, want)
+	}
+}
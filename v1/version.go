@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/cnych/admission-webhook/pkg/policy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// set at build time, e.g.
+//
+//	go build -ldflags "-X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+// versionInfo tells which build serves with which policy.
+type versionInfo struct {
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	// Rules are the sections of the current policy config which are set,
+	// sorted
+	Rules []string `json:"rules"`
+	// PolicyHash identifies the current policy config, changing on every
+	// reload or activation which changes it
+	PolicyHash string `json:"policyHash"`
+}
+
+func currentVersion() versionInfo {
+	info := versionInfo{
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Rules:     []string{},
+	}
+	data, err := json.Marshal(policy.CurrentConfig())
+	if err != nil {
+		return info
+	}
+	sum := sha256.Sum256(data)
+	info.PolicyHash = hex.EncodeToString(sum[:6])
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return info
+	}
+	// the sections choosing the policy, already merged, aren't rules
+	delete(sections, "activations")
+	delete(sections, "clusters")
+	for name, value := range sections {
+		// sections without any field set marshal empty
+		switch string(value) {
+		case "{}", "[]", "null", `""`, "false", "0":
+			continue
+		}
+		info.Rules = append(info.Rules, name)
+	}
+	sort.Strings(info.Rules)
+	return info
+}
+
+// versionHandler serves the versionInfo as JSON.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentVersion())
+}
+
+// buildInfoCollector exposes the versionInfo as the labels of
+// webhook_build_info, read on every scrape so they follow the policy.
+type buildInfoCollector struct {
+	desc *prometheus.Desc
+}
+
+func newBuildInfoCollector() *buildInfoCollector {
+	return &buildInfoCollector{desc: prometheus.NewDesc(
+		"webhook_build_info",
+		"Always 1, labeled with the git commit, build date and Go version of the binary and the rules and hash of the current policy config.",
+		[]string{"git_commit", "build_date", "go_version", "rules", "policy_hash"}, nil,
+	)}
+}
+
+func (c *buildInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *buildInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	info := currentVersion()
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1,
+		info.GitCommit, info.BuildDate, info.GoVersion, strings.Join(info.Rules, ","), info.PolicyHash)
+}
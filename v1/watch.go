@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// watchFiles calls reload whenever one of files changes, until ctx is done.
+// Secret and ConfigMap volumes are updated by atomically swapping the ..data
+// symlink, which never touches the files themselves, so the parent
+// directories are watched rather than the files. what names the files in
+// logs.
+func watchFiles(ctx context.Context, what string, files []string, reload func() error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs := map[string]bool{}
+	for _, file := range files {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			// the files may still be in flux, the next event retries
+			if err := reload(); err != nil {
+				glog.Warningf("Failed to reload %s after %s: %v", what, event, err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			glog.Errorf("Watcher error on %s: %v", what, err)
+		}
+	}
+}
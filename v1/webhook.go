@@ -1,461 +1,441 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/cnych/admission-webhook/pkg/admission"
+	"github.com/cnych/admission-webhook/pkg/messages"
+	"github.com/cnych/admission-webhook/pkg/notify"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/api/admission/v1"
-	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
-	appsv1 "k8s.io/api/apps/v1"
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
-	"k8s.io/apimachinery/pkg/api/resource"
-)
-
-var (
-	runtimeScheme = runtime.NewScheme()
-	codecs        = serializer.NewCodecFactory(runtimeScheme)
-	deserializer  = codecs.UniversalDeserializer()
-
-	// (https://github.com/kubernetes/kubernetes/issues/57982)
-	defaulter = runtime.ObjectDefaulter(runtimeScheme)
-)
-
-var (
-	ignoredNamespaces = []string{
-		metav1.NamespaceSystem,
-		metav1.NamespacePublic,
-	}
-	requiredLabels = []string{
-		nameLabel,
-		instanceLabel,
-		versionLabel,
-		componentLabel,
-		partOfLabel,
-		managedByLabel,
-	}
-	addLabels = map[string]string{
-		nameLabel:      NA,
-		instanceLabel:  NA,
-		versionLabel:   NA,
-		componentLabel: NA,
-		partOfLabel:    NA,
-		managedByLabel: NA,
-	}
-)
-
-const (
-	admissionWebhookAnnotationValidateKey = "admission-webhook-example.qikqiak.com/validate"
-	admissionWebhookAnnotationMutateKey   = "admission-webhook-example.qikqiak.com/mutate"
-	admissionWebhookAnnotationStatusKey   = "admission-webhook-example.qikqiak.com/status"
-
-	nameLabel      = "app.kubernetes.io/name"
-	instanceLabel  = "app.kubernetes.io/instance"
-	versionLabel   = "app.kubernetes.io/version"
-	componentLabel = "app.kubernetes.io/component"
-	partOfLabel    = "app.kubernetes.io/part-of"
-	managedByLabel = "app.kubernetes.io/managed-by"
-
-	NA = "not_available"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
 )
 
 type WebhookServer struct {
-	server *http.Server
+	server          *http.Server
+	maxRequestBytes int64             // reject AdmissionReview bodies larger than this
+	notifier        *notify.Notifier  // reports denials, nil when disabled
+	decisions       *decisionCache    // caches the responses, nil when disabled
+	deadlineMargin  time.Duration     // time kept from the timeout of the apiserver to answer
+	onDeadline      string            // answer when the rules don't finish in time: allow or deny
+	namespaceLimits *namespaceLimiter // rate limits the requests of every namespace, nil when disabled
+	snapshots       *snapshotStore    // keeps the last requests and responses of every kind, nil when disabled
+	patchWarnBytes  int               // warn about the patches of at least this size, 0 disables the warning
 }
 
 // Webhook Server parameters
 type WhSvrParameters struct {
-	port           int    // webhook server port
-	certFile       string // path to the x509 certificate for https
-	keyFile        string // path to the x509 private key matching `CertFile`
-	sidecarCfgFile string // path to sidecar injector configuration file
-}
-
-type patchOperation struct {
-	Op    string      `json:"op"`
-	Path  string      `json:"path"`
-	Value interface{} `json:"value,omitempty"`
-}
-
-func init() {
-	_ = corev1.AddToScheme(runtimeScheme)
-	_ = admissionregistrationv1.AddToScheme(runtimeScheme)
-	// defaulting with webhooks:
-	// https://github.com/kubernetes/kubernetes/issues/57982
-	_ = v1.AddToScheme(runtimeScheme)
+	port                        int           // webhook server port
+	listenUnix                  string        // unix socket to serve on instead of port
+	certFile                    string        // path to the x509 certificate for https
+	keyFile                     string        // path to the x509 private key matching `CertFile`
+	insecureHTTP                bool          // serve plain HTTP behind a TLS terminating mesh
+	certExpiryWindow            time.Duration // fail readiness when the serving certificate expires within this window
+	clientCAFile                string        // path to the CA bundle verifying apiserver client certificates
+	certBootstrap               bool          // generate the serving certificate into a Secret and patch the caBundle
+	kubeconfig                  string        // path to a kubeconfig, in-cluster config when empty
+	serviceName                 string        // name of the webhook Service
+	serviceNamespace            string        // namespace of the webhook Service and certificate Secret
+	certSecretName              string        // Secret storing the bootstrapped certificate
+	certValidity                time.Duration // validity of bootstrapped certificates
+	mutatingWebhookConfigName   string        // MutatingWebhookConfiguration to patch the caBundle of
+	validatingWebhookConfigName string        // ValidatingWebhookConfiguration to patch the caBundle of
+	register                    bool          // create or update the webhook configurations at startup
+	failurePolicy               string        // failurePolicy of the registered webhooks
+	webhookTimeoutSeconds       int           // timeoutSeconds of the registered webhooks
+	namespaceSelector           string        // label selector of the namespaces the registered webhooks apply to
+	caBundleFile                string        // CA registered as caBundle when not bootstrapping certificates
+	tlsMinVersion               string        // minimum TLS version of the listener
+	tlsCipherSuites             string        // comma separated TLS 1.2 cipher suites
+	tlsCurvePreferences         string        // comma separated elliptic curves
+	maxRequestBytes             int64         // max size of an AdmissionReview request body
+	readTimeout                 time.Duration // max duration for reading the entire request
+	readHeaderTimeout           time.Duration // max duration for reading request headers
+	writeTimeout                time.Duration // max duration before timing out writes of the response
+	idleTimeout                 time.Duration // max time to wait for the next request on a keep-alive connection
+	maxHeaderBytes              int           // max size of request headers
+	maxInflight                 int           // max number of admission requests processed concurrently
+	inflightQueueTimeout        time.Duration // how long a request waits for a free slot
+	chaos                       bool          // inject the latency and failures of the chaos parameters, staging only
+	chaosLatency                time.Duration // delay added to every admission request in chaos mode
+	chaosLatencyJitter          time.Duration // max random delay added to chaosLatency
+	chaosFailureRate            float64       // fraction of the admission requests failed in chaos mode
+	chaosFailure                string        // how the requests fail in chaos mode: error or timeout
+	sidecarCfgFile              string        // path to sidecar injector configuration file
+	otlpEndpoint                string        // OTLP/gRPC collector address, tracing is disabled when empty
+	otlpInsecure                bool          // connect to the collector without TLS
+	metricsPort                 int           // plaintext port of /metrics, /healthz, /readyz and pprof, 0 serves them on the webhook port
+	enablePprof                 bool          // serve net/http/pprof next to the metrics
+	selfTest                    bool          // run a sample AdmissionReview through the handlers at startup
+	adminTokenFile              string        // bearer token guarding the runtime log level endpoint
+	checkTokenFile              string        // bearer token guarding the manifest check endpoint
+	adminTokenReview            bool          // accept the tokens the apiserver authenticates on the log level endpoint
+	adminSubjects               string        // users and groups allowed on the log level endpoint with a reviewed token
+	adminAccessResource         string        // resource the users of the log level endpoint need access to through a SubjectAccessReview
+	adminAccessNamespace        string        // namespace of the resource of the admin access review
+	checkTokenReview            bool          // accept the tokens the apiserver authenticates on the manifest check endpoint
+	checkSubjects               string        // users and groups allowed on the manifest check endpoint with a reviewed token
+	tokenReviewAudiences        string        // audiences the reviewed tokens must be issued for
+	tokenReviewCacheTTL         time.Duration // how long the outcome of a TokenReview is cached
+	snapshots                   int           // admission requests and responses kept per kind for /debug/snapshots, 0 disables them
+	snapshotDir                 string        // directory the snapshots are written to and read back from on startup
+	logLanguage                 string        // language of the request logs, responses are always English
+	logTimezone                 string        // time zone of the timestamps of the request logs
+	ignoredNamespaces           string        // comma separated namespace patterns skipped in addition to kube-system and kube-public
+	policyConfigFile            string        // policy config file, reloaded on change
+	clusterName                 string        // name of the cluster selecting the clusters sections of the policy config
+	annotationDomain            string        // domain of the keys of the annotations, labels and finalizer of the webhook
+	readLegacyAnnotations       bool          // read the keys under the legacy domain where the objects don't have the new ones
+	exemptSelector              string        // label selector of the objects admitted without running any rule
+	skipMutationOwners          string        // comma separated owner kinds whose objects aren't mutated
+	skipMutationManagers        string        // comma separated field managers whose objects aren't mutated
+	immutableFields             string        // comma separated field paths updates can't change
+	ruleWorkers                 int           // validation rules and image lookups of a request run at once
+	selfSelector                string        // label selector of the objects of the webhook itself, admitted unchanged
+	selfNamespace               bool          // admit every object of the namespace of the webhook unchanged
+	mutateNamespaces            bool          // register the mutation of new namespaces
+	restrictedServiceTypes      string        // comma separated Service types only allowed in serviceTypeNamespaces
+	serviceTypeNamespaces       string        // comma separated namespace patterns allowed the restricted Service types
+	watchPDBs                   bool          // cache PodDisruptionBudgets for the podDisruptionBudgets policy
+	watchNetworkPolicies        bool          // cache NetworkPolicies for the networkPolicies policy
+	configChecksums             bool          // read the ConfigMaps and Secrets pods reference for the configChecksum policy
+	managedFinalizer            bool          // add a finalizer to the managed Deployments and record their deletion
+	watchNamespaces             bool          // cache namespaces for the rules depending on their labels
+	namespaceFailOpen           bool          // admit without the namespace rules while the namespace cache is cold
+	watchDeployments            bool          // cache Deployments for checking the replicas of their scale subresource and the selectors of Services
+	watchServices               bool          // cache Services for the preStop hook of the termination policy and the ports of Services
+	watchReferences             bool          // cache the metadata of the ConfigMaps, Secrets and PersistentVolumeClaims pods reference
+	watchPolicyOverrides        bool          // watch the WebhookPolicyOverrides changing the policy of their namespace
+	watchHPAs                   bool          // cache HorizontalPodAutoscalers, whose targets own their replicas
+	watchNodes                  bool          // cache nodes for checking the requests of pods against their allocatable
+	pinImageDigests             bool          // pin images to the digest of their tag
+	registryTimeout             time.Duration // timeout of registry requests resolving digests
+	digestCacheTTL              time.Duration // how long resolved digests are cached
+	signatureCacheTTL           time.Duration // how long verified image signatures are cached
+	harborURL                   string        // Harbor whose vulnerability scans images are checked against
+	harborCredentialsFile       string        // file with the username:password of a Harbor robot account
+	scanCacheTTL                time.Duration // how long vulnerability scans are cached
+	calloutURL                  string        // external policy service deciding on the kinds of the callout policy
+	calloutTimeout              time.Duration // timeout of each request to the policy service
+	calloutRetries              int           // how often failed requests to the policy service are retried
+	notifyURL                   string        // Slack or generic webhook denials are reported to
+	notifyFormat                string        // payload of the notifications: slack or webhook
+	notifyTemplateFile          string        // text/template of the notification message
+	notifyPerMinute             int           // max number of notifications sent per minute
+	notifyBurst                 int           // max number of notifications sent at once
+	decisionCacheSize           int           // max number of cached responses, 0 disables the cache
+	decisionCacheTTL            time.Duration // how long cached responses are used
+	deadlineMargin              time.Duration // time kept from the timeout of the apiserver to answer
+	deadlineResponse            string        // answer when the rules don't finish in time: allow or deny
+	onInternalError             string        // answer when the webhook fails to process a request: allow or deny
+	shutdownGracePeriod         time.Duration // how long running requests may take on shutdown before they are cancelled
+	namespaceQPS                float64       // CREATE and UPDATE requests admitted per second and namespace, 0 disables the limit
+	namespaceBurst              int           // CREATE and UPDATE requests of a namespace admitted at once
+	disableHTTP2                bool          // serve HTTP/1.1 only
+	http2MaxStreams             uint          // max concurrent streams of an HTTP/2 connection, 0 keeps the Go default
+	disableKeepAlives           bool          // close the connections after every response
+	tcpKeepAlivePeriod          time.Duration // period of the TCP keep-alive probes, 0 keeps the Go default, negative disables them
+	gzipResponses               bool          // compress the large responses for the callers accepting gzip
+	patchWarningBytes           int           // warn about the patches of at least this size, 0 disables the warning
 }
 
-func admissionRequired(ignoredList []string, admissionAnnotationKey string, metadata *metav1.ObjectMeta) bool {
-	// skip special kubernetes system namespaces
-	for _, namespace := range ignoredList {
-		if metadata.Namespace == namespace {
-			glog.Infof("Skip validation for %v for it's in special namespace:%v", metadata.Name, metadata.Namespace)
-			return false
-		}
-	}
-
-	annotations := metadata.GetAnnotations()
-	if annotations == nil {
-		annotations = map[string]string{}
-	}
-
-	var required bool
-	switch strings.ToLower(annotations[admissionAnnotationKey]) {
-	default:
-		required = true
-	case "n", "no", "false", "off":
-		required = false
-	}
-	return required
-}
-
-func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
-	required := admissionRequired(ignoredList, admissionWebhookAnnotationMutateKey, metadata)
-	annotations := metadata.GetAnnotations()
-	if annotations == nil {
-		annotations = map[string]string{}
+// mutate runs the mutation and dumps the resulting patch when enabled.
+func (whsvr *WebhookServer) mutate(ctx context.Context, ar *v1.AdmissionReview, log *requestLogger) *v1.AdmissionResponse {
+	response := whsvr.decisions.do(ctx, "mutate", ar.Request, func() *v1.AdmissionResponse {
+		return admission.Mutate(ctx, ar.Request, log)
+	})
+	if response.Allowed && logFinalPatch.Enabled() {
+		log.Infof(messages.ResponsePatch, string(response.Patch))
 	}
-	status := annotations[admissionWebhookAnnotationStatusKey]
-
-	if strings.ToLower(status) == "mutated" {
-		required = false
+	if whsvr.patchWarnBytes > 0 && len(response.Patch) >= whsvr.patchWarnBytes {
+		largePatches.Inc()
+		log.Warningf(messages.PatchLarge, ar.Request.Kind.Kind, ar.Request.Namespace, admission.ObjectName(ar.Request), len(response.Patch), whsvr.patchWarnBytes)
 	}
-
-	glog.Infof("Mutation policy for %v/%v: required:%v", metadata.Namespace, metadata.Name, required)
-	return required
+	whsvr.notifyDenial(ctx, ar.Request, response)
+	return response
 }
 
-func validationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
-	required := admissionRequired(ignoredList, admissionWebhookAnnotationValidateKey, metadata)
-	glog.Infof("Validation policy for %v/%v: required:%v", metadata.Namespace, metadata.Name, required)
-	return required
-}
-
-func updateAnnotation(target map[string]string, added map[string]string) (patch []patchOperation) {
-	for key, value := range added {
-		if target == nil || target[key] == "" {
-			target = map[string]string{}
-			patch = append(patch, patchOperation{
-				Op:   "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{
-					key: value,
-				},
-			})
-		} else {
-			patch = append(patch, patchOperation{
-				Op:    "replace",
-				Path:  "/metadata/annotations/" + key,
-				Value: value,
-			})
-		}
-	}
-	return patch
-}
-
-func updateLabels(target map[string]string, added map[string]string) (patch []patchOperation) {
-	values := make(map[string]string)
-	for key, value := range added {
-		if target == nil || target[key] == "" {
-			values[key] = value
-		}
-	}
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/labels",
-		Value: values,
+// validate deployments and services
+func (whsvr *WebhookServer) validate(ctx context.Context, ar *v1.AdmissionReview, log *requestLogger) *v1.AdmissionResponse {
+	response := whsvr.decisions.do(ctx, "validate", ar.Request, func() *v1.AdmissionResponse {
+		return admission.Validate(ctx, ar.Request, log)
 	})
-	return patch
+	whsvr.notifyDenial(ctx, ar.Request, response)
+	return response
 }
 
-// applyResourceReduction applies a 90% reduction to the resource requests of all containers.
-func applyResourceReduction(containers []corev1.Container, resourceType string) (patch []patchOperation) {
-	var patchPath string;
-	if (resourceType == "Pod"){
-		patchPath = "/spec/containers/%d/resources/requests/%s";
-	}else{
-		patchPath = "/spec/template/spec/containers/%d/resources/requests/%s";
+// notifyDenial reports req to the notification sink when response denies it,
+// unless ctx is done: the apiserver got another answer then.
+func (whsvr *WebhookServer) notifyDenial(ctx context.Context, req *v1.AdmissionRequest, response *v1.AdmissionResponse) {
+	if whsvr.notifier == nil || response == nil || response.Allowed || ctx.Err() != nil {
+		return
 	}
-	for i, container := range containers {
-		for resourceName, quantity := range container.Resources.Requests {
-			// Calculate 90% of the original value
-			originalValue := quantity.DeepCopy()
-			ninetyPercentValue := originalValue.MilliValue() * 90 / 100
-			// Create a new Quantity with 90% of the original value
-			ninetyPercentQuantity := resource.NewMilliQuantity(ninetyPercentValue, originalValue.Format)
-			// Create a patch operation
-			patch = append(patch, patchOperation{
-				Op:    "replace",
-				Path:  fmt.Sprintf(patchPath, i, strings.ToLower(string(resourceName))),
-				Value: ninetyPercentQuantity.String(),
-			})
-		}
+	d := notify.Denial{
+		Namespace: req.Namespace,
+		Kind:      req.Kind.Kind,
+		Name:      admission.ObjectName(req),
+		Operation: string(req.Operation),
+		User:      req.UserInfo.Username,
 	}
-	return patch
-}
-
-func createPatch(availableAnnotations map[string]string, annotations map[string]string, containers []corev1.Container, resourceType string) ([]byte, error) {
-	var patch []patchOperation
-
-	patch = append(patch, updateAnnotation(availableAnnotations, annotations)...)
-	
-	//skip lables
-	//patch = append(patch, updateLabels(availableLabels, labels)...)
-
-	patch = append(patch, applyResourceReduction(containers,resourceType)...);
-
-	return json.Marshal(patch)
-}
-
-
-// validate deployments and services
-func (whsvr *WebhookServer) validate(ar *v1.AdmissionReview, log *bytes.Buffer) *v1.AdmissionResponse {
-	req := ar.Request
-	var (
-		availableLabels                 map[string]string
-		objectMeta                      *metav1.ObjectMeta
-		resourceNamespace, resourceName string
-	)
-
-	log.WriteString(fmt.Sprintf("\n======begin Admission for Namespace=[%v], Kind=[%v], Name=[%v]======", req.Namespace, req.Kind.Kind, req.Name))
-
-	switch req.Kind.Kind {
-	case "Deployment":
-		var deployment appsv1.Deployment
-		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
-			log.WriteString(fmt.Sprintf("\nCould not unmarshal raw object: %v", err))
-			glog.Errorf(log.String())
-			return &v1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		resourceName, resourceNamespace, objectMeta = deployment.Name, deployment.Namespace, &deployment.ObjectMeta
-		availableLabels = deployment.Labels
-	case "Service":
-		var service corev1.Service
-		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
-			log.WriteString(fmt.Sprintf("\nCould not unmarshal raw object: %v", err))
-			glog.Errorf(log.String())
-			return &v1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		resourceName, resourceNamespace, objectMeta = service.Name, service.Namespace, &service.ObjectMeta
-		availableLabels = service.Labels
-	//其他不支持的类型
-	default:
-		msg := fmt.Sprintf("\nNot support for this Kind of resource  %v", req.Kind.Kind)
-		log.WriteString(msg)
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: msg,
-			},
-		}
+	if response.Result != nil {
+		d.Reason = response.Result.Message
 	}
-
-	if !validationRequired(ignoredNamespaces, objectMeta) {
-		log.WriteString(fmt.Sprintf("Skipping validation for %s/%s due to policy check", resourceNamespace, resourceName))
-		return &v1.AdmissionResponse{
-			Allowed: true,
-		}
+	if !whsvr.notifier.Notify(d) {
+		notificationsDropped.Inc()
 	}
+}
 
-	allowed := true
-	var result *metav1.Status
-	log.WriteString(fmt.Sprintf("available labels: %s ", availableLabels))
-	log.WriteString(fmt.Sprintf("required labels: %s", requiredLabels))
-	for _, rl := range requiredLabels {
-		if _, ok := availableLabels[rl]; !ok {
-			allowed = false
-			result = &metav1.Status{
-				Reason: "required labels are not set",
-			}
-			break
-		}
-	}
+// admissionHandler processes a decoded AdmissionReview, ctx is done when the
+// apiserver stops waiting for the answer or the server shuts down.
+type admissionHandler func(ctx context.Context, ar *v1.AdmissionReview, log *requestLogger) *v1.AdmissionResponse
 
-	return &v1.AdmissionResponse{
-		Allowed: allowed,
-		Result:  result,
-	}
+// handler returns the endpoint serving AdmissionReviews with admit, name is
+// used in logs and traces.
+func (whsvr *WebhookServer) handler(name string, admit admissionHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whsvr.serve(w, r, name, admit)
+	})
 }
 
-// main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1.AdmissionReview, log *bytes.Buffer) *v1.AdmissionResponse {
-	req := ar.Request
-	var (
-		//availableLabels, 
-		availableAnnotations map[string]string
-		//objectMeta                            *metav1.ObjectMeta
-		//resourceNamespace, resourceName       string
-		containers			      []corev1.Container
-	)
+// Serve method for webhook server
+func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request, name string, admit admissionHandler) {
+	//记录日志，请求解析出来之前没有UID
+	log := newRequestLogger(nil)
 
-	log.WriteString(fmt.Sprintf("\n======begin Admission for Namespace=[%v], Kind=[%v], Name=[%v]======", req.Namespace, req.Kind.Kind, req.Name))
-	log.WriteString("\n>>>>>>" + req.Kind.Kind)
+	start := time.Now()
 
-	switch req.Kind.Kind {
-	case "Deployment":
-		var deployment appsv1.Deployment
-		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
-			log.WriteString(fmt.Sprintf("\nCould not unmarshal raw object: %v", err))
-			glog.Errorf(log.String())
-			return &v1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		//resourceName, resourceNamespace, objectMeta = deployment.Name, deployment.Namespace, &deployment.ObjectMeta
-		containers = deployment.Spec.Template.Spec.Containers
-		//availableLabels = deployment.Labels
-	case "Pod":
-		var pod corev1.Pod
-		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-			log.WriteString(fmt.Sprintf("\nCould not unmarshal raw object: %v", err))
-			glog.Errorf(log.String())
-			return &v1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		containers = pod.Spec.Containers
-		//resourceName, resourceNamespace, objectMeta = service.Name, service.Namespace, &service.ObjectMeta
-		//availableLabels = service.Labels
-	//其他不支持的类型
-	default:
-		msg := fmt.Sprintf("\nNot support for this Kind of resource  %v", req.Kind.Kind)
-		log.WriteString(msg)
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: msg,
-			},
-		}
+	//ApiServer只会POST AdmissionReview，其他方法返回405
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf(messages.MethodNotAllowed, r.Method), http.StatusMethodNotAllowed)
+		return
 	}
 
-	// skip check.
-	// if !mutationRequired(ignoredNamespaces, objectMeta) {
-	// 	log.WriteString(fmt.Sprintf("Skipping validation for %s/%s due to policy check", resourceNamespace, resourceName))
-	// 	return &v1.AdmissionResponse{
-	// 		Allowed: true,
-	// 	}
-	// }
+	// continue the apiserver's trace if it sent one
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "serve",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.target", r.URL.Path)))
+	defer span.End()
 
-	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "mutated"}
-	patchBytes, err := createPatch(availableAnnotations, annotations, containers, req.Kind.Kind)
+	//ApiServer在timeout参数中带上它等待的时间，超时前先给出应答，避免按failurePolicy处理
+	ctx, cancel, err := requestContext(ctx, r, whsvr.deadlineMargin)
+	defer cancel()
 	if err != nil {
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		log.Warningf("%v", err)
 	}
+	ctx = context.WithValue(ctx, handlerKey{}, name)
 
-	log.WriteString(fmt.Sprintf("AdmissionResponse: patch=%v\n", string(patchBytes)))
-	return &v1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
-		PatchType: func() *v1.PatchType {
-			pt := v1.PatchTypeJSONPatch
-			return &pt
-		}(),
-	}
-}
-
-// Serve method for webhook server
-func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
-	//记录日志
-	var log bytes.Buffer
-
-	//读取从ApiServer过来的数据放到body
+	//读取从ApiServer过来的数据放到body，超过maxRequestBytes的直接拒绝，防止撑爆内存
 	var body []byte
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+		buf, err := readBody(http.MaxBytesReader(w, r.Body, whsvr.maxRequestBytes))
+		if err != nil {
+			status := http.StatusBadRequest
+			if isBodyTooLarge(err) {
+				//返回状态码413
+				status = http.StatusRequestEntityTooLarge
+			}
+			log.Errorf(messages.ReadBodyFailed, err)
+			http.Error(w, fmt.Sprintf(messages.ReadBodyFailed, err), status)
+			return
 		}
+		// the decoded AdmissionReview copies what it keeps of the body
+		defer putBuffer(buf)
+		body = buf.Bytes()
 	}
 	if len(body) == 0 {
-		log.WriteString("empty body")
-		glog.Info(log.String())
+		log.Infof(messages.EmptyBody)
 		//返回状态码400
 		//如果在Apiserver调用此Webhook返回是400，说明APIServer自己传过来的数据是空
-		http.Error(w, log.String(), http.StatusBadRequest)
+		http.Error(w, messages.EmptyBody, http.StatusBadRequest)
 		return
 	}
 
-	// verify the content type is accurate
+	// verify the content type is accurate, YAML from proxies and test tools is
+	// converted to JSON before decoding
 	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		log.WriteString(fmt.Sprintf("Content-Type=%s, expect `application/json`", contentType))
-		glog.Errorf(log.String())
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json", runtime.ContentTypeProtobuf:
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		converted, err := yaml.YAMLToJSON(body)
+		if err != nil {
+			log.Errorf(messages.ConvertYAMLFailed, err)
+			http.Error(w, fmt.Sprintf(messages.ConvertYAMLFailed, err), http.StatusBadRequest)
+			return
+		}
+		body = converted
+	default:
+		msg := fmt.Sprintf(messages.UnsupportedContentType, contentType, runtime.ContentTypeProtobuf)
+		log.Errorf(messages.UnsupportedContentType, contentType, runtime.ContentTypeProtobuf)
 		//如果在Apiserver调用此Webhook返回是415，说明APIServer自己传过来的数据不是json格式，处理不了
-		http.Error(w, log.String(), http.StatusUnsupportedMediaType)
+		http.Error(w, msg, http.StatusUnsupportedMediaType)
 		return
 	}
 
 	var admissionResponse *v1.AdmissionResponse
-	ar := v1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+	ar := &v1.AdmissionReview{}
+	if decoded, err := admission.Decode(body); err != nil {
 		//组装错误信息
-		log.WriteString(fmt.Sprintf("\nCan't decode body,error info is :  %s", err.Error()))
-		glog.Errorln(log.String())
+		msg := fmt.Sprintf(messages.DecodeReviewFailed, err)
+		log.Errorf(messages.DecodeReviewFailed, err)
+		span.SetStatus(codes.Error, err.Error())
 		//返回错误信息，形式表现为资源创建会失败，
 		admissionResponse = &v1.AdmissionResponse{
 			Result: &metav1.Status{
-				Message: log.String(),
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusBadRequest,
+				Reason:  metav1.StatusReasonBadRequest,
+				Message: msg,
 			},
 		}
 	} else {
-		fmt.Println(r.URL.Path)
-		if r.URL.Path == "/mutate" {
-			admissionResponse = whsvr.mutate(&ar, &log)
-		} else if r.URL.Path == "/validate" {
-			admissionResponse = whsvr.validate(&ar, &log)
+		ar = decoded
+		log.setRequest(ar.Request)
+		log.Infof(messages.RequestPath, r.URL.Path)
+		span.SetAttributes(admissionAttributes(ar.Request)...)
+		//同一个命名空间请求过多时直接拒绝，不占用其他命名空间的处理能力
+		if limited := whsvr.namespaceLimits.admit(name, ar.Request); limited != nil {
+			log.Warningf("%s", limited.Result.Message)
+			admissionResponse = limited
+		} else {
+			admissionResponse = whsvr.admitWithin(ctx, name, func() *v1.AdmissionResponse {
+				return traceAdmission(ctx, name, ar.Request, func(ctx context.Context) *v1.AdmissionResponse {
+					return admit(ctx, ar, log)
+				})
+			})
 		}
 	}
 
-	//admissionReview := v1.AdmissionReview{}
-	admissionReview := v1.AdmissionReview{        
-		TypeMeta: metav1.TypeMeta{            
-			APIVersion: "admission.k8s.io/v1",            
-			Kind:       "AdmissionReview",        
-		},
-	}
 	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
+		admissionResponses.WithLabelValues(name, strconv.Itoa(int(responseCode(admissionResponse)))).Inc()
 		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
+			observeDuration(ctx, admissionDuration.WithLabelValues(name, ar.Request.Kind.Kind), time.Since(start))
+			whsvr.snapshots.record(name, ar.Request, admissionResponse)
 		}
 	}
 
-	resp, err := json.Marshal(admissionReview)
+	// the answer to a review which doesn't decode carries its uid too, for
+	// the proxies matching answers to requests
+	var uid types.UID
+	if ar.Request != nil {
+		uid = ar.Request.UID
+	} else {
+		uid = reviewUID(body)
+	}
+	writeReview(w, r, log, uid, admissionResponse)
+
+	log.Infof(messages.AdmissionEnd)
+}
+
+// reviewUID returns the uid of the request of body, a JSON AdmissionReview
+// which may not decode as one, empty when it can't be read.
+func reviewUID(body []byte) types.UID {
+	var review struct {
+		Request struct {
+			UID types.UID `json:"uid"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal(body, &review); err != nil {
+		return ""
+	}
+	return review.Request.UID
+}
+
+// writeReview answers the request of uid with response, in protobuf to the
+// callers asking for it: the AdmissionReview always carries its apiVersion,
+// kind and the uid, without which the apiserver rejects the answer, and a
+// nil response denies the request as an internal error. It is encoded
+// before anything is written, so a failure is answered with a 500 alone,
+// and a write failing once the status is sent is only logged.
+func writeReview(w http.ResponseWriter, r *http.Request, log *requestLogger, uid types.UID, response *v1.AdmissionResponse) {
+	if response == nil {
+		response = &v1.AdmissionResponse{
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusInternalServerError,
+				Reason:  metav1.StatusReasonInternalError,
+				Message: messages.NoResponse,
+			},
+		}
+	}
+	response.UID = uid
+	review := v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1.SchemeGroupVersion.String(),
+			Kind:       "AdmissionReview",
+		},
+		Response: response,
+	}
+
+	responseType := "application/json"
+	resp := getBuffer()
+	defer putBuffer(resp)
+	var err error
+	if acceptsProtobuf(r) {
+		responseType = runtime.ContentTypeProtobuf
+		err = admission.EncodeTo(resp, &review, responseType)
+	} else {
+		err = json.NewEncoder(resp).Encode(review)
+	}
 	if err != nil {
-		log.WriteString(fmt.Sprintf("\nCan't encode response: %v", err))
-		http.Error(w, log.String(), http.StatusInternalServerError)
+		log.Errorf(messages.EncodeResponseFailed, err)
+		http.Error(w, fmt.Sprintf(messages.EncodeResponseFailed, err), http.StatusInternalServerError)
+		return
 	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		log.WriteString(fmt.Sprintf("\nCan't write response: %v", err))
-		http.Error(w, log.String(), http.StatusInternalServerError)
+	log.Infof(messages.WritingResponse)
+	// large responses are compressed for the apiservers accepting gzip
+	if err := writeResponse(w, r, responseType, resp.Bytes()); err != nil {
+		// the status is sent already, another answer would only corrupt it
+		log.Errorf(messages.WriteResponseFailed, err)
 	}
+}
 
-	log.WriteString("\n======ended Admission already writed to reponse======")
-	//东八区时间
-	datetime := time.Now().In(time.FixedZone("GMT", 8*3600)).Format("2006-01-02 15:04:05")
-	//最后打印日志
-	glog.Infof(datetime + " " + log.String())
+// responseCode is the Status.Code of response, 200 when it is allowed and
+// 403 when a denial doesn't set it.
+func responseCode(response *v1.AdmissionResponse) int32 {
+	switch {
+	case response.Allowed:
+		return http.StatusOK
+	case response.Result == nil || response.Result.Code == 0:
+		return http.StatusForbidden
+	}
+	return response.Result.Code
+}
+
+// isBodyTooLarge reports whether err comes from http.MaxBytesReader hitting
+// its limit. It has no typed error before go1.19, so match the message.
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
 }
 
+// acceptsProtobuf reports whether the response should be protobuf: the Accept
+// header asks for it, or, without one, the request was protobuf.
+func acceptsProtobuf(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		return mediaType == runtime.ContentTypeProtobuf
+	}
+	for _, part := range strings.Split(accept, ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == runtime.ContentTypeProtobuf {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1"
+)
+
+// countingWriter counts the calls answering a request, and fails the writes
+// with failWrites.
+type countingWriter struct {
+	*httptest.ResponseRecorder
+	writeHeaders, writes int
+	failWrites           bool
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	w.writeHeaders++
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	if w.failWrites {
+		return 0, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+// allowAll admits every request.
+func allowAll(ctx context.Context, ar *v1.AdmissionReview, log *requestLogger) *v1.AdmissionResponse {
+	return &v1.AdmissionResponse{Allowed: true}
+}
+
+// serveReview posts body of contentType to a WebhookServer admitting with
+// admit.
+func serveReview(method, contentType, body string, admit admissionHandler) *countingWriter {
+	whsvr := &WebhookServer{maxRequestBytes: 1024}
+	req := httptest.NewRequest(method, "/validate", strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+	whsvr.serve(w, req, "validate", admit)
+	return w
+}
+
+// decodeAnswer decodes the AdmissionReview answered to w, checking its
+// apiVersion, kind and uid.
+func decodeAnswer(t *testing.T, w *countingWriter, uid string) *v1.AdmissionResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type is %q, want application/json", contentType)
+	}
+	var answer v1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("invalid AdmissionReview: %v", err)
+	}
+	if answer.APIVersion != "admission.k8s.io/v1" || answer.Kind != "AdmissionReview" {
+		t.Errorf("answered a %q %q, want an admission.k8s.io/v1 AdmissionReview", answer.APIVersion, answer.Kind)
+	}
+	if answer.Response == nil {
+		t.Fatal("AdmissionReview has no response")
+	}
+	if string(answer.Response.UID) != uid {
+		t.Errorf("response uid is %q, want %q", answer.Response.UID, uid)
+	}
+	return answer.Response
+}
+
+func TestServeAnswersReview(t *testing.T) {
+	body := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"a1","kind":{"group":"","version":"v1","kind":"ConfigMap"},"resource":{"group":"","version":"v1","resource":"configmaps"},"operation":"CREATE"}}`
+	w := serveReview(http.MethodPost, "application/json", body, allowAll)
+	if response := decodeAnswer(t, w, "a1"); !response.Allowed {
+		t.Errorf("denied: %v", response.Result)
+	}
+}
+
+func TestServeAnswersUndecodableReview(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		uid  string
+	}{
+		{"invalid field", `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"u1","operation":0}}`, "u1"},
+		{"unknown kind", `{"apiVersion":"admission.k8s.io/v1","kind":"Pod","request":{"uid":"u2"}}`, "u2"},
+		{"not JSON", `AdmissionReview`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveReview(http.MethodPost, "application/json", tt.body, allowAll)
+			response := decodeAnswer(t, w, tt.uid)
+			if response.Allowed || response.Result == nil || response.Result.Code != http.StatusBadRequest {
+				t.Errorf("not denied as a bad request: %v", response.Result)
+			}
+		})
+	}
+}
+
+func TestServeAnswersWithoutResponse(t *testing.T) {
+	body := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"n1","operation":"CREATE"}}`
+	w := serveReview(http.MethodPost, "application/json", body, func(ctx context.Context, ar *v1.AdmissionReview, log *requestLogger) *v1.AdmissionResponse {
+		return nil
+	})
+	response := decodeAnswer(t, w, "n1")
+	if response.Allowed || response.Result == nil || response.Result.Code != http.StatusInternalServerError {
+		t.Errorf("not denied as an internal error: %v", response.Result)
+	}
+}
+
+func TestServeRejectsRequest(t *testing.T) {
+	review := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"r1"}}`
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"method", http.MethodGet, "application/json", review, http.StatusMethodNotAllowed},
+		{"too large", http.MethodPost, "application/json", strings.Repeat(" ", 2048) + review, http.StatusRequestEntityTooLarge},
+		{"content type", http.MethodPost, "text/plain", review, http.StatusUnsupportedMediaType},
+		{"empty body", http.MethodPost, "application/json", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveReview(tt.method, tt.contentType, tt.body, allowAll)
+			if w.Code != tt.code {
+				t.Errorf("answered %d, want %d", w.Code, tt.code)
+			}
+			if w.writeHeaders != 1 || w.writes != 1 {
+				t.Errorf("WriteHeader called %d times and Write %d times, want once each", w.writeHeaders, w.writes)
+			}
+			if tt.code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != http.MethodPost {
+				t.Errorf("Allow is %q, want POST", w.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestServeWritesOnce(t *testing.T) {
+	body := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"w1","operation":"CREATE"}}`
+	for _, failWrites := range []bool{false, true} {
+		whsvr := &WebhookServer{maxRequestBytes: 1024}
+		req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := &countingWriter{ResponseRecorder: httptest.NewRecorder(), failWrites: failWrites}
+		whsvr.serve(w, req, "validate", allowAll)
+		// the status is sent with the first write
+		if w.writeHeaders != 0 || w.writes != 1 {
+			t.Errorf("failWrites=%t: WriteHeader called %d times and Write %d times, want Write once", failWrites, w.writeHeaders, w.writes)
+		}
+	}
+}
+
+func TestServeCompressesLargeAnswers(t *testing.T) {
+	body := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"g1","operation":"CREATE"}}`
+	warned := func(ctx context.Context, ar *v1.AdmissionReview, log *requestLogger) *v1.AdmissionResponse {
+		return &v1.AdmissionResponse{Allowed: true, Warnings: []string{strings.Repeat("large ", 512)}}
+	}
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		admit          admissionHandler
+		gzipped        bool
+	}{
+		{"large", "gzip", warned, true},
+		{"large with weights", "br;q=1.0, gzip;q=0.5", warned, true},
+		{"gzip refused", "gzip;q=0", warned, false},
+		{"gzip not accepted", "", warned, false},
+		{"small", "gzip", allowAll, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := &WebhookServer{maxRequestBytes: 1024}
+			req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+			whsvr.serve(w, req, "validate", tt.admit)
+
+			if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != tt.gzipped {
+				t.Fatalf("Content-Encoding is %q, want gzip %t", w.Header().Get("Content-Encoding"), tt.gzipped)
+			}
+			if length := w.Header().Get("Content-Length"); length != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length is %s for %d bytes", length, w.Body.Len())
+			}
+			if tt.gzipped {
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decompressed, err := ioutil.ReadAll(gz)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.Body.Reset()
+				w.Body.Write(decompressed)
+			}
+			if response := decodeAnswer(t, w, "g1"); !response.Allowed {
+				t.Errorf("denied: %v", response.Result)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooledBufferBytes bounds the buffers kept for reuse, the few requests
+// with huge objects shouldn't pin their memory for the small ones.
+const maxPooledBufferBytes = 1024 * 1024
+
+// bufferPool holds the buffers the request bodies are read into and the
+// responses encoded into, so serving doesn't allocate and grow new ones on
+// every request.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer of the pool, give it back with
+// putBuffer once nothing refers to its bytes anymore.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferBytes {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// readBody reads r into a buffer of the pool.
+func readBody(r io.Reader) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
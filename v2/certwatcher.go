@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// certReloader serves the key pair found in certFile/keyFile and reloads it
+// whenever the files change, so certificates rotated by cert-manager (or any
+// update of the mounted Secret) are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) *certReloader {
+	return &certReloader{certFile: certFile, keyFile: keyFile}
+}
+
+// reload reads the key pair from disk, the previous one is kept on failure.
+func (r *certReloader) reload() error {
+	pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	pair.Leaf = leaf
+
+	r.mu.Lock()
+	r.cert = &pair
+	r.mu.Unlock()
+
+	certReloads.Inc()
+	recordServedCert(leaf)
+	glog.Infof("Loaded serving certificate %s, serial %s, expires at %s (in %s)",
+		r.certFile, leaf.SerialNumber, leaf.NotAfter.Format(time.RFC3339), time.Until(leaf.NotAfter).Round(time.Minute))
+	return nil
+}
+
+// GetCertificate is the tls.Config hook returning the current key pair.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, errNoCertificate
+	}
+	return r.cert, nil
+}
+
+// watch reloads the key pair until ctx is done. Secret volumes are updated by
+// atomically swapping the ..data symlink, which never touches the files
+// themselves, so the parent directories are watched rather than the files.
+func (r *certReloader) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs := map[string]bool{
+		filepath.Dir(r.certFile): true,
+		filepath.Dir(r.keyFile):  true,
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			// both files may still be in flux, the next event retries
+			if err := r.reload(); err != nil {
+				glog.Warningf("Failed to reload serving certificate after %s: %v", event, err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			glog.Errorf("Certificate watcher error: %v", err)
+		}
+	}
+}
+
+// loaded is the readiness check of the reloader: a key pair must be loaded.
+func (r *certReloader) loaded() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return errNoCertificate
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinBytes is the size from which responses are worth compressing.
+const gzipMinBytes = 1024
+
+// gzipResponses compresses the AdmissionReview responses for callers
+// accepting gzip, set by -gzipResponses.
+var gzipResponses = true
+
+// gzipWriters holds the gzip writers of the responses, each one allocates
+// several hundred KiB of compression state.
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(ioutil.Discard) },
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || (coding != "gzip" && coding != "*") {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if weight, err := strconv.ParseFloat(q, 64); err != nil || weight == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writeResponse writes resp of contentType, compressed when the caller
+// accepts gzip and it is large enough. It is written uncompressed when the
+// compression fails, the error returned is the one of the write: the
+// response is partly written then.
+func writeResponse(w http.ResponseWriter, r *http.Request, contentType string, resp []byte) error {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if gzipResponses && len(resp) >= gzipMinBytes && acceptsGzip(r) {
+		compressed := getBuffer()
+		defer putBuffer(compressed)
+		if err := compress(compressed, resp); err == nil {
+			w.Header().Set("Content-Encoding", "gzip")
+			resp = compressed.Bytes()
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	_, err := w.Write(resp)
+	return err
+}
+
+// compress writes data gzipped to w.
+func compress(w io.Writer, data []byte) error {
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+	gz.Reset(w)
+	if _, err := gz.Write(data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
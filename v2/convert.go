@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	qosGroup = "stable.example.com"
+	// qosV1beta1 names the spec fields after their unit, the older versions
+	// (v1alpha1, v1) call them cpu and memory
+	qosV1beta1 = qosGroup + "/v1beta1"
+)
+
+// qosVersions are the versions of the QoS CRD.
+var qosVersions = map[string]bool{
+	"v1alpha1": true,
+	"v1":       true,
+	"v1beta1":  true,
+}
+
+// qosRenamedFields maps the spec fields of the older QoS versions to their
+// v1beta1 name.
+var qosRenamedFields = map[string]string{
+	"cpu":    "cpuMillicores",
+	"memory": "memoryMebibytes",
+}
+
+// conversionReview is the apiextensions.k8s.io/v1 ConversionReview the
+// apiserver posts to the CRD conversion webhook.
+type conversionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *conversionRequest  `json:"request,omitempty"`
+	Response        *conversionResponse `json:"response,omitempty"`
+}
+
+type conversionRequest struct {
+	UID               types.UID              `json:"uid"`
+	DesiredAPIVersion string                 `json:"desiredAPIVersion"`
+	Objects           []runtime.RawExtension `json:"objects"`
+}
+
+type conversionResponse struct {
+	UID              types.UID              `json:"uid"`
+	ConvertedObjects []runtime.RawExtension `json:"convertedObjects"`
+	Result           metav1.Status          `json:"result"`
+}
+
+// decodeQoS decodes a QoS of any version.
+func decodeQoS(raw []byte) (*QoS, error) {
+	var meta metav1.TypeMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, err
+	}
+	if meta.APIVersion == qosV1beta1 {
+		converted, err := convertQoS(raw, qosGroup+"/v1")
+		if err != nil {
+			return nil, err
+		}
+		raw = converted
+	}
+	var qos QoS
+	if err := json.Unmarshal(raw, &qos); err != nil {
+		return nil, err
+	}
+	return &qos, nil
+}
+
+// convertQoS converts the QoS raw to desiredAPIVersion, renaming its spec
+// fields between v1beta1 and the older versions. The other fields are kept
+// as they are.
+func convertQoS(raw []byte, desiredAPIVersion string) ([]byte, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	apiVersion, _ := object["apiVersion"].(string)
+	from, err := parseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseGroupVersion(desiredAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+	if from.Group != qosGroup || to.Group != qosGroup || !qosVersions[from.Version] || !qosVersions[to.Version] {
+		return nil, fmt.Errorf("can't convert %s to %s, only the versions v1alpha1, v1 and v1beta1 of %s are supported", apiVersion, desiredAPIVersion, qosGroup)
+	}
+
+	if spec, ok := object["spec"].(map[string]interface{}); ok && (apiVersion == qosV1beta1) != (desiredAPIVersion == qosV1beta1) {
+		for old, renamed := range qosRenamedFields {
+			source, target := old, renamed
+			if apiVersion == qosV1beta1 {
+				source, target = renamed, old
+			}
+			if value, ok := spec[source]; ok {
+				delete(spec, source)
+				spec[target] = value
+			}
+		}
+	}
+	object["apiVersion"] = desiredAPIVersion
+	return json.Marshal(object)
+}
+
+// parseGroupVersion parses apiVersion, which needs a version.
+func parseGroupVersion(apiVersion string) (schema.GroupVersion, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil || gv.Version == "" {
+		return schema.GroupVersion{}, fmt.Errorf("invalid apiVersion %q", apiVersion)
+	}
+	return gv, nil
+}
+
+// convert serves the CRD conversion webhook of the QoS versions.
+func (whsvr *WebhookServer) convert(w http.ResponseWriter, r *http.Request) {
+	log := newRequestLogger(nil)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, whsvr.maxRequestBytes))
+	if err != nil {
+		status := http.StatusBadRequest
+		if isBodyTooLarge(err) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		log.Errorf("Can't read body: %v", err)
+		http.Error(w, fmt.Sprintf("Can't read body: %v", err), status)
+		return
+	}
+	var review conversionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		log.Errorf("Can't decode ConversionReview: %v", err)
+		http.Error(w, "Can't decode ConversionReview", http.StatusBadRequest)
+		return
+	}
+
+	req := review.Request
+	response := &conversionResponse{
+		UID:    req.UID,
+		Result: metav1.Status{Status: metav1.StatusSuccess},
+	}
+	for _, object := range req.Objects {
+		converted, err := convertQoS(object.Raw, req.DesiredAPIVersion)
+		if err != nil {
+			log.Errorf("Conversion %s to %s failed: %v", req.UID, req.DesiredAPIVersion, err)
+			response.ConvertedObjects = nil
+			response.Result = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+			break
+		}
+		response.ConvertedObjects = append(response.ConvertedObjects, runtime.RawExtension{Raw: converted})
+	}
+	if response.Result.Status == metav1.StatusSuccess {
+		log.Infof("Converted %d QoS objects to %s", len(response.ConvertedObjects), req.DesiredAPIVersion)
+	}
+
+	resp, err := json.Marshal(conversionReview{TypeMeta: review.TypeMeta, Response: response})
+	if err != nil {
+		log.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("Can't encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		log.Errorf("Can't write response: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestConvertQoS(t *testing.T) {
+	for _, c := range []struct {
+		name, object, desired string
+		want                  string // empty when the conversion fails
+	}{{
+		name:    "v1 to v1beta1",
+		object:  `{"apiVersion":"stable.example.com/v1","kind":"QoS","metadata":{"name":"gold"},"spec":{"cpu":500,"memory":256}}`,
+		desired: "stable.example.com/v1beta1",
+		want:    `{"apiVersion":"stable.example.com/v1beta1","kind":"QoS","metadata":{"name":"gold"},"spec":{"cpuMillicores":500,"memoryMebibytes":256}}`,
+	}, {
+		name:    "v1beta1 to v1alpha1",
+		object:  `{"apiVersion":"stable.example.com/v1beta1","kind":"QoS","metadata":{"name":"gold"},"spec":{"cpuMillicores":500,"memoryMebibytes":256}}`,
+		desired: "stable.example.com/v1alpha1",
+		want:    `{"apiVersion":"stable.example.com/v1alpha1","kind":"QoS","metadata":{"name":"gold"},"spec":{"cpu":500,"memory":256}}`,
+	}, {
+		name:    "between the older versions",
+		object:  `{"apiVersion":"stable.example.com/v1alpha1","kind":"QoS","metadata":{"name":"gold"},"spec":{"cpu":500}}`,
+		desired: "stable.example.com/v1",
+		want:    `{"apiVersion":"stable.example.com/v1","kind":"QoS","metadata":{"name":"gold"},"spec":{"cpu":500}}`,
+	}, {
+		name:    "other fields kept",
+		object:  `{"apiVersion":"stable.example.com/v1","kind":"QoS","metadata":{"name":"gold","labels":{"tier":"a"}},"spec":{"memory":256,"selector":{"matchLabels":{"app":"web"}}},"status":{"applied":true}}`,
+		desired: "stable.example.com/v1beta1",
+		want:    `{"apiVersion":"stable.example.com/v1beta1","kind":"QoS","metadata":{"name":"gold","labels":{"tier":"a"}},"spec":{"memoryMebibytes":256,"selector":{"matchLabels":{"app":"web"}}},"status":{"applied":true}}`,
+	}, {
+		name:    "unknown version",
+		object:  `{"apiVersion":"stable.example.com/v2","kind":"QoS","spec":{"cpu":500}}`,
+		desired: "stable.example.com/v1beta1",
+	}, {
+		name:    "unknown desired version",
+		object:  `{"apiVersion":"stable.example.com/v1","kind":"QoS","spec":{"cpu":500}}`,
+		desired: "stable.example.com/v2",
+	}, {
+		name:    "other group",
+		object:  `{"apiVersion":"apps/v1","kind":"Deployment"}`,
+		desired: "stable.example.com/v1beta1",
+	}, {
+		name:    "no apiVersion",
+		object:  `{"kind":"QoS","spec":{"cpu":500}}`,
+		desired: "stable.example.com/v1beta1",
+	}, {
+		name:    "malformed",
+		object:  `{"apiVersion":"stable.example.com/v1",`,
+		desired: "stable.example.com/v1beta1",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			converted, err := convertQoS([]byte(c.object), c.desired)
+			if c.want == "" {
+				if err == nil {
+					t.Errorf("converted to %s, want an error", converted)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(converted, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(c.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s, want %s", converted, c.want)
+			}
+		})
+	}
+}
+
+// postConversion posts a ConversionReview of objects to desired and returns
+// the review answered.
+func postConversion(t *testing.T, desired string, objects ...string) *conversionReview {
+	t.Helper()
+	body := `{"apiVersion":"apiextensions.k8s.io/v1","kind":"ConversionReview","request":{"uid":"c1","desiredAPIVersion":"` +
+		desired + `","objects":[` + strings.Join(objects, ",") + `]}}`
+	whsvr := &WebhookServer{maxRequestBytes: 1 << 20}
+	w := httptest.NewRecorder()
+	whsvr.convert(w, httptest.NewRequest(http.MethodPost, "/convert", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", w.Code, w.Body.String())
+	}
+	var review conversionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	if review.APIVersion != "apiextensions.k8s.io/v1" || review.Kind != "ConversionReview" {
+		t.Errorf("answered a %q %q, want the apiextensions.k8s.io/v1 ConversionReview", review.APIVersion, review.Kind)
+	}
+	if review.Response == nil || review.Response.UID != "c1" {
+		t.Fatalf("response %+v, want the one of c1", review.Response)
+	}
+	return &review
+}
+
+func TestConvert(t *testing.T) {
+	v1 := `{"apiVersion":"stable.example.com/v1","kind":"QoS","metadata":{"name":"gold"},"spec":{"cpu":500}}`
+	review := postConversion(t, qosV1beta1, v1, v1)
+	if review.Response.Result.Status != metav1.StatusSuccess || len(review.Response.ConvertedObjects) != 2 {
+		t.Fatalf("result %+v with %d objects, want both converted", review.Response.Result, len(review.Response.ConvertedObjects))
+	}
+	qos, err := decodeQoS(review.Response.ConvertedObjects[0].Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qos.Name != "gold" || qos.Spec.Cpu != 500 {
+		t.Errorf("converted %s, want gold with 500 millicores", review.Response.ConvertedObjects[0].Raw)
+	}
+
+	for name, objects := range map[string][]string{
+		"unknown apiVersion": {v1, `{"apiVersion":"stable.example.com/v2","kind":"QoS"}`},
+		"malformed object":   {v1, `"gold"`},
+	} {
+		review := postConversion(t, qosV1beta1, objects...)
+		if review.Response.Result.Status != metav1.StatusFailure || review.Response.ConvertedObjects != nil {
+			t.Errorf("%s: result %+v with %d objects, want a failure without objects", name, review.Response.Result, len(review.Response.ConvertedObjects))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// legacyAnnotationDomain is the domain of the annotation keys of the webhook
+// unless setAnnotationDomain sets another one, the same as in v1.
+const legacyAnnotationDomain = "admission-webhook-example.qikqiak.com"
+
+var (
+	admissionWebhookAnnotationMutateKey   = legacyAnnotationDomain + "/mutate"
+	admissionWebhookAnnotationValidateKey = legacyAnnotationDomain + "/validate"
+
+	// readLegacyAnnotations tells whether the keys under
+	// legacyAnnotationDomain are read too when the domain is another one
+	readLegacyAnnotations bool
+)
+
+// setAnnotationDomain puts the annotation keys under domain, such as
+// webhook.example.com/mutate. With readLegacy the keys under
+// legacyAnnotationDomain are read where the objects don't have those under
+// domain, while migrating. It is not safe to call while requests are being
+// admitted.
+func setAnnotationDomain(domain string, readLegacy bool) error {
+	if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+		return fmt.Errorf("invalid annotation domain %q: %s", domain, strings.Join(errs, ", "))
+	}
+	admissionWebhookAnnotationMutateKey = domain + "/mutate"
+	admissionWebhookAnnotationValidateKey = domain + "/validate"
+	readLegacyAnnotations = readLegacy && domain != legacyAnnotationDomain
+	return nil
+}
+
+// lookupAnnotation returns the value of key, a key under the annotation
+// domain, in annotations, or the value of its legacy key where the object
+// doesn't have key.
+func lookupAnnotation(annotations map[string]string, key string) string {
+	if value, ok := annotations[key]; ok || !readLegacyAnnotations {
+		return value
+	}
+	return annotations[legacyAnnotationDomain+key[strings.Index(key, "/"):]]
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestAnnotationDomain(t *testing.T) {
+	defer setAnnotationDomain(legacyAnnotationDomain, true)
+	if err := setAnnotationDomain("Webhook_Example", true); err == nil {
+		t.Error("invalid domain accepted")
+	}
+	if err := setAnnotationDomain("webhook.example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if admissionWebhookAnnotationMutateKey != "webhook.example.com/mutate" || admissionWebhookAnnotationValidateKey != "webhook.example.com/validate" {
+		t.Errorf("keys are %s and %s, want them under webhook.example.com", admissionWebhookAnnotationMutateKey, admissionWebhookAnnotationValidateKey)
+	}
+
+	legacy := map[string]string{legacyAnnotationDomain + "/mutate": "true"}
+	both := map[string]string{legacyAnnotationDomain + "/mutate": "true", "webhook.example.com/mutate": "false"}
+	if got := lookupAnnotation(legacy, admissionWebhookAnnotationMutateKey); got != "true" {
+		t.Errorf("legacy key read as %q, want true", got)
+	}
+	if got := lookupAnnotation(both, admissionWebhookAnnotationMutateKey); got != "false" {
+		t.Errorf("key under the domain read as %q, want false", got)
+	}
+
+	if err := setAnnotationDomain("webhook.example.com", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupAnnotation(legacy, admissionWebhookAnnotationMutateKey); got != "" {
+		t.Errorf("legacy key read as %q without -readLegacyAnnotations", got)
+	}
+}
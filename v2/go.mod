@@ -3,9 +3,13 @@ module github.com/cnych/admission-webhook
 go 1.13
 
 require (
+	github.com/evanphx/json-patch v4.2.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/ghodss/yaml v1.0.0
 	github.com/golang/glog v1.0.0
+	github.com/prometheus/client_golang v1.11.0
 	github.com/wI2L/jsondiff v0.1.1
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
 	k8s.io/api v0.16.10
 	k8s.io/apimachinery v0.16.10
 	k8s.io/kubernetes v1.16.10
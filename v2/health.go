@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// healthz reports the process is up, for liveness probes.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler reports whether the webhook can admit requests, i.e. every
+// registered check passes, for readiness probes.
+type readyzHandler struct {
+	mu     sync.RWMutex
+	names  []string
+	checks []func() error
+}
+
+// add registers a readiness check, name shows up in the probe output.
+func (h *readyzHandler) add(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.names = append(h.names, name)
+	h.checks = append(h.checks, check)
+}
+
+func (h *readyzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.RLock()
+	var out strings.Builder
+	ready := true
+	for i, check := range h.checks {
+		if err := check(); err != nil {
+			ready = false
+			fmt.Fprintf(&out, "[-]%s failed: %v\n", h.names[i], err)
+		} else {
+			fmt.Fprintf(&out, "[+]%s ok\n", h.names[i])
+		}
+	}
+	h.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write([]byte(out.String()))
+}
+
+// notAfter of the served certificate as unix seconds, 0 until one is loaded
+var servedNotAfter int64
+
+// recordServedCert tracks the expiry of the certificate being served.
+func recordServedCert(leaf *x509.Certificate) {
+	atomic.StoreInt64(&servedNotAfter, leaf.NotAfter.Unix())
+	certNotAfter.Set(float64(leaf.NotAfter.Unix()))
+}
+
+func servedCertNotAfter() (time.Time, bool) {
+	notAfter := atomic.LoadInt64(&servedNotAfter)
+	if notAfter == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(notAfter, 0), true
+}
+
+// certExpiryCheck is a readiness check failing once the served certificate
+// expires within window, so a stuck rotation shows up before the apiserver
+// runs into TLS errors.
+func certExpiryCheck(window time.Duration) func() error {
+	return func() error {
+		notAfter, ok := servedCertNotAfter()
+		if !ok {
+			return errNoCertificate
+		}
+		if left := time.Until(notAfter); left < window {
+			return fmt.Errorf("serving certificate expires at %s, within %s", notAfter.Format(time.RFC3339), window)
+		}
+		return nil
+	}
+}
+
+// registerOpsHandlers adds the endpoints for Prometheus and the kubelet,
+// and pprof when enabled, to mux.
+func registerOpsHandlers(mux *http.ServeMux, ready *readyzHandler, enablePprof bool) {
+	mux.HandleFunc("/healthz", healthz)
+	mux.Handle("/readyz", ready)
+	mux.Handle("/metrics", promhttp.Handler())
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultInitContainer is injected when no -initContainerFile is given.
+const defaultInitContainer = `name: init
+image: busybox
+command: ["/bin/sh", "-c", " echo 'init' && sleep 100 "]
+`
+
+// initContainerTemplate renders the init container injected into
+// Deployments, the YAML of a corev1.Container executed as a text/template
+// with the templateData of the Deployment.
+type initContainerTemplate struct {
+	tmpl *template.Template
+}
+
+// templateData is what the templates of the init container and of the
+// injections can refer to, e.g. {{.Namespace}}.
+type templateData struct {
+	Namespace string
+	Name      string
+}
+
+var initContainerInst = mustParseInitContainer(defaultInitContainer)
+
+// loadInitContainerTemplate reads the template of the init container from
+// file and checks it renders a container.
+func loadInitContainerTemplate(file string) (*initContainerTemplate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseInitContainer(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if _, err := t.render(templateData{Namespace: "default", Name: "self-test"}); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return t, nil
+}
+
+func parseInitContainer(text string) (*initContainerTemplate, error) {
+	tmpl, err := template.New("initContainer").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &initContainerTemplate{tmpl: tmpl}, nil
+}
+
+func mustParseInitContainer(text string) *initContainerTemplate {
+	t, err := parseInitContainer(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// render returns the init container of the Deployment described by data.
+func (t *initContainerTemplate) render(data templateData) (*corev1.Container, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	var container corev1.Container
+	if err := yaml.Unmarshal(buf.Bytes(), &container); err != nil {
+		return nil, err
+	}
+	if container.Name == "" || container.Image == "" {
+		return nil, fmt.Errorf("init container needs a name and an image")
+	}
+	return &container, nil
+}
+
+// injectInitContainer replaces the init container of spec named like
+// container, or runs container before the existing ones.
+func injectInitContainer(spec *corev1.PodSpec, container *corev1.Container) {
+	for i := range spec.InitContainers {
+		if spec.InitContainers[i].Name == container.Name {
+			spec.InitContainers[i] = *container
+			return
+		}
+	}
+	spec.InitContainers = append([]corev1.Container{*container}, spec.InitContainers...)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// injectionTemplateAnnotation lists the comma separated names of the
+// injections applied to a Deployment, e.g. vault-agent.
+const injectionTemplateAnnotation = "inject.webhook/template"
+
+// injection is a named entry of the library merged into the pod template,
+// entries named like existing ones replace them.
+type injection struct {
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	Containers     []corev1.Container `json:"containers,omitempty"`
+	Volumes        []corev1.Volume    `json:"volumes,omitempty"`
+}
+
+// injectionLibrary renders the injections by name, the YAML of a
+// map[string]injection executed as a text/template with the templateData of
+// the Deployment.
+type injectionLibrary struct {
+	tmpl *template.Template
+}
+
+// injectionLibraryInst is nil without -injectionTemplatesFile.
+var injectionLibraryInst *injectionLibrary
+
+// loadInjectionLibrary reads the library from file and checks it renders.
+func loadInjectionLibrary(file string) (*injectionLibrary, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("injections").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	l := &injectionLibrary{tmpl: tmpl}
+	if _, err := l.render(templateData{Namespace: "default", Name: "self-test"}); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return l, nil
+}
+
+// render returns the injections of the Deployment described by data.
+func (l *injectionLibrary) render(data templateData) (map[string]injection, error) {
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	var injections map[string]injection
+	if err := yaml.Unmarshal(buf.Bytes(), &injections); err != nil {
+		return nil, err
+	}
+	return injections, nil
+}
+
+// selectedInjections returns the names of the injections annotations select.
+func selectedInjections(annotations map[string]string) []string {
+	var names []string
+	for _, name := range strings.Split(annotations[injectionTemplateAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// annotationError is an error of inject caused by the annotation of the
+// Deployment rather than the templates, which the user has to fix.
+type annotationError string
+
+func (e annotationError) Error() string { return string(e) }
+
+// inject applies the injections named names to spec, in order. Unknown names
+// are an error rather than silently skipped.
+func (l *injectionLibrary) inject(spec *corev1.PodSpec, names []string, data templateData) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if l == nil {
+		return annotationError(fmt.Sprintf("no injection templates configured, can't inject %s", strings.Join(names, ",")))
+	}
+	injections, err := l.render(data)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		in, ok := injections[name]
+		if !ok {
+			return annotationError(fmt.Sprintf("unknown injection template %q", name))
+		}
+		for i := range in.InitContainers {
+			injectInitContainer(spec, &in.InitContainers[i])
+		}
+		for _, container := range in.Containers {
+			spec.Containers = mergeContainer(spec.Containers, container)
+		}
+		for _, volume := range in.Volumes {
+			spec.Volumes = mergeVolume(spec.Volumes, volume)
+		}
+	}
+	return nil
+}
+
+// mergeContainer replaces the container of containers named like container,
+// or appends it.
+func mergeContainer(containers []corev1.Container, container corev1.Container) []corev1.Container {
+	for i := range containers {
+		if containers[i].Name == container.Name {
+			containers[i] = container
+			return containers
+		}
+	}
+	return append(containers, container)
+}
+
+// mergeVolume replaces the volume of volumes named like volume, or appends
+// it.
+func mergeVolume(volumes []corev1.Volume, volume corev1.Volume) []corev1.Volume {
+	for i := range volumes {
+		if volumes[i].Name == volume.Name {
+			volumes[i] = volume
+			return volumes
+		}
+	}
+	return append(volumes, volume)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serviceAccountDir holds the token and CA of the service account of the pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient calls the REST API of the apiserver with the service account of
+// the pod, the few calls the webhook makes don't need client-go.
+type kubeClient struct {
+	host      string
+	client    *http.Client
+	tokenFile string
+}
+
+// newInClusterClient returns the client of the apiserver of the cluster the
+// pod runs in. It has no timeout, the callers bound their calls with the
+// context.
+func newInClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are unset")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate in %s/ca.crt", serviceAccountDir)
+	}
+	return &kubeClient{
+		host: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		tokenFile: serviceAccountDir + "/token",
+	}, nil
+}
+
+// do sends a request for path with body of contentType, when not nil, and
+// returns the response of a 200 OK. The caller closes its body.
+func (c *kubeClient) do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.host+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	// the projected token is rotated, read it every time
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &kubeError{status: resp.StatusCode, message: fmt.Sprintf("%s %s: %s: %s", method, path, resp.Status, message)}
+	}
+	return resp, nil
+}
+
+// kubeError is an answer of the apiserver other than 200 OK.
+type kubeError struct {
+	status  int
+	message string
+}
+
+func (e *kubeError) Error() string {
+	return e.message
+}
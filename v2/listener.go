@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/http2"
+)
+
+// webhookListener opens the listener of the admission endpoints: the unix
+// socket -listenUnix when set, e.g. for a local proxy or integration tests,
+// the TCP -port otherwise.
+func webhookListener(parameters *WhSvrParameters) (net.Listener, error) {
+	if parameters.listenUnix == "" {
+		// a zero period keeps the Go default, a negative one disables TCP
+		// keep-alive probes
+		config := net.ListenConfig{KeepAlive: parameters.tcpKeepAlivePeriod}
+		return config.Listen(context.Background(), "tcp", fmt.Sprintf(":%v", parameters.port))
+	}
+	// a socket left behind by a killed process would fail the bind
+	if err := os.Remove(parameters.listenUnix); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", parameters.listenUnix)
+}
+
+// configureConnections applies the HTTP/2 and keep-alive flags to server.
+// The apiserver reuses its connections to the webhook, these let a cluster
+// whose connections go stale behind a proxy or balancer spread or recycle
+// them instead.
+func configureConnections(server *http.Server, parameters *WhSvrParameters) error {
+	if parameters.disableHTTP2 && parameters.http2MaxStreams > 0 {
+		return errors.New("-http2MaxConcurrentStreams can't apply with -disableHTTP2")
+	}
+	if parameters.disableKeepAlives {
+		// every request gets a connection of its own, closed after the response
+		server.SetKeepAlivesEnabled(false)
+	}
+	// plain HTTP is only ever served as HTTP/1.1
+	if server.TLSConfig == nil {
+		return nil
+	}
+	if parameters.disableHTTP2 {
+		// a non-nil empty map turns the HTTP/2 support of net/http off
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		server.TLSConfig.NextProtos = []string{"http/1.1"}
+		return nil
+	}
+	if parameters.http2MaxStreams == 0 {
+		return nil
+	}
+	// also idles HTTP/2 connections out after -idleTimeout
+	return http2.ConfigureServer(server, &http2.Server{
+		MaxConcurrentStreams: uint32(parameters.http2MaxStreams),
+	})
+}
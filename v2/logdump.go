@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+)
+
+var (
+	// dumpSampleRate logs the dumps of 1 in this many allowed mutations, set
+	// by -logDumpSampleRate. 1 or less logs every one.
+	dumpSampleRate int64 = 1
+	// dumpFailuresOnly logs the dumps of denied and failed mutations only
+	dumpFailuresOnly = newLogToggle(false)
+	// mutations seen by the sampling
+	dumpCount uint64
+)
+
+// logDump is a dump of the mutations, logged at its own glog verbosity when
+// enabled.
+type logDump struct {
+	*logToggle
+	// logged when -v is at least level, set by -logFinalYamlV...
+	level int64
+}
+
+func newLogDump(enabled bool) *logDump {
+	return &logDump{logToggle: newLogToggle(enabled)}
+}
+
+func (d *logDump) Level() int64 {
+	return atomic.LoadInt64(&d.level)
+}
+
+func (d *logDump) SetLevel(level int64) {
+	atomic.StoreInt64(&d.level, level)
+}
+
+// logged reports whether d is enabled at the current verbosity.
+func (d *logDump) logged() bool {
+	return d.Enabled() && bool(glog.V(glog.Level(d.Level())))
+}
+
+// sampled counts a mutation and reports whether its dumps are logged under
+// dumpSampleRate.
+func sampled() bool {
+	rate := atomic.LoadInt64(&dumpSampleRate)
+	n := atomic.AddUint64(&dumpCount, 1)
+	return rate <= 1 || (n-1)%uint64(rate) == 0
+}
+
+// mutationDumps collects the dumps of one mutation and logs them once its
+// response is known, so denied and failed mutations can be dumped whatever
+// the sampling. The dumps are only rendered when logged.
+type mutationDumps struct {
+	log     *requestLogger
+	sampled bool
+	entries []dumpEntry
+}
+
+type dumpEntry struct {
+	dump *logDump
+	// format of the log line of the rendered dump
+	format string
+	render func() (string, error)
+}
+
+func newMutationDumps(log *requestLogger) *mutationDumps {
+	return &mutationDumps{log: log, sampled: sampled()}
+}
+
+// add registers a dump rendered by render and logged with format when logged.
+func (m *mutationDumps) add(dump *logDump, format string, render func() (string, error)) {
+	m.entries = append(m.entries, dumpEntry{dump: dump, format: format, render: render})
+}
+
+// flush logs the dumps for resp: always when the mutation was denied or
+// failed, only when sampled and not -logDumpFailuresOnly otherwise.
+func (m *mutationDumps) flush(resp *v1beta1.AdmissionResponse) {
+	if resp != nil && resp.Allowed && (dumpFailuresOnly.Enabled() || !m.sampled) {
+		return
+	}
+	for _, entry := range m.entries {
+		if !entry.dump.logged() {
+			continue
+		}
+		s, err := entry.render()
+		if err != nil {
+			m.log.Warningf("Could not render dump: %v", err)
+			continue
+		}
+		m.log.Infof(entry.format, truncateLog(s))
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// dump the mutated pod spec as yaml
+	logFinalYaml = newLogDump(true)
+	// dump the generated patch of every mutation
+	logFinalPatch = newLogDump(true)
+)
+
+// logToggle is a logging switch that can be flipped at runtime while
+// requests are being served.
+type logToggle struct {
+	v int32
+}
+
+func newLogToggle(enabled bool) *logToggle {
+	t := &logToggle{}
+	t.Set(enabled)
+	return t
+}
+
+func (t *logToggle) Enabled() bool {
+	return atomic.LoadInt32(&t.v) == 1
+}
+
+func (t *logToggle) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&t.v, v)
+}
+
+// logLevelHandler reports and changes the glog verbosity and the dump
+// settings at runtime, e.g.
+//
+//	curl -k -H "Authorization: Bearer $TOKEN" -X PUT "https://webhook/debug/loglevel?v=4&logFinalYaml=false"
+//	curl -k -H "Authorization: Bearer $TOKEN" -X PUT "https://webhook/debug/loglevel?logDumpSampleRate=100&maxLoggedBytes=4096"
+//
+// Every call must carry the bearer token read from -adminTokenFile.
+type logLevelHandler struct {
+	token []byte
+}
+
+func newLogLevelHandler(tokenFile string) (*logLevelHandler, error) {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("admin token file %s is empty", tokenFile)
+	}
+	return &logLevelHandler{token: []byte(token)}, nil
+}
+
+func (h *logLevelHandler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), h.token) == 1
+}
+
+func (h *logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		if err := h.apply(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"v":                   flag.Lookup("v").Value.String(),
+		"logFinalYaml":        logFinalYaml.Enabled(),
+		"logFinalYamlV":       logFinalYaml.Level(),
+		"logFinalPatch":       logFinalPatch.Enabled(),
+		"logFinalPatchV":      logFinalPatch.Level(),
+		"logDumpSampleRate":   atomic.LoadInt64(&dumpSampleRate),
+		"logDumpFailuresOnly": dumpFailuresOnly.Enabled(),
+		"maxLoggedBytes":      atomic.LoadInt64(&maxLoggedBytes),
+	})
+}
+
+// apply validates all query parameters before changing anything, so a bad
+// request leaves the settings untouched.
+func (h *logLevelHandler) apply(r *http.Request) error {
+	query := r.URL.Query()
+
+	var level string
+	if v := query.Get("v"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return fmt.Errorf("invalid verbosity %q", v)
+		}
+		level = v
+	}
+	yaml, err := parseToggle(query.Get("logFinalYaml"), "logFinalYaml")
+	if err != nil {
+		return err
+	}
+	patch, err := parseToggle(query.Get("logFinalPatch"), "logFinalPatch")
+	if err != nil {
+		return err
+	}
+	failuresOnly, err := parseToggle(query.Get("logDumpFailuresOnly"), "logDumpFailuresOnly")
+	if err != nil {
+		return err
+	}
+	yamlLevel, err := parseCount(query.Get("logFinalYamlV"), "logFinalYamlV")
+	if err != nil {
+		return err
+	}
+	patchLevel, err := parseCount(query.Get("logFinalPatchV"), "logFinalPatchV")
+	if err != nil {
+		return err
+	}
+	sampleRate, err := parseCount(query.Get("logDumpSampleRate"), "logDumpSampleRate")
+	if err != nil {
+		return err
+	}
+	maxBytes, err := parseCount(query.Get("maxLoggedBytes"), "maxLoggedBytes")
+	if err != nil {
+		return err
+	}
+
+	if level != "" {
+		if err := flag.Set("v", level); err != nil {
+			return err
+		}
+		glog.Infof("Log verbosity set to %s", level)
+	}
+	if yaml != nil {
+		logFinalYaml.Set(*yaml)
+		glog.Infof("logFinalYaml set to %v", *yaml)
+	}
+	if patch != nil {
+		logFinalPatch.Set(*patch)
+		glog.Infof("logFinalPatch set to %v", *patch)
+	}
+	if failuresOnly != nil {
+		dumpFailuresOnly.Set(*failuresOnly)
+		glog.Infof("logDumpFailuresOnly set to %v", *failuresOnly)
+	}
+	if yamlLevel != nil {
+		logFinalYaml.SetLevel(*yamlLevel)
+		glog.Infof("logFinalYamlV set to %d", *yamlLevel)
+	}
+	if patchLevel != nil {
+		logFinalPatch.SetLevel(*patchLevel)
+		glog.Infof("logFinalPatchV set to %d", *patchLevel)
+	}
+	if sampleRate != nil {
+		atomic.StoreInt64(&dumpSampleRate, *sampleRate)
+		glog.Infof("logDumpSampleRate set to %d", *sampleRate)
+	}
+	if maxBytes != nil {
+		atomic.StoreInt64(&maxLoggedBytes, *maxBytes)
+		glog.Infof("maxLoggedBytes set to %d", *maxBytes)
+	}
+	return nil
+}
+
+// parseToggle parses an optional boolean query parameter, nil meaning unset.
+func parseToggle(value, name string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return &b, nil
+}
+
+// parseCount parses an optional non-negative integer query parameter, nil
+// meaning unset.
+func parseCount(value, name string) (*int64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return &n, nil
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -18,35 +19,184 @@ func main() {
 
 	// get command line parameters
 	flag.IntVar(&parameters.port, "port", 443, "Webhook server port.")
+	flag.StringVar(&parameters.listenUnix, "listenUnix", "", "Serve the webhook on this unix socket instead of -port.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/var/lib/docker/overlay2/40acbb2b689468ceb106b3a9335a498ed2f39272c2519f189b8fbf9392975b7b/merged/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/var/lib/docker/overlay2/40acbb2b689468ceb106b3a9335a498ed2f39272c2519f189b8fbf9392975b7b/merged/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flag.BoolVar(&parameters.insecureHTTP, "insecureHTTP", false, "INSECURE: serve plain HTTP, for meshes (Istio, Linkerd) terminating mTLS in front of the webhook. The apiserver must never reach the webhook over plain HTTP.")
+	flag.DurationVar(&parameters.certExpiryWindow, "certExpiryWindow", 24*time.Hour, "Fail readiness once the serving certificate expires within this window, 0 disables the check.")
+	flag.StringVar(&parameters.clientCAFile, "tlsClientCAFile", "", "File containing the CA certificates used to verify client certificates. When set, only callers presenting a valid client certificate (the kube-apiserver) are served, except on /debug/loglevel which authenticates its callers with a bearer token; serve the probes and metrics on -metricsPort.")
+	flag.StringVar(&parameters.tlsMinVersion, "tlsMinVersion", "1.2", "Minimum TLS version accepted by the webhook listener: 1.0, 1.1, 1.2 or 1.3.")
+	flag.StringVar(&parameters.tlsCipherSuites, "tlsCipherSuites", "", "Comma separated list of TLS 1.2 cipher suites (IANA names), in order of preference. Go defaults when empty.")
+	flag.StringVar(&parameters.tlsCurvePreferences, "tlsCurvePreferences", "", "Comma separated list of elliptic curves (X25519, P256, P384, P521), in order of preference. Go defaults when empty.")
+	flag.Int64Var(&parameters.maxRequestBytes, "maxRequestBytes", 6*1024*1024, "Max size in bytes of an AdmissionReview request body, larger requests are rejected with 413.")
+	flag.DurationVar(&parameters.readTimeout, "readTimeout", 30*time.Second, "Max duration for reading an entire request, including the body.")
+	flag.DurationVar(&parameters.readHeaderTimeout, "readHeaderTimeout", 10*time.Second, "Max duration for reading request headers.")
+	flag.DurationVar(&parameters.writeTimeout, "writeTimeout", 30*time.Second, "Max duration before timing out writes of the response.")
+	flag.DurationVar(&parameters.idleTimeout, "idleTimeout", 90*time.Second, "Max time to wait for the next request when keep-alives are enabled.")
+	flag.BoolVar(&parameters.disableHTTP2, "disableHTTP2", false, "Serve HTTP/1.1 only, so the apiserver opens a connection per concurrent request instead of multiplexing them over one HTTP/2 connection.")
+	flag.UintVar(&parameters.http2MaxStreams, "http2MaxConcurrentStreams", 0, "Max number of concurrent streams of an HTTP/2 connection, the apiserver opens more connections beyond it. 0 keeps the Go default of 250.")
+	flag.BoolVar(&parameters.disableKeepAlives, "disableKeepAlives", false, "Close the connection after every response instead of reusing it.")
+	flag.DurationVar(&parameters.tcpKeepAlivePeriod, "tcpKeepAlivePeriod", 0, "Period of the TCP keep-alive probes of the webhook connections. 0 keeps the Go default of 15s, negative disables them.")
+	flag.IntVar(&parameters.maxHeaderBytes, "maxHeaderBytes", http.DefaultMaxHeaderBytes, "Max size in bytes of request headers.")
+	flag.IntVar(&parameters.maxInflight, "maxInflight", 100, "Max number of admission requests processed concurrently, 0 disables the limit.")
+	flag.DurationVar(&parameters.inflightQueueTimeout, "inflightQueueTimeout", 2*time.Second, "How long a request waits for a free slot before being rejected with 429.")
+	flag.IntVar(&parameters.metricsPort, "metricsPort", 8080, "Plaintext port serving /metrics, /healthz, /readyz and pprof, so probes and Prometheus don't need the serving certificate. 0 serves them on the webhook port.")
+	flag.BoolVar(&parameters.enablePprof, "enablePprof", false, "Serve net/http/pprof under /debug/pprof/ on -metricsPort.")
+	flag.BoolVar(&parameters.selfTest, "selfTest", true, "Mutate a sample Deployment through the handler chain at startup and stay unready if that fails.")
+	flag.StringVar(&parameters.initContainerFile, "initContainerFile", "", "YAML file with the init container injected into Deployments (name, image, command, resources, volumeMounts...), a Go template with {{.Namespace}} and {{.Name}} of the Deployment. A busybox sleeping 100s when empty.")
+	flag.StringVar(&parameters.injectionsFile, "injectionTemplatesFile", "", "YAML file mapping template names to the initContainers, containers and volumes they inject, Go templates like -initContainerFile. Deployments select them with the comma separated inject.webhook/template annotation.")
+	flag.BoolVar(&parameters.qosStatus, "qosStatus", false, "Write the status subresource of applied QoS objects (acceptance, effective values, number of Deployments mutated under them) with the service account of the pod.")
+	flag.DurationVar(&parameters.qosStatusInterval, "qosStatusInterval", 30*time.Second, "How often the number of Deployments mutated under the QoS in force is written to its status.")
+	flag.BoolVar(&parameters.watchQoS, "watchQoS", false, "Apply the QoS objects from a list and watch of the apiserver instead of the admission requests, so all replicas of the webhook serve the same profiles. Required when running more than one replica.")
+	flag.BoolVar(&gzipResponses, "gzipResponses", true, "Compress the AdmissionReview responses of at least 1KiB with gzip when the caller accepts it.")
+	flag.Int64Var(&maxLoggedBytes, "maxLoggedBytes", 16*1024, "Truncate the mutated YAML and the patches logged to this many bytes, 0 logs them whole.")
+	flag.Int64Var(&dumpSampleRate, "logDumpSampleRate", 1, "Log the mutated YAML and the patch of 1 in this many allowed mutations, denied and failed mutations are always logged.")
+	flag.BoolVar(&parameters.logDumpFailuresOnly, "logDumpFailuresOnly", false, "Log the mutated YAML and the patch of denied and failed mutations only.")
+	flag.StringVar(&parameters.logTimezone, "logTimezone", "UTC", "Time zone of the RFC3339 timestamps the admission request logs start with, an IANA name such as Asia/Shanghai, UTC or Local.")
+	flag.Int64Var(&logFinalYaml.level, "logFinalYamlV", 0, "Log the mutated YAML from this glog verbosity on.")
+	flag.Int64Var(&logFinalPatch.level, "logFinalPatchV", 0, "Log the generated patch from this glog verbosity on.")
+	flag.IntVar(&patchWarningBytes, "patchWarningBytes", 256*1024, "Log a warning and count webhook_large_patches_total when a generated patch reaches this many bytes, 0 disables the warning.")
+	flag.StringVar(&parameters.adminTokenFile, "adminTokenFile", "", "File containing the bearer token for /debug/loglevel, the endpoint is disabled when empty.")
+	flag.StringVar(&parameters.annotationDomain, "annotationDomain", legacyAnnotationDomain, "Domain of the keys of the mutate and validate annotations, such as webhook.example.com for webhook.example.com/mutate.")
+	flag.BoolVar(&parameters.readLegacyAnnotations, "readLegacyAnnotations", true, "With another -annotationDomain, read the keys under "+legacyAnnotationDomain+" where the objects don't have those under the domain, while migrating.")
 	flag.Parse()
+	dumpFailuresOnly.Set(parameters.logDumpFailuresOnly)
+	if err := setLogTimezone(parameters.logTimezone); err != nil {
+		glog.Exitf("Invalid -logTimezone: %v", err)
+	}
+	if err := setAnnotationDomain(parameters.annotationDomain, parameters.readLegacyAnnotations); err != nil {
+		glog.Exitf("Invalid -annotationDomain: %v", err)
+	}
 
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
-	if err != nil {
-		glog.Errorf("Failed to load key pair: %v", err)
+	if parameters.initContainerFile != "" {
+		t, err := loadInitContainerTemplate(parameters.initContainerFile)
+		if err != nil {
+			glog.Exitf("Failed to load init container template: %v", err)
+		}
+		initContainerInst = t
+	}
+	if parameters.injectionsFile != "" {
+		l, err := loadInjectionLibrary(parameters.injectionsFile)
+		if err != nil {
+			glog.Exitf("Failed to load injection templates: %v", err)
+		}
+		injectionLibraryInst = l
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ready := &readyzHandler{}
+	if parameters.qosStatus || parameters.watchQoS {
+		client, err := newInClusterClient()
+		if err != nil {
+			glog.Exitf("Failed to set up the apiserver client: %v", err)
+		}
+		if parameters.qosStatus {
+			writer, err := newQoSStatusWriter(client, parameters.qosStatusInterval)
+			if err != nil {
+				glog.Exitf("Failed to set up QoS status updates: %v", err)
+			}
+			qosStatusInst = writer
+			go writer.run(ctx)
+		}
+		if parameters.watchQoS {
+			watcher := newQoSWatcher(client)
+			qosWatched = true
+			ready.add("qos-sync", watcher.ready)
+			go watcher.run(ctx)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if parameters.insecureHTTP {
+		warnInsecureHTTP(&parameters)
+	} else {
+		tlsConfig = servingTLSConfig(ctx, &parameters, ready)
 	}
 
 	whsvr := &WebhookServer{
 		server: &http.Server{
-			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			Addr:              fmt.Sprintf(":%v", parameters.port),
+			TLSConfig:         tlsConfig,
+			ReadTimeout:       parameters.readTimeout,
+			ReadHeaderTimeout: parameters.readHeaderTimeout,
+			WriteTimeout:      parameters.writeTimeout,
+			IdleTimeout:       parameters.idleTimeout,
+			MaxHeaderBytes:    parameters.maxHeaderBytes,
 		},
+		maxRequestBytes: parameters.maxRequestBytes,
+	}
+	if err := configureConnections(whsvr.server, &parameters); err != nil {
+		glog.Exitf("Failed to configure the webhook connections: %v", err)
 	}
 
 	// define http server and server handler
+	limiter := newInflightLimiter(parameters.maxInflight, parameters.inflightQueueTimeout)
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", whsvr.serve)
-	mux.HandleFunc("/validate", whsvr.serve)
-	whsvr.server.Handler = mux
+	mux.Handle("/mutate", limiter.wrap(whsvr.handler("mutate", whsvr.mutate)))
+	mux.Handle("/validate", limiter.wrap(whsvr.handler("validate", whsvr.validate)))
+	mux.Handle("/convert", limiter.wrap(http.HandlerFunc(whsvr.convert)))
+
+	// probes and metrics go to a plaintext listener unless -metricsPort is 0
+	var opsServer *http.Server
+	if parameters.metricsPort == 0 {
+		registerOpsHandlers(mux, ready, parameters.enablePprof)
+	} else {
+		opsMux := http.NewServeMux()
+		registerOpsHandlers(opsMux, ready, parameters.enablePprof)
+		opsServer = &http.Server{
+			Addr:              fmt.Sprintf(":%v", parameters.metricsPort),
+			Handler:           opsMux,
+			ReadHeaderTimeout: parameters.readHeaderTimeout,
+		}
+	}
+	if parameters.adminTokenFile != "" {
+		// an unreadable or empty token file would leave the endpoint closed
+		// without anyone noticing
+		logLevel, err := newLogLevelHandler(parameters.adminTokenFile)
+		if err != nil {
+			glog.Exitf("Failed to load admin token: %v", err)
+		}
+		mux.Handle("/debug/loglevel", logLevel)
+	}
+	whsvr.server.Handler = requireClientCert(&parameters, mux)
+
+	// mutate a sample Deployment through the handler chain before taking traffic
+	if parameters.selfTest {
+		selfTestErr := selfTest(mux)
+		if selfTestErr != nil {
+			glog.Errorf("Self-test failed, staying unready: %v", selfTestErr)
+		} else {
+			glog.Info("Self-test passed")
+		}
+		ready.add("self-test", func() error { return selfTestErr })
+	}
+
+	listener, err := webhookListener(&parameters)
+	if err != nil {
+		glog.Exitf("Failed to listen: %v", err)
+	}
 
 	// start webhook server in new routine
 	go func() {
-		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
+		serve := func() error { return whsvr.server.ServeTLS(listener, "", "") }
+		if tlsConfig == nil {
+			serve = func() error { return whsvr.server.Serve(listener) }
+		}
+		if err := serve(); err != nil {
 			glog.Errorf("Failed to listen and serve webhook server: %v", err)
 		}
 	}()
 
+	if opsServer != nil {
+		go func() {
+			if err := opsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("Failed to listen and serve metrics server: %v", err)
+			}
+		}()
+	}
+
 	glog.Info("Server started")
 
 	// listening OS shutdown singal
@@ -56,4 +206,31 @@ func main() {
 
 	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
 	whsvr.server.Shutdown(context.Background())
+	if opsServer != nil {
+		opsServer.Shutdown(context.Background())
+	}
+}
+
+// servingTLSConfig configures TLS with the -tlsCertFile/-tlsKeyFile pair,
+// reloaded whenever the files change.
+func servingTLSConfig(ctx context.Context, parameters *WhSvrParameters, ready *readyzHandler) *tls.Config {
+	// keep serving rotated certificates without a restart
+	reloader := newCertReloader(parameters.certFile, parameters.keyFile)
+	if err := reloader.reload(); err != nil {
+		glog.Errorf("Failed to load key pair: %v", err)
+	}
+	go func() {
+		if err := reloader.watch(ctx); err != nil {
+			glog.Errorf("Failed to watch serving certificate: %v", err)
+		}
+	}()
+	ready.add("certificate", reloader.loaded)
+	tlsConfig, err := newTLSConfig(reloader.GetCertificate, parameters)
+	if err != nil {
+		glog.Exitf("Invalid TLS configuration: %v", err)
+	}
+	if parameters.certExpiryWindow > 0 {
+		ready.add("certificate-expiry", certExpiryCheck(parameters.certExpiryWindow))
+	}
+	return tlsConfig
 }
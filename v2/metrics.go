@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_inflight_requests",
+		Help: "Number of admission requests currently being processed.",
+	})
+	inflightLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_inflight_limit",
+		Help: "Configured max number of concurrently processed admission requests, 0 means unlimited.",
+	})
+	inflightRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_inflight_rejected_total",
+		Help: "Number of admission requests rejected with 429 because no slot freed up in time.",
+	})
+	inflightQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webhook_inflight_queue_wait_seconds",
+		Help:    "Time admission requests waited for a free processing slot.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+	certReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_cert_reloads_total",
+		Help: "Number of times the serving certificate was (re)loaded from disk.",
+	})
+	certNotAfter = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_cert_not_after_timestamp_seconds",
+		Help: "Expiry of the currently served certificate as a unix timestamp.",
+	})
+	largePatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_large_patches_total",
+		Help: "Number of generated patches of at least -patchWarningBytes.",
+	})
+	admissionResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_admission_responses_total",
+		Help: "Number of admission responses by handler and Status.Code, 200 when allowed: 400 and 422 are requests to fix and 500 failures of the webhook.",
+	}, []string{"handler", "code"})
+	certExpiry = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "webhook_cert_expiry_seconds",
+		Help: "Seconds until the currently served certificate expires, negative once expired.",
+	}, func() float64 {
+		notAfter, ok := servedCertNotAfter()
+		if !ok {
+			return 0
+		}
+		return time.Until(notAfter).Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		inflightRequests,
+		inflightLimit,
+		inflightRejected,
+		inflightQueueWait,
+		certReloads,
+		certNotAfter,
+		certExpiry,
+		largePatches,
+		admissionResponses,
+	)
+}
@@ -1,31 +1,142 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
 type QoS struct {
-	Spec QoSpec `json:"spec,omitempty"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              QoSpec    `json:"spec,omitempty"`
+	Status            QoSStatus `json:"status,omitempty"`
 }
 
 type QoSpec struct {
 	Cpu    int64 `json:"cpu,omitempty"`
 	Memory int64 `json:"memory,omitempty"`
+	// Selector picks the Deployments the profile applies to by their labels,
+	// all of them when nil.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
 }
 
-var (
-	QoSInst = &QoSpec{}
-)
+// empty reports whether spec sets no resources.
+func (spec *QoSpec) empty() bool {
+	return spec.Cpu == 0 && spec.Memory == 0
+}
+
+// defaultQoSpec applies when no profile matches a Deployment.
+var defaultQoSpec = QoSpec{
+	Cpu:    200,
+	Memory: 400,
+}
+
+// qosProfile is an applied QoS with its compiled selector.
+type qosProfile struct {
+	name        string
+	spec        QoSpec
+	selector    labels.Selector
+	specificity int
+}
+
+// qosProfiles are the applied QoS objects by name, each Deployment gets the
+// resources of the most specific one selecting it.
+type qosProfiles struct {
+	mu       sync.RWMutex
+	profiles map[string]*qosProfile
+}
+
+var qosProfilesInst = &qosProfiles{profiles: map[string]*qosProfile{}}
+
+// selector compiles the selector of the spec of the QoS name, specificity
+// is its number of requirements.
+func (spec *QoSpec) selector(name string) (selector labels.Selector, specificity int, err error) {
+	if spec.Selector == nil {
+		return labels.Everything(), 0, nil
+	}
+	if selector, err = metav1.LabelSelectorAsSelector(spec.Selector); err != nil {
+		return nil, 0, fmt.Errorf("invalid selector of QoS %s: %v", name, err)
+	}
+	return selector, len(spec.Selector.MatchLabels) + len(spec.Selector.MatchExpressions), nil
+}
 
-func (qos *QoSpec) getQoSpec() *QoSpec {
-	//判断空对象
-	if (*QoSInst == QoSpec{}) {
-		//默认值
-		return &QoSpec{
-			Cpu:    200,
-			Memory: 400,
+// set applies the QoS name, replacing the previous spec of that name.
+func (p *qosProfiles) set(name string, spec QoSpec) error {
+	selector, specificity, err := spec.selector(name)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profiles[name] = &qosProfile{name: name, spec: spec, selector: selector, specificity: specificity}
+	return nil
+}
+
+// get returns the spec of the QoS name, ok is false when it isn't applied.
+func (p *qosProfiles) get(name string) (spec QoSpec, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if profile, found := p.profiles[name]; found {
+		return profile.spec, true
+	}
+	return QoSpec{}, false
+}
+
+// delete removes the QoS name.
+func (p *qosProfiles) delete(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.profiles, name)
+}
+
+// match returns the name and the spec of the profile selecting a Deployment
+// with deploymentLabels with the most requirements, the first by name on a
+// tie. It is the defaults and no name when none selects it.
+func (p *qosProfiles) match(deploymentLabels map[string]string) (string, QoSpec) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var matched []*qosProfile
+	for _, profile := range p.profiles {
+		if profile.selector.Matches(labels.Set(deploymentLabels)) {
+			matched = append(matched, profile)
 		}
-	} else {
-		return QoSInst
 	}
+	if len(matched) == 0 {
+		return "", defaultQoSpec
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].specificity != matched[j].specificity {
+			return matched[i].specificity > matched[j].specificity
+		}
+		return matched[i].name < matched[j].name
+	})
+	return matched[0].name, matched[0].spec
+}
+
+// applyQoS puts qos in force unless its spec is empty and records it in its
+// status.
+func applyQoS(qos *QoS) error {
+	if qos.Spec.empty() {
+		//只更新status的请求不会走到这里，status是子资源
+		if previous, ok := qosProfilesInst.get(qos.Name); ok {
+			qosStatusInst.applied(qos, false, "empty spec ignored, the previous values stay in force", previous)
+		} else {
+			qosStatusInst.applied(qos, false, "empty spec ignored", QoSpec{})
+		}
+		return nil
+	}
+	if err := qosProfilesInst.set(qos.Name, qos.Spec); err != nil {
+		return err
+	}
+	qosStatusInst.applied(qos, true, "in force", qos.Spec)
+	return nil
 }
 
-func (qos *QoSpec) setQoSpec(qoSpec *QoSpec) {
-	QoSInst = qoSpec
+// deleteQoS takes the deleted QoS name out of force.
+func deleteQoS(name string) {
+	qosProfilesInst.delete(name)
+	qosStatusInst.deleted(name)
 }
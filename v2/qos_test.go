@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeAPIServer serves handler as the apiserver, checking the bearer token
+// of the client it returns. stop shuts it down.
+func fakeAPIServer(t *testing.T, handler http.HandlerFunc) (client *kubeClient, stop func()) {
+	t.Helper()
+	file, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("secret\n")
+	file.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	return &kubeClient{host: server.URL, client: server.Client(), tokenFile: file.Name()}, func() {
+		server.Close()
+		os.Remove(file.Name())
+	}
+}
+
+// swapQoSProfiles replaces qosProfilesInst by empty profiles until the
+// returned function restores it.
+func swapQoSProfiles() func() {
+	saved := qosProfilesInst
+	qosProfilesInst = &qosProfiles{profiles: map[string]*qosProfile{}}
+	return func() { qosProfilesInst = saved }
+}
+
+func TestQoSProfilesMatch(t *testing.T) {
+	p := &qosProfiles{profiles: map[string]*qosProfile{}}
+	web := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	for name, spec := range map[string]QoSpec{
+		"web":      {Cpu: 100, Selector: web},
+		"a-web":    {Cpu: 110, Selector: web},
+		"web-prod": {Cpu: 300, Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web", "env": "prod"}}},
+		"frontend": {Cpu: 150, Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"frontend"}},
+		}}},
+	} {
+		if err := p.set(name, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "most requirements", labels: map[string]string{"app": "web", "env": "prod"}, want: "web-prod"},
+		{name: "equal specificity by name", labels: map[string]string{"app": "web"}, want: "a-web"},
+		{name: "tie between labels and expressions", labels: map[string]string{"app": "web", "tier": "frontend"}, want: "a-web"},
+		{name: "expression only", labels: map[string]string{"tier": "frontend"}, want: "frontend"},
+		{name: "no match", labels: map[string]string{"app": "db"}},
+		{name: "no labels"},
+	} {
+		name, spec := p.match(c.labels)
+		if name != c.want {
+			t.Errorf("%s: matched %q, want %q", c.name, name, c.want)
+		}
+		if c.want == "" && spec != defaultQoSpec {
+			t.Errorf("%s: got %+v, want the defaults", c.name, spec)
+		}
+	}
+
+	// a profile without selector selects all the Deployments, the others
+	// are more specific
+	if err := p.set("all", QoSpec{Cpu: 50}); err != nil {
+		t.Fatal(err)
+	}
+	if name, spec := p.match(map[string]string{"app": "db"}); name != "all" || spec.Cpu != 50 {
+		t.Errorf("matched %q %+v, want all", name, spec)
+	}
+	if name, _ := p.match(map[string]string{"app": "web", "env": "prod"}); name != "web-prod" {
+		t.Errorf("matched %q, want web-prod over all", name)
+	}
+	p.delete("web-prod")
+	if name, _ := p.match(map[string]string{"app": "web", "env": "prod"}); name != "a-web" {
+		t.Errorf("matched %q after web-prod was deleted, want a-web", name)
+	}
+}
+
+func TestQoSStatusWrite(t *testing.T) {
+	var mu sync.Mutex
+	var patches []map[string]QoSStatus
+	fail := true
+	client, stop := fakeAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/apis/stable.example.com/v1/qoss/gold/status" {
+			http.NotFound(w, r)
+			return
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/merge-patch+json" {
+			t.Errorf("Content-Type is %q, want a merge patch", contentType)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			fail = false
+			http.Error(w, "etcd unavailable", http.StatusInternalServerError)
+			return
+		}
+		var patch map[string]QoSStatus
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			t.Errorf("invalid patch: %v", err)
+		}
+		patches = append(patches, patch)
+		w.Write([]byte("{}"))
+	})
+	defer stop()
+	s := &qosStatusWriter{client: client, replica: "webhook-0", notify: make(chan struct{}, 1), statuses: map[string]*qosStatusEntry{}}
+	ctx := context.Background()
+
+	gold := &QoS{
+		ObjectMeta: metav1.ObjectMeta{Name: "gold", Generation: 3},
+		Spec:       QoSpec{Cpu: 500, Memory: 256},
+		Status: QoSStatus{Replicas: map[string]QoSReplicaStatus{
+			"webhook-1": {ObservedGeneration: 3, MutatedDeployments: 4},
+			// counted under the previous spec
+			"webhook-2": {ObservedGeneration: 2, MutatedDeployments: 9},
+		}},
+	}
+	s.applied(gold, true, "in force", gold.Spec)
+	s.deploymentMutated("gold")
+	s.deploymentMutated("gold")
+	s.deploymentMutated("silver")
+
+	// the failed write is retried on the next flush
+	s.flush(ctx)
+	s.flush(ctx)
+	s.flush(ctx)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(patches) != 1 {
+		t.Fatalf("wrote %d statuses, want the one which changed", len(patches))
+	}
+	status := patches[0]["status"]
+	want := QoSStatus{
+		Accepted:           true,
+		Message:            "in force",
+		Effective:          QoSpec{Cpu: 500, Memory: 256},
+		MutatedDeployments: 6,
+		Replicas: map[string]QoSReplicaStatus{
+			"webhook-0": {ObservedGeneration: 3, MutatedDeployments: 2},
+		},
+		ObservedGeneration: 3,
+	}
+	if fmt.Sprint(status) != fmt.Sprint(want) {
+		t.Errorf("wrote %+v, want %+v", status, want)
+	}
+}
+
+func TestQoSWatcherSync(t *testing.T) {
+	defer swapQoSProfiles()()
+	client, stop := fakeAPIServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != qosPath {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("watch") == "" {
+			w.Write([]byte(`{"metadata":{"resourceVersion":"10"},"items":[` +
+				`{"apiVersion":"stable.example.com/v1","kind":"QoS","metadata":{"name":"gold","resourceVersion":"8"},"spec":{"cpu":500}},` +
+				`{"apiVersion":"stable.example.com/v1beta1","kind":"QoS","metadata":{"name":"silver","resourceVersion":"9"},"spec":{"cpuMillicores":300}}]}`))
+			return
+		}
+		if rv := r.URL.Query().Get("resourceVersion"); rv != "10" {
+			t.Errorf("watching from %q, want the resourceVersion of the list", rv)
+		}
+		for _, event := range []string{
+			`{"type":"MODIFIED","object":{"apiVersion":"stable.example.com/v1","kind":"QoS","metadata":{"name":"gold","resourceVersion":"11"},"spec":{"cpu":600}}}`,
+			`{"type":"DELETED","object":{"apiVersion":"stable.example.com/v1","kind":"QoS","metadata":{"name":"silver","resourceVersion":"12"},"spec":{"cpu":300}}}`,
+			`{"type":"ADDED","object":{"apiVersion":"stable.example.com/v1","kind":"QoS","metadata":{"name":"bronze","resourceVersion":"13"},"spec":{"cpu":100}}}`,
+		} {
+			w.Write([]byte(event + "\n"))
+		}
+	})
+	defer stop()
+	w := newQoSWatcher(client)
+	ctx := context.Background()
+	if err := w.ready(); err == nil {
+		t.Error("ready before the QoS objects were listed")
+	}
+
+	// the QoS deleted while the watch was down goes when listing
+	qosProfilesInst.set("stale", QoSpec{Cpu: 1})
+	w.names["stale"] = true
+	resourceVersion, err := w.list(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resourceVersion != "10" {
+		t.Errorf("listed at %q, want 10", resourceVersion)
+	}
+	if err := w.ready(); err != nil {
+		t.Errorf("not ready after the list: %v", err)
+	}
+	for name, cpu := range map[string]int64{"gold": 500, "silver": 300, "stale": 0} {
+		if spec, _ := qosProfilesInst.get(name); spec.Cpu != cpu {
+			t.Errorf("QoS %s has %d millicores after the list, want %d", name, spec.Cpu, cpu)
+		}
+	}
+
+	if resourceVersion, err = w.watch(ctx, resourceVersion); err != nil {
+		t.Fatal(err)
+	}
+	if resourceVersion != "13" {
+		t.Errorf("watch ended at %q, want 13", resourceVersion)
+	}
+	for name, cpu := range map[string]int64{"gold": 600, "silver": 0, "bronze": 100} {
+		if spec, _ := qosProfilesInst.get(name); spec.Cpu != cpu {
+			t.Errorf("QoS %s has %d millicores after the watch, want %d", name, spec.Cpu, cpu)
+		}
+	}
+	if len(w.names) != 2 || !w.names["gold"] || !w.names["bronze"] {
+		t.Errorf("watcher knows %v, want gold and bronze", w.names)
+	}
+}
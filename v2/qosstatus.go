@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// QoSStatus is the status subresource of a QoS the webhook writes back.
+type QoSStatus struct {
+	// Accepted reports whether the spec is in force, an empty one is
+	// ignored.
+	Accepted bool   `json:"accepted"`
+	Message  string `json:"message,omitempty"`
+	// Effective are the values mutateDeploy uses, after defaulting.
+	Effective QoSpec `json:"effective"`
+	// MutatedDeployments counts the Deployments mutated under this spec by
+	// all the replicas of the webhook.
+	MutatedDeployments int64 `json:"mutatedDeployments"`
+	// Replicas are the counts of the replicas by pod name, every replica
+	// only writes its own.
+	Replicas           map[string]QoSReplicaStatus `json:"replicas,omitempty"`
+	ObservedGeneration int64                       `json:"observedGeneration,omitempty"`
+}
+
+// QoSReplicaStatus is the count of a replica of the webhook.
+type QoSReplicaStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration"`
+	MutatedDeployments int64 `json:"mutatedDeployments"`
+}
+
+// qosStatusWriter patches the status of the applied QoS objects, in the
+// background since a QoS doesn't exist yet while it is admitted.
+type qosStatusWriter struct {
+	client   *kubeClient
+	replica  string
+	interval time.Duration
+	notify   chan struct{}
+
+	mu       sync.Mutex
+	statuses map[string]*qosStatusEntry // by QoS name
+}
+
+type qosStatusEntry struct {
+	status  QoSStatus
+	mutated int64                       // Deployments mutated by this replica since the QoS was applied
+	others  map[string]QoSReplicaStatus // counts of the other replicas last watched
+	written bool                        // status with mutated and others written
+}
+
+// qosStatusInst is nil unless -qosStatus is set, its methods do nothing then.
+var qosStatusInst *qosStatusWriter
+
+// newQoSStatusWriter returns the writer of this replica, named after the
+// pod, flushing the Deployment counts every interval.
+func newQoSStatusWriter(client *kubeClient, interval time.Duration) (*qosStatusWriter, error) {
+	replica, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &qosStatusWriter{
+		client:   client,
+		replica:  replica,
+		interval: interval,
+		notify:   make(chan struct{}, 1),
+		statuses: map[string]*qosStatusEntry{},
+	}, nil
+}
+
+// applied records that qos was applied, accepted reports whether its spec
+// is in force and effective is the spec used for the Deployments it
+// selects. The count of mutated Deployments starts over with every
+// generation of qos, applying the same one again only takes the counts of
+// the other replicas from its status.
+func (s *qosStatusWriter) applied(qos *QoS, accepted bool, message string, effective QoSpec) {
+	if s == nil || qos == nil || qos.Name == "" {
+		return
+	}
+	s.mu.Lock()
+	entry, ok := s.statuses[qos.Name]
+	if !ok || qos.Generation == 0 || entry.status.ObservedGeneration != qos.Generation {
+		entry = &qosStatusEntry{
+			status: QoSStatus{
+				Accepted:           accepted,
+				Message:            message,
+				Effective:          effective,
+				ObservedGeneration: qos.Generation,
+			},
+		}
+		s.statuses[qos.Name] = entry
+	}
+	if entry.observe(s.replica, qos.Status.Replicas) {
+		entry.written = false
+	}
+	written := entry.written
+	s.mu.Unlock()
+	if !written {
+		s.wake()
+	}
+}
+
+// observe keeps the counts of the other replicas for the generation of the
+// entry, it reports whether they changed. The replicas only write their own
+// count, so writing the total doesn't change them again.
+func (e *qosStatusEntry) observe(self string, replicas map[string]QoSReplicaStatus) bool {
+	others := map[string]QoSReplicaStatus{}
+	for replica, count := range replicas {
+		if replica != self && count.ObservedGeneration == e.status.ObservedGeneration {
+			others[replica] = count
+		}
+	}
+	changed := len(others) != len(e.others)
+	for replica, count := range others {
+		if e.others[replica] != count {
+			changed = true
+		}
+	}
+	e.others = others
+	return changed
+}
+
+// deleted stops writing the status of the deleted QoS name.
+func (s *qosStatusWriter) deleted(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.statuses, name)
+	s.mu.Unlock()
+}
+
+// deploymentMutated counts a Deployment mutated under the QoS name, none
+// when the defaults applied.
+func (s *qosStatusWriter) deploymentMutated(name string) {
+	if s == nil || name == "" {
+		return
+	}
+	s.mu.Lock()
+	if entry, ok := s.statuses[name]; ok {
+		entry.mutated++
+		entry.written = false
+	}
+	s.mu.Unlock()
+}
+
+func (s *qosStatusWriter) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the status of a QoS when it is applied and every interval when
+// its count of mutated Deployments changed, until ctx is done. Failed writes
+// are retried on the next tick.
+func (s *qosStatusWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	var applied <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.notify:
+			// the QoS is only stored once the apiserver got the answer
+			applied = time.After(time.Second)
+			continue
+		case <-applied:
+		case <-ticker.C:
+		}
+		s.flush(ctx)
+	}
+}
+
+// flush writes the statuses that changed since they were last written.
+func (s *qosStatusWriter) flush(ctx context.Context) {
+	type pending struct {
+		entry   *qosStatusEntry
+		mutated int64
+		status  QoSStatus
+	}
+	changed := map[string]pending{}
+	s.mu.Lock()
+	for name, entry := range s.statuses {
+		if entry.written {
+			continue
+		}
+		status := entry.status
+		// the merge patch only sets the count of this replica and keeps
+		// the others
+		status.Replicas = map[string]QoSReplicaStatus{
+			s.replica: {ObservedGeneration: status.ObservedGeneration, MutatedDeployments: entry.mutated},
+		}
+		status.MutatedDeployments = entry.mutated
+		for _, count := range entry.others {
+			status.MutatedDeployments += count.MutatedDeployments
+		}
+		changed[name] = pending{entry, entry.mutated, status}
+	}
+	s.mu.Unlock()
+
+	for name, p := range changed {
+		if err := s.patch(ctx, name, p.status); err != nil {
+			glog.Warningf("Failed to write QoS status: %v", err)
+			continue
+		}
+		s.mu.Lock()
+		// the QoS may have been applied again or more Deployments mutated
+		// meanwhile
+		if s.statuses[name] == p.entry && p.entry.mutated == p.mutated {
+			p.entry.written = true
+		}
+		s.mu.Unlock()
+	}
+}
+
+// patch merges status into the status subresource of the QoS name.
+func (s *qosStatusWriter) patch(ctx context.Context, name string, status QoSStatus) error {
+	body, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := s.client.do(ctx, http.MethodPatch, fmt.Sprintf("/apis/%s/v1/qoss/%s/status", qosGroup, name), "application/merge-patch+json", body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
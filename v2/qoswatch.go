@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// qosWatched is set with -watchQoS, the QoS objects are then applied from
+// the apiserver by every replica and admission only validates them.
+var qosWatched bool
+
+const (
+	qosPath = "/apis/" + qosGroup + "/v1/qoss"
+	// qosWatchTimeout ends every watch on the apiserver side, it is resumed
+	// from the last resourceVersion
+	qosWatchTimeout = 5 * time.Minute
+	qosRelistDelay  = 5 * time.Second
+)
+
+// qosWatcher keeps qosProfilesInst in sync with the QoS objects stored in
+// the apiserver. Every replica of the webhook watches them, so they all
+// apply the same profiles whichever of them admitted the QoS, without
+// electing a leader: the apiserver is the shared store.
+type qosWatcher struct {
+	client *kubeClient
+
+	mu     sync.Mutex
+	synced bool
+	names  map[string]bool // QoS objects applied
+}
+
+func newQoSWatcher(client *kubeClient) *qosWatcher {
+	return &qosWatcher{client: client, names: map[string]bool{}}
+}
+
+// ready is the readiness check of the watcher, the replica doesn't admit
+// Deployments before it listed the QoS objects.
+func (w *qosWatcher) ready() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.synced {
+		return errors.New("QoS objects not listed yet")
+	}
+	return nil
+}
+
+// run lists and watches the QoS objects until ctx is done, it lists them
+// again after an error.
+func (w *qosWatcher) run(ctx context.Context) {
+	for {
+		resourceVersion, err := w.list(ctx)
+		for err == nil {
+			resourceVersion, err = w.watch(ctx, resourceVersion)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		glog.Warningf("Failed to sync QoS objects, listing them again in %v: %v", qosRelistDelay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(qosRelistDelay):
+		}
+	}
+}
+
+// list applies all the QoS objects, the ones gone while the watch was down
+// are deleted. It returns the resourceVersion to watch from.
+func (w *qosWatcher) list(ctx context.Context) (string, error) {
+	listCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := w.client.do(listCtx, http.MethodGet, qosPath, "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata metav1.ListMeta   `json:"metadata"`
+		Items    []json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("can't decode the QoS list: %v", err)
+	}
+
+	listed := map[string]bool{}
+	for _, item := range list.Items {
+		qos, err := decodeQoS(item)
+		if err != nil {
+			return "", fmt.Errorf("can't decode QoS: %v", err)
+		}
+		w.apply(qos)
+		listed[qos.Name] = true
+	}
+	w.mu.Lock()
+	for name := range w.names {
+		if !listed[name] {
+			deleteQoS(name)
+			glog.Infof("QoS [%s] deleted", name)
+		}
+	}
+	w.names = listed
+	w.synced = true
+	w.mu.Unlock()
+	glog.Infof("Listed %d QoS objects", len(list.Items))
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies the changes to the QoS objects since resourceVersion until
+// the apiserver ends the watch, it returns the resourceVersion to resume
+// from. An error means the QoS objects have to be listed again.
+func (w *qosWatcher) watch(ctx context.Context, resourceVersion string) (string, error) {
+	query := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(qosWatchTimeout.Seconds()))},
+	}
+	resp, err := w.client.do(ctx, http.MethodGet, qosPath+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			// the apiserver ended the watch after timeoutSeconds
+			if err == io.EOF {
+				return resourceVersion, nil
+			}
+			return "", err
+		}
+		if event.Type == "ERROR" {
+			var status metav1.Status
+			json.Unmarshal(event.Object, &status)
+			return "", fmt.Errorf("watch failed: %s", status.Message)
+		}
+		qos, err := decodeQoS(event.Object)
+		if err != nil {
+			return "", fmt.Errorf("can't decode QoS: %v", err)
+		}
+		resourceVersion = qos.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			w.apply(qos)
+			w.mu.Lock()
+			w.names[qos.Name] = true
+			w.mu.Unlock()
+		case "DELETED":
+			deleteQoS(qos.Name)
+			w.mu.Lock()
+			delete(w.names, qos.Name)
+			w.mu.Unlock()
+			glog.Infof("QoS [%s] deleted", qos.Name)
+		}
+	}
+}
+
+// apply puts qos in force, the changes of its status only update the counts
+// of the other replicas.
+func (w *qosWatcher) apply(qos *QoS) {
+	if err := applyQoS(qos); err != nil {
+		// admission rejects them, unless the webhook was bypassed
+		glog.Warningf("Ignoring QoS [%s]: %v", qos.Name, err)
+		return
+	}
+	glog.V(2).Infof("QoS [%s] applied: [%v]", qos.Name, qos.Spec)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// newTLSConfig builds the listener TLS config from the tls* flags, serving
+// the key pair returned by getCertificate. Empty cipher suite and curve lists
+// keep the Go defaults.
+func newTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), parameters *WhSvrParameters) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[parameters.tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q, expect one of 1.0, 1.1, 1.2, 1.3", parameters.tlsMinVersion)
+	}
+	cipherSuites, err := parseCipherSuites(parameters.tlsCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	curves, err := parseCurves(parameters.tlsCurvePreferences)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		GetCertificate:           getCertificate,
+		MinVersion:               minVersion,
+		CipherSuites:             cipherSuites,
+		CurvePreferences:         curves,
+		PreferServerCipherSuites: len(cipherSuites) > 0,
+	}
+
+	// verify the client certificates signed by the configured CA, i.e. the
+	// kube-apiserver's, when given: the listener also serves /debug/loglevel
+	// to callers authenticated by their bearer token, requireClientCert
+	// demands the certificate on the other paths
+	if parameters.clientCAFile != "" {
+		pool, err := loadCertPool(parameters.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// tokenAuthPaths are the paths authenticating their callers with bearer
+// tokens, the only ones served without a client certificate under
+// -tlsClientCAFile.
+var tokenAuthPaths = map[string]bool{
+	"/debug/loglevel": true,
+}
+
+// requireClientCert denies the requests whose caller presented no client
+// certificate verified against -tlsClientCAFile, but to the tokenAuthPaths,
+// next serves the others. It returns next when -tlsClientCAFile isn't set.
+func requireClientCert(parameters *WhSvrParameters, next http.Handler) http.Handler {
+	if parameters.clientCAFile == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tokenAuthPaths[r.URL.Path] && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			glog.Warningf("Denied %s from %s without a client certificate", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// parseCipherSuites maps comma separated IANA names such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 to their ids. Suites known to be
+// insecure are refused. TLS 1.3 suites are not configurable in Go and are
+// always enabled.
+func parseCipherSuites(names string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var ids []uint16
+	for _, name := range splitList(names) {
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseCurves(names string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range splitList(names) {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %s, expect one of X25519, P256, P384, P521", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var errNoCertificate = errors.New("no serving certificate loaded")
+
+// warnInsecureHTTP refuses TLS settings which can't apply to -insecureHTTP and
+// warns loudly that nothing protects the admission traffic but the mesh.
+func warnInsecureHTTP(parameters *WhSvrParameters) {
+	if parameters.clientCAFile != "" {
+		glog.Exitf("-insecureHTTP can't verify client certificates, drop -tlsClientCAFile")
+	}
+	glog.Warning("======================================================================")
+	glog.Warning("-insecureHTTP: serving admission requests over PLAIN HTTP.")
+	glog.Warning("Only safe when a service mesh terminates mTLS in front of this pod,")
+	glog.Warning("AdmissionReviews carry whole objects including Secrets otherwise.")
+	glog.Warning("======================================================================")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireClientCert(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := requireClientCert(&WhSvrParameters{clientCAFile: "ca.crt"}, next)
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	for _, c := range []struct {
+		path  string
+		state *tls.ConnectionState
+		want  int
+	}{
+		{path: "/mutate", state: verified, want: http.StatusOK},
+		{path: "/convert", state: verified, want: http.StatusOK},
+		{path: "/validate", state: &tls.ConnectionState{}, want: http.StatusUnauthorized},
+		{path: "/convert", want: http.StatusUnauthorized},
+		// the ops endpoints share the listener when -metricsPort is 0
+		{path: "/metrics", state: &tls.ConnectionState{}, want: http.StatusUnauthorized},
+		{path: "/debug/pprof/", want: http.StatusUnauthorized},
+		// the log level endpoint checks its callers itself
+		{path: "/debug/loglevel", state: &tls.ConnectionState{}, want: http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, c.path, nil)
+		r.TLS = c.state
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s with %+v: got %d, want %d", c.path, c.state, w.Code, c.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//Deployment和Service必须设置的标签
+var requiredLabels = []string{
+	"app.kubernetes.io/name",
+	"app.kubernetes.io/instance",
+	"app.kubernetes.io/version",
+	"app.kubernetes.io/component",
+	"app.kubernetes.io/part-of",
+	"app.kubernetes.io/managed-by",
+}
+
+// validationRule checks one requirement of the object of metadata, returning
+// a cause for every field violating it.
+type validationRule func(kind string, metadata *metav1.ObjectMeta) []metav1.StatusCause
+
+// validationRules are the rules every validated object is checked against,
+// in order.
+var validationRules = []validationRule{
+	checkRequiredLabels,
+}
+
+//validationRequired和mutationRequired相反，没有注解时也要校验，注解为n、no、false、off时跳过
+func validationRequired(ignoredList []string, metadata *metav1.ObjectMeta, log *requestLogger) bool {
+	// K8S 默认的命名空间不做校验
+	for _, namespace := range ignoredList {
+		if metadata.Namespace == namespace {
+			log.Infof("Skip validation for [%v] for it's in special namespace: [%v]", metadata.Name, metadata.Namespace)
+			return false
+		}
+	}
+
+	required := true
+	switch strings.ToLower(lookupAnnotation(metadata.GetAnnotations(), admissionWebhookAnnotationValidateKey)) {
+	case "n", "no", "false", "off":
+		required = false
+	}
+
+	log.Infof("Validation policy for [%v/%v]: required:%v", metadata.Namespace, metadata.Name, required)
+	return required
+}
+
+//checkRequiredLabels对缺少的每个requiredLabels给出一个cause
+func checkRequiredLabels(kind string, metadata *metav1.ObjectMeta) []metav1.StatusCause {
+	var causes []metav1.StatusCause
+	for _, label := range requiredLabels {
+		if _, ok := metadata.Labels[label]; !ok {
+			causes = append(causes, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldValueRequired,
+				Message: fmt.Sprintf("required label %s is not set", label),
+				Field:   fmt.Sprintf("metadata.labels[%s]", label),
+			})
+		}
+	}
+	return causes
+}
+
+// main validation process
+func (whsvr *WebhookServer) validate(ar *v1beta1.AdmissionReview, log *requestLogger) *v1beta1.AdmissionResponse {
+	req := ar.Request
+
+	log.Infof("======begin Admission for Namespace=[%v], Kind=[%v], Name=[%v]======", req.Namespace, req.Kind.Kind, req.Name)
+	//删除时没有新对象，不做校验
+	if req.Operation == v1beta1.Delete {
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	var metadata *metav1.ObjectMeta
+	switch req.Kind.Kind {
+	case "Deployment":
+		var deployment appsv1.Deployment
+		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
+			log.Errorf("Could not unmarshal raw object: %v", err)
+			return invalid(err)
+		}
+		metadata = &deployment.ObjectMeta
+	case "Service":
+		var service corev1.Service
+		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
+			log.Errorf("Could not unmarshal raw object: %v", err)
+			return invalid(err)
+		}
+		metadata = &service.ObjectMeta
+	default:
+		msg := fmt.Sprintf("Not support for this Kind of resource  %v", req.Kind.Kind)
+		log.Infof("%s", msg)
+		return failure(http.StatusBadRequest, metav1.StatusReasonBadRequest, msg)
+	}
+	//创建时对象里可能没有命名空间
+	if metadata.Namespace == "" {
+		metadata.Namespace = req.Namespace
+	}
+
+	if !validationRequired(ignoredNamespaces, metadata, log) {
+		log.Infof("Skipping validation for [%s/%s] due to policy check", metadata.Namespace, metadata.Name)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	var causes []metav1.StatusCause
+	for _, rule := range validationRules {
+		causes = append(causes, rule(req.Kind.Kind, metadata)...)
+	}
+	if len(causes) == 0 {
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	messages := make([]string, 0, len(causes))
+	for _, cause := range causes {
+		messages = append(messages, cause.Message)
+	}
+	msg := fmt.Sprintf("%s %s is invalid: %s", req.Kind.Kind, metadata.Name, strings.Join(messages, "; "))
+	log.Infof("%s", msg)
+	//causes列出每个不合规的字段，kubectl会逐条显示
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: msg,
+			Details: &metav1.StatusDetails{
+				Name:   metadata.Name,
+				Kind:   req.Kind.Kind,
+				Causes: causes,
+			},
+		},
+	}
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ghodss/yaml"
-	"github.com/golang/glog"
 	"github.com/wI2L/jsondiff"
 	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
@@ -20,6 +20,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	appsdefaults "k8s.io/kubernetes/pkg/apis/apps/v1"
 	v1 "k8s.io/kubernetes/pkg/apis/core/v1"
 )
 
@@ -30,9 +32,6 @@ var (
 
 	// (https://github.com/kubernetes/kubernetes/issues/57982)
 	defaulter = runtime.ObjectDefaulter(runtimeScheme)
-
-	logFinalYaml  = true
-	logFinalPatch = true
 )
 
 var (
@@ -40,38 +39,74 @@ var (
 		metav1.NamespaceSystem,
 		metav1.NamespacePublic,
 	}
-)
 
-const (
-	admissionWebhookAnnotationMutateKey = "admission-webhook-example.qikqiak.com/mutate"
+	// patches from this size are logged as too large, the apiserver limits
+	// the size of the objects. 0 disables the warning
+	patchWarningBytes = 256 * 1024
 )
 
 type WebhookServer struct {
-	server *http.Server
+	server          *http.Server
+	maxRequestBytes int64 // reject AdmissionReview bodies larger than this
 }
 
 // Webhook Server parameters
 type WhSvrParameters struct {
-	port           int    // webhook server port
-	certFile       string // path to the x509 certificate for https
-	keyFile        string // path to the x509 private key matching `CertFile`
-	sidecarCfgFile string // path to sidecar injector configuration file
+	port                  int           // webhook server port
+	listenUnix            string        // unix socket to serve on instead of port
+	certFile              string        // path to the x509 certificate for https
+	keyFile               string        // path to the x509 private key matching `CertFile`
+	insecureHTTP          bool          // serve plain HTTP behind a TLS terminating mesh
+	certExpiryWindow      time.Duration // fail readiness when the serving certificate expires within this window
+	clientCAFile          string        // path to the CA bundle verifying apiserver client certificates
+	tlsMinVersion         string        // minimum TLS version of the listener
+	tlsCipherSuites       string        // comma separated TLS 1.2 cipher suites
+	tlsCurvePreferences   string        // comma separated elliptic curves
+	maxRequestBytes       int64         // max size of an AdmissionReview request body
+	readTimeout           time.Duration // max duration for reading the entire request
+	readHeaderTimeout     time.Duration // max duration for reading request headers
+	writeTimeout          time.Duration // max duration before timing out writes of the response
+	idleTimeout           time.Duration // max time to wait for the next request on a keep-alive connection
+	maxHeaderBytes        int           // max size of request headers
+	maxInflight           int           // max number of admission requests processed concurrently
+	inflightQueueTimeout  time.Duration // how long a request waits for a free slot
+	sidecarCfgFile        string        // path to sidecar injector configuration file
+	initContainerFile     string        // path to the template of the injected init container
+	injectionsFile        string        // path to the library of injection templates selected by annotation
+	metricsPort           int           // plaintext port of /metrics, /healthz, /readyz and pprof, 0 serves them on the webhook port
+	enablePprof           bool          // serve net/http/pprof next to the metrics
+	selfTest              bool          // run a sample AdmissionReview through the handlers at startup
+	adminTokenFile        string        // bearer token guarding the runtime log level endpoint
+	qosStatus             bool          // write the status of applied QoS objects back
+	qosStatusInterval     time.Duration // how often the count of mutated Deployments is written
+	watchQoS              bool          // apply the QoS objects from a watch of the apiserver instead of admission
+	disableHTTP2          bool          // serve HTTP/1.1 only
+	http2MaxStreams       uint          // max concurrent streams of an HTTP/2 connection, 0 keeps the Go default
+	disableKeepAlives     bool          // close the connections after every response
+	tcpKeepAlivePeriod    time.Duration // period of the TCP keep-alive probes, 0 keeps the Go default, negative disables them
+	logDumpFailuresOnly   bool          // dump denied and failed mutations only, changeable at runtime
+	logTimezone           string        // time zone of the timestamps of the request logs
+	annotationDomain      string        // domain of the annotation keys
+	readLegacyAnnotations bool          // read the keys under the legacy domain too while migrating
 }
 
 func init() {
 	_ = corev1.AddToScheme(runtimeScheme)
 	_ = admissionregistrationv1beta1.AddToScheme(runtimeScheme)
+	// AdmissionReview itself, for protobuf responses
+	_ = v1beta1.AddToScheme(runtimeScheme)
 	// defaulting with webhooks:
 	// https://github.com/kubernetes/kubernetes/issues/57982
 	_ = v1.AddToScheme(runtimeScheme)
+	_ = appsdefaults.AddToScheme(runtimeScheme)
 }
 
-func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta, log *bytes.Buffer) (required bool) {
+func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta, log *requestLogger) (required bool) {
 
 	// K8S 默认的命名空间不做修改
 	for _, namespace := range ignoredList {
 		if metadata.Namespace == namespace {
-			log.WriteString(fmt.Sprintf("\nSkip validation for [%v] for it's in special namespace: [%v]", metadata.Name, metadata.Namespace))
+			log.Infof("Skip validation for [%v] for it's in special namespace: [%v]", metadata.Name, metadata.Namespace)
 			required = false
 			return required
 		}
@@ -84,21 +119,22 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta, log *by
 	}
 
 	//如果是没有开启ccnp.cib.io/runtimeEnable为真的话不做修改
-	log.WriteString(fmt.Sprintf("\nadmission-webhook-example.qikqiak.com/mutate: [%v]", annotations[admissionWebhookAnnotationMutateKey]))
-	switch strings.ToLower(annotations[admissionWebhookAnnotationMutateKey]) {
+	mutate := lookupAnnotation(annotations, admissionWebhookAnnotationMutateKey)
+	log.Infof("%s: [%v]", admissionWebhookAnnotationMutateKey, mutate)
+	switch strings.ToLower(mutate) {
 	default:
 		required = true
 	case "n", "no", "false", "off", "": //注意如果是空(没有配置这个注解ccnp.cib.io/runtimeEnable，也不会执行修改)
 		required = false
 	}
 
-	log.WriteString(fmt.Sprintf("\nMutation policy for [%v/%v]: required:%v", metadata.Namespace, metadata.Name, required))
+	log.Infof("Mutation policy for [%v/%v]: required:%v", metadata.Namespace, metadata.Name, required)
 
 	return required
 }
 
-//修改Deployment
-func mutateDeploy(deploy *appsv1.Deployment, log *bytes.Buffer) *v1beta1.AdmissionResponse {
+//修改Deployment，namespace是请求的命名空间，创建时对象里可能没有
+func mutateDeploy(deploy *appsv1.Deployment, namespace string, log *requestLogger) (resp *v1beta1.AdmissionResponse) {
 
 	var (
 		objectMeta                      *metav1.ObjectMeta
@@ -106,83 +142,95 @@ func mutateDeploy(deploy *appsv1.Deployment, log *bytes.Buffer) *v1beta1.Admissi
 	)
 	resourceName, resourceNamespace, objectMeta = deploy.Name, deploy.Namespace, &deploy.ObjectMeta
 
-	log.WriteString("\n---------begin mumate check---------")
+	log.Infof("---------begin mumate check---------")
 	//检查本次是否需要修改
 	if !mutationRequired(ignoredNamespaces, objectMeta, log) {
-		log.WriteString(fmt.Sprintf("\nSkipping mutation for [%s/%s] due to policy check", resourceNamespace, resourceName))
+		log.Infof("Skipping mutation for [%s/%s] due to policy check", resourceNamespace, resourceName)
 		return &v1beta1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
-	log.WriteString("\n---------ended mumate check---------")
+	log.Infof("---------ended mumate check---------")
 
 	/********************************************************* 进行修改操作 */
-	log.WriteString("\n---------begin mumate---------")
+	log.Infof("---------begin mumate---------")
+	//补全默认值，避免diff里出现用户没有设置、ApiServer会补全的字段
+	defaulter.Default(deploy)
 	newDeploy := deploy.DeepCopy()
 	newPodSpec := &newDeploy.Spec.Template.Spec
 
-	//添加一个initContainer
-	var initContainer *corev1.Container
-
-	//如果没有initContainer则新加一个
-	if len(newPodSpec.InitContainers) == 0 {
-		newPodSpec.InitContainers = []corev1.Container{
-			{
-				Name:    "init",
-				Image:   "busybox",
-				Command: []string{"/bin/sh", "-c", " echo 'init' && sleep 100 "},
-			},
+	//应答确定后按采样打印修改后的yaml和patch，失败时打印到失败为止修改的yaml
+	dumps := newMutationDumps(log)
+	defer func() { dumps.flush(resp) }()
+	dumps.add(logFinalYaml, "---------mumated yaml---------\n%s", func() (string, error) {
+		bytes, err := json.Marshal(newPodSpec)
+		if err != nil {
+			return "", err
 		}
-		initContainer = &newPodSpec.InitContainers[0]
-		log.WriteString("\nmutate add initContainer sucess!")
-		//资源限制
+		yamlStr, err := yaml.JSONToYAML(bytes)
+		return string(yamlStr), err
+	})
+
+	//按模板生成initContainer，已有同名的则替换，否则放在最前面
+	data := templateData{Namespace: namespace, Name: deploy.Name}
+	initContainer, err := initContainerInst.render(data)
+	if err != nil {
+		log.Errorf("Render initContainer error: %v", err)
+		return internalError(err)
+	}
+	//模板没有设置资源时按选中Deployment的QoS设置资源限制
+	profile, qos := qosProfilesInst.match(deploy.Labels)
+	log.Infof("QoS profile [%s]: [%v]", profile, qos)
+	if len(initContainer.Resources.Requests) == 0 {
 		initConRequest := make(map[corev1.ResourceName]resource.Quantity)
-		initConRequest[corev1.ResourceCPU] = *resource.NewMilliQuantity(QoSInst.getQoSpec().Cpu, resource.DecimalSI)           //cpu资源限制 100m
-		initConRequest[corev1.ResourceMemory] = *resource.NewQuantity(QoSInst.getQoSpec().Memory*1024*1024, resource.BinarySI) //内存资源限制 100Mi
+		initConRequest[corev1.ResourceCPU] = *resource.NewMilliQuantity(qos.Cpu, resource.DecimalSI)           //cpu资源限制 100m
+		initConRequest[corev1.ResourceMemory] = *resource.NewQuantity(qos.Memory*1024*1024, resource.BinarySI) //内存资源限制 100Mi
 		initContainer.Resources.Requests = initConRequest
 	}
-
-	/********************************************************* 结束修改操作 */
-	log.WriteString("\n---------ended mumate---------")
-
-	//打印修改后的yaml
-	if logFinalYaml {
-		log.WriteString("\n---------begin mumated yaml---------")
-		bytes, err := json.Marshal(newPodSpec)
-		if err == nil {
-			yamlStr, err := yaml.JSONToYAML(bytes)
-			if err == nil {
-				log.WriteString("\n" + string(yamlStr))
+	injectInitContainer(newPodSpec, initContainer)
+	log.Infof("mutate add initContainer sucess!")
+
+	//注解选择的注入模板
+	if names := selectedInjections(deploy.Annotations); len(names) > 0 {
+		if err := injectionLibraryInst.inject(newPodSpec, names, data); err != nil {
+			log.Errorf("Inject templates error: %v", err)
+			//注解选了不存在的模板需要用户修改，模板渲染失败是webhook的问题
+			if _, ok := err.(annotationError); ok {
+				return invalid(err)
 			}
+			return internalError(err)
 		}
-		log.WriteString("\n---------ended mumated yaml---------")
+		log.Infof("mutate inject templates %v sucess!", names)
 	}
 
+	/********************************************************* 结束修改操作 */
+	log.Infof("---------ended mumate---------")
+
+	//注入的容器同样补全默认值，重复调用时才不会因为默认值产生patch
+	defaulter.Default(newDeploy)
+
 	// 比较新旧deploy的不同，返回不同的bytes
 	patch, err := jsondiff.Compare(deploy, newDeploy)
 	if err != nil {
-		log.WriteString(fmt.Sprintf("\nPatch Compare process error: %v", err.Error()))
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		log.Errorf("Patch Compare process error: %v", err.Error())
+		return internalError(err)
 	}
 
-	//打patch
-	patchBytes, err := json.MarshalIndent(patch, "", "    ")
+	//打patch，不缩进，大的Deployment缩进后patch会大很多
+	patchBytes, err := json.Marshal(patch)
 	if err != nil {
-		log.WriteString(fmt.Sprintf("\nPatch process error: %v", err.Error()))
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		log.Errorf("Patch process error: %v", err.Error())
+		return internalError(err)
 	}
 
-	if logFinalPatch {
-		log.WriteString(fmt.Sprintf("\nAdmissionResponse: patch=%v\n", string(patchBytes)))
+	if patchWarningBytes > 0 && len(patchBytes) >= patchWarningBytes {
+		largePatches.Inc()
+		log.Warningf("Patch of Deployment %s/%s is %d bytes, above the warning threshold of %d bytes", namespace, deploy.Name, len(patchBytes), patchWarningBytes)
 	}
+	dumps.add(logFinalPatch, "AdmissionResponse: patch=%s", func() (string, error) {
+		return string(patchBytes), nil
+	})
+	qosStatusInst.deploymentMutated(profile)
 	return &v1beta1.AdmissionResponse{
 		Allowed: true,
 		Patch:   patchBytes,
@@ -194,17 +242,29 @@ func mutateDeploy(deploy *appsv1.Deployment, log *bytes.Buffer) *v1beta1.Admissi
 }
 
 //设置QoS
-func mutateQoS(qos *QoS, operation v1beta1.Operation, log *bytes.Buffer) *v1beta1.AdmissionResponse {
+func mutateQoS(qos *QoS, operation v1beta1.Operation, log *requestLogger) *v1beta1.AdmissionResponse {
 	if operation == "DELETE" {
-		//删除设置空对象
-		QoSInst.setQoSpec(&QoSpec{})
-		log.WriteString(fmt.Sprintf("\ndelete QoS from crd : [%v] ,reset to default [%v]", qos.Spec, qoSpecFromCRD.getQoSpec()))
+		//删除时去掉同名的profile，-watchQoS时由watch处理
+		if !qosWatched {
+			deleteQoS(qos.Name)
+		}
+		log.Infof("delete QoS [%s] from crd : [%v]", qos.Name, qos.Spec)
 	} else {
-		if qos != nil && (qos.Spec != QoSpec{}) {
-			QoSInst.setQoSpec(&qos.Spec)
-			log.WriteString(fmt.Sprintf("\nget QoS value : [%v]", qos.Spec))
+		var err error
+		if qosWatched {
+			//多副本时所有副本都从watch应用QoS，这里只校验
+			_, _, err = qos.Spec.selector(qos.Name)
 		} else {
-			log.WriteString(fmt.Sprintf("\nget an empty QoS value : [%v]", qos.Spec))
+			err = applyQoS(qos)
+		}
+		if err != nil {
+			log.Errorf("Reject QoS: %v", err)
+			return invalid(err)
+		}
+		if qos.Spec.empty() {
+			log.Infof("get an empty QoS value : [%v]", qos.Spec)
+		} else {
+			log.Infof("get QoS [%s] value : [%v]", qos.Name, qos.Spec)
 		}
 	}
 
@@ -214,81 +274,130 @@ func mutateQoS(qos *QoS, operation v1beta1.Operation, log *bytes.Buffer) *v1beta
 }
 
 // main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview, log *bytes.Buffer) *v1beta1.AdmissionResponse {
+func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview, log *requestLogger) *v1beta1.AdmissionResponse {
 	req := ar.Request
 
-	log.WriteString(fmt.Sprintf("\n======begin Admission for Namespace=[%v], Kind=[%v], Name=[%v]======", req.Namespace, req.Kind.Kind, req.Name))
-	log.WriteString("\n>>>>>>" + req.Kind.Kind)
+	log.Infof("======begin Admission for Namespace=[%v], Kind=[%v], Name=[%v]======", req.Namespace, req.Kind.Kind, req.Name)
+	log.Infof(">>>>>>%s", req.Kind.Kind)
 	switch req.Kind.Kind {
 	case "Deployment":
 		var deployment appsv1.Deployment
 		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
-			log.WriteString(fmt.Sprintf("\nCould not unmarshal raw object: %v", err))
-			glog.Errorf(log.String())
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+			log.Errorf("Could not unmarshal raw object: %v", err)
+			return invalid(err)
 		}
-		return mutateDeploy(&deployment, log)
+		return mutateDeploy(&deployment, req.Namespace, log)
 	case "QoS":
-		var qos QoS
 		var raw []byte
 		if req.Operation == "DELETE" {
 			raw = req.OldObject.Raw
 		} else {
 			raw = req.Object.Raw
 		}
-		if err := json.Unmarshal(raw, &qos); err != nil {
-			log.WriteString(fmt.Sprintf("\nCould not unmarshal raw object: %v", err))
-			glog.Errorf(log.String())
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+		//v1beta1改了字段名，统一转换成v1
+		qos, err := decodeQoS(raw)
+		if err != nil {
+			log.Errorf("Could not unmarshal raw object: %v", err)
+			return invalid(err)
 		}
-		return mutateQoS(&qos, req.Operation, log)
+		return mutateQoS(qos, req.Operation, log)
 	default:
-		msg := fmt.Sprintf("\nNot support for this Kind of resource  %v", req.Kind.Kind)
-		log.WriteString(msg)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: msg,
-			},
-		}
+		msg := fmt.Sprintf("Not support for this Kind of resource  %v", req.Kind.Kind)
+		log.Infof("%s", msg)
+		return failure(http.StatusBadRequest, metav1.StatusReasonBadRequest, msg)
+	}
+}
+
+//invalid拒绝无法解析或者不合法的对象，用户需要修改对象
+func invalid(err error) *v1beta1.AdmissionResponse {
+	return failure(http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error())
+}
+
+//internalError拒绝webhook自身处理失败的请求，不是用户的问题
+func internalError(err error) *v1beta1.AdmissionResponse {
+	return failure(http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+}
+
+//failure拒绝请求，Code和Reason让用户和监控区分需要修改的请求（400、422）和webhook自身的故障（500）
+func failure(code int32, reason metav1.StatusReason, message string) *v1beta1.AdmissionResponse {
+	return &v1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  reason,
+			Message: message,
+		},
 	}
 }
 
+// admissionHandler processes a decoded AdmissionReview.
+type admissionHandler func(ar *v1beta1.AdmissionReview, log *requestLogger) *v1beta1.AdmissionResponse
+
+// handler returns the endpoint serving AdmissionReviews with admit, name is
+// used in logs and traces.
+func (whsvr *WebhookServer) handler(name string, admit admissionHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		whsvr.serve(w, r, name, admit)
+	})
+}
+
 // Serve method for webhook server
-func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
-	//记录日志
-	var log bytes.Buffer
+func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request, name string, admit admissionHandler) {
+	//记录日志，请求解析出来之前没有UID
+	log := newRequestLogger(nil)
+
+	//ApiServer只会POST AdmissionReview，其他方法返回405
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
 
-	//读取从ApiServer过来的数据放到body
+	//读取从ApiServer过来的数据放到body，超过maxRequestBytes的直接拒绝，防止撑爆内存
 	var body []byte
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+		buf, err := readBody(http.MaxBytesReader(w, r.Body, whsvr.maxRequestBytes))
+		if err != nil {
+			status := http.StatusBadRequest
+			if isBodyTooLarge(err) {
+				//返回状态码413
+				status = http.StatusRequestEntityTooLarge
+			}
+			log.Errorf("Can't read body: %v", err)
+			http.Error(w, fmt.Sprintf("Can't read body: %v", err), status)
+			return
 		}
+		//解码出来的AdmissionReview会复制body中用到的部分
+		defer putBuffer(buf)
+		body = buf.Bytes()
 	}
 	if len(body) == 0 {
-		log.WriteString("empty body")
-		glog.Info(log.String())
+		log.Infof("empty body")
 		//返回状态码400
 		//如果在Apiserver调用此Webhook返回是400，说明APIServer自己传过来的数据是空
-		http.Error(w, log.String(), http.StatusBadRequest)
+		http.Error(w, "empty body", http.StatusBadRequest)
 		return
 	}
 
-	// verify the content type is accurate
+	// verify the content type is accurate, YAML from proxies and test tools is
+	// converted to JSON before decoding
 	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		log.WriteString(fmt.Sprintf("Content-Type=%s, expect `application/json`", contentType))
-		glog.Errorf(log.String())
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json", runtime.ContentTypeProtobuf:
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		converted, err := yaml.YAMLToJSON(body)
+		if err != nil {
+			log.Errorf("Can't convert yaml body: %v", err)
+			http.Error(w, fmt.Sprintf("Can't convert yaml body: %v", err), http.StatusBadRequest)
+			return
+		}
+		body = converted
+	default:
+		msg := fmt.Sprintf("Content-Type=%s, expect `application/json`, `application/yaml` or `%s`", contentType, runtime.ContentTypeProtobuf)
+		log.Errorf("%s", msg)
 		//如果在Apiserver调用此Webhook返回是415，说明APIServer自己传过来的数据不是json格式，处理不了
-		http.Error(w, log.String(), http.StatusUnsupportedMediaType)
+		http.Error(w, msg, http.StatusUnsupportedMediaType)
 		return
 	}
 
@@ -296,43 +405,130 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	ar := v1beta1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
 		//组装错误信息
-		log.WriteString(fmt.Sprintf("\nCan't decode body,error info is :  %s", err.Error()))
-		glog.Errorln(log.String())
+		msg := fmt.Sprintf("Can't decode body,error info is :  %s", err.Error())
+		log.Errorf("%s", msg)
 		//返回错误信息，形式表现为资源创建会失败，
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: log.String(),
-			},
-		}
+		admissionResponse = failure(http.StatusBadRequest, metav1.StatusReasonBadRequest, msg)
 	} else {
-		fmt.Println(r.URL.Path)
-		if r.URL.Path == "/mutate" {
-			admissionResponse = whsvr.mutate(&ar, &log)
-		}
+		log.setRequest(ar.Request)
+		log.Infof("path: %s", r.URL.Path)
+		admissionResponse = admit(&ar, log)
 	}
 
-	admissionReview := v1beta1.AdmissionReview{}
 	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
-		}
+		admissionResponses.WithLabelValues(name, strconv.Itoa(int(responseCode(admissionResponse)))).Inc()
+	}
+
+	//无法解码的AdmissionReview也带上它的uid应答，代理按uid匹配请求和应答
+	var uid types.UID
+	if ar.Request != nil {
+		uid = ar.Request.UID
+	} else {
+		uid = reviewUID(body)
 	}
+	writeReview(w, r, log, uid, admissionResponse)
 
-	resp, err := json.Marshal(admissionReview)
+	log.Infof("======ended Admission already writed to reponse======")
+}
+
+// reviewUID returns the uid of the request of body, a JSON AdmissionReview
+// which may not decode as one, empty when it can't be read.
+func reviewUID(body []byte) types.UID {
+	var review struct {
+		Request struct {
+			UID types.UID `json:"uid"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal(body, &review); err != nil {
+		return ""
+	}
+	return review.Request.UID
+}
+
+// writeReview answers the request of uid with response, in protobuf to the
+// callers asking for it: the AdmissionReview always carries its apiVersion,
+// kind and the uid, without which the apiserver rejects the answer, and a
+// nil response denies the request as an internal error. It is encoded
+// before anything is written, so a failure is answered with a 500 alone,
+// and a write failing once the status is sent is only logged.
+func writeReview(w http.ResponseWriter, r *http.Request, log *requestLogger, uid types.UID, response *v1beta1.AdmissionResponse) {
+	if response == nil {
+		response = internalError(errors.New("the webhook didn't answer the request"))
+	}
+	response.UID = uid
+	review := v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1beta1.SchemeGroupVersion.String(),
+			Kind:       "AdmissionReview",
+		},
+		Response: response,
+	}
+
+	// answer in protobuf only to callers asking for it
+	responseType := "application/json"
+	var resp []byte
+	var err error
+	if acceptsProtobuf(r) {
+		responseType = runtime.ContentTypeProtobuf
+		resp, err = encodeReview(&review, responseType)
+	} else {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		err = json.NewEncoder(buf).Encode(review)
+		resp = buf.Bytes()
+	}
 	if err != nil {
-		log.WriteString(fmt.Sprintf("\nCan't encode response: %v", err))
-		http.Error(w, log.String(), http.StatusInternalServerError)
+		log.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("Can't encode response: %v", err), http.StatusInternalServerError)
+		return
 	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		log.WriteString(fmt.Sprintf("\nCan't write response: %v", err))
-		http.Error(w, log.String(), http.StatusInternalServerError)
+	log.Infof("Ready to write reponse ...")
+	//ApiServer接受gzip时压缩较大的应答
+	if err := writeResponse(w, r, responseType, resp); err != nil {
+		//状态码已经发出，再写入错误只会破坏应答
+		log.Errorf("Can't write response: %v", err)
 	}
+}
+
+//responseCode是response的Status.Code，允许时为200，拒绝时没有设置的为403
+func responseCode(response *v1beta1.AdmissionResponse) int32 {
+	switch {
+	case response.Allowed:
+		return http.StatusOK
+	case response.Result == nil || response.Result.Code == 0:
+		return http.StatusForbidden
+	}
+	return response.Result.Code
+}
 
-	log.WriteString("\n======ended Admission already writed to reponse======")
-	//东八区时间
-	datetime := time.Now().In(time.FixedZone("GMT", 8*3600)).Format("2006-01-02 15:04:05")
-	//最后打印日志
-	glog.Infof(datetime + " " + log.String())
+// isBodyTooLarge reports whether err comes from http.MaxBytesReader hitting
+// its limit. It has no typed error before go1.19, so match the message.
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// encodeReview encodes an AdmissionReview response as mediaType, any media
+// type the scheme has a serializer for.
+func encodeReview(ar *v1beta1.AdmissionReview, mediaType string) ([]byte, error) {
+	info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), mediaType)
+	if !ok {
+		return nil, fmt.Errorf("no serializer for %s", mediaType)
+	}
+	return runtime.Encode(codecs.EncoderForVersion(info.Serializer, v1beta1.SchemeGroupVersion), ar)
+}
+
+// acceptsProtobuf reports whether the response should be protobuf: the Accept
+// header asks for it, or, without one, the request was protobuf.
+func acceptsProtobuf(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		return mediaType == runtime.ContentTypeProtobuf
+	}
+	for _, part := range strings.Split(accept, ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == runtime.ContentTypeProtobuf {
+			return true
+		}
+	}
+	return false
 }
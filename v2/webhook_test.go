@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// countingWriter counts the calls answering a request, and fails the writes
+// with failWrites.
+type countingWriter struct {
+	*httptest.ResponseRecorder
+	writeHeaders, writes int
+	failWrites           bool
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	w.writeHeaders++
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	if w.failWrites {
+		return 0, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+// allowAll admits every request.
+func allowAll(ar *v1beta1.AdmissionReview, log *requestLogger) *v1beta1.AdmissionResponse {
+	return &v1beta1.AdmissionResponse{Allowed: true}
+}
+
+// serveReview posts body of contentType to a WebhookServer admitting with
+// admit.
+func serveReview(method, contentType, body string, admit admissionHandler) *countingWriter {
+	whsvr := &WebhookServer{maxRequestBytes: 1024}
+	req := httptest.NewRequest(method, "/validate", strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+	whsvr.serve(w, req, "validate", admit)
+	return w
+}
+
+// decodeAnswer decodes the AdmissionReview answered to w, checking its
+// apiVersion, kind and uid.
+func decodeAnswer(t *testing.T, w *countingWriter, uid string) *v1beta1.AdmissionResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type is %q, want application/json", contentType)
+	}
+	var answer v1beta1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("invalid AdmissionReview: %v", err)
+	}
+	if answer.APIVersion != "admission.k8s.io/v1beta1" || answer.Kind != "AdmissionReview" {
+		t.Errorf("answered a %q %q, want an admission.k8s.io/v1beta1 AdmissionReview", answer.APIVersion, answer.Kind)
+	}
+	if answer.Response == nil {
+		t.Fatal("AdmissionReview has no response")
+	}
+	if string(answer.Response.UID) != uid {
+		t.Errorf("response uid is %q, want %q", answer.Response.UID, uid)
+	}
+	return answer.Response
+}
+
+func TestServeAnswersReview(t *testing.T) {
+	body := `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"a1","kind":{"group":"","version":"v1","kind":"ConfigMap"},"resource":{"group":"","version":"v1","resource":"configmaps"},"operation":"CREATE"}}`
+	w := serveReview(http.MethodPost, "application/json", body, allowAll)
+	if response := decodeAnswer(t, w, "a1"); !response.Allowed {
+		t.Errorf("denied: %v", response.Result)
+	}
+}
+
+func TestServeAnswersUndecodableReview(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		uid  string
+	}{
+		{"invalid field", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"u1","operation":0}}`, "u1"},
+		{"unknown kind", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"Pod","request":{"uid":"u2"}}`, "u2"},
+		{"not JSON", `AdmissionReview`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveReview(http.MethodPost, "application/json", tt.body, allowAll)
+			response := decodeAnswer(t, w, tt.uid)
+			if response.Allowed || response.Result == nil || response.Result.Code != http.StatusBadRequest {
+				t.Errorf("not denied as a bad request: %v", response.Result)
+			}
+		})
+	}
+}
+
+func TestServeAnswersWithoutResponse(t *testing.T) {
+	body := `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"n1","operation":"CREATE"}}`
+	w := serveReview(http.MethodPost, "application/json", body, func(ar *v1beta1.AdmissionReview, log *requestLogger) *v1beta1.AdmissionResponse {
+		return nil
+	})
+	response := decodeAnswer(t, w, "n1")
+	if response.Allowed || response.Result == nil || response.Result.Code != http.StatusInternalServerError {
+		t.Errorf("not denied as an internal error: %v", response.Result)
+	}
+}
+
+func TestServeRejectsRequest(t *testing.T) {
+	review := `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"r1"}}`
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"method", http.MethodGet, "application/json", review, http.StatusMethodNotAllowed},
+		{"too large", http.MethodPost, "application/json", strings.Repeat(" ", 2048) + review, http.StatusRequestEntityTooLarge},
+		{"content type", http.MethodPost, "text/plain", review, http.StatusUnsupportedMediaType},
+		{"empty body", http.MethodPost, "application/json", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveReview(tt.method, tt.contentType, tt.body, allowAll)
+			if w.Code != tt.code {
+				t.Errorf("answered %d, want %d", w.Code, tt.code)
+			}
+			if w.writeHeaders != 1 || w.writes != 1 {
+				t.Errorf("WriteHeader called %d times and Write %d times, want once each", w.writeHeaders, w.writes)
+			}
+			if tt.code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != http.MethodPost {
+				t.Errorf("Allow is %q, want POST", w.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestServeWritesOnce(t *testing.T) {
+	body := `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"w1","operation":"CREATE"}}`
+	for _, failWrites := range []bool{false, true} {
+		whsvr := &WebhookServer{maxRequestBytes: 1024}
+		req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := &countingWriter{ResponseRecorder: httptest.NewRecorder(), failWrites: failWrites}
+		whsvr.serve(w, req, "validate", allowAll)
+		// the status is sent with the first write
+		if w.writeHeaders != 0 || w.writes != 1 {
+			t.Errorf("failWrites=%t: WriteHeader called %d times and Write %d times, want Write once", failWrites, w.writeHeaders, w.writes)
+		}
+	}
+}
+
+// mutatedDeployment runs mutateDeploy on the Deployment raw, a request
+// object, and returns raw with the patch answered applied.
+func mutatedDeployment(t *testing.T, raw []byte) ([]byte, []map[string]interface{}) {
+	t.Helper()
+	var deploy appsv1.Deployment
+	if err := json.Unmarshal(raw, &deploy); err != nil {
+		t.Fatal(err)
+	}
+	resp := mutateDeploy(&deploy, deploy.Namespace, newRequestLogger(nil))
+	if !resp.Allowed {
+		t.Fatalf("mutation denied: %v", resp.Result)
+	}
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(resp.Patch, &ops); err != nil {
+		t.Fatalf("invalid patch %s: %v", resp.Patch, err)
+	}
+	p, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := p.Apply(raw)
+	if err != nil {
+		t.Fatalf("patch %s doesn't apply: %v", resp.Patch, err)
+	}
+	return patched, ops
+}
+
+func TestMutateDeployReinvoked(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	raw, err := json.Marshal(&appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{admissionWebhookAnnotationMutateKey: "true"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "web", Image: "nginx"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patched, ops := mutatedDeployment(t, raw)
+	if len(ops) == 0 {
+		t.Fatal("no patch, want the init container injected")
+	}
+	// the fields the apiserver defaults, such as the strategy or the pull
+	// policy of the containers of the user, aren't patched
+	for _, op := range ops {
+		if path, _ := op["path"].(string); !strings.HasPrefix(path, "/spec/template/spec/initContainers") {
+			t.Errorf("patched %s %s, want the init container patched only", op["op"], path)
+		}
+	}
+	var deploy appsv1.Deployment
+	if err := json.Unmarshal(patched, &deploy); err != nil {
+		t.Fatal(err)
+	}
+	if init := deploy.Spec.Template.Spec.InitContainers; len(init) != 1 || init[0].Name != "init" || init[0].TerminationMessagePath == "" {
+		t.Errorf("init containers %+v, want the defaulted init container", init)
+	}
+
+	// reinvoked on its own output the webhook finds the init container
+	// injected already
+	if _, ops := mutatedDeployment(t, patched); len(ops) != 0 {
+		t.Errorf("second patch %v, want none", ops)
+	}
+}